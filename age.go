@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"filippo.io/age"
+)
+
+// Backups encrypted with --recipient use the age format instead of the
+// passphrase scheme in crypto.go, so they can be decrypted with the age CLI too
+const (
+	encSchemePassphrase = "aes-256-gcm+scrypt"
+	encSchemeAge        = "age"
+
+	ageMagic = "age-encryption.org/v1\n"
+)
+
+// ErrNoMatchingIdentity is returned when none of the --identity keys can
+// decrypt an age-encrypted backup
+var ErrNoMatchingIdentity = errors.New("decryption failed: no --identity matches the backup's recipients")
+
+// recipients and identities are parsed once per run and shared by all workers
+var (
+	recipients     []age.Recipient
+	recipientsErr  error
+	recipientsOnce sync.Once
+
+	identities     []age.Identity
+	identitiesErr  error
+	identitiesOnce sync.Once
+)
+
+// isAgeHeader reports whether the bytes start with the age header
+func isAgeHeader(header []byte) bool {
+	return bytes.HasPrefix(header, []byte(ageMagic))
+}
+
+// encryptionScheme returns the scheme new backups are encrypted with, or ""
+// when encryption is off
+func encryptionScheme() string {
+	switch {
+	case !config.Encrypt:
+		return ""
+	case len(config.Recipients) > 0:
+		return encSchemeAge
+	default:
+		return encSchemePassphrase
+	}
+}
+
+// loadRecipients parses the --recipient values. Each is either an age public
+// key or a file with one key per line, like `age -R`.
+func loadRecipients() ([]age.Recipient, error) {
+	recipientsOnce.Do(func() {
+		for _, value := range config.Recipients {
+			if strings.HasPrefix(value, "age1") {
+				recipient, err := age.ParseX25519Recipient(value)
+				if err != nil {
+					recipientsErr = fmt.Errorf("invalid --recipient %s: %w", value, err)
+					return
+				}
+				recipients = append(recipients, recipient)
+				continue
+			}
+
+			file, err := os.Open(value)
+			if err != nil {
+				recipientsErr = fmt.Errorf("invalid --recipient %s: not an age public key or a readable recipients file", value)
+				return
+			}
+			parsed, err := age.ParseRecipients(file)
+			file.Close()
+			if err != nil {
+				recipientsErr = fmt.Errorf("invalid recipients file %s: %w", value, err)
+				return
+			}
+			recipients = append(recipients, parsed...)
+		}
+	})
+	return recipients, recipientsErr
+}
+
+// loadIdentities parses the --identity files used to decrypt age backups
+func loadIdentities() ([]age.Identity, error) {
+	identitiesOnce.Do(func() {
+		if len(config.IdentityFiles) == 0 {
+			identitiesErr = errors.New("backup is encrypted to age recipients; use --identity to pass the matching key file")
+			return
+		}
+		for _, path := range config.IdentityFiles {
+			file, err := os.Open(path)
+			if err != nil {
+				identitiesErr = fmt.Errorf("failed to read identity file: %w", err)
+				return
+			}
+			parsed, err := age.ParseIdentities(file)
+			file.Close()
+			if err != nil {
+				identitiesErr = fmt.Errorf("invalid identity file %s: %w", path, err)
+				return
+			}
+			identities = append(identities, parsed...)
+		}
+	})
+	return identities, identitiesErr
+}
+
+// recipientKeys returns the public keys backups are encrypted to, for the
+// metadata
+func recipientKeys() []string {
+	var keys []string
+	for _, recipient := range recipients {
+		if stringer, ok := recipient.(fmt.Stringer); ok {
+			keys = append(keys, stringer.String())
+		}
+	}
+	return keys
+}
+
+// newAgeEncryptWriter returns a writer that encrypts to the --recipient keys.
+// Close must be called to emit the final chunk; it does not close w.
+func newAgeEncryptWriter(w io.Writer) (io.WriteCloser, error) {
+	recipients, err := loadRecipients()
+	if err != nil {
+		return nil, err
+	}
+	return age.Encrypt(w, recipients...)
+}
+
+// newDecryptingReader decrypts an encrypted backup with either the passphrase
+// or the --identity keys, depending on its header. Both fail before returning
+// when the key is wrong.
+func newDecryptingReader(r *bufio.Reader) (io.Reader, error) {
+	header, _ := r.Peek(len(ageMagic))
+	if !isAgeHeader(header) {
+		key, err := loadPassphrase(true)
+		if err != nil {
+			return nil, err
+		}
+		return newDecryptReader(r, key)
+	}
+
+	identities, err := loadIdentities()
+	if err != nil {
+		return nil, err
+	}
+	decrypted, err := age.Decrypt(r, identities...)
+	var noMatch *age.NoIdentityMatchError
+	if errors.As(err, &noMatch) {
+		return nil, ErrNoMatchingIdentity
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decryption failed: %w", err)
+	}
+	return decrypted, nil
+}
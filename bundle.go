@@ -0,0 +1,324 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/distribution/reference"
+)
+
+// backupBundle saves all images into a single multi-image tarball so layers
+// shared between them are stored only once
+func backupBundle(cli DockerClient, ctx context.Context, bundleName string, imageNames []string) error {
+	bundleInfo := ImageInfo{
+		SchemaVersion: imageInfoSchemaVersion,
+		ImageName:     bundleName,
+		CompressType:  metadataCompressType(),
+		CompressLevel: compressLevel(),
+		Format:        config.Format,
+		Encrypted:     config.Encrypt,
+		BackupLabels:  backupLabels,
+	}
+
+	for _, imageName := range imageNames {
+		logger.Debug(fmt.Sprintf("Adding image %s to bundle %s", imageName, bundleName), "image", imageName, "bundle", bundleName)
+
+		img, err := inspectImage(cli, ctx, imageName)
+		if err != nil {
+			return fmt.Errorf("error inspecting image %s: %w", imageName, err)
+		}
+		defer removePulledImage(cli, ctx, imageName)
+
+		bundleInfo.Images = append(bundleInfo.Images, BundledImage{
+			ImageName: imageName,
+			ImageID:   img.ID,
+			Tags:      img.RepoTags,
+			Size:      img.Size,
+		})
+		bundleInfo.Tags = append(bundleInfo.Tags, img.RepoTags...)
+		bundleInfo.Size += img.Size
+	}
+
+	baseName, err := renderName(nameTmpl, newNameData(bundleName, "", time.Now()))
+	if err != nil {
+		return fmt.Errorf("failed to build backup name: %w", err)
+	}
+
+	tarballName, err := resolveTarballName(tarballPath(baseName), bundleName)
+	if errors.Is(err, errExists) {
+		logger.Info(fmt.Sprintf("%s already exists, skipped bundle %s", tarballName, bundleName), "bundle", bundleName, "path", tarballName, outcomeKey, "skipped")
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	// A bundle that fails before it is signed gives its name back
+	kept := false
+	defer func() {
+		if !kept {
+			releaseTarballName(tarballName)
+		}
+	}()
+	printSaving(fmt.Sprintf("bundle %s (%d images)", bundleName, len(imageNames)), tarballName)
+	setPending(tarballName, true)
+
+	var encryption EncryptionParams
+	err = withRetry(ctx, "save bundle "+bundleName, func() (err error) {
+		encryption, err = saveImage(cli, ctx, imageNames, partialName(tarballName))
+		return err
+	})
+	if err != nil {
+		removeBackup(tarballName)
+		return saveError("bundle", err)
+	}
+	bundleInfo.EncryptionSalt = encryption.Salt
+	bundleInfo.EncryptionNonce = encryption.Nonce
+	bundleInfo.EncryptionScheme = encryptionScheme()
+	bundleInfo.EncryptionRecipients = encryption.Recipients
+
+	bundleInfo.BackupDate = time.Now()
+	if config.SplitSize > 0 {
+		bundleInfo.Parts = listSavedParts(tarballName)
+	}
+	if err := writeImageInfo(tarballName+".json", bundleInfo); err != nil {
+		removeBackup(tarballName)
+		return err
+	}
+	if err := commitBackup(tarballName); err != nil {
+		removeBackup(tarballName)
+		return err
+	}
+	setPending(tarballName, false)
+	if config.Sign {
+		if err := signBackup(tarballName); err != nil {
+			removeBackup(tarballName)
+			return err
+		}
+	}
+	kept = true
+	recordBackupOutput(bundleName, tarballName)
+
+	if err := uploadBackup(ctx, tarballName); err != nil {
+		return err
+	}
+	if !config.RemoteOnly {
+		backupCatalog.add(tarballName, bundleInfo)
+		dirIndexUpdates.add(tarballName, bundleInfo)
+	}
+
+	logSuccess(fmt.Sprintf("Successfully backed up %d images to bundle %s", len(imageNames), tarballName),
+		"bundle", bundleName, "images", imageNames, "path", tarballName)
+
+	if err := rotateBackups(ctx, bundleName); err != nil {
+		logger.Warn(fmt.Sprintf("Failed to rotate backups of bundle %s: %v", bundleName, err), "bundle", bundleName, "error", err)
+	}
+	return nil
+}
+
+// saveManifestEntry is one image in the manifest.json of a `docker save` archive
+type saveManifestEntry struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// imageID returns the ID of an image in the archive, the digest its config
+// file is named after
+func (e saveManifestEntry) imageID() string {
+	return strings.TrimSuffix(path.Base(e.Config), ".json")
+}
+
+// matchesID reports whether ref is the image's ID, full or shortened to at
+// least 12 characters, so untagged images can be selected too
+func (e saveManifestEntry) matchesID(ref string) bool {
+	ref = strings.TrimPrefix(ref, "sha256:")
+	return len(ref) >= 12 && strings.HasPrefix(e.imageID(), ref)
+}
+
+// selectImages returns a `docker save` stream holding only the images tagged
+// with one of refs, or whose ID one of refs is. The archive is read twice: once to find manifest.json,
+// which docker writes near the end, and once to copy the needed entries. The
+// OCI index is dropped so docker load falls back to the filtered manifest.
+func selectImages(open imageStream, refs []string) (io.ReadCloser, error) {
+	manifest, links, err := scanSaveArchive(open)
+	if err != nil {
+		return nil, err
+	}
+
+	var selected []saveManifestEntry
+	matched := make(map[string]bool)
+	var available []string
+	for _, entry := range manifest {
+		if len(entry.RepoTags) > 0 {
+			available = append(available, entry.RepoTags...)
+		} else {
+			available = append(available, shortID(entry.imageID()))
+		}
+
+		var tags []string
+		for _, tag := range entry.RepoTags {
+			for _, ref := range refs {
+				if sameReference(tag, ref) {
+					tags = append(tags, tag)
+					matched[ref] = true
+				}
+			}
+		}
+		// An image selected by ID keeps all its tags
+		byID := false
+		for _, ref := range refs {
+			if entry.matchesID(ref) {
+				byID = true
+				matched[ref] = true
+			}
+		}
+		if byID {
+			selected = append(selected, entry)
+		} else if len(tags) > 0 {
+			entry.RepoTags = tags
+			selected = append(selected, entry)
+		}
+	}
+
+	for _, ref := range refs {
+		if !matched[ref] {
+			return nil, fmt.Errorf("image %s is not in this backup (contains: %s)", ref, strings.Join(available, ", "))
+		}
+	}
+
+	// Keep each image's config and layers, following symlinks docker uses
+	// for layers shared inside the archive
+	keep := make(map[string]bool)
+	var add func(name string)
+	add = func(name string) {
+		if keep[name] {
+			return
+		}
+		keep[name] = true
+		if target, ok := links[name]; ok {
+			add(target)
+		}
+	}
+	for _, entry := range selected {
+		add(entry.Config)
+		for _, layer := range entry.Layers {
+			add(layer)
+		}
+	}
+
+	manifestData, err := json.Marshal(selected)
+	if err != nil {
+		return nil, err
+	}
+
+	source, err := open()
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		defer source.Close()
+		pw.CloseWithError(copySelected(pw, source, keep, manifestData))
+	}()
+	return pr, nil
+}
+
+// scanSaveArchive reads manifest.json and the symlinks of a `docker save` stream
+func scanSaveArchive(open imageStream) ([]saveManifestEntry, map[string]string, error) {
+	reader, err := open()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer reader.Close()
+
+	var manifest []saveManifestEntry
+	links := make(map[string]string)
+	tr := tar.NewReader(reader)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		switch {
+		case header.Name == "manifest.json":
+			if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+				return nil, nil, fmt.Errorf("invalid manifest.json: %w", err)
+			}
+		case header.Typeflag == tar.TypeSymlink:
+			links[header.Name] = path.Join(path.Dir(header.Name), header.Linkname)
+		case header.Typeflag == tar.TypeLink:
+			links[header.Name] = header.Linkname
+		}
+	}
+
+	if manifest == nil {
+		return nil, nil, errors.New("backup has no manifest.json, so individual images cannot be selected")
+	}
+	return manifest, links, nil
+}
+
+// copySelected writes the kept entries and the replacement manifest.json.
+// Directories are always copied so every kept file has its parents.
+func copySelected(w io.Writer, source io.Reader, keep map[string]bool, manifestData []byte) error {
+	tw := tar.NewWriter(w)
+	tr := tar.NewReader(source)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeDir && !keep[header.Name] {
+			continue
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+
+	header := &tar.Header{
+		Name:     "manifest.json",
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     int64(len(manifestData)),
+		ModTime:  time.Now(),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := tw.Write(manifestData); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// sameReference compares two image references after normalization, so that
+// nginx and docker.io/library/nginx:latest are considered equal
+func sameReference(a, b string) bool {
+	if a == b {
+		return true
+	}
+	na, errA := reference.ParseNormalizedNamed(a)
+	nb, errB := reference.ParseNormalizedNamed(b)
+	if errA != nil || errB != nil {
+		return false
+	}
+	return reference.TagNameOnly(na).String() == reference.TagNameOnly(nb).String()
+}
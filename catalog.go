@@ -0,0 +1,291 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+	_ "modernc.org/sqlite"
+)
+
+// catalogFile is the SQLite index kept at the root of the backup directory
+const catalogFile = "catalog.db"
+
+const catalogSchema = `
+CREATE TABLE IF NOT EXISTS backups (
+	path          TEXT PRIMARY KEY,
+	image_name    TEXT NOT NULL,
+	image_id      TEXT NOT NULL,
+	size          INTEGER NOT NULL,
+	backup_date   TEXT NOT NULL,
+	compress_type TEXT NOT NULL,
+	encrypted     INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS backup_tags (
+	path TEXT NOT NULL REFERENCES backups(path) ON DELETE CASCADE,
+	tag  TEXT NOT NULL,
+	PRIMARY KEY (path, tag)
+);
+CREATE INDEX IF NOT EXISTS idx_backups_image ON backups(image_name);
+CREATE INDEX IF NOT EXISTS idx_backups_date ON backups(backup_date);
+CREATE INDEX IF NOT EXISTS idx_backup_tags_tag ON backup_tags(tag);
+`
+
+// openCatalog opens (creating if needed) the catalog database in dir
+func openCatalog(dir string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", filepath.Join(dir, catalogFile)+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(catalogSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize catalog: %w", err)
+	}
+	return db, nil
+}
+
+// upsertCatalogEntry inserts or replaces the row for a backup. relPath is
+// relative to the backup directory.
+func upsertCatalogEntry(exec interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}, relPath string, info ImageInfo) error {
+	_, err := exec.Exec(`INSERT INTO backups (path, image_name, image_id, size, backup_date, compress_type, encrypted)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(path) DO UPDATE SET image_name = excluded.image_name, image_id = excluded.image_id,
+			size = excluded.size, backup_date = excluded.backup_date,
+			compress_type = excluded.compress_type, encrypted = excluded.encrypted`,
+		relPath, info.ImageName, info.ImageID, info.Size, info.BackupDate.UTC().Format(time.RFC3339),
+		info.CompressType, info.Encrypted)
+	if err != nil {
+		return err
+	}
+
+	if _, err := exec.Exec(`DELETE FROM backup_tags WHERE path = ?`, relPath); err != nil {
+		return err
+	}
+	for _, tag := range info.Tags {
+		if _, err := exec.Exec(`INSERT OR IGNORE INTO backup_tags (path, tag) VALUES (?, ?)`, relPath, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteCatalogEntry removes the row and tags of a backup. relPath is relative
+// to the backup directory.
+func deleteCatalogEntry(db *sql.DB, relPath string) error {
+	if _, err := db.Exec(`DELETE FROM backup_tags WHERE path = ?`, relPath); err != nil {
+		return err
+	}
+	_, err := db.Exec(`DELETE FROM backups WHERE path = ?`, relPath)
+	return err
+}
+
+func runCatalogBuild(cmd *cobra.Command, args []string) {
+	if _, err := os.Stat(config.BackupDir); err != nil {
+		log.Fatalf("Backup directory %s is not accessible: %v", config.BackupDir, err)
+	}
+
+	db, err := openCatalog(config.BackupDir)
+	if err != nil {
+		log.Fatalf("Failed to open catalog: %v", err)
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatalf("Failed to start catalog transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	// Rebuilding from scratch keeps the operation idempotent and drops rows
+	// for backups that were deleted since the last build
+	if _, err := tx.Exec(`DELETE FROM backup_tags; DELETE FROM backups;`); err != nil {
+		log.Fatalf("Failed to reset catalog: %v", err)
+	}
+
+	count := 0
+	err = filepath.WalkDir(config.BackupDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, ".json") {
+			return err
+		}
+
+		tarball := strings.TrimSuffix(path, ".json")
+		if _, _, err := statBackup(tarball); err != nil {
+			return nil
+		}
+
+		info, err := loadImageInfo(path)
+		if err != nil {
+			logger.Debug(fmt.Sprintf("Skipping unreadable metadata %s: %v", path, err), "path", path, "error", err)
+			return nil
+		}
+
+		relPath, err := filepath.Rel(config.BackupDir, tarball)
+		if err != nil {
+			return err
+		}
+		if err := upsertCatalogEntry(tx, relPath, info); err != nil {
+			return fmt.Errorf("failed to index %s: %w", relPath, err)
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("Failed to build catalog: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Fatalf("Failed to commit catalog: %v", err)
+	}
+
+	color.New(color.FgGreen, color.Bold).Printf("Catalog %s built with %d backups\n",
+		filepath.Join(config.BackupDir, catalogFile), count)
+}
+
+func runCatalogQuery(cmd *cobra.Command, args []string) {
+	imageName, _ := cmd.Flags().GetString("image")
+	tag, _ := cmd.Flags().GetString("tag")
+	after, _ := cmd.Flags().GetString("after")
+	before, _ := cmd.Flags().GetString("before")
+
+	if _, err := os.Stat(filepath.Join(config.BackupDir, catalogFile)); err != nil {
+		log.Fatalf("No catalog found in %s; run 'catalog build' first", config.BackupDir)
+	}
+
+	db, err := openCatalog(config.BackupDir)
+	if err != nil {
+		log.Fatalf("Failed to open catalog: %v", err)
+	}
+	defer db.Close()
+
+	query := `SELECT DISTINCT b.path FROM backups b LEFT JOIN backup_tags t ON t.path = b.path WHERE 1 = 1`
+	var queryArgs []interface{}
+
+	if imageName != "" {
+		query += ` AND b.image_name = ?`
+		queryArgs = append(queryArgs, imageName)
+	}
+	if tag != "" {
+		query += ` AND t.tag = ?`
+		queryArgs = append(queryArgs, tag)
+	}
+	if after != "" {
+		t, err := parseCatalogTime(after)
+		if err != nil {
+			log.Fatalf("Invalid --after value: %v", err)
+		}
+		query += ` AND b.backup_date >= ?`
+		queryArgs = append(queryArgs, t.UTC().Format(time.RFC3339))
+	}
+	if before != "" {
+		t, err := parseCatalogTime(before)
+		if err != nil {
+			log.Fatalf("Invalid --before value: %v", err)
+		}
+		query += ` AND b.backup_date < ?`
+		queryArgs = append(queryArgs, t.UTC().Format(time.RFC3339))
+	}
+	query += ` ORDER BY b.backup_date DESC`
+
+	rows, err := db.Query(query, queryArgs...)
+	if err != nil {
+		log.Fatalf("Catalog query failed: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var relPath string
+		if err := rows.Scan(&relPath); err != nil {
+			log.Fatalf("Catalog query failed: %v", err)
+		}
+		fmt.Println(filepath.Join(config.BackupDir, relPath))
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalf("Catalog query failed: %v", err)
+	}
+}
+
+// parseCatalogTime accepts RFC 3339 timestamps or plain dates
+func parseCatalogTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", value, time.Local)
+}
+
+// catalogUpdater records successful backups in an existing catalog from a
+// single background goroutine so workers never wait on SQLite
+type catalogUpdater struct {
+	db      *sql.DB
+	entries chan catalogEntry
+	done    sync.WaitGroup
+}
+
+type catalogEntry struct {
+	tarballName string
+	info        ImageInfo
+	removed     bool
+}
+
+// startCatalogUpdater returns nil when the backup directory has no catalog
+func startCatalogUpdater(dir string) *catalogUpdater {
+	if _, err := os.Stat(filepath.Join(dir, catalogFile)); err != nil {
+		return nil
+	}
+
+	db, err := openCatalog(dir)
+	if err != nil {
+		logger.Warn(fmt.Sprintf("Catalog updates disabled: %v", err), "path", filepath.Join(dir, catalogFile), "error", err)
+		return nil
+	}
+
+	u := &catalogUpdater{db: db, entries: make(chan catalogEntry, 64)}
+	u.done.Add(1)
+	go func() {
+		defer u.done.Done()
+		for entry := range u.entries {
+			relPath, err := filepath.Rel(dir, entry.tarballName)
+			if err == nil && entry.removed {
+				err = deleteCatalogEntry(db, relPath)
+			} else if err == nil {
+				err = upsertCatalogEntry(db, relPath, entry.info)
+			}
+			if err != nil {
+				logger.Warn(fmt.Sprintf("Failed to update catalog for %s: %v", entry.tarballName, err), "path", entry.tarballName, "error", err)
+			}
+		}
+	}()
+	return u
+}
+
+func (u *catalogUpdater) add(tarballName string, info ImageInfo) {
+	if u != nil {
+		u.entries <- catalogEntry{tarballName: tarballName, info: info}
+	}
+}
+
+// remove drops a deleted backup from the catalog
+func (u *catalogUpdater) remove(tarballName string) {
+	if u != nil {
+		u.entries <- catalogEntry{tarballName: tarballName, removed: true}
+	}
+}
+
+// Close flushes pending updates and closes the database
+func (u *catalogUpdater) Close() {
+	if u == nil {
+		return
+	}
+	close(u.entries)
+	u.done.Wait()
+	u.db.Close()
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/errdefs"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// compareChangedExit is the exit status of compare when the image differs from
+// its backup, so scripts can tell a change apart from an error
+const compareChangedExit = 2
+
+func runCompare(cmd *cobra.Command, args []string) {
+	imageName, tarballPath := args[0], logicalBackupPath(args[1])
+	checksum, _ := cmd.Flags().GetBool("checksum")
+	layers, _ := cmd.Flags().GetBool("layers")
+
+	cli, err := newDockerClient("")
+	if err != nil {
+		log.Fatalf("Failed to create Docker client: %v", err)
+	}
+	defer cli.Close()
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	img, _, err := cli.ImageInspectWithRaw(ctx, imageName)
+	if errdefs.IsNotFound(err) {
+		color.New(color.FgYellow, color.Bold).Printf("Image %s does not exist locally; use 'restore %s' to load it from the backup\n", imageName, args[1])
+		cli.Close()
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Fatalf("Failed to inspect %s: %v", imageName, err)
+	}
+
+	var changed bool
+	if layers {
+		changed, err = compareLayerDiff(cli, ctx, img, imageName, tarballPath, checksum)
+	} else if checksum {
+		changed, err = compareLayers(ctx, img, imageName, tarballPath)
+	} else {
+		changed, err = compareImageID(img, imageName, tarballPath)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if changed {
+		cli.Close()
+		os.Exit(compareChangedExit)
+	}
+}
+
+// compareImageID compares the live image ID with the one recorded in the
+// backup's metadata and reports whether they differ
+func compareImageID(img image.InspectResponse, imageName, tarballPath string) (bool, error) {
+	info, err := loadImageInfo(tarballPath + ".json")
+	if err != nil {
+		return false, fmt.Errorf("cannot read the metadata of %s (%v); use --checksum to compare the backup contents instead", tarballPath, err)
+	}
+
+	backupID := info.ImageID
+	if len(info.Images) > 0 {
+		backupID = ""
+		for _, bundled := range info.Images {
+			if containsReference(append([]string{bundled.ImageName}, bundled.Tags...), imageName) {
+				backupID = bundled.ImageID
+				break
+			}
+		}
+		if backupID == "" {
+			return false, fmt.Errorf("bundle %s does not contain %s", tarballPath, imageName)
+		}
+	}
+	if backupID == "" {
+		return false, fmt.Errorf("the metadata of %s has no image ID; use --checksum to compare the backup contents instead", tarballPath)
+	}
+
+	if img.ID == backupID {
+		color.New(color.FgGreen, color.Bold).Println("Image is unchanged since backup")
+		return false, nil
+	}
+	color.New(color.FgYellow, color.Bold).Println("Image has changed since backup")
+	fmt.Printf("  Live ID:   %s\n", img.ID)
+	fmt.Printf("  Backup ID: %s\n", backupID)
+	return true, nil
+}
+
+// compareLayers hashes the uncompressed layers stored in the backup and
+// compares them with the live image's layer digests. This reads and
+// decompresses the whole backup.
+func compareLayers(ctx context.Context, img image.InspectResponse, imageName, tarballPath string) (bool, error) {
+	fmt.Printf("Computing layer digests of %s...\n", tarballPath)
+	backupLayers, err := backupLayerDigests(ctx, tarballPath, imageName)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", tarballPath, err)
+	}
+
+	liveLayers := img.RootFS.Layers
+	if slices.Equal(liveLayers, backupLayers) {
+		color.New(color.FgGreen, color.Bold).Println("Image is unchanged since backup (layer contents match)")
+		return false, nil
+	}
+
+	color.New(color.FgYellow, color.Bold).Println("Image has changed since backup")
+	fmt.Printf("  Live layers:   %d\n", len(liveLayers))
+	fmt.Printf("  Backup layers: %d\n", len(backupLayers))
+	for i := 0; i < min(len(liveLayers), len(backupLayers)); i++ {
+		if liveLayers[i] != backupLayers[i] {
+			fmt.Printf("  First difference at layer %d:\n    live:   %s\n    backup: %s\n", i+1, liveLayers[i], backupLayers[i])
+			break
+		}
+	}
+	return true, nil
+}
+
+// maxConfigSize bounds the archive entries kept in memory while looking for an
+// image config, which is a few kilobytes of JSON
+const maxConfigSize = 1 << 20
+
+// layerInfo is one layer of an image: its uncompressed digest, by which layers
+// are compared, and the instruction that created it when known
+type layerInfo struct {
+	digest    string
+	createdBy string
+}
+
+// compareLayerDiff prints which layers were added and removed between the
+// backup and the live image, matched by digest, and reports whether they
+// differ
+func compareLayerDiff(cli DockerClient, ctx context.Context, img image.InspectResponse, imageName, tarballPath string, checksum bool) (bool, error) {
+	backup, err := backupLayers(ctx, imageName, tarballPath, checksum)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", tarballPath, err)
+	}
+	live := liveLayers(cli, ctx, img)
+
+	var added, removed int
+	fmt.Printf("Layers of %s compared with %s:\n", imageName, tarballPath)
+	for _, line := range diffLayers(backup, live) {
+		text := shortID(line.layer.digest)
+		if line.layer.createdBy != "" {
+			text += "  " + truncateCommand(line.layer.createdBy)
+		}
+		switch line.op {
+		case '-':
+			removed++
+			color.New(color.FgRed).Printf("- %s\n", text)
+		case '+':
+			added++
+			color.New(color.FgGreen).Printf("+ %s\n", text)
+		default:
+			fmt.Printf("  %s\n", text)
+		}
+	}
+
+	if added == 0 && removed == 0 {
+		color.New(color.FgGreen, color.Bold).Println("Image is unchanged since backup (layers match)")
+		return false, nil
+	}
+	color.New(color.FgYellow, color.Bold).Printf("Image has changed since backup: %d layers added, %d removed, %d unchanged\n",
+		added, removed, len(live)-added)
+	return true, nil
+}
+
+// layerDiffLine is one line of a layer diff: '-' for a layer only in the
+// backup, '+' for one only in the live image and ' ' for one in both
+type layerDiffLine struct {
+	op    byte
+	layer layerInfo
+}
+
+// diffLayers aligns the backup and live layers by their longest common
+// subsequence of digests, like a unified diff
+func diffLayers(backup, live []layerInfo) []layerDiffLine {
+	// common[i][j] is the length of the longest common subsequence of
+	// backup[i:] and live[j:]
+	common := make([][]int, len(backup)+1)
+	for i := range common {
+		common[i] = make([]int, len(live)+1)
+	}
+	for i := len(backup) - 1; i >= 0; i-- {
+		for j := len(live) - 1; j >= 0; j-- {
+			if backup[i].digest == live[j].digest {
+				common[i][j] = common[i+1][j+1] + 1
+			} else {
+				common[i][j] = max(common[i+1][j], common[i][j+1])
+			}
+		}
+	}
+
+	var lines []layerDiffLine
+	i, j := 0, 0
+	for i < len(backup) || j < len(live) {
+		switch {
+		case i < len(backup) && j < len(live) && backup[i].digest == live[j].digest:
+			layer := live[j]
+			if layer.createdBy == "" {
+				layer.createdBy = backup[i].createdBy
+			}
+			lines = append(lines, layerDiffLine{' ', layer})
+			i++
+			j++
+		case j == len(live) || (i < len(backup) && common[i+1][j] >= common[i][j+1]):
+			lines = append(lines, layerDiffLine{'-', backup[i]})
+			i++
+		default:
+			lines = append(lines, layerDiffLine{'+', live[j]})
+			j++
+		}
+	}
+	return lines
+}
+
+// truncateCommand shortens a layer's creating instruction to one short line
+func truncateCommand(command string) string {
+	command = strings.Join(strings.Fields(strings.TrimPrefix(command, "/bin/sh -c #(nop) ")), " ")
+	if len(command) > 60 {
+		command = command[:57] + "..."
+	}
+	return command
+}
+
+// liveLayers returns the layers of the live image. The instructions come from
+// its history, whose entries that created layers are only known to line up
+// with the layers when there are as many of them.
+func liveLayers(cli DockerClient, ctx context.Context, img image.InspectResponse) []layerInfo {
+	layers := make([]layerInfo, len(img.RootFS.Layers))
+	for i, digest := range img.RootFS.Layers {
+		layers[i].digest = digest
+	}
+
+	history, err := cli.ImageHistory(ctx, img.ID)
+	if err != nil {
+		logger.Debug(fmt.Sprintf("Could not read the history of %s: %v", img.ID, err), "image", img.ID, "error", err)
+		return layers
+	}
+	var commands []string
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Size > 0 {
+			commands = append(commands, history[i].CreatedBy)
+		}
+	}
+	if len(commands) == len(layers) {
+		for i := range layers {
+			layers[i].createdBy = commands[i]
+		}
+	}
+	return layers
+}
+
+// backupLayers returns the layers of imageName in the backup: hashed from the
+// archive with checksum, otherwise from the metadata, or from the image config
+// in the archive when the metadata does not list them
+func backupLayers(ctx context.Context, imageName, tarballPath string, checksum bool) ([]layerInfo, error) {
+	var digests []string
+	if checksum {
+		fmt.Printf("Computing layer digests of %s...\n", tarballPath)
+		var err error
+		if digests, err = backupLayerDigests(ctx, tarballPath, imageName); err != nil {
+			return nil, err
+		}
+	} else if info, err := loadImageInfo(tarballPath + ".json"); err == nil && len(info.Images) == 0 && len(info.Layers) > 0 {
+		digests = info.Layers
+	} else {
+		return backupConfigLayers(ctx, tarballPath, imageName)
+	}
+
+	layers := make([]layerInfo, len(digests))
+	for i, digest := range digests {
+		layers[i].digest = digest
+	}
+	return layers, nil
+}
+
+// backupConfigLayers reads the layer digests and their instructions from the
+// config of imageName in a `docker save` backup. The archive is streamed and
+// only small JSON files are kept until manifest.json names the config.
+func backupConfigLayers(ctx context.Context, tarballPath, imageName string) ([]layerInfo, error) {
+	encoding, err := detectEncoding(tarballPath, tarballPath)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := encoding.stream(tarballPath)()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var manifest []saveManifestEntry
+	configs := make(map[string][]byte)
+	tr := tar.NewReader(reader)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg || header.Size > maxConfigSize {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		if header.Name == "manifest.json" {
+			if err := json.Unmarshal(data, &manifest); err != nil {
+				return nil, fmt.Errorf("invalid manifest.json: %w", err)
+			}
+		} else if len(data) > 0 && data[0] == '{' {
+			configs[header.Name] = data
+		}
+	}
+	if manifest == nil {
+		return nil, errors.New("backup has no manifest.json; --layers needs a `docker save` archive")
+	}
+
+	entry, err := findManifestEntry(manifest, imageName)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		RootFS struct {
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+		History []struct {
+			CreatedBy  string `json:"created_by"`
+			EmptyLayer bool   `json:"empty_layer"`
+		} `json:"history"`
+	}
+	data, ok := configs[entry.Config]
+	if !ok {
+		return nil, fmt.Errorf("image config %s is missing from the backup", entry.Config)
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid image config %s: %w", entry.Config, err)
+	}
+
+	layers := make([]layerInfo, len(config.RootFS.DiffIDs))
+	for i, digest := range config.RootFS.DiffIDs {
+		layers[i].digest = digest
+	}
+	var commands []string
+	for _, h := range config.History {
+		if !h.EmptyLayer {
+			commands = append(commands, h.CreatedBy)
+		}
+	}
+	if len(commands) == len(layers) {
+		for i := range layers {
+			layers[i].createdBy = commands[i]
+		}
+	}
+	return layers, nil
+}
+
+// backupLayerDigests returns the digests of the uncompressed layers of
+// imageName in a `docker save` backup, in manifest order. Every regular file is
+// hashed on the way through because manifest.json comes near the end.
+func backupLayerDigests(ctx context.Context, tarballPath, imageName string) ([]string, error) {
+	encoding, err := detectEncoding(tarballPath, tarballPath)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := encoding.stream(tarballPath)()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var manifest []saveManifestEntry
+	digests := make(map[string]string)
+	links := make(map[string]string)
+	tr := tar.NewReader(reader)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case header.Name == "manifest.json":
+			if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+				return nil, fmt.Errorf("invalid manifest.json: %w", err)
+			}
+		case header.Typeflag == tar.TypeSymlink:
+			links[header.Name] = path.Join(path.Dir(header.Name), header.Linkname)
+		case header.Typeflag == tar.TypeLink:
+			links[header.Name] = header.Linkname
+		case header.Typeflag == tar.TypeReg:
+			digest, err := contentDigest(tr)
+			if err != nil {
+				return nil, fmt.Errorf("failed to hash %s: %w", header.Name, err)
+			}
+			digests[header.Name] = digest
+		}
+	}
+	if manifest == nil {
+		return nil, errors.New("backup has no manifest.json; --checksum needs a `docker save` archive")
+	}
+
+	entry, err := findManifestEntry(manifest, imageName)
+	if err != nil {
+		return nil, err
+	}
+
+	layers := make([]string, 0, len(entry.Layers))
+	for _, layer := range entry.Layers {
+		// Follow the symlinks docker uses for layers shared inside the archive
+		for seen := 0; seen < len(links); seen++ {
+			target, ok := links[layer]
+			if !ok {
+				break
+			}
+			layer = target
+		}
+		digest, ok := digests[layer]
+		if !ok {
+			return nil, fmt.Errorf("layer %s is missing from the backup", layer)
+		}
+		layers = append(layers, digest)
+	}
+	return layers, nil
+}
+
+// findManifestEntry returns the manifest entry tagged imageName, or the only
+// entry when the archive holds a single image
+func findManifestEntry(manifest []saveManifestEntry, imageName string) (saveManifestEntry, error) {
+	var available []string
+	for _, entry := range manifest {
+		if containsReference(entry.RepoTags, imageName) {
+			return entry, nil
+		}
+		available = append(available, entry.RepoTags...)
+	}
+	if len(manifest) == 1 {
+		return manifest[0], nil
+	}
+	return saveManifestEntry{}, fmt.Errorf("image %s is not in this backup (contains: %s)", imageName, strings.Join(available, ", "))
+}
+
+// contentDigest returns the sha256 digest of r after decompression, which for
+// a layer is the diff ID Docker reports in RootFS.Layers
+func contentDigest(r io.Reader) (string, error) {
+	buffered := bufio.NewReader(r)
+	header, _ := buffered.Peek(sniffLength)
+	kind := detectCompression(header)
+	if kind == "" {
+		kind = compressionNone
+	}
+
+	decompressed, err := newDecompressReader(buffered, kind)
+	if err != nil {
+		return "", err
+	}
+	defer decompressed.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, decompressed); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
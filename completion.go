@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/image"
+	"github.com/spf13/cobra"
+)
+
+// imageCompletionTTL is how long the image names listed for shell completion
+// are reused, so pressing tab repeatedly does not query the daemon every time
+const imageCompletionTTL = 30 * time.Second
+
+// isCompletionCommand reports whether cmd generates a completion script or
+// answers a completion request, whose output the shell reads and which must
+// not contain the banner
+func isCompletionCommand(cmd *cobra.Command) bool {
+	for c := cmd; c != nil; c = c.Parent() {
+		switch c.Name() {
+		case "completion", cobra.ShellCompRequestCmd, cobra.ShellCompNoDescRequestCmd:
+			return true
+		}
+	}
+	return false
+}
+
+// completeImages completes the repo tags of the local images. The list is
+// cached in the user cache directory for imageCompletionTTL.
+func completeImages(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	// --host and --context may come from the config file
+	applyConfig(cmd)
+	useConfig(cmd)
+	names := cachedImageNames()
+	if names == nil {
+		names = listImageNames()
+		writeImageNameCache(names)
+	}
+
+	var matches []string
+	for _, name := range names {
+		if strings.HasPrefix(name, toComplete) && !slices.Contains(args, name) {
+			matches = append(matches, name)
+		}
+	}
+	return matches, cobra.ShellCompDirectiveNoFileComp
+}
+
+// listImageNames asks the daemon for the repo tags of the local images,
+// giving up quickly when it does not answer
+func listImageNames() []string {
+	cli, err := newDockerClient("")
+	if err != nil {
+		return nil
+	}
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	summaries, err := cli.ImageList(ctx, image.ListOptions{})
+	if err != nil {
+		return nil
+	}
+	names := []string{}
+	for _, summary := range summaries {
+		names = appendUnique(names, imageRepoTags(summary.RepoTags)...)
+	}
+	return names
+}
+
+func imageNameCachePath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "go-backup-docker-image", "completion-images")
+}
+
+// cachedImageNames returns the cached image names, or nil when the cache is
+// missing or older than imageCompletionTTL
+func cachedImageNames() []string {
+	path := imageNameCachePath()
+	if path == "" {
+		return nil
+	}
+	stat, err := os.Stat(path)
+	if err != nil || time.Since(stat.ModTime()) > imageCompletionTTL {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	return strings.Fields(string(data))
+}
+
+// writeImageNameCache stores names for the next completion request. The cache
+// is an optimization, so failing to write it is ignored.
+func writeImageNameCache(names []string) {
+	path := imageNameCachePath()
+	if path == "" || names == nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return
+	}
+	writeFileAtomic(path, []byte(strings.Join(names, "\n")+"\n"))
+}
+
+// completeBackups completes the backups in the backup directory. Paths
+// outside it still complete as files.
+func completeBackups(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	// Commands with --dir pick up its value from the config file
+	applyConfig(cmd)
+	useConfig(cmd)
+	if isRemotePath(config.BackupDir) {
+		return nil, cobra.ShellCompDirectiveDefault
+	}
+	files, err := listLocalFiles(config.BackupDir)
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveDefault
+	}
+
+	var matches []string
+	for _, file := range files {
+		if !isBackupFile(file.Key) || isPartialFile(file.Key) {
+			continue
+		}
+		path := backupDirPath(logicalBackupPath(file.Key))
+		if strings.HasPrefix(path, toComplete) && !slices.Contains(args, path) {
+			matches = appendUnique(matches, path)
+		}
+	}
+	return matches, cobra.ShellCompDirectiveDefault
+}
+
+// completeValues completes a flag from a fixed set of values
+func completeValues(values ...string) func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+	return cobra.FixedCompletions(values, cobra.ShellCompDirectiveNoFileComp)
+}
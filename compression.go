@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/ulikunitz/xz"
+)
+
+// Compression formats recognized on restore
+const (
+	compressionNone = "none"
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+	compressionXz   = "xz"
+)
+
+// sniffLength is how many bytes are needed to recognize every supported
+// format, including the "ustar" marker of an uncompressed tar header
+const sniffLength = 262
+
+var compressionMagic = []struct {
+	kind  string
+	magic []byte
+}{
+	{compressionGzip, []byte{0x1f, 0x8b}},
+	{compressionZstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{compressionXz, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+}
+
+// compressLevelRanges are the --compress-level values each compressor used
+// for writing backups accepts
+var compressLevelRanges = map[string][2]int{
+	compressionGzip: {gzip.BestSpeed, gzip.BestCompression},
+}
+
+// defaultCompressLevel is the --compress-level used when none is given,
+// matching the default of the gzip binary the backups used to be piped through
+const defaultCompressLevel = 6
+
+// compressLevelFlag is the --compress-level flag. Values outside every
+// compressor's range are rejected while the flags are parsed; 0 is accepted
+// as an alias for the fastest level.
+type compressLevelFlag int
+
+func (l *compressLevelFlag) String() string {
+	return strconv.Itoa(int(*l))
+}
+
+func (l *compressLevelFlag) Set(value string) error {
+	level, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("%q is not a number", value)
+	}
+	highest := 0
+	for _, levels := range compressLevelRanges {
+		highest = max(highest, levels[1])
+	}
+	if level < 0 || level > highest {
+		return fmt.Errorf("level %d is out of range (0 to %d)", level, highest)
+	}
+	*l = compressLevelFlag(level)
+	return nil
+}
+
+func (l *compressLevelFlag) Type() string {
+	return "int"
+}
+
+// validateCompressLevel checks an explicitly given --compress-level against
+// the selected compressor
+func validateCompressLevel(compressType string, level int) error {
+	levels, ok := compressLevelRanges[compressType]
+	if !ok {
+		return fmt.Errorf("--compress-level has no effect with --compress %s", compressType)
+	}
+	if level != 0 && (level < levels[0] || level > levels[1]) {
+		return fmt.Errorf("--compress-level %d is out of range for %s (%d fastest to %d smallest)", level, compressType, levels[0], levels[1])
+	}
+	return nil
+}
+
+// compressLevel returns the level backups are compressed with, mapping 0 to
+// the compressor's fastest level. It is 0 when the backup is not compressed.
+func compressLevel() int {
+	levels, ok := compressLevelRanges[config.CompressType]
+	if !ok {
+		return 0
+	}
+	if config.CompressLevel == 0 {
+		return levels[0]
+	}
+	return config.CompressLevel
+}
+
+// gzipBlockSize is the size of the blocks compressed in parallel. Each
+// thread holds about two of them in memory.
+const gzipBlockSize = 1 << 20
+
+// activeWorkers is the number of workers runJobs is running, which share the
+// CPUs for compression
+var activeWorkers atomic.Int32
+
+// compressThreads returns how many blocks each backup compresses at once:
+// --compress-threads, or by default the CPUs divided across the active
+// workers, so that many workers do not oversubscribe the machine
+func compressThreads() int {
+	if config.CompressThreads > 0 {
+		return config.CompressThreads
+	}
+	workers := int(activeWorkers.Load())
+	if workers < 1 {
+		workers = max(config.MaxWorkers, 1)
+	}
+	// Only --io-workers of them compress at the same time
+	if config.IOWorkers > 0 {
+		workers = min(workers, config.IOWorkers)
+	}
+	return max(runtime.GOMAXPROCS(0)/workers, 1)
+}
+
+// newGzipWriter returns a gzip writer at the configured --compress-level that
+// compresses compressThreads blocks in parallel. The output is a single
+// standard gzip stream, which gunzip and docker load read as usual.
+func newGzipWriter(w io.Writer) (*pgzip.Writer, error) {
+	level := config.CompressLevel
+	if level == 0 {
+		level = gzip.BestSpeed
+	}
+	gzWriter, err := pgzip.NewWriterLevel(w, level)
+	if err != nil {
+		return nil, err
+	}
+	if err := gzWriter.SetConcurrency(gzipBlockSize, compressThreads()); err != nil {
+		return nil, err
+	}
+	return gzWriter, nil
+}
+
+// detectCompression identifies the compression format from the first bytes of
+// a backup. It returns an empty string when the bytes are inconclusive.
+func detectCompression(header []byte) string {
+	for _, m := range compressionMagic {
+		if bytes.HasPrefix(header, m.magic) {
+			return m.kind
+		}
+	}
+	if len(header) >= sniffLength && bytes.HasPrefix(header[257:], []byte("ustar")) {
+		return compressionNone
+	}
+	return ""
+}
+
+// isEncryptedHeader reports whether the bytes start with the passphrase or
+// age encryption header
+func isEncryptedHeader(header []byte) bool {
+	return bytes.HasPrefix(header, []byte(encMagic)) || isAgeHeader(header)
+}
+
+// readHeader returns up to sniffLength bytes from the start of a backup
+func readHeader(path string) ([]byte, error) {
+	if path == stdinPath {
+		header, err := stdinBackup.Peek(sniffLength)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		return header, nil
+	}
+
+	file, err := openBackup(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	header := make([]byte, sniffLength)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	return header[:n], nil
+}
+
+// newDecompressReader wraps r with the decompressor for the given format
+func newDecompressReader(r io.Reader, kind string) (io.ReadCloser, error) {
+	switch kind {
+	case compressionGzip:
+		gzReader, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip stream: %w", err)
+		}
+		return gzReader, nil
+	case compressionZstd:
+		zstdReader, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid zstd stream: %w", err)
+		}
+		return zstdReader.IOReadCloser(), nil
+	case compressionXz:
+		xzReader, err := xz.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid xz stream: %w", err)
+		}
+		return io.NopCloser(xzReader), nil
+	default:
+		return io.NopCloser(r), nil
+	}
+}
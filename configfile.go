@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// Defaults for any flag can come from a YAML config file and from GBDI_*
+// environment variables. Flags on the command line win over the environment,
+// which wins over the file, which wins over the built-in defaults.
+const (
+	configEnvPrefix = "GBDI_"
+	configAppDir    = "go-backup-docker-image"
+	configFileName  = "config.yaml"
+	homeConfigFile  = ".go-backup-docker-image.yaml"
+	localConfigFile = "go-backup-docker-image.yaml"
+)
+
+// configAliases maps alternative config keys to flag names
+var configAliases = map[string]string{
+	"backup-dir":  "dir",
+	"compression": "compress",
+	"max-workers": "workers",
+}
+
+// loadedConfigFile is the config file applied to this run, if any
+var loadedConfigFile string
+
+// configuredFlags records the flags set from the environment or the config
+// file rather than the command line
+var configuredFlags = map[string]bool{}
+
+// configValue is one setting from the config file
+type configValue struct {
+	key  string
+	node *yaml.Node
+}
+
+// findConfigFile returns the config file to use: --config (or GBDI_CONFIG),
+// then $XDG_CONFIG_HOME/go-backup-docker-image/config.yaml, then
+// ~/.go-backup-docker-image.yaml, then go-backup-docker-image.yaml in the
+// current directory. Only an explicit path has to exist.
+func findConfigFile(cmd *cobra.Command) (string, error) {
+	path, _ := cmd.Flags().GetString("config")
+	if path == "" {
+		path = os.Getenv(configEnvPrefix + "CONFIG")
+	}
+	if path != "" {
+		if _, err := os.Stat(path); err != nil {
+			return "", fmt.Errorf("failed to read config file: %w", err)
+		}
+		return path, nil
+	}
+
+	var candidates []string
+	if path := defaultConfigPath(); path != "" {
+		candidates = append(candidates, path)
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		candidates = append(candidates, filepath.Join(home, homeConfigFile))
+	}
+	candidates = append(candidates, localConfigFile)
+
+	for _, candidate := range candidates {
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return "", fmt.Errorf("failed to read config file: %w", err)
+		}
+	}
+	return "", nil
+}
+
+// defaultConfigPath returns $XDG_CONFIG_HOME/go-backup-docker-image/config.yaml,
+// falling back to ~/.config when XDG_CONFIG_HOME is unset
+func defaultConfigPath() string {
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		configHome = filepath.Join(home, ".config")
+	}
+	return filepath.Join(configHome, configAppDir, configFileName)
+}
+
+// applyConfig fills the flags of cmd that were not given on the command line
+// from GBDI_* environment variables and the config file
+func applyConfig(cmd *cobra.Command) error {
+	path, err := findConfigFile(cmd)
+	if err != nil {
+		return err
+	}
+	var values map[string]configValue
+	if path != "" {
+		if values, err = readConfigFile(path, cmd); err != nil {
+			return err
+		}
+		loadedConfigFile = path
+	}
+
+	var applyErr error
+	cmd.Flags().VisitAll(func(flag *pflag.Flag) {
+		if applyErr != nil || flag.Changed || flag.Name == "config" {
+			return
+		}
+		for _, key := range configKeys(flag.Name) {
+			env := configEnvPrefix + strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+			if value, ok := os.LookupEnv(env); ok {
+				if err := cmd.Flags().Set(flag.Name, value); err != nil {
+					applyErr = fmt.Errorf("invalid value for %s: %w", env, err)
+				}
+				configuredFlags[flag.Name] = true
+				return
+			}
+		}
+		if value, ok := values[flag.Name]; ok {
+			if err := setFromNode(cmd.Flags(), flag.Name, value.node); err != nil {
+				applyErr = fmt.Errorf("%s:%d: invalid value for %q: %w", path, value.node.Line, value.key, err)
+			}
+			configuredFlags[flag.Name] = true
+		}
+	})
+	return applyErr
+}
+
+// configKeys returns the flag name and its aliases
+func configKeys(flagName string) []string {
+	keys := []string{flagName}
+	for alias, name := range configAliases {
+		if name == flagName {
+			keys = append(keys, alias)
+		}
+	}
+	return keys
+}
+
+// readConfigFile parses the config file into the values that apply to cmd,
+// keyed by flag name. Top-level keys apply to every command with that flag; a
+// section named after a command, such as "backup:" or "list:", applies only to
+// that command and its subcommands and overrides the top-level keys. Unknown
+// keys are rejected with their line.
+func readConfigFile(path string, cmd *cobra.Command) (map[string]configValue, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s:%d: config file must be a mapping of option names to values", path, root.Line)
+	}
+
+	known := map[string]bool{}
+	commands := map[string]bool{}
+	collectConfigNames(cmd.Root(), known, commands)
+
+	active := map[string]bool{}
+	for c := cmd; c != nil && c.HasParent(); c = c.Parent() {
+		active[c.Name()] = true
+	}
+
+	values := map[string]configValue{}
+	var sections []*yaml.Node
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		keyNode, valueNode := root.Content[i], root.Content[i+1]
+		key := keyNode.Value
+		if commands[key] && valueNode.Kind == yaml.MappingNode {
+			if active[key] {
+				sections = append(sections, keyNode, valueNode)
+			} else if err := checkSection(path, valueNode, known); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		name := configFlagName(key)
+		if !known[name] {
+			return nil, fmt.Errorf("%s:%d: unknown key %q", path, keyNode.Line, key)
+		}
+		values[name] = configValue{key: key, node: valueNode}
+	}
+
+	// Sections are applied after the top-level keys so they take precedence
+	for i := 0; i < len(sections); i += 2 {
+		section := sections[i+1]
+		if err := checkSection(path, section, known); err != nil {
+			return nil, err
+		}
+		for j := 0; j+1 < len(section.Content); j += 2 {
+			key := section.Content[j].Value
+			values[configFlagName(key)] = configValue{key: sections[i].Value + "." + key, node: section.Content[j+1]}
+		}
+	}
+	return values, nil
+}
+
+// checkSection rejects unknown and nested keys in a command section
+func checkSection(path string, section *yaml.Node, known map[string]bool) error {
+	for i := 0; i+1 < len(section.Content); i += 2 {
+		keyNode, valueNode := section.Content[i], section.Content[i+1]
+		if !known[configFlagName(keyNode.Value)] {
+			return fmt.Errorf("%s:%d: unknown key %q", path, keyNode.Line, keyNode.Value)
+		}
+		if valueNode.Kind == yaml.MappingNode {
+			return fmt.Errorf("%s:%d: %q must be a value or a list, not a mapping", path, valueNode.Line, keyNode.Value)
+		}
+	}
+	return nil
+}
+
+// configFlagName maps a config key to its flag name; keys may use
+// underscores instead of dashes
+func configFlagName(key string) string {
+	name := strings.ReplaceAll(strings.ToLower(key), "_", "-")
+	if alias, ok := configAliases[name]; ok {
+		return alias
+	}
+	return name
+}
+
+// collectConfigNames gathers every flag and command name below cmd
+func collectConfigNames(cmd *cobra.Command, flags, commands map[string]bool) {
+	visit := func(flag *pflag.Flag) { flags[flag.Name] = true }
+	cmd.LocalFlags().VisitAll(visit)
+	cmd.PersistentFlags().VisitAll(visit)
+	for _, sub := range cmd.Commands() {
+		commands[sub.Name()] = true
+		collectConfigNames(sub, flags, commands)
+	}
+}
+
+// setFromNode sets a flag from a YAML scalar, or from each item of a list for
+// repeatable flags
+func setFromNode(flags *pflag.FlagSet, name string, node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return flags.Set(name, node.Value)
+	case yaml.SequenceNode:
+		if !strings.HasSuffix(flags.Lookup(name).Value.Type(), "Array") {
+			return errors.New("expected a single value, not a list")
+		}
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				return errors.New("list items must be plain values")
+			}
+			if err := flags.Set(name, item.Value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return errors.New("expected a value or a list")
+}
+
+func runConfigInit(cmd *cobra.Command, args []string) {
+	force, _ := cmd.Flags().GetBool("force")
+	path := defaultConfigPath()
+	if len(args) > 0 {
+		path = args[0]
+	}
+	if path == "" {
+		log.Fatal("Cannot find the home directory; give the path of the config file")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Fatalf("Failed to create %s: %v", filepath.Dir(path), err)
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	file, err := os.OpenFile(path, flags, 0644)
+	if errors.Is(err, fs.ErrExist) {
+		log.Fatalf("%s already exists (use --force to overwrite)", path)
+	}
+	if err != nil {
+		log.Fatalf("Failed to write config file: %v", err)
+	}
+	_, err = file.Write(defaultConfigFile(cmd.Root()))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Fatalf("Failed to write config file: %v", err)
+	}
+
+	color.New(color.FgGreen, color.Bold).Printf("Wrote config file %s\n", path)
+	fmt.Println("  Uncomment a setting to change its default")
+}
+
+// defaultConfigFile renders a config file listing every flag with its
+// built-in default, commented out. It is generated from the flags themselves
+// so it cannot drift from them: global flags come first, then a section for
+// each command.
+func defaultConfigFile(root *cobra.Command) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# Defaults for %s, generated by `%s config init`.\n", root.Name(), root.Name())
+	buf.WriteString("# Every setting below shows its built-in default; uncomment one to change it.\n")
+	buf.WriteString("# Top-level keys apply to every command with that flag, and a section named\n")
+	buf.WriteString("# after a command applies only to that command. Flags on the command line and\n")
+	buf.WriteString("# GBDI_* environment variables take precedence over this file.\n")
+	writeConfigFlags(&buf, "", root.PersistentFlags())
+
+	var visit func(cmd *cobra.Command)
+	visit = func(cmd *cobra.Command) {
+		for _, sub := range cmd.Commands() {
+			if sub.Name() == "config" || sub.Name() == "help" || sub.Name() == "completion" {
+				continue
+			}
+			if sub.HasAvailableLocalFlags() {
+				fmt.Fprintf(&buf, "\n# %s: %s\n#%s:\n", sub.CommandPath(), sub.Short, sub.Name())
+				writeConfigFlags(&buf, "  ", sub.LocalFlags())
+			}
+			visit(sub)
+		}
+	}
+	visit(root)
+	return buf.Bytes()
+}
+
+// writeConfigFlags writes one commented line per flag with its default
+func writeConfigFlags(buf *bytes.Buffer, indent string, flags *pflag.FlagSet) {
+	flags.VisitAll(func(flag *pflag.Flag) {
+		if flag.Name == "config" || flag.Name == "help" || flag.Hidden || flag.Deprecated != "" {
+			return
+		}
+		if _, required := flag.Annotations[cobra.BashCompOneRequiredFlag]; required {
+			return
+		}
+		fmt.Fprintf(buf, "#%s%s: %s  # %s\n", indent, flag.Name, configDefault(flag), flag.Usage)
+	})
+}
+
+// configDefault formats the default of a flag as a YAML value
+func configDefault(flag *pflag.Flag) string {
+	switch flag.Value.Type() {
+	case "bool", "int", "int64", "uint", "float64", "duration", "count":
+		return flag.DefValue
+	}
+	if strings.HasSuffix(flag.Value.Type(), "Array") || strings.HasSuffix(flag.Value.Type(), "Slice") {
+		return flag.DefValue
+	}
+	value, err := yaml.Marshal(flag.DefValue)
+	if err != nil {
+		return `""`
+	}
+	return strings.TrimSpace(string(value))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+)
+
+// containerBackupRepo is the repository containers are committed to with
+// --container, as backup/<container>:<timestamp>
+const containerBackupRepo = "backup/"
+
+// SourceContainer records the container a backup was committed from
+type SourceContainer struct {
+	Name    string     `json:"name"`
+	ID      string     `json:"id"`
+	Paused  bool       `json:"paused"`
+	Started *time.Time `json:"started,omitempty"`
+}
+
+func (c SourceContainer) String() string {
+	s := fmt.Sprintf("%s (%s)", c.Name, shortID(c.ID))
+	if c.Paused {
+		s += ", paused during commit"
+	}
+	return s
+}
+
+// committedContainers maps the tags created by --container to the container
+// each was committed from, so backupImage can record it in the metadata
+var committedContainers sync.Map
+
+// committedContainer returns the container imageName was committed from by
+// this run, if any
+func committedContainer(imageName string) *SourceContainer {
+	if source, ok := committedContainers.Load(imageName); ok {
+		return source.(*SourceContainer)
+	}
+	return nil
+}
+
+// containerBackupTag returns the tag a container is committed under. Container
+// names may contain upper case letters, which repositories may not, and names
+// that still do not form a valid repository fall back to the container ID.
+func containerBackupTag(name, id string, now time.Time) string {
+	tag := now.Format("20060102-150405")
+	ref := containerBackupRepo + strings.ToLower(name) + ":" + tag
+	if _, err := reference.ParseNormalizedNamed(ref); err != nil {
+		ref = containerBackupRepo + shortID(id) + ":" + tag
+	}
+	return ref
+}
+
+// backupContainer commits a container to a temporary image and backs that
+// image up like any other. With --keep-image=false the committed tag is
+// removed afterwards, which deletes the image since nothing else uses it.
+func backupContainer(cli DockerClient, ctx context.Context, containerName string) error {
+	inspect, err := cli.ContainerInspect(ctx, containerName)
+	if err != nil {
+		return fmt.Errorf("error inspecting container: %w", err)
+	}
+	name := strings.TrimPrefix(inspect.Name, "/")
+	tag := containerBackupTag(name, inspect.ID, time.Now())
+
+	// Pausing a container that is not running fails, and it has nothing to
+	// freeze anyway
+	pause := config.Pause && inspect.State != nil && inspect.State.Running && !inspect.State.Paused
+	logger.Info(fmt.Sprintf("Committing container %s to %s...", name, tag), "container", name, "image", tag)
+	_, err = cli.ContainerCommit(ctx, inspect.ID, container.CommitOptions{
+		Reference: tag,
+		Comment:   "Committed by go-backup-docker-image",
+		Pause:     pause,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to commit container %s: %w", name, err)
+	}
+	committedContainers.Store(tag, &SourceContainer{Name: name, ID: inspect.ID, Paused: pause})
+	defer committedContainers.Delete(tag)
+
+	if !config.KeepImage {
+		defer func() {
+			if _, err := cli.ImageRemove(context.WithoutCancel(ctx), tag, image.RemoveOptions{PruneChildren: true}); err != nil {
+				logger.Warn(fmt.Sprintf("Warning: failed to remove committed image %s: %v", tag, err), "image", tag, "error", err)
+			} else {
+				logger.Debug("Removed committed image "+tag, "image", tag)
+			}
+		}()
+	}
+
+	return backupImage(cli, ctx, tag)
+}
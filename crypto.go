@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+// Encrypted backups are a small header followed by a sequence of AES-256-GCM
+// sealed chunks. Every chunk except the last holds exactly encChunkSize bytes
+// of plaintext, and the last chunk is authenticated with a distinct additional
+// data byte so a truncated file is detected instead of silently accepted.
+const (
+	encMagic      = "GBDIENC1"
+	encSaltSize   = 16
+	encChunkSize  = 64 * 1024
+	encExtension  = ".enc"
+	passphraseEnv = "BACKUP_PASSPHRASE"
+
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// ErrWrongPassphrase is returned when an encrypted backup fails authentication
+var ErrWrongPassphrase = errors.New("decryption failed: wrong passphrase or corrupted backup")
+
+// EncryptionParams are the non-secret values needed to derive the key and
+// nonces of an encrypted backup
+type EncryptionParams struct {
+	Salt       []byte
+	Nonce      []byte
+	Recipients []string
+}
+
+// readPassphrase loads the passphrase from a file or the BACKUP_PASSPHRASE
+// environment variable. When prompt is set and neither is available, the
+// passphrase is read interactively from the terminal.
+func readPassphrase(passphraseFile string, prompt bool) ([]byte, error) {
+	if passphraseFile != "" {
+		data, err := os.ReadFile(passphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read passphrase file: %w", err)
+		}
+		passphrase := strings.TrimRight(string(data), "\r\n")
+		if passphrase == "" {
+			return nil, fmt.Errorf("passphrase file %s is empty", passphraseFile)
+		}
+		return []byte(passphrase), nil
+	}
+
+	if passphrase := os.Getenv(passphraseEnv); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+
+	if !prompt || !term.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, fmt.Errorf("no passphrase provided; use --passphrase-file or set %s", passphraseEnv)
+	}
+
+	fmt.Fprint(os.Stderr, "Backup passphrase: ")
+	passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read passphrase: %w", err)
+	}
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("empty passphrase")
+	}
+	return passphrase, nil
+}
+
+// newGCM derives an AES-256 key from the passphrase with scrypt
+func newGCM(passphrase, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce combines the base nonce with the chunk counter
+func chunkNonce(base []byte, counter uint64) []byte {
+	nonce := make([]byte, len(base))
+	copy(nonce, base)
+	tail := binary.BigEndian.Uint64(nonce[len(nonce)-8:])
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], tail^counter)
+	return nonce
+}
+
+func chunkAAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// encryptWriter seals everything written to it into chunks on the underlying writer
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint64
+	buf     []byte
+	closed  bool
+}
+
+// newEncryptWriter writes the encryption header to w and returns a writer that
+// encrypts the stream. Close must be called to emit the final chunk.
+func newEncryptWriter(w io.Writer, passphrase []byte) (*encryptWriter, EncryptionParams, error) {
+	params := EncryptionParams{Salt: make([]byte, encSaltSize)}
+	if _, err := rand.Read(params.Salt); err != nil {
+		return nil, params, err
+	}
+
+	aead, err := newGCM(passphrase, params.Salt)
+	if err != nil {
+		return nil, params, err
+	}
+
+	params.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(params.Nonce); err != nil {
+		return nil, params, err
+	}
+
+	header := append([]byte(encMagic), params.Salt...)
+	header = append(header, params.Nonce...)
+	if _, err := w.Write(header); err != nil {
+		return nil, params, err
+	}
+
+	return &encryptWriter{
+		w:     w,
+		aead:  aead,
+		nonce: params.Nonce,
+		buf:   make([]byte, 0, encChunkSize),
+	}, params, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(e.buf[len(e.buf):encChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+
+		// Full chunks are flushed eagerly so the final chunk is always short
+		if len(e.buf) == encChunkSize {
+			if err := e.flush(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (e *encryptWriter) flush(final bool) error {
+	sealed := e.aead.Seal(nil, chunkNonce(e.nonce, e.counter), e.buf, chunkAAD(final))
+	e.counter++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+// Close writes the final authenticated chunk. It does not close the underlying writer.
+func (e *encryptWriter) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return e.flush(true)
+}
+
+// decryptReader opens chunks produced by encryptWriter
+type decryptReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint64
+	chunk   []byte
+	plain   []byte
+	done    bool
+}
+
+// newDecryptReader reads the encryption header and authenticates the first
+// chunk up front, so a wrong passphrase is reported before any data is consumed
+func newDecryptReader(r io.Reader, passphrase []byte) (*decryptReader, error) {
+	magic := make([]byte, len(encMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != encMagic {
+		return nil, fmt.Errorf("not an encrypted backup")
+	}
+
+	salt := make([]byte, encSaltSize)
+	if _, err := io.ReadFull(r, salt); err != nil {
+		return nil, fmt.Errorf("truncated encryption header: %w", err)
+	}
+
+	aead, err := newGCM(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(r, nonce); err != nil {
+		return nil, fmt.Errorf("truncated encryption header: %w", err)
+	}
+
+	d := &decryptReader{
+		r:     r,
+		aead:  aead,
+		nonce: nonce,
+		chunk: make([]byte, encChunkSize+aead.Overhead()),
+	}
+	if err := d.next(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *decryptReader) next() error {
+	n, err := io.ReadFull(d.r, d.chunk)
+	final := false
+	switch {
+	case err == io.ErrUnexpectedEOF:
+		final = true
+	case err == io.EOF:
+		return fmt.Errorf("encrypted backup is truncated")
+	case err != nil:
+		return err
+	}
+
+	plain, err := d.aead.Open(d.chunk[:0], chunkNonce(d.nonce, d.counter), d.chunk[:n], chunkAAD(final))
+	if err != nil {
+		return ErrWrongPassphrase
+	}
+	d.counter++
+	d.plain = plain
+	d.done = final
+	return nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/pgzip"
+	"github.com/spf13/cobra"
+)
+
+// Deduplicated backups replace the tarball with a manifest listing the entries
+// of the `docker save` stream. File contents live once per digest in a shared
+// blob store next to the manifests, so layers shared between images and
+// between successive backups take no extra space.
+const (
+	dedupExtension = ".dedup"
+	dedupFormat    = "dedup-v1"
+	blobStoreDir   = "blobs"
+)
+
+// DedupManifest describes one deduplicated backup
+type DedupManifest struct {
+	Format  string       `json:"format"`
+	Entries []DedupEntry `json:"entries"`
+}
+
+// DedupEntry is one tar entry of the original `docker save` stream. Regular
+// files reference their content by SHA-256 digest.
+type DedupEntry struct {
+	Name     string    `json:"name"`
+	Type     byte      `json:"type"`
+	Mode     int64     `json:"mode"`
+	Size     int64     `json:"size,omitempty"`
+	ModTime  time.Time `json:"mod_time"`
+	Linkname string    `json:"linkname,omitempty"`
+	Digest   string    `json:"digest,omitempty"`
+}
+
+// blobDir returns the blob store used by manifests in backupDir
+func blobDir(backupDir string) string {
+	return filepath.Join(backupDir, blobStoreDir, "sha256")
+}
+
+// findBlobStore locates the blob store for a manifest by searching its
+// directory and then each parent, since name templates may place manifests in
+// subdirectories of the backup directory
+func findBlobStore(manifestPath string) string {
+	dir, _ := filepath.Abs(filepath.Dir(manifestPath))
+	for {
+		candidate := blobDir(dir)
+		if stat, err := os.Stat(candidate); err == nil && stat.IsDir() {
+			return candidate
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return blobDir(filepath.Dir(manifestPath))
+		}
+		dir = parent
+	}
+}
+
+// findBlob returns the stored file for a digest, which is gzip compressed when
+// it carries a .gz suffix
+func findBlob(dir, digest string) (string, bool) {
+	for _, name := range []string{digest, digest + ".gz"} {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// isDedupHeader reports whether a file starts like a deduplicated manifest
+func isDedupHeader(header []byte) bool {
+	return bytes.HasPrefix(header, []byte(`{"format":"`+dedupFormat+`"`))
+}
+
+// saveDedup streams the save archive into the blob store and writes the
+// manifest for the backup to manifestPath
+func saveDedup(cli DockerClient, ctx context.Context, imageNames []string, manifestPath string) (EncryptionParams, error) {
+	dir := blobDir(config.BackupDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return EncryptionParams{}, err
+	}
+
+	body, err := imageSave(cli, ctx, imageNames)
+	if err != nil {
+		return EncryptionParams{}, err
+	}
+	defer body.Close()
+
+	manifest := DedupManifest{Format: dedupFormat}
+	readErr := func() error {
+		tr := tar.NewReader(&contextReader{ctx: ctx, r: body})
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			entry := DedupEntry{
+				Name:     header.Name,
+				Type:     header.Typeflag,
+				Mode:     header.Mode,
+				ModTime:  header.ModTime,
+				Linkname: header.Linkname,
+			}
+			if header.Typeflag == tar.TypeReg {
+				entry.Size = header.Size
+				entry.Digest, err = storeBlob(ctx, dir, tr, digestFromName(header.Name))
+				if err != nil {
+					return fmt.Errorf("failed to store %s: %w", header.Name, err)
+				}
+			}
+			manifest.Entries = append(manifest.Entries, entry)
+		}
+	}()
+
+	if readErr != nil {
+		return EncryptionParams{}, readErr
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return EncryptionParams{}, err
+	}
+	return EncryptionParams{}, os.WriteFile(manifestPath, data, 0644)
+}
+
+// digestFromName extracts the digest from content-addressed entry names such
+// as blobs/sha256/<hex>, which lets known blobs be skipped without hashing
+func digestFromName(name string) string {
+	dir, file := filepath.Split(name)
+	if filepath.Base(filepath.Clean(dir)) == "sha256" && len(file) == sha256.Size*2 {
+		if _, err := hex.DecodeString(file); err == nil {
+			return file
+		}
+	}
+	return ""
+}
+
+// storeBlob writes r into the blob store under its SHA-256 digest, unless a
+// blob with that digest is already present, and returns the digest
+func storeBlob(ctx context.Context, dir string, r io.Reader, knownDigest string) (string, error) {
+	if knownDigest != "" {
+		if _, ok := findBlob(dir, knownDigest); ok {
+			_, err := io.Copy(io.Discard, r)
+			return knownDigest, err
+		}
+	}
+
+	tmp, err := os.CreateTemp(dir, ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	var out io.Writer = throttle(ctx, tmp)
+	var gzWriter *pgzip.Writer
+	if config.CompressType == compressionGzip {
+		if gzWriter, err = newGzipWriter(out); err != nil {
+			return "", err
+		}
+		out = gzWriter
+	}
+
+	if _, err := io.Copy(io.MultiWriter(out, hash), r); err != nil {
+		return "", err
+	}
+	if gzWriter != nil {
+		if err := gzWriter.Close(); err != nil {
+			return "", err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	digest := hex.EncodeToString(hash.Sum(nil))
+	if _, ok := findBlob(dir, digest); ok {
+		return digest, nil
+	}
+
+	name := digest
+	if gzWriter != nil {
+		name += ".gz"
+	}
+	// Concurrent workers may store the same blob; the rename is atomic and
+	// both copies are identical, so the last one in simply wins
+	return digest, os.Rename(tmp.Name(), filepath.Join(dir, name))
+}
+
+// readDedupManifest loads and validates a deduplicated backup manifest
+func readDedupManifest(path string) (DedupManifest, error) {
+	var manifest DedupManifest
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return manifest, err
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, fmt.Errorf("invalid dedup manifest %s: %w", path, err)
+	}
+	if manifest.Format != dedupFormat {
+		return manifest, fmt.Errorf("unsupported dedup manifest format %q in %s", manifest.Format, path)
+	}
+	return manifest, nil
+}
+
+// dedupStream returns the opener that reassembles the `docker save` stream
+// of a deduplicated backup from its manifest and blobs on the fly
+func dedupStream(manifestPath string) imageStream {
+	return func() (io.ReadCloser, error) {
+		manifest, err := readDedupManifest(manifestPath)
+		if err != nil {
+			return nil, err
+		}
+
+		// Check every blob up front so a missing one fails before docker starts
+		dir := findBlobStore(manifestPath)
+		for _, entry := range manifest.Entries {
+			if entry.Digest == "" {
+				continue
+			}
+			if _, ok := findBlob(dir, entry.Digest); !ok {
+				return nil, fmt.Errorf("blob %s for %s is missing from %s", entry.Digest, entry.Name, dir)
+			}
+		}
+
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(writeDedupTar(pw, dir, manifest))
+		}()
+		return pr, nil
+	}
+}
+
+func writeDedupTar(w io.Writer, dir string, manifest DedupManifest) error {
+	tw := tar.NewWriter(w)
+	for _, entry := range manifest.Entries {
+		header := &tar.Header{
+			Name:     entry.Name,
+			Typeflag: entry.Type,
+			Mode:     entry.Mode,
+			Size:     entry.Size,
+			ModTime:  entry.ModTime,
+			Linkname: entry.Linkname,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if entry.Digest == "" {
+			continue
+		}
+		if err := copyBlob(tw, dir, entry.Digest); err != nil {
+			return fmt.Errorf("failed to read blob for %s: %w", entry.Name, err)
+		}
+	}
+	return tw.Close()
+}
+
+func copyBlob(w io.Writer, dir, digest string) error {
+	path, ok := findBlob(dir, digest)
+	if !ok {
+		return fmt.Errorf("blob %s not found", digest)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	compression := compressionNone
+	if strings.HasSuffix(path, ".gz") {
+		compression = compressionGzip
+	}
+	reader, err := newDecompressReader(file, compression)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	_, err = io.Copy(w, reader)
+	return err
+}
+
+// dedupUsage summarizes the manifests and blob store of a backup directory
+type dedupUsage struct {
+	backups      int
+	logicalBytes int64
+	storedBytes  int64
+	blobs        int
+	referenced   map[string]bool
+	unreferenced []string
+	orphanBytes  int64
+}
+
+// scanDedupUsage reads every manifest in dir and the blob store they share
+func scanDedupUsage(dir string) (dedupUsage, error) {
+	usage := dedupUsage{referenced: make(map[string]bool)}
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != dir && d.Name() == blobStoreDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// Manifests of backups still being written hold on to their blobs
+		if !strings.HasSuffix(strings.TrimSuffix(path, partialExtension), dedupExtension) {
+			return nil
+		}
+
+		manifest, err := readDedupManifest(path)
+		if err != nil {
+			return err
+		}
+		usage.backups++
+		for _, entry := range manifest.Entries {
+			if entry.Digest != "" {
+				usage.logicalBytes += entry.Size
+				usage.referenced[entry.Digest] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return usage, err
+	}
+
+	blobs, err := os.ReadDir(blobDir(dir))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return usage, err
+	}
+	for _, blob := range blobs {
+		info, err := blob.Info()
+		if err != nil || blob.IsDir() || strings.HasPrefix(blob.Name(), ".tmp-") {
+			continue
+		}
+		usage.blobs++
+		usage.storedBytes += info.Size()
+		if !usage.referenced[strings.TrimSuffix(blob.Name(), ".gz")] {
+			usage.unreferenced = append(usage.unreferenced, blob.Name())
+			usage.orphanBytes += info.Size()
+		}
+	}
+	return usage, nil
+}
+
+func runPrune(cmd *cobra.Command, args []string) {
+	verb := "Removed"
+	if config.DryRun {
+		verb = "Would remove"
+	}
+
+	// Leftovers go first, so blobs only an abandoned backup referenced are
+	// pruned in the same run
+	if config.PruneIncomplete {
+		removed, size, err := pruneIncomplete(config.BackupDir)
+		if err != nil {
+			log.Fatalf("Failed to read backup directory: %v", err)
+		}
+		logSuccess(fmt.Sprintf("%s %d incomplete backup files (%.2f MB)", verb, removed, float64(size)/(1024*1024)),
+			"files", removed, "bytes", size)
+	}
+
+	usage, err := scanDedupUsage(config.BackupDir)
+	if err != nil {
+		log.Fatalf("Failed to read backup directory: %v", err)
+	}
+
+	dir := blobDir(config.BackupDir)
+	for _, name := range usage.unreferenced {
+		if config.DryRun {
+			logger.Info("Would remove unreferenced blob "+name, "blob", name)
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			logger.Error(fmt.Sprintf("Failed to remove blob %s: %v", name, err), "blob", name, "error", err)
+		} else {
+			logger.Debug("Removed unreferenced blob "+name, "blob", name)
+		}
+	}
+
+	logSuccess(fmt.Sprintf("%s %d unreferenced blobs (%.2f MB)", verb, len(usage.unreferenced), float64(usage.orphanBytes)/(1024*1024)),
+		"blobs", len(usage.unreferenced), "bytes", usage.orphanBytes)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+func runDelete(cmd *cobra.Command, args []string) {
+	imageName, _ := cmd.Flags().GetString("image")
+	before, _ := cmd.Flags().GetString("before")
+	yes, _ := cmd.Flags().GetBool("yes")
+
+	if len(args) == 0 && imageName == "" {
+		log.Fatal("Name the backups to delete or select them with --image")
+	}
+	if len(args) > 0 && imageName != "" {
+		log.Fatal("Backup names cannot be combined with --image")
+	}
+	if before != "" && imageName == "" {
+		log.Fatal("--before requires --image")
+	}
+	var cutoff time.Time
+	if before != "" {
+		t, err := parseCatalogTime(before)
+		if err != nil {
+			log.Fatalf("Invalid --before value: %v", err)
+		}
+		cutoff = t
+	}
+	if isRemotePath(config.BackupDir) {
+		log.Fatal("delete only removes backups from a local --dir")
+	}
+
+	entries, err := localEntries(config.BackupDir)
+	if err != nil {
+		log.Fatalf("Failed to read backup directory: %v", err)
+	}
+
+	var selected []listEntry
+	if imageName != "" {
+		selected = selectImageBackups(entries, imageName, cutoff)
+	} else if selected, err = selectNamedBackups(entries, args); err != nil {
+		log.Fatal(err)
+	}
+	if len(selected) == 0 {
+		color.New(color.FgHiRed, color.Bold).Println("No matching backups found")
+		return
+	}
+
+	var total int64
+	for _, entry := range selected {
+		total += entry.size
+		fmt.Printf("  %s (%s, %s)\n", backupDirPath(entry.name), entry.imageName(), formatBytes(entry.size))
+	}
+	if config.DryRun {
+		fmt.Printf("Would delete %d backups, freeing %s\n", len(selected), formatBytes(total))
+		return
+	}
+	if !yes {
+		ok, err := confirm(fmt.Sprintf("Delete %d backups (%s)?", len(selected), formatBytes(total)))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !ok {
+			fmt.Println("Nothing deleted")
+			return
+		}
+	}
+
+	catalog := startCatalogUpdater(config.BackupDir)
+	var index *dirIndexUpdater
+	if _, err := os.Stat(filepath.Join(config.BackupDir, indexFile)); err == nil {
+		index = startDirIndexUpdater(config.BackupDir)
+	}
+
+	var freed int64
+	var deleted, failed int
+	for _, entry := range selected {
+		tarballName := backupDirPath(entry.name)
+		if err := deleteBackup(context.Background(), tarballName, entry.signed); err != nil {
+			logger.Error(fmt.Sprintf("Failed to delete %s: %v", tarballName, err), "path", tarballName, "error", err)
+			failed++
+			continue
+		}
+		catalog.remove(tarballName)
+		index.remove(tarballName)
+		logger.Info("Deleted "+tarballName, "path", tarballName, "image", entry.imageName(), "bytes", entry.size)
+		freed += entry.size
+		deleted++
+	}
+	catalog.Close()
+	index.Close()
+
+	logSuccess(fmt.Sprintf("Deleted %d backups, freed %s", deleted, formatBytes(freed)), "backups", deleted, "bytes", freed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// selectImageBackups returns the complete backups of imageName, only those
+// taken before cutoff unless it is zero, oldest first
+func selectImageBackups(entries []listEntry, imageName string, cutoff time.Time) []listEntry {
+	var selected []listEntry
+	for _, entry := range entries {
+		if entry.incomplete || !entry.hasMeta || !sameReference(metadataImageName(entry.meta), imageName) {
+			continue
+		}
+		if !cutoff.IsZero() && !entry.date.Before(cutoff) {
+			continue
+		}
+		selected = append(selected, entry)
+	}
+	sort.SliceStable(selected, func(i, j int) bool { return selected[i].date.Before(selected[j].date) })
+	return selected
+}
+
+// selectNamedBackups resolves backup names, given relative to the current
+// directory or to --dir, to the backups they name. Anything that is not a
+// backup inside --dir is refused, so a mistyped path cannot delete other files.
+func selectNamedBackups(entries []listEntry, names []string) ([]listEntry, error) {
+	dir, err := filepath.Abs(config.BackupDir)
+	if err != nil {
+		return nil, err
+	}
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = resolved
+	}
+	byKey := make(map[string]listEntry, len(entries))
+	for _, entry := range entries {
+		if !entry.incomplete {
+			byKey[entry.name] = entry
+		}
+	}
+
+	var selected []listEntry
+	seen := make(map[string]bool)
+	for _, name := range names {
+		path := logicalBackupPath(strings.TrimSuffix(name, ".json"))
+		if _, err := os.Stat(path); err != nil && !filepath.IsAbs(path) {
+			path = filepath.Join(config.BackupDir, path)
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		if resolved, err := filepath.EvalSymlinks(filepath.Dir(abs)); err == nil {
+			abs = filepath.Join(resolved, filepath.Base(abs))
+		}
+
+		rel, err := filepath.Rel(dir, abs)
+		if err != nil || !filepath.IsLocal(rel) {
+			return nil, fmt.Errorf("refusing to delete %s: it is outside the backup directory %s", name, config.BackupDir)
+		}
+		entry, ok := byKey[filepath.ToSlash(rel)]
+		if !ok {
+			return nil, fmt.Errorf("%s is not a backup in %s", name, config.BackupDir)
+		}
+		if !seen[entry.name] {
+			seen[entry.name] = true
+			selected = append(selected, entry)
+		}
+	}
+	return selected, nil
+}
+
+// confirm asks a yes/no question on the terminal. Without a terminal there is
+// nobody to answer, so it fails and asks for --yes instead.
+func confirm(question string) (bool, error) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return false, fmt.Errorf("refusing to delete without confirmation; pass --yes to delete from a script")
+	}
+	fmt.Printf("%s [y/N] ", question)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false, nil
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", nil
+}
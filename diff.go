@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/docker/docker/api/types/image"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// DiffImage is a local image tag without an up-to-date backup
+type DiffImage struct {
+	Image    string `json:"image"`
+	ImageID  string `json:"image_id"`
+	BackupID string `json:"backup_id,omitempty"`
+	Backup   string `json:"backup,omitempty"`
+}
+
+// DiffBackup is the newest backup of an image that no longer exists locally
+type DiffBackup struct {
+	Image      string `json:"image"`
+	ImageID    string `json:"image_id"`
+	Backup     string `json:"backup"`
+	BackupDate string `json:"backup_date"`
+}
+
+// DiffReport is the result of diff, printed as is with --output json
+type DiffReport struct {
+	Missing  []DiffImage  `json:"missing"`
+	Outdated []DiffImage  `json:"outdated"`
+	Orphaned []DiffBackup `json:"orphaned"`
+}
+
+func runDiff(cmd *cobra.Command, args []string) {
+	failOnMissing, _ := cmd.Flags().GetBool("fail-on-missing")
+	if config.Output != "text" && config.Output != "json" {
+		log.Fatalf("Invalid output format %q (expected text or json)", config.Output)
+	}
+	if isRemotePath(config.BackupDir) {
+		log.Fatal("diff reads the metadata files of a local --dir; use migrate to copy remote backups first")
+	}
+	if _, err := os.Stat(config.BackupDir); err != nil {
+		log.Fatalf("Backup directory %s is not accessible: %v", config.BackupDir, err)
+	}
+
+	cli, err := newDockerClient("")
+	if err != nil {
+		log.Fatalf("Failed to create Docker client: %v", err)
+	}
+	defer cli.Close()
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	images, err := cli.ImageList(ctx, image.ListOptions{})
+	if err != nil {
+		log.Fatalf("Failed to list images: %v", err)
+	}
+
+	report := diffBackups(images, newestBackups(config.BackupDir))
+	if config.Output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		printDiff(report)
+	}
+
+	if failOnMissing && len(report.Missing) > 0 {
+		cli.Close()
+		os.Exit(1)
+	}
+}
+
+// newestBackups returns the newest backup of every image name in dir, keyed
+// by reference. A backup covers every tag recorded for its image, since
+// restoring it brings them all back, and every image of a bundle.
+func newestBackups(dir string) map[string]DiffBackup {
+	newest := make(map[string]DiffBackup)
+	dates := make(map[string]time.Time)
+	note := func(name, id, tarball string, info ImageInfo) {
+		key := referenceKey(name)
+		if prev, ok := dates[key]; ok && prev.After(info.BackupDate) {
+			return
+		}
+		dates[key] = info.BackupDate
+		newest[key] = DiffBackup{Image: name, ImageID: id, Backup: tarball, BackupDate: info.BackupDate.Format("2006-01-02 15:04:05")}
+	}
+
+	scanMetadata(dir, func(tarball string, info ImageInfo) {
+		if len(info.Images) == 0 {
+			for _, name := range appendUnique([]string{metadataImageName(info)}, info.Tags...) {
+				note(name, info.ImageID, tarball, info)
+			}
+			return
+		}
+		for _, img := range info.Images {
+			for _, name := range appendUnique([]string{img.ImageName}, img.Tags...) {
+				note(name, img.ImageID, tarball, info)
+			}
+		}
+	})
+	return newest
+}
+
+// diffBackups joins the tagged local images with the newest backups by
+// reference. An image whose newest backup has another ID is outdated; a backup
+// is orphaned when neither its name nor its image ID exists locally anymore.
+func diffBackups(images []image.Summary, backups map[string]DiffBackup) DiffReport {
+	report := DiffReport{Missing: []DiffImage{}, Outdated: []DiffImage{}, Orphaned: []DiffBackup{}}
+	local := make(map[string]bool)
+	localIDs := make(map[string]bool)
+
+	for _, img := range images {
+		localIDs[img.ID] = true
+		for _, tag := range img.RepoTags {
+			if tag == "<none>:<none>" {
+				continue
+			}
+			local[referenceKey(tag)] = true
+			backup, ok := backups[referenceKey(tag)]
+			switch {
+			case !ok:
+				report.Missing = append(report.Missing, DiffImage{Image: tag, ImageID: img.ID})
+			case backup.ImageID != img.ID:
+				report.Outdated = append(report.Outdated, DiffImage{Image: tag, ImageID: img.ID, BackupID: backup.ImageID, Backup: backup.Backup})
+			}
+		}
+	}
+	for key, backup := range backups {
+		if !local[key] && !localIDs[backup.ImageID] {
+			report.Orphaned = append(report.Orphaned, backup)
+		}
+	}
+
+	sort.Slice(report.Missing, func(i, j int) bool { return report.Missing[i].Image < report.Missing[j].Image })
+	sort.Slice(report.Outdated, func(i, j int) bool { return report.Outdated[i].Image < report.Outdated[j].Image })
+	sort.Slice(report.Orphaned, func(i, j int) bool { return report.Orphaned[i].Image < report.Orphaned[j].Image })
+	return report
+}
+
+func printDiff(report DiffReport) {
+	color.New(color.FgRed, color.Bold).Printf("Not backed up (%d):\n", len(report.Missing))
+	for _, img := range report.Missing {
+		fmt.Printf("  %s (%s)\n", img.Image, shortID(img.ImageID))
+	}
+	color.New(color.FgYellow, color.Bold).Printf("Outdated (%d):\n", len(report.Outdated))
+	for _, img := range report.Outdated {
+		fmt.Printf("  %s: local %s, backup %s in %s\n", img.Image, shortID(img.ImageID), shortID(img.BackupID), img.Backup)
+	}
+	color.New(color.FgCyan, color.Bold).Printf("Orphaned backups (%d):\n", len(report.Orphaned))
+	for _, backup := range report.Orphaned {
+		fmt.Printf("  %s: %s (%s)\n", backup.Image, backup.Backup, backup.BackupDate)
+	}
+}
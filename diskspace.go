@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+// defaultCompressionRatio is the heuristic fraction of the raw image size a
+// compressed tarball is expected to occupy, unless --compression-ratio is set
+const defaultCompressionRatio = 0.4
+
+// errDiskSpaceUnsupported is returned by freeDiskSpace on platforms where free
+// space cannot be queried
+var errDiskSpaceUnsupported = errors.New("free disk space check not supported on this platform")
+
+// estimatedBackupSize returns the expected on-disk size of a backup of an
+// image with the given uncompressed size
+func estimatedBackupSize(size int64) int64 {
+	if config.CompressType != compressionNone {
+		return int64(float64(size) * config.CompressionRatio)
+	}
+	return size
+}
+
+// isDiskFull reports whether err comes from running out of space, in a write
+// of this process or in the output of `docker save -o`
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || strings.Contains(err.Error(), "no space left on device")
+}
+
+// saveError describes a failed save of an image or bundle, pointing out when
+// the backup directory filled up
+func saveError(what string, err error) error {
+	if isDiskFull(err) {
+		return fmt.Errorf("failed to save %s: %s is full, the partial backup was removed: %w", what, config.BackupDir, err)
+	}
+	return fmt.Errorf("failed to save %s: %w", what, err)
+}
+
+// checkDiskSpace compares the estimated size of the backups, plus the space
+// --min-free keeps, against the free space of the backup directory. Images
+// unchanged since their last backup are not counted. Unless --force or
+// --ignore-space-check is set, running short of space is an error.
+func checkDiskSpace(cli DockerClient, ctx context.Context, imageNames []string) error {
+	free, err := freeDiskSpace(config.BackupDir)
+	if errors.Is(err, errDiskSpaceUnsupported) {
+		logger.Debug("Skipping free disk space check: not supported on this platform")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to determine free space in %s: %w", config.BackupDir, err)
+	}
+
+	var raw, needed int64
+	for _, imageName := range imageNames {
+		img, _, err := cli.ImageInspectWithRaw(ctx, imageName)
+		if err != nil {
+			// Reported as a failure of the backup itself
+			continue
+		}
+		if config.Bundle == "" {
+			if _, ok := lastBackups.unchanged(canonicalName(imageName, img.RepoTags, img.ID), img.ID); ok {
+				continue
+			}
+			if _, ok := lastBackups.identical(img.ID); ok && config.Deduplicate {
+				continue
+			}
+		}
+		raw += img.Size
+		needed += estimatedBackupSize(img.Size)
+		if config.Format == formatOCI {
+			// The `docker save` output is staged next to the layout
+			needed += img.Size
+		}
+	}
+
+	logger.Debug(fmt.Sprintf("Estimated backup size: %s (%s uncompressed), %s free in %s",
+		formatBytes(needed), formatBytes(raw), formatBytes(int64(free)), config.BackupDir),
+		"needed", needed, "free", free, "dir", config.BackupDir)
+	if needed+config.MinFree <= int64(free) {
+		return nil
+	}
+
+	message := fmt.Sprintf("backups need an estimated %s (%s uncompressed) but only %s is free in %s",
+		formatBytes(needed), formatBytes(raw), formatBytes(int64(free)), config.BackupDir)
+	if config.MinFree > 0 {
+		message = fmt.Sprintf("backups need an estimated %s (%s uncompressed) and --min-free keeps %s free, but only %s is free in %s",
+			formatBytes(needed), formatBytes(raw), formatBytes(config.MinFree), formatBytes(int64(free)), config.BackupDir)
+	}
+	if config.Force || config.IgnoreSpaceCheck {
+		logger.Warn(fmt.Sprintf("Warning: %s; continuing anyway", message))
+		return nil
+	}
+	return fmt.Errorf("%s (compressed sizes are estimated with --compression-ratio %g; use --ignore-space-check to back up anyway)", message, config.CompressionRatio)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+)
+
+// MockDockerClient is a DockerClient whose image calls run the hooks a test
+// sets. Calls without a hook, and every other method, go to the fake daemon
+// of newTestDaemon, so a test that reaches the daemon unexpectedly fails with
+// the API call it made instead of a nil pointer panic.
+type MockDockerClient struct {
+	DockerClient
+
+	InspectFunc func(ref string) (image.InspectResponse, error)
+	SaveFunc    func(images []string) (io.ReadCloser, error)
+	LoadFunc    func(input io.Reader) (image.LoadResponse, error)
+	ListFunc    func(options image.ListOptions) ([]image.Summary, error)
+	TagFunc     func(source, target string) error
+	PullFunc    func(ref string, options image.PullOptions) (io.ReadCloser, error)
+}
+
+// newMockDockerClient returns a MockDockerClient without hooks whose fake
+// daemon answers no API calls
+func newMockDockerClient(t *testing.T) *MockDockerClient {
+	return &MockDockerClient{DockerClient: newTestDaemon(t, nil)}
+}
+
+// newTestDaemon starts an httptest server standing in for the Docker daemon
+// and returns a client of it. handler answers the requests it knows and
+// reports whether it did; the others fail the test.
+func newTestDaemon(t *testing.T, handler func(w http.ResponseWriter, r *http.Request) bool) *client.Client {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if handler != nil && handler(w, r) {
+			return
+		}
+		t.Errorf("unexpected Docker API call %s %s", r.Method, r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotImplemented)
+		io.WriteString(w, `{"message":"not stubbed by the test"}`)
+	}))
+	t.Cleanup(server.Close)
+
+	cli, err := client.NewClientWithOpts(client.WithHost("tcp://"+server.Listener.Addr().String()), client.WithHTTPClient(server.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cli.Close() })
+	return cli
+}
+
+func (m *MockDockerClient) ImageInspectWithRaw(ctx context.Context, ref string) (image.InspectResponse, []byte, error) {
+	if m.InspectFunc == nil {
+		return m.DockerClient.ImageInspectWithRaw(ctx, ref)
+	}
+	img, err := m.InspectFunc(ref)
+	return img, nil, err
+}
+
+func (m *MockDockerClient) ImageSave(ctx context.Context, images []string, opts ...client.ImageSaveOption) (io.ReadCloser, error) {
+	if m.SaveFunc == nil {
+		return m.DockerClient.ImageSave(ctx, images, opts...)
+	}
+	return m.SaveFunc(images)
+}
+
+func (m *MockDockerClient) ImageLoad(ctx context.Context, input io.Reader, opts ...client.ImageLoadOption) (image.LoadResponse, error) {
+	if m.LoadFunc == nil {
+		return m.DockerClient.ImageLoad(ctx, input, opts...)
+	}
+	return m.LoadFunc(input)
+}
+
+func (m *MockDockerClient) ImageList(ctx context.Context, options image.ListOptions) ([]image.Summary, error) {
+	if m.ListFunc == nil {
+		return m.DockerClient.ImageList(ctx, options)
+	}
+	return m.ListFunc(options)
+}
+
+func (m *MockDockerClient) ImageTag(ctx context.Context, source, target string) error {
+	if m.TagFunc == nil {
+		return m.DockerClient.ImageTag(ctx, source, target)
+	}
+	return m.TagFunc(source, target)
+}
+
+func (m *MockDockerClient) ImagePull(ctx context.Context, ref string, options image.PullOptions) (io.ReadCloser, error) {
+	if m.PullFunc == nil {
+		return m.DockerClient.ImagePull(ctx, ref, options)
+	}
+	return m.PullFunc(ref, options)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/cli/cli/connhelper"
+	"github.com/docker/docker/client"
+)
+
+// defaultContextName is the docker CLI's name for the environment-configured daemon
+const defaultContextName = "default"
+
+// contextMeta is the part of a docker CLI context's meta.json that describes
+// the daemon endpoint
+type contextMeta struct {
+	Name      string
+	Endpoints map[string]struct {
+		Host          string
+		SkipTLSVerify bool
+	}
+}
+
+// daemonEndpoint is the daemon the last client created by newDockerClient
+// talks to and where it was configured, for connection errors. ssh:// clients
+// report a placeholder as their DaemonHost, so the configured host is kept.
+var daemonEndpoint struct {
+	host   string
+	source string
+}
+
+// newDockerClient creates a client for the daemon chosen by, in order, the
+// command's --from-host or --to-host, the named docker CLI context, the global
+// --host and --context, and DOCKER_CONTEXT. Without any of them it uses
+// DOCKER_HOST and the other environment variables like the docker CLI does.
+func newDockerClient(contextName string) (*client.Client, error) {
+	host := config.DockerHost
+	if host == "" && contextName == "" {
+		host = config.Host
+	}
+	if host != "" {
+		return hostDockerClient(host, config.TLSCA, config.TLSCert, config.TLSKey)
+	}
+
+	if contextName == "" {
+		contextName = config.Context
+	}
+	if contextName == "" {
+		contextName = os.Getenv("DOCKER_CONTEXT")
+	}
+	if contextName == "" || contextName == defaultContextName {
+		daemonEndpoint.host, daemonEndpoint.source = "", ""
+		return client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	}
+
+	opts, err := contextClientOpts(contextName)
+	if err != nil {
+		return nil, err
+	}
+	return client.NewClientWithOpts(append(opts, client.WithAPIVersionNegotiation())...)
+}
+
+// hostDockerClient creates a client for the daemon at host, ignoring
+// DOCKER_HOST, DOCKER_TLS_VERIFY and DOCKER_CERT_PATH. With any of the TLS files
+// the connection uses TLS and verifies the daemon against ca, or the system
+// roots when ca is empty.
+func hostDockerClient(host, ca, cert, key string) (*client.Client, error) {
+	opts, err := hostClientOpts(host)
+	if err != nil {
+		return nil, err
+	}
+	if ca != "" || cert != "" || key != "" {
+		opts = append(opts, client.WithTLSClientConfig(ca, cert, key))
+	}
+	daemonEndpoint.host, daemonEndpoint.source = host, "set on the command line"
+	return client.NewClientWithOpts(append(opts, client.WithAPIVersionNegotiation())...)
+}
+
+// hostClientOpts connects to a daemon address such as
+// unix:///run/podman/podman.sock, tcp://10.0.0.5:2376 or ssh://user@host.
+// ssh:// addresses tunnel through `docker system dial-stdio` on the remote host.
+func hostClientOpts(host string) ([]client.Opt, error) {
+	helper, err := connhelper.GetConnectionHelper(host)
+	if err != nil {
+		return nil, err
+	}
+	if helper != nil {
+		return []client.Opt{
+			client.WithHTTPClient(&http.Client{Transport: &http.Transport{DialContext: helper.Dialer}}),
+			client.WithHost(helper.Host),
+			client.WithDialContext(helper.Dialer),
+		}, nil
+	}
+	return []client.Opt{client.WithHost(host)}, nil
+}
+
+// validateDockerHost checks the flags that select the daemon. hostFlag is the
+// command's own host flag, --from-host or --to-host.
+func validateDockerHost(hostFlag string) error {
+	if config.Host != "" && config.Context != "" {
+		return fmt.Errorf("--host cannot be combined with --context")
+	}
+	if config.DockerHost != "" && config.TargetContext != "" {
+		return fmt.Errorf("--%s cannot be combined with --target-context", hostFlag)
+	}
+
+	host, flag := config.DockerHost, hostFlag
+	if host == "" && config.TargetContext == "" {
+		host, flag = config.Host, "host"
+	}
+	if host == "" {
+		if config.TLSCA != "" || config.TLSCert != "" || config.TLSKey != "" {
+			return fmt.Errorf("--tls-ca, --tls-cert and --tls-key require --%s or --host", hostFlag)
+		}
+		return nil
+	}
+	if (config.TLSCert == "") != (config.TLSKey == "") {
+		return fmt.Errorf("--tls-cert and --tls-key must be given together")
+	}
+	url, err := client.ParseHostURL(host)
+	if err != nil {
+		return fmt.Errorf("invalid --%s %q: %w", flag, host, err)
+	}
+	if url.Scheme == "ssh" && (config.TLSCA != "" || config.TLSCert != "" || config.TLSKey != "") {
+		return fmt.Errorf("--tls-ca, --tls-cert and --tls-key do not apply to ssh:// hosts")
+	}
+	return nil
+}
+
+// contextClientOpts reads the endpoint and TLS material of a context from the
+// docker CLI context store
+func contextClientOpts(name string) ([]client.Opt, error) {
+	id := sha256.Sum256([]byte(name))
+	contextID := hex.EncodeToString(id[:])
+	storeDir := filepath.Join(dockerConfigDir(), "contexts")
+
+	data, err := os.ReadFile(filepath.Join(storeDir, "meta", contextID, "meta.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("docker context %q does not exist (see 'docker context ls')", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read docker context %q: %w", name, err)
+	}
+
+	var meta contextMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("invalid docker context %q: %w", name, err)
+	}
+	endpoint, ok := meta.Endpoints["docker"]
+	if !ok || endpoint.Host == "" {
+		return nil, fmt.Errorf("docker context %q has no docker endpoint", name)
+	}
+
+	daemonEndpoint.host, daemonEndpoint.source = endpoint.Host, fmt.Sprintf("docker context %q", name)
+	if strings.HasPrefix(endpoint.Host, "ssh://") {
+		opts, err := hostClientOpts(endpoint.Host)
+		if err != nil {
+			return nil, fmt.Errorf("docker context %q: %w", name, err)
+		}
+		return opts, nil
+	}
+
+	tlsConfig, err := contextTLSConfig(filepath.Join(storeDir, "tls", contextID, "docker"), endpoint.SkipTLSVerify)
+	if err != nil {
+		return nil, fmt.Errorf("docker context %q: %w", name, err)
+	}
+
+	var opts []client.Opt
+	if tlsConfig != nil {
+		opts = append(opts, client.WithHTTPClient(&http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}))
+	}
+	return append(opts, client.WithHost(endpoint.Host)), nil
+}
+
+// contextTLSConfig loads ca.pem, cert.pem and key.pem from a context's TLS
+// directory. It returns nil when the context has no TLS material.
+func contextTLSConfig(dir string, skipVerify bool) (*tls.Config, error) {
+	ca, caErr := os.ReadFile(filepath.Join(dir, "ca.pem"))
+	cert, certErr := os.ReadFile(filepath.Join(dir, "cert.pem"))
+	key, keyErr := os.ReadFile(filepath.Join(dir, "key.pem"))
+	if caErr != nil && certErr != nil && keyErr != nil && !skipVerify {
+		return nil, nil
+	}
+
+	config := &tls.Config{InsecureSkipVerify: skipVerify, MinVersion: tls.VersionTLS12}
+	if caErr == nil {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("invalid CA certificate in %s", dir)
+		}
+		config.RootCAs = pool
+	}
+	if certErr == nil && keyErr == nil {
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate in %s: %w", dir, err)
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+	return config, nil
+}
+
+// dockerConfigDir returns the docker CLI configuration directory
+func dockerConfigDir() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return dir
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".docker")
+}
+
+// daemonAddress returns the address of the daemon cli talks to
+func daemonAddress(cli DockerClient) string {
+	if daemonEndpoint.host != "" {
+		return daemonEndpoint.host
+	}
+	return cli.DaemonHost()
+}
+
+// pingDaemon checks that the daemon answers before any work starts, so an
+// unreachable daemon is one clear error rather than a failure per image
+func pingDaemon(cli DockerClient, ctx context.Context) error {
+	err := withRetry(ctx, "ping Docker daemon", func() error {
+		_, err := cli.Ping(ctx)
+		return err
+	})
+	if err == nil {
+		return nil
+	}
+
+	host, source := daemonAddress(cli), daemonEndpoint.source
+	if source == "" {
+		source = "DOCKER_HOST is not set"
+		if env := os.Getenv("DOCKER_HOST"); env != "" {
+			source = "DOCKER_HOST=" + env
+		}
+	}
+	if client.IsErrConnectionFailed(err) {
+		return fmt.Errorf("cannot reach Docker daemon at %s (%s); is it running?", host, source)
+	}
+	return fmt.Errorf("cannot reach Docker daemon at %s (%s): %w", host, source, err)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/errdefs"
+	"github.com/fatih/color"
+)
+
+// DryRunResult describes what a backup would produce for a single image
+type DryRunResult struct {
+	ImageName     string   `json:"image_name"`
+	Images        []string `json:"images,omitempty"`
+	PullImages    []string `json:"pull_images,omitempty"`
+	Missing       []string `json:"missing,omitempty"`
+	Path          string   `json:"path,omitempty"`
+	Mirror        string   `json:"mirror,omitempty"`
+	Size          int64    `json:"size,omitempty"`
+	EstimatedSize int64    `json:"estimated_size,omitempty"`
+	CompressType  string   `json:"compress_type,omitempty"`
+	Skip          string   `json:"skip,omitempty"`
+	Pull          bool     `json:"pull,omitempty"`
+	Error         string   `json:"error,omitempty"`
+}
+
+// runDryRun inspects every image and reports the planned backups in the order
+// of imageNames, followed by their total estimated size, without touching the
+// filesystem. With --bundle the images are planned as the one tarball the run
+// writes. It returns false if any image could not be resolved.
+func runDryRun(cli DockerClient, ctx context.Context, imageNames []string) bool {
+	if config.Bundle != "" {
+		result := planBundle(cli, ctx, config.Bundle, imageNames)
+		printDryRunResult(result)
+		printDryRunTotal([]DryRunResult{result})
+		return result.Error == ""
+	}
+
+	results := make([]DryRunResult, len(imageNames))
+	pool := newWorkerPool(context.Background(), min(config.MaxWorkers, len(imageNames)), func(_ int, i int) struct{} {
+		results[i] = planBackup(cli, ctx, imageNames[i])
+		return struct{}{}
+	})
+	for i := range imageNames {
+		pool.Submit(i)
+	}
+	pool.Wait()
+
+	ok := true
+	for _, result := range results {
+		if result.Error != "" {
+			ok = false
+		}
+		printDryRunResult(result)
+	}
+	printDryRunTotal(results)
+	return ok
+}
+
+// planBackup resolves the image and computes the would-be tarball path and size
+func planBackup(cli DockerClient, ctx context.Context, imageName string) DryRunResult {
+	result := DryRunResult{ImageName: imageName, CompressType: metadataCompressType()}
+
+	img, _, err := cli.ImageInspectWithRaw(ctx, imageName)
+	if err != nil && config.Pull && errdefs.IsNotFound(err) {
+		// Name and size are only known once the image is pulled
+		result.Pull = true
+		return result
+	}
+	if err != nil {
+		result.Error = fmt.Sprintf("error inspecting image: %v", err)
+		return result
+	}
+
+	result.Size = img.Size
+	if selectedPlatform != nil {
+		_, size, err := localPlatform(cli, ctx, imageName, img)
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		if size > 0 {
+			result.Size = size
+		}
+	}
+	name := canonicalName(imageName, img.RepoTags, img.ID)
+	if config.ToRegistry != "" {
+		if result.Mirror, err = mirrorReference(config.ToRegistry, name, time.Now()); err != nil {
+			result.Error = err.Error()
+			return result
+		}
+	}
+	if config.NoTarball {
+		return result
+	}
+
+	baseName, err := backupBaseName(name, img.ID, time.Now())
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	if !config.Force && !isRemotePath(config.BackupDir) {
+		if latest, ok := findLatestBackup(config.BackupDir, name); ok && latest.current(img.ID) {
+			result.Skip = fmt.Sprintf("unchanged since %s, backed up %s", latest.tarball, formatAge(latest.date))
+			return result
+		}
+		if config.Deduplicate {
+			if identical, ok := findIdenticalBackup(config.BackupDir, img.ID); ok {
+				result.Skip = "identical backup at " + identical.tarball
+				return result
+			}
+		}
+	}
+
+	// --on-exist and name collisions between images are resolved as in a real
+	// run; the names are only claimed in memory
+	result.Path, err = resolveTarballName(tarballPath(baseName), imageName)
+	if errors.Is(err, errExists) {
+		result.Skip = result.Path + " already exists"
+		result.Path = ""
+		return result
+	}
+	if err != nil {
+		result.Path = ""
+		result.Error = err.Error()
+		return result
+	}
+	result.EstimatedSize = estimatedBackupSize(result.Size)
+	return result
+}
+
+// planBundle resolves the images of a --bundle run and computes the path and
+// size of the single tarball it writes. The size is the sum of the images, so
+// layers they share make the estimate high. Every image that cannot be
+// inspected is listed in Missing and reported in Error together.
+func planBundle(cli DockerClient, ctx context.Context, bundleName string, imageNames []string) DryRunResult {
+	result := DryRunResult{ImageName: bundleName, Images: imageNames, CompressType: metadataCompressType()}
+
+	var inspectErrs []string
+	for _, imageName := range imageNames {
+		img, _, err := cli.ImageInspectWithRaw(ctx, imageName)
+		if err != nil && config.Pull && errdefs.IsNotFound(err) {
+			result.PullImages = append(result.PullImages, imageName)
+			continue
+		}
+		if err != nil {
+			result.Missing = append(result.Missing, imageName)
+			inspectErrs = append(inspectErrs, fmt.Sprintf("%s (%v)", imageName, err))
+			continue
+		}
+		result.Size += img.Size
+	}
+	if len(inspectErrs) > 0 {
+		result.Error = "error inspecting images: " + strings.Join(inspectErrs, ", ")
+		return result
+	}
+
+	baseName, err := renderName(nameTmpl, newNameData(bundleName, "", time.Now()))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Path, err = resolveTarballName(tarballPath(baseName), bundleName)
+	if errors.Is(err, errExists) {
+		result.Skip = result.Path + " already exists"
+		result.Path = ""
+		return result
+	}
+	if err != nil {
+		result.Path = ""
+		result.Error = err.Error()
+		return result
+	}
+	result.EstimatedSize = estimatedBackupSize(result.Size)
+	return result
+}
+
+// printDryRunTotal prints how many images would be backed up and their total
+// estimated size on disk. JSON output has the estimate on every line instead.
+func printDryRunTotal(results []DryRunResult) {
+	if config.Output == "json" {
+		return
+	}
+	var saved, skipped, pulled int
+	var size, estimated int64
+	for _, result := range results {
+		switch {
+		case result.Skip != "":
+			skipped++
+		case len(result.Images) > 0:
+			saved += len(result.Images) - len(result.PullImages)
+			pulled += len(result.PullImages)
+			size += result.Size
+			estimated += result.EstimatedSize
+		case result.Pull:
+			pulled++
+		case result.Path != "":
+			saved++
+			size += result.Size
+			estimated += result.EstimatedSize
+		}
+	}
+
+	summary := fmt.Sprintf("[dry-run] Would back up %d images: %.2f MB (estimated on disk: %.2f MB)",
+		saved, float64(size)/(1024*1024), float64(estimated)/(1024*1024))
+	if skipped > 0 {
+		summary += fmt.Sprintf(", %d skipped", skipped)
+	}
+	if pulled > 0 {
+		summary += fmt.Sprintf(", %d to pull first (size unknown)", pulled)
+	}
+	fmt.Println()
+	color.New(color.Bold).Println(summary)
+}
+
+func printDryRunResult(result DryRunResult) {
+	if config.Output == "json" {
+		json.NewEncoder(os.Stdout).Encode(result)
+		return
+	}
+
+	if result.Error != "" {
+		color.New(color.FgRed, color.Bold).Printf("[dry-run] %s: %s\n", result.ImageName, result.Error)
+		return
+	}
+
+	if len(result.Images) > 0 && result.Skip == "" {
+		fmt.Printf("[dry-run] Would save bundle %s of %d images to %s\n", result.ImageName, len(result.Images), result.Path)
+		fmt.Printf("  Images: %s\n", strings.Join(result.Images, ", "))
+		if len(result.PullImages) > 0 {
+			fmt.Printf("  Pulled from their registry first (size unknown): %s\n", strings.Join(result.PullImages, ", "))
+		}
+		fmt.Printf("  Size: %.2f MB (estimated on disk: %.2f MB)\n",
+			float64(result.Size)/(1024*1024), float64(result.EstimatedSize)/(1024*1024))
+	} else if len(result.Images) > 0 {
+		fmt.Printf("[dry-run] Would skip bundle %s: %s\n", result.ImageName, result.Skip)
+	} else if result.Pull {
+		fmt.Printf("[dry-run] Would pull image %s from its registry and back it up\n", result.ImageName)
+	} else if result.Skip != "" {
+		fmt.Printf("[dry-run] Would skip image %s: %s\n", result.ImageName, result.Skip)
+	} else if result.Path != "" {
+		fmt.Printf("[dry-run] Would save image %s to %s\n", result.ImageName, result.Path)
+		fmt.Printf("  Size: %.2f MB (estimated on disk: %.2f MB)\n",
+			float64(result.Size)/(1024*1024), float64(result.EstimatedSize)/(1024*1024))
+	}
+	if result.Mirror != "" {
+		fmt.Printf("[dry-run] Would push image %s to %s\n", result.ImageName, result.Mirror)
+	}
+}
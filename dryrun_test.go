@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/errdefs"
+)
+
+func TestPlanBundle(t *testing.T) {
+	sizes := map[string]int64{"nginx:latest": 100 << 20, "redis:7": 50 << 20}
+	tests := []struct {
+		name        string
+		images      []string
+		wantMissing []string
+	}{
+		{"present", []string{"nginx:latest", "redis:7"}, nil},
+		{"two missing", []string{"nginx:latest", "app:1.0", "redis:7", "db:2"}, []string{"app:1.0", "db:2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupBackupTest(t, compressionGzip)
+			config.Bundle = "web"
+			cli := newMockDockerClient(t)
+			cli.InspectFunc = func(ref string) (image.InspectResponse, error) {
+				if _, ok := sizes[ref]; !ok {
+					return image.InspectResponse{}, errdefs.NotFound(errors.New("No such image: " + ref))
+				}
+				return image.InspectResponse{ID: "sha256:" + ref, RepoTags: []string{ref}, Size: sizes[ref]}, nil
+			}
+
+			result := planBundle(cli, context.Background(), config.Bundle, tt.images)
+			if len(tt.wantMissing) > 0 {
+				if !slices.Equal(result.Missing, tt.wantMissing) {
+					t.Errorf("missing = %v, want %v", result.Missing, tt.wantMissing)
+				}
+				for _, name := range tt.wantMissing {
+					if !strings.Contains(result.Error, name) {
+						t.Errorf("error %q does not report %s", result.Error, name)
+					}
+				}
+				return
+			}
+			if result.Error != "" {
+				t.Fatal(result.Error)
+			}
+			if want := filepath.Join(config.BackupDir, "web.tar.gz"); result.Path != want {
+				t.Errorf("path = %s, want %s", result.Path, want)
+			}
+			if want := sizes["nginx:latest"] + sizes["redis:7"]; result.Size != want {
+				t.Errorf("size = %d, want %d", result.Size, want)
+			}
+			if result.EstimatedSize != estimatedBackupSize(result.Size) {
+				t.Errorf("estimated size = %d, want %d", result.EstimatedSize, estimatedBackupSize(result.Size))
+			}
+		})
+	}
+}
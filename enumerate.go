@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+)
+
+// untaggedName is what --exclude patterns are matched against for images
+// without any repo tags
+const untaggedName = "<none>"
+
+// errDisappeared is returned by backupImage for an image found by --all or
+// --filter that was removed before it could be saved
+var errDisappeared = errors.New("image disappeared during backup")
+
+// enumeratedImages holds the images found by --all and --filter rather than
+// named by the user. It is filled before the workers start.
+var enumeratedImages = map[string]bool{}
+
+// disappeared reports whether err means that an enumerated image was removed
+// after it was listed. A missing image the user named is a real failure.
+func disappeared(imageName string, err error) bool {
+	return enumeratedImages[imageName] && isImageNotFound(err)
+}
+
+// listImages enumerates the local images matching the daemon filters (all
+// images when args is empty), one entry per image. Tagged images are named by
+// their first repo tag and untagged images by their short ID. Images with a
+// repo tag matching an --exclude pattern are dropped.
+func listImages(cli DockerClient, ctx context.Context, args filters.Args) ([]string, error) {
+	summaries, err := cli.ImageList(ctx, image.ListOptions{Filters: args})
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, summary := range summaries {
+		tags := imageRepoTags(summary.RepoTags)
+
+		if pattern, ok := matchExclude(tags); ok {
+			logExcluded(tags[0], pattern)
+			continue
+		}
+
+		if tags[0] == untaggedName {
+			names = append(names, shortID(summary.ID))
+		} else {
+			names = append(names, tags[0])
+		}
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// parseImageFilters converts --filter key=value expressions into daemon
+// filters. Like `docker images --filter`, different keys must all match and
+// repeated keys match any of their values.
+func parseImageFilters(exprs []string) (filters.Args, error) {
+	args := filters.NewArgs()
+	for _, expr := range exprs {
+		key, value, ok := strings.Cut(expr, "=")
+		if !ok || key == "" {
+			return args, fmt.Errorf("invalid --filter %q (expected key=value, e.g. reference=myregistry/* or label=backup=true)", expr)
+		}
+		args.Add(strings.TrimSpace(key), value)
+	}
+	if err := args.Validate(imageFilterKeys); err != nil {
+		return args, fmt.Errorf("invalid --filter: %w", err)
+	}
+	return args, nil
+}
+
+// imageFilterKeys are the filters the daemon accepts when listing images
+var imageFilterKeys = map[string]bool{
+	"before":    true,
+	"dangling":  true,
+	"label":     true,
+	"reference": true,
+	"since":     true,
+	"until":     true,
+}
+
+// appendUnique appends names that are not already in list
+func appendUnique(list []string, names ...string) []string {
+	seen := make(map[string]bool, len(list))
+	for _, name := range list {
+		seen[name] = true
+	}
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			list = append(list, name)
+		}
+	}
+	return list
+}
+
+// imageRepoTags returns the sorted repo tags of an image, or untaggedName for
+// dangling images (the daemon reports these as no tags or "<none>:<none>")
+func imageRepoTags(repoTags []string) []string {
+	var tags []string
+	for _, tag := range repoTags {
+		if tag != "<none>:<none>" {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) == 0 {
+		return []string{untaggedName}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// canonicalName returns the name a backup of an image is known by: in its
+// file name, its metadata, the unchanged check and list. An image named by one
+// of its tags keeps that name. One named by ID or digest is named the way
+// --all names it, by its first repo tag or by its short ID when untagged, so
+// backing it up by ID and by tag yields the same history.
+func canonicalName(imageName string, repoTags []string, id string) string {
+	key := referenceKey(imageName)
+	for _, tag := range repoTags {
+		if referenceKey(tag) == key {
+			return imageName
+		}
+	}
+	tags := imageRepoTags(repoTags)
+	if tags[0] == untaggedName {
+		return shortID(id)
+	}
+	return tags[0]
+}
+
+// metadataImageName returns the canonical name of the image in a metadata
+// sidecar. Backups written before names were made canonical may name their
+// image by ID or digest. Bundles keep their bundle name.
+func metadataImageName(info ImageInfo) string {
+	if len(info.Images) > 0 || info.ImageID == "" || info.ImageName == "" {
+		return info.ImageName
+	}
+	if len(info.Tags) == 0 && !namesID(info.ImageName, info.ImageID) {
+		return info.ImageName
+	}
+	return canonicalName(info.ImageName, info.Tags, info.ImageID)
+}
+
+// imageIDPattern matches image IDs with their sha256: prefix, full or
+// abbreviated. shortIDPattern matches IDs without it, which repository names
+// made only of hex letters such as cafe also match.
+var (
+	imageIDPattern = regexp.MustCompile(`^sha256:[0-9a-f]{1,64}$`)
+	shortIDPattern = regexp.MustCompile(`^[0-9a-f]{12,64}$`)
+)
+
+// normalizeImageNames checks the image names to back up before any work
+// starts, reporting every invalid one together, and returns them in the form
+// --all names images: nginx and docker.io/library/nginx both become
+// nginx:latest. Image IDs are kept as given.
+func normalizeImageNames(cli DockerClient, ctx context.Context, names []string) ([]string, error) {
+	var normalized, invalid []string
+	for _, name := range names {
+		if isImageID(cli, ctx, name) {
+			normalized = appendUnique(normalized, name)
+			continue
+		}
+		named, err := reference.ParseNormalizedNamed(name)
+		if err != nil {
+			invalid = append(invalid, fmt.Sprintf("%q (%v)", name, err))
+			continue
+		}
+		normalized = appendUnique(normalized, reference.FamiliarString(reference.TagNameOnly(named)))
+	}
+	if len(invalid) > 0 {
+		return nil, fmt.Errorf("invalid image names: %s", strings.Join(invalid, ", "))
+	}
+	return normalized, nil
+}
+
+// isImageID reports whether name is an image ID rather than a reference: it
+// has the sha256: prefix, or is at least 12 hex characters and the daemon
+// resolves it to the image with that ID
+func isImageID(cli DockerClient, ctx context.Context, name string) bool {
+	if imageIDPattern.MatchString(name) {
+		return true
+	}
+	if !shortIDPattern.MatchString(name) {
+		return false
+	}
+	img, _, err := cli.ImageInspectWithRaw(ctx, name)
+	return err == nil && namesID(name, img.ID)
+}
+
+// namesID reports whether name is the image ID id or a prefix of it
+func namesID(name, id string) bool {
+	name = strings.TrimPrefix(name, "sha256:")
+	return name != "" && strings.HasPrefix(strings.TrimPrefix(id, "sha256:"), name)
+}
+
+// dedupeImages drops names that resolve to the same image as an earlier name,
+// such as an image named on the command line and found again by --filter, so
+// it is not saved twice. Names that cannot be inspected are kept and fail or
+// get pulled in their own job.
+func dedupeImages(cli DockerClient, ctx context.Context, names []string) []string {
+	if len(names) < 2 {
+		return names
+	}
+	byID := make(map[string]string, len(names))
+	kept := names[:0]
+	for _, name := range names {
+		img, _, err := cli.ImageInspectWithRaw(ctx, name)
+		if err != nil {
+			kept = append(kept, name)
+			continue
+		}
+		if first, ok := byID[img.ID]; ok {
+			logger.Info(fmt.Sprintf("Deduplication: skipping %s, same image as %s", name, first), "image", name, "duplicate_of", first)
+			delete(enumeratedImages, name)
+			continue
+		}
+		byID[img.ID] = name
+		kept = append(kept, name)
+	}
+	return kept
+}
+
+// excludeImages drops the names matching an --exclude pattern, either exactly
+// or as a glob. It runs on the final image list, whatever its source.
+func excludeImages(names []string) []string {
+	if len(config.Excludes) == 0 {
+		return names
+	}
+	kept := names[:0]
+	for _, name := range names {
+		if pattern, ok := matchExclude([]string{name}); ok {
+			logExcluded(name, pattern)
+			continue
+		}
+		kept = append(kept, name)
+	}
+	return kept
+}
+
+// logExcluded reports an image skipped by --exclude
+func logExcluded(name, pattern string) {
+	logger.Info(fmt.Sprintf("Excluding %s (matches --exclude %q)", name, pattern), "image", name, "pattern", pattern)
+}
+
+// matchExclude returns the first --exclude pattern matching any of the tags.
+// A pattern that is a plain image reference is also compared in the form
+// normalizeImageNames gives names, so --exclude nginx and --exclude
+// docker.io/library/nginx both match nginx:latest.
+func matchExclude(tags []string) (string, bool) {
+	for _, pattern := range config.Excludes {
+		forms := []string{pattern}
+		if named, err := reference.ParseNormalizedNamed(pattern); err == nil {
+			forms = appendUnique(forms, reference.FamiliarString(reference.TagNameOnly(named)))
+		}
+		for _, form := range forms {
+			for _, tag := range tags {
+				if ok, _ := path.Match(form, tag); ok || form == tag {
+					return pattern, true
+				}
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/errdefs"
+)
+
+func TestNormalizeImageNames(t *testing.T) {
+	const id = "sha256:deadbeefcafe0123456789abcdef0123456789abcdef0123456789abcdef0123"
+	inspect := func(ref string) (image.InspectResponse, error) {
+		if namesID(ref, id) {
+			return image.InspectResponse{ID: id}, nil
+		}
+		return image.InspectResponse{}, errdefs.NotFound(errors.New("No such image: " + ref))
+	}
+
+	tests := []struct {
+		name    string
+		names   []string
+		want    []string
+		wantErr bool
+	}{
+		{"tag added", []string{"nginx", "docker.io/library/nginx:latest"}, []string{"nginx:latest"}, false},
+		{"hex repository name", []string{"cafe", "cafe:latest", "deadbeef"}, []string{"cafe:latest", "deadbeef:latest"}, false},
+		{"short ID", []string{"deadbeefcafe"}, []string{"deadbeefcafe"}, false},
+		{"hex name of another image", []string{"beefbeefbeef"}, []string{"beefbeefbeef:latest"}, false},
+		{"prefixed ID", []string{"sha256:deadbeef"}, []string{"sha256:deadbeef"}, false},
+		{"invalid", []string{"Nginx", "nginx:"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cli := newMockDockerClient(t)
+			cli.InspectFunc = inspect
+			got, err := normalizeImageNames(cli, context.Background(), tt.names)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("normalizeImageNames() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("normalizeImageNames() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExcludeImages(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{"nginx", []string{"redis:7"}},
+		{"docker.io/library/nginx", []string{"redis:7"}},
+		{"nginx:*", []string{"redis:7"}},
+		{"redis:7", []string{"nginx:latest"}},
+		{"postgres", []string{"nginx:latest", "redis:7"}},
+		{"<none>", []string{"nginx:latest", "redis:7"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			config = defaultConfig()
+			config.Excludes = []string{tt.pattern}
+			t.Cleanup(func() { config = defaultConfig() })
+
+			names, err := normalizeImageNames(newMockDockerClient(t), context.Background(), []string{"nginx", "docker.io/library/redis:7"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := excludeImages(names); !slices.Equal(got, tt.want) {
+				t.Errorf("excludeImages() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
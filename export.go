@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/spf13/cobra"
+)
+
+// kindExport marks the metadata of a container filesystem export. Image
+// backups leave the kind empty.
+const kindExport = "container-export"
+
+// isExport reports whether the metadata describes a container filesystem
+// export rather than an image backup
+func (info ImageInfo) isExport() bool {
+	return info.Kind == kindExport
+}
+
+// errIsExport is returned when an export is handed to a command that loads
+// image backups
+var errIsExport = errors.New("is a container filesystem export; load it with import")
+
+func runExport(cmd *cobra.Command, args []string) {
+	if config.CompressType != compressionGzip && config.CompressType != compressionNone {
+		log.Fatalf("Invalid --compress %q (expected gzip or none)", config.CompressType)
+	}
+	if config.Timeout < 0 {
+		log.Fatal("--timeout cannot be negative")
+	}
+
+	cli, err := newDockerClient("")
+	if err != nil {
+		log.Fatalf("Failed to create Docker client: %v", err)
+	}
+	defer cli.Close()
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	if err := pingDaemon(cli, ctx); err != nil {
+		log.Fatal(err)
+	}
+	if config.DryRun {
+		if !dryRunExport(cli, ctx, appendUnique(nil, args...)) {
+			os.Exit(1)
+		}
+		return
+	}
+	if err := os.MkdirAll(config.BackupDir, 0755); err != nil {
+		log.Fatalf("Failed to create backup directory: %v", err)
+	}
+
+	started := time.Now()
+	results := runJobs(ctx, appendUnique(nil, args...), func(ctx context.Context, name string) error {
+		return exportContainer(cli, ctx, name)
+	})
+
+	logger.Info("All export operations completed")
+	failed := printSummary("Export", results)
+	finishReport(newRunReport("export", results, started))
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// exportContainer writes the flattened filesystem of a container to
+// <container>-export-<timestamp>.tar[.gz] with a metadata sidecar naming the
+// container and the image it was created from
+func exportContainer(cli DockerClient, ctx context.Context, containerName string) error {
+	inspect, err := cli.ContainerInspect(ctx, containerName)
+	if err != nil {
+		return fmt.Errorf("error inspecting container: %w", err)
+	}
+	name := strings.TrimPrefix(inspect.Name, "/")
+	now := time.Now()
+	tarballName := exportPath(name, now)
+	printSaving(name, tarballName)
+
+	if err := writeExport(cli, ctx, inspect.ID, partialName(tarballName)); err != nil {
+		removeBackup(tarballName)
+		return saveError("export", err)
+	}
+
+	info := ImageInfo{
+		SchemaVersion: imageInfoSchemaVersion,
+		Kind:          kindExport,
+		ImageName:     name,
+		BackupDate:    now,
+		CompressType:  metadataCompressType(),
+		CompressLevel: compressLevel(),
+		Container:     &SourceContainer{Name: name, ID: inspect.ID, Started: containerStarted(inspect)},
+	}
+	if inspect.Config != nil {
+		info.SourceImage = inspect.Config.Image
+	}
+	if stat, err := os.Stat(partialName(tarballName)); err == nil {
+		info.Size = stat.Size()
+	}
+	if err := writeImageInfo(tarballName+".json", info); err != nil {
+		removeBackup(tarballName)
+		return err
+	}
+	if err := commitBackup(tarballName); err != nil {
+		removeBackup(tarballName)
+		return err
+	}
+	recordBackupOutput(containerName, tarballName)
+
+	logSuccess(fmt.Sprintf("Successfully exported container %s to %s", name, tarballName), "container", name, "path", tarballName)
+	return nil
+}
+
+// exportPath returns the tarball an export of the named container taken at now
+// is written to
+func exportPath(name string, now time.Time) string {
+	return tarballPath(fmt.Sprintf("%s-export-%s", name, now.Format("20060102-150405")))
+}
+
+// containerStarted returns when the container was last started, or nil if it
+// never was
+func containerStarted(inspect container.InspectResponse) *time.Time {
+	if inspect.State == nil {
+		return nil
+	}
+	started, err := time.Parse(time.RFC3339Nano, inspect.State.StartedAt)
+	if err != nil || started.IsZero() {
+		return nil
+	}
+	return &started
+}
+
+// dryRunExport reports the containers export would write and where, and
+// whether all of them exist
+func dryRunExport(cli DockerClient, ctx context.Context, names []string) bool {
+	ok := true
+	now := time.Now()
+	for _, containerName := range names {
+		inspect, err := cli.ContainerInspect(ctx, containerName)
+		if err != nil {
+			logger.Error(fmt.Sprintf("[dry-run] Cannot export container %s: %v", containerName, err), "container", containerName, "error", err)
+			ok = false
+			continue
+		}
+		name := strings.TrimPrefix(inspect.Name, "/")
+		source := ""
+		if inspect.Config != nil && inspect.Config.Image != "" {
+			source = fmt.Sprintf(" (from %s)", inspect.Config.Image)
+		}
+		fmt.Printf("[dry-run] Would export container %s%s to %s\n", name, source, exportPath(name, now))
+	}
+	return ok
+}
+
+// writeExport streams `docker export` through the configured compression
+func writeExport(cli DockerClient, ctx context.Context, containerID, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	body, err := cli.ContainerExport(ctx, containerID)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	out, _, err := newBackupWriter(throttle(ctx, file))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, &contextReader{ctx: ctx, r: body}); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+func runImport(cmd *cobra.Command, args []string) {
+	ref, _ := cmd.Flags().GetString("ref")
+	changes, _ := cmd.Flags().GetStringArray("change")
+	tarballName := args[0]
+
+	// Image backups need docker load; importing one would produce an image
+	// holding the save archive as its filesystem
+	if info, err := loadImageInfo(logicalBackupPath(tarballName) + ".json"); err == nil && !info.isExport() {
+		log.Fatalf("%s is an image backup; load it with restore", tarballName)
+	}
+
+	cli, err := newDockerClient("")
+	if err != nil {
+		log.Fatalf("Failed to create Docker client: %v", err)
+	}
+	defer cli.Close()
+	defer closeRemoteBackends()
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	if err := pingDaemon(cli, ctx); err != nil {
+		log.Fatal(err)
+	}
+
+	id, err := importExport(cli, ctx, tarballName, ref, changes)
+	if err != nil {
+		log.Fatalf("Failed to import %s: %v", tarballName, err)
+	}
+	if ref != "" {
+		logSuccess(fmt.Sprintf("Imported %s as %s (%s)", tarballName, ref, shortID(id)), "path", tarballName, "image", ref, "id", id)
+	} else {
+		logSuccess(fmt.Sprintf("Imported %s as %s", tarballName, id), "path", tarballName, "id", id)
+	}
+}
+
+// importExport streams a container export into the daemon as a new image
+// tagged ref, applying the Dockerfile instructions in changes, and returns the
+// ID of the image. The daemon detects the compression itself.
+func importExport(cli DockerClient, ctx context.Context, tarballName, ref string, changes []string) (string, error) {
+	data, err := openBackup(logicalBackupPath(tarballName))
+	if err != nil {
+		return "", err
+	}
+	defer data.Close()
+
+	logger.Info(fmt.Sprintf("Importing %s...", tarballName), "path", tarballName)
+	body, err := cli.ImageImport(ctx, image.ImportSource{Source: data, SourceName: "-"}, ref, image.ImportOptions{
+		Changes: changes,
+		Message: "Imported by go-backup-docker-image from " + filepath.Base(tarballName),
+	})
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	// The daemon reports the ID of the new image as the last status
+	var id string
+	decoder := json.NewDecoder(body)
+	for {
+		var msg struct {
+			Status      string `json:"status"`
+			ErrorDetail *struct {
+				Message string `json:"message"`
+			} `json:"errorDetail"`
+		}
+		if err := decoder.Decode(&msg); err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+		if msg.ErrorDetail != nil && msg.ErrorDetail.Message != "" {
+			return "", errors.New(msg.ErrorDetail.Message)
+		}
+		if strings.HasPrefix(msg.Status, "sha256:") {
+			id = msg.Status
+		}
+	}
+	if id == "" {
+		return "", fmt.Errorf("the daemon did not report the imported image")
+	}
+	return id, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// httpResumeAttempts is how many times a download that broke off is resumed
+// with a range request before the read fails
+const httpResumeAttempts = 5
+
+var errReadOnlyBackend = errors.New("http and https locations are read-only")
+
+// httpBackend reads backups served by a web server, such as an artifact
+// server. Backups can be restored from it but not written to or listed.
+type httpBackend struct {
+	base   *url.URL
+	client *http.Client
+	// missing remembers the keys the server answered 404 for, so the metadata
+	// sidecar that plain web servers usually lack is only asked for once
+	missing sync.Map
+}
+
+// newHTTPBackend creates the backend for a location such as
+// https://artifacts.internal/backups. Credentials in the URL are sent with
+// basic authentication.
+func newHTTPBackend(u *url.URL) *httpBackend {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Downloads take as long as they take, but a server must start answering
+	transport.ResponseHeaderTimeout = time.Minute
+	return &httpBackend{base: u, client: &http.Client{Transport: transport}}
+}
+
+func (b *httpBackend) String() string {
+	return b.base.Redacted()
+}
+
+func (b *httpBackend) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	return errReadOnlyBackend
+}
+
+func (b *httpBackend) Delete(ctx context.Context, key string) error {
+	return errReadOnlyBackend
+}
+
+func (b *httpBackend) List(ctx context.Context) ([]RemoteFile, error) {
+	return nil, fmt.Errorf("cannot list %s: %w", b, errReadOnlyBackend)
+}
+
+// Open starts downloading key. A missing file is reported as fs.ErrNotExist.
+func (b *httpBackend) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	u := b.base.JoinPath(key)
+	if _, ok := b.missing.Load(key); ok {
+		return nil, fmt.Errorf("%s: %w", u.Redacted(), fs.ErrNotExist)
+	}
+	r := &httpReader{ctx: ctx, client: b.client, url: u}
+	if err := r.get(); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			b.missing.Store(key, true)
+		}
+		return nil, err
+	}
+	return r, nil
+}
+
+// httpReader is the body of a download. When the connection breaks off and
+// the server supports range requests, the download is resumed where it
+// stopped instead of failing the restore; If-Range makes sure the file did
+// not change on the server in between.
+type httpReader struct {
+	ctx       context.Context
+	client    *http.Client
+	url       *url.URL
+	body      io.ReadCloser
+	offset    int64
+	validator string
+	resumable bool
+	resumes   int
+}
+
+// get requests the file from the current offset
+func (r *httpReader) get() error {
+	req, err := http.NewRequestWithContext(r.ctx, http.MethodGet, r.url.String(), nil)
+	if err != nil {
+		return err
+	}
+	if r.offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", r.offset))
+		req.Header.Set("If-Range", r.validator)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case r.offset == 0 && resp.StatusCode == http.StatusOK:
+		// Weak ETags cannot be used with If-Range
+		r.validator = resp.Header.Get("ETag")
+		if r.validator == "" || strings.HasPrefix(r.validator, "W/") {
+			r.validator = resp.Header.Get("Last-Modified")
+		}
+		r.resumable = resp.Header.Get("Accept-Ranges") == "bytes" && r.validator != ""
+	case r.offset > 0 && resp.StatusCode == http.StatusPartialContent:
+	default:
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode == http.StatusNotFound:
+			return fmt.Errorf("%s: %w", r.url.Redacted(), fs.ErrNotExist)
+		case r.offset > 0 && resp.StatusCode == http.StatusOK:
+			return fmt.Errorf("%s changed on the server during the download", r.url.Redacted())
+		}
+		return fmt.Errorf("GET %s: %s", r.url.Redacted(), resp.Status)
+	}
+	r.body = resp.Body
+	return nil
+}
+
+func (r *httpReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.body.Read(p)
+		r.offset += int64(n)
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		// Hand out what arrived; the next read gets the error again
+		if n > 0 {
+			return n, nil
+		}
+		if !r.resumable || r.resumes >= httpResumeAttempts || r.ctx.Err() != nil {
+			return 0, err
+		}
+
+		r.resumes++
+		r.body.Close()
+		logger.Warn(fmt.Sprintf("Warning: download of %s broke off after %s, resuming (attempt %d/%d): %v",
+			r.url.Redacted(), formatBytes(r.offset), r.resumes, httpResumeAttempts, err),
+			"url", r.url.Redacted(), "offset", r.offset, "attempt", r.resumes, "error", err)
+		select {
+		case <-r.ctx.Done():
+			return 0, err
+		case <-time.After(time.Duration(r.resumes) * time.Second):
+		}
+		if err := r.get(); err != nil {
+			return 0, fmt.Errorf("failed to resume download: %w", err)
+		}
+	}
+}
+
+func (r *httpReader) Close() error {
+	return r.body.Close()
+}
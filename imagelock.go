@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/reference"
+)
+
+// errDuplicate marks a restore that was skipped because another backup in the
+// same batch restores the same images
+var errDuplicate = errors.New("another backup in this batch restores the same images")
+
+// imageLocks holds one mutex per image reference so concurrent operations on
+// the same image never overlap
+var imageLocks = struct {
+	sync.Mutex
+	byRef map[string]*sync.Mutex
+}{byRef: make(map[string]*sync.Mutex)}
+
+// referenceKey normalizes ref so that nginx and docker.io/library/nginx:latest
+// share a lock, keeping the short form for messages
+func referenceKey(ref string) string {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return ref
+	}
+	return reference.FamiliarString(reference.TagNameOnly(named))
+}
+
+// lockImages locks every reference in refs and returns the function that
+// unlocks them. Locks are taken in sorted order so that two operations with
+// overlapping references cannot deadlock.
+func lockImages(refs []string) func() {
+	var keys []string
+	for _, ref := range refs {
+		keys = appendUnique(keys, referenceKey(ref))
+	}
+	sort.Strings(keys)
+
+	mutexes := make([]*sync.Mutex, len(keys))
+	imageLocks.Lock()
+	for i, key := range keys {
+		mu, ok := imageLocks.byRef[key]
+		if !ok {
+			mu = &sync.Mutex{}
+			imageLocks.byRef[key] = mu
+		}
+		mutexes[i] = mu
+	}
+	imageLocks.Unlock()
+
+	for _, mu := range mutexes {
+		mu.Lock()
+	}
+	return func() {
+		for i := len(mutexes) - 1; i >= 0; i-- {
+			mutexes[i].Unlock()
+		}
+	}
+}
+
+// imageReferences returns the normalized references a backup loads into the
+// daemon according to its metadata, restricted by --only. Images backed up by
+// ID are identified by their ID.
+func imageReferences(info ImageInfo) []string {
+	images := []BundledImage{{ImageName: info.ImageName, ImageID: info.ImageID, Tags: info.Tags}}
+	if len(info.Images) > 0 {
+		images = info.Images
+	}
+
+	var refs []string
+	for _, img := range images {
+		if len(config.Only) > 0 && !containsReference(config.Only, img.ImageName) {
+			continue
+		}
+		if len(img.Tags) == 0 && img.ImageID != "" {
+			refs = appendUnique(refs, img.ImageID)
+		}
+		for _, tag := range img.Tags {
+			refs = appendUnique(refs, referenceKey(tag))
+		}
+	}
+	return refs
+}
+
+// restoreReferences returns the references restoring tarballPath will load,
+// or nil when the backup has no metadata
+func restoreReferences(tarballPath string) []string {
+	info, err := loadImageInfo(logicalBackupPath(tarballPath) + ".json")
+	if err != nil {
+		return nil
+	}
+	return imageReferences(info)
+}
+
+// duplicateRestore records why a backup in a restore batch is skipped
+type duplicateRestore struct {
+	winner string
+	refs   []string
+}
+
+// findDuplicateRestores finds backups in a restore batch whose images are all
+// restored by other backups too. For each image the backup with the newest
+// backup date wins, or the first one listed when the dates are equal; a backup
+// that wins none of its images is skipped. Backups without metadata are never
+// skipped.
+func findDuplicateRestores(paths []string) map[string]duplicateRestore {
+	type candidate struct {
+		path string
+		refs []string
+		date time.Time
+	}
+
+	var candidates []candidate
+	newest := make(map[string]int)
+	for _, path := range paths {
+		info, err := loadImageInfo(logicalBackupPath(path) + ".json")
+		if err != nil {
+			continue
+		}
+		c := candidate{path: path, refs: imageReferences(info), date: info.BackupDate}
+		if len(c.refs) == 0 {
+			continue
+		}
+		candidates = append(candidates, c)
+
+		for _, ref := range c.refs {
+			if i, ok := newest[ref]; !ok || c.date.After(candidates[i].date) {
+				newest[ref] = len(candidates) - 1
+			}
+		}
+	}
+
+	duplicates := make(map[string]duplicateRestore)
+	for i, c := range candidates {
+		wins := false
+		for _, ref := range c.refs {
+			if newest[ref] == i {
+				wins = true
+				break
+			}
+		}
+		if !wins {
+			duplicates[c.path] = duplicateRestore{winner: candidates[newest[c.refs[0]]].path, refs: c.refs}
+		}
+	}
+	return duplicates
+}
+
+// printDuplicateRestores reports which backup wins for each skipped duplicate
+func printDuplicateRestores(paths []string, duplicates map[string]duplicateRestore) {
+	for _, path := range paths {
+		if dup, ok := duplicates[path]; ok {
+			logger.Info(fmt.Sprintf("Skipping %s: %s is restored from %s instead", path, strings.Join(dup.refs, ", "), dup.winner),
+				"path", path, "winner", dup.winner, outcomeKey, "skipped")
+		}
+	}
+}
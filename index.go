@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// indexFile describes every backup of a local backup directory in one file,
+// so list does not have to open each metadata sidecar
+const indexFile = "index.json"
+
+const dirIndexVersion = 1
+
+// dirIndex is the content of index.json
+type dirIndex struct {
+	Version int             `json:"version"`
+	Updated time.Time       `json:"updated"`
+	Backups []dirIndexEntry `json:"backups"`
+}
+
+// dirIndexEntry is one backup: its path relative to the backup directory,
+// the SHA-256 of its data and the metadata from its sidecar
+type dirIndexEntry struct {
+	File   string `json:"file"`
+	SHA256 string `json:"sha256,omitempty"`
+	ImageInfo
+}
+
+// loadDirIndex reads the index of dir, keyed by the slash-separated path of
+// each backup
+func loadDirIndex(dir string) (map[string]dirIndexEntry, error) {
+	data, err := os.ReadFile(filepath.Join(dir, indexFile))
+	if err != nil {
+		return nil, err
+	}
+	var index dirIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", indexFile, err)
+	}
+	if index.Version > dirIndexVersion {
+		return nil, fmt.Errorf("%s has version %d, newer than this build supports", indexFile, index.Version)
+	}
+	entries := make(map[string]dirIndexEntry, len(index.Backups))
+	for _, entry := range index.Backups {
+		if entry.SchemaVersion == 0 {
+			entry.SchemaVersion = 1
+		}
+		entries[entry.File] = entry
+	}
+	return entries, nil
+}
+
+// writeDirIndex replaces the index of dir. It is written to a temporary file
+// and renamed into place, so readers see either the old or the new index.
+func writeDirIndex(dir string, entries map[string]dirIndexEntry) error {
+	index := dirIndex{Version: dirIndexVersion, Updated: time.Now(), Backups: make([]dirIndexEntry, 0, len(entries))}
+	for _, entry := range entries {
+		index.Backups = append(index.Backups, entry)
+	}
+	sort.Slice(index.Backups, func(i, j int) bool { return index.Backups[i].File < index.Backups[j].File })
+
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, "."+indexFile+"-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(append(data, '\n'))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(dir, indexFile))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// backupSHA256 hashes the data of a backup, all parts of a split backup
+// together
+func backupSHA256(tarballName string) (string, error) {
+	data, err := openBackup(tarballName)
+	if err != nil {
+		return "", err
+	}
+	defer data.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, data); err != nil {
+		return "", fmt.Errorf("failed to read backup: %w", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// dirIndexUpdater applies the backups added and removed by this run to the
+// index of a local backup directory. A single goroutine owns the index, so
+// concurrent workers never write it at the same time.
+type dirIndexUpdater struct {
+	dir     string
+	changes chan dirIndexChange
+	done    sync.WaitGroup
+}
+
+type dirIndexChange struct {
+	tarballName string
+	entry       dirIndexEntry
+	removed     bool
+}
+
+// startDirIndexUpdater returns nil for remote backup directories, which have
+// no index. An unreadable index is left alone until reindex rebuilds it.
+func startDirIndexUpdater(dir string) *dirIndexUpdater {
+	if isRemotePath(dir) {
+		return nil
+	}
+	entries, err := loadDirIndex(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		entries = make(map[string]dirIndexEntry)
+	} else if err != nil {
+		logger.Warn(fmt.Sprintf("Index updates disabled: %v (run 'reindex' to rebuild it)", err), "error", err)
+		return nil
+	}
+
+	u := &dirIndexUpdater{dir: dir, changes: make(chan dirIndexChange, 64)}
+	u.done.Add(1)
+	go func() {
+		defer u.done.Done()
+		for change := range u.changes {
+			u.apply(entries, change)
+			// Changes that queued up meanwhile go into the same write
+			for pending := true; pending; {
+				select {
+				case next, ok := <-u.changes:
+					if ok {
+						u.apply(entries, next)
+					} else {
+						pending = false
+					}
+				default:
+					pending = false
+				}
+			}
+			if err := writeDirIndex(dir, entries); err != nil {
+				logger.Warn(fmt.Sprintf("Failed to update %s: %v", filepath.Join(dir, indexFile), err), "error", err)
+			}
+		}
+	}()
+	return u
+}
+
+func (u *dirIndexUpdater) apply(entries map[string]dirIndexEntry, change dirIndexChange) {
+	relPath, err := filepath.Rel(u.dir, change.tarballName)
+	if err != nil {
+		return
+	}
+	relPath = filepath.ToSlash(relPath)
+	if change.removed {
+		delete(entries, relPath)
+		return
+	}
+	change.entry.File = relPath
+	entries[relPath] = change.entry
+}
+
+// add records a new backup with the checksum of its data. It is computed by
+// the calling worker, so workers hash their backups in parallel.
+func (u *dirIndexUpdater) add(tarballName string, info ImageInfo) {
+	if u == nil {
+		return
+	}
+	sum, err := backupSHA256(tarballName)
+	if err != nil {
+		logger.Warn(fmt.Sprintf("Failed to checksum %s for the index: %v", tarballName, err), "path", tarballName, "error", err)
+	}
+	u.changes <- dirIndexChange{tarballName: tarballName, entry: dirIndexEntry{SHA256: sum, ImageInfo: info}}
+}
+
+// remove drops a deleted backup from the index
+func (u *dirIndexUpdater) remove(tarballName string) {
+	if u != nil {
+		u.changes <- dirIndexChange{tarballName: tarballName, removed: true}
+	}
+}
+
+// Close writes pending updates
+func (u *dirIndexUpdater) Close() {
+	if u == nil {
+		return
+	}
+	close(u.changes)
+	u.done.Wait()
+}
+
+func runReindex(cmd *cobra.Command, args []string) {
+	if isRemotePath(config.BackupDir) {
+		log.Fatal("reindex needs a local backup directory")
+	}
+	if _, err := os.Stat(config.BackupDir); err != nil {
+		log.Fatalf("Backup directory %s is not accessible: %v", config.BackupDir, err)
+	}
+
+	// Checksums of backups whose metadata did not change are kept, so only
+	// new backups are read in full
+	previous, err := loadDirIndex(config.BackupDir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		logger.Warn(fmt.Sprintf("Ignoring the existing index: %v", err), "error", err)
+	}
+
+	files, err := listLocalFiles(config.BackupDir)
+	if err != nil {
+		log.Fatalf("Failed to read backup directory: %v", err)
+	}
+	entries := make(map[string]dirIndexEntry)
+	for _, file := range files {
+		if !strings.HasSuffix(file.Key, ".json") || file.Key == indexFile {
+			continue
+		}
+		key := strings.TrimSuffix(file.Key, ".json")
+		tarballName := filepath.Join(config.BackupDir, filepath.FromSlash(key))
+		if _, _, err := statBackup(tarballName); err != nil {
+			continue
+		}
+		info, err := loadImageInfo(tarballName + ".json")
+		if err != nil {
+			logger.Debug(fmt.Sprintf("Skipping unreadable metadata %s: %v", file.Key, err), "path", file.Key, "error", err)
+			continue
+		}
+
+		entry := dirIndexEntry{File: key, ImageInfo: info}
+		if old, ok := previous[key]; ok && old.SHA256 != "" && old.ImageID == info.ImageID && old.BackupDate.Equal(info.BackupDate) {
+			entry.SHA256 = old.SHA256
+		} else {
+			logger.Debug("Computing checksum of "+key, "path", key)
+			if entry.SHA256, err = backupSHA256(tarballName); err != nil {
+				logger.Warn(fmt.Sprintf("Failed to checksum %s: %v", key, err), "path", key, "error", err)
+			}
+		}
+		entries[key] = entry
+	}
+
+	if err := writeDirIndex(config.BackupDir, entries); err != nil {
+		log.Fatalf("Failed to write index: %v", err)
+	}
+	color.New(color.FgGreen, color.Bold).Printf("Index %s rebuilt with %d backups\n",
+		filepath.Join(config.BackupDir, indexFile), len(entries))
+}
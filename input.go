@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+// stdinPath is the restore argument that reads a single backup from stdin,
+// as in `ssh host 'cat backup.tar.gz' | go-backup-docker-image restore -`
+const stdinPath = "-"
+
+var errStdinReread = errors.New("a backup read from stdin can only be read once")
+
+// stdinBackup buffers stdin so the compression can be detected from its first
+// bytes without consuming them
+var (
+	stdinBackup       = bufio.NewReader(os.Stdin)
+	stdinBackupOpened bool
+)
+
+// openStdinBackup returns the backup on stdin. Unlike a file it cannot be
+// opened a second time, so retries and --only do not work with it.
+func openStdinBackup() (io.ReadCloser, error) {
+	if stdinBackupOpened {
+		return nil, errStdinReread
+	}
+	stdinBackupOpened = true
+	return io.NopCloser(stdinBackup), nil
+}
+
+// readInputList reads the image names or backup paths given to --file and
+// --stdin. Names are separated by newlines, commas or spaces, so a line may
+// hold several of them; blank lines and lines starting with # are skipped, and
+// Windows line endings are accepted.
+func readInputList(r io.Reader) ([]string, error) {
+	var names []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		names = append(names, strings.FieldsFunc(line, func(c rune) bool {
+			return c == ',' || c == ' ' || c == '\t' || c == '\r'
+		})...)
+	}
+	return names, scanner.Err()
+}
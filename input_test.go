@@ -0,0 +1,36 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestReadInputList(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{"one per line", "nginx:latest\nredis:7\n", []string{"nginx:latest", "redis:7"}},
+		{"comments", "# web tier\nnginx:latest\n  # cache\nredis:7\n", []string{"nginx:latest", "redis:7"}},
+		{"blank lines", "\nnginx:latest\n\n   \nredis:7", []string{"nginx:latest", "redis:7"}},
+		{"commas", "nginx:latest,redis:7,\n", []string{"nginx:latest", "redis:7"}},
+		{"spaces and tabs", "nginx:latest redis:7\tpostgres:16\n", []string{"nginx:latest", "redis:7", "postgres:16"}},
+		{"mixed separators", "nginx:latest, redis:7 ,postgres:16", []string{"nginx:latest", "redis:7", "postgres:16"}},
+		{"CRLF", "# images\r\nnginx:latest\r\nredis:7, postgres:16\r\n\r\n", []string{"nginx:latest", "redis:7", "postgres:16"}},
+		{"backup paths", "docker-backups/nginx_latest-20240101-030000.tar.gz\n", []string{"docker-backups/nginx_latest-20240101-030000.tar.gz"}},
+		{"empty", "# nothing to back up\n", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readInputList(strings.NewReader(tt.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("readInputList(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// legacyNamePattern matches the default {SafeName}-{Timestamp} file name
+var legacyNamePattern = regexp.MustCompile(`^(.+)-(\d{8}-\d{6})$`)
+
+// maxArchiveMetadataSize bounds the files kept in memory while reading an
+// archive; manifests and image configs are far smaller
+const maxArchiveMetadataSize = 4 << 20
+
+// InspectData is the value passed to inspect --template and printed by --json
+type InspectData struct {
+	ImageInfo
+	Path          string         `json:"path"`
+	FileSize      int64          `json:"file_size"`
+	ModTime       time.Time      `json:"mod_time"`
+	HasMetadata   bool           `json:"has_metadata"`
+	Contents      []ArchiveImage `json:"contents,omitempty"`
+	ContentsError string         `json:"contents_error,omitempty"`
+}
+
+// ArchiveImage is an image found in the manifest of a backup archive
+type ArchiveImage struct {
+	ID           string         `json:"id"`
+	RepoTags     []string       `json:"repo_tags"`
+	Architecture string         `json:"architecture,omitempty"`
+	Os           string         `json:"os,omitempty"`
+	Created      time.Time      `json:"created,omitempty"`
+	Layers       []ArchiveLayer `json:"layers"`
+}
+
+// ArchiveLayer is one layer of an ArchiveImage. Digest is the uncompressed
+// diff ID from the image config; Size is the size stored in the archive.
+type ArchiveLayer struct {
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
+// archiveConfig holds the fields of an image config that inspect reports
+type archiveConfig struct {
+	Architecture string    `json:"architecture"`
+	Os           string    `json:"os"`
+	Created      time.Time `json:"created"`
+	RootFS       struct {
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+func runInspect(cmd *cobra.Command, args []string) {
+	templateText, _ := cmd.Flags().GetString("template")
+	jsonOutput, _ := cmd.Flags().GetBool("json")
+	if jsonOutput && templateText != "" {
+		log.Fatal("--json cannot be combined with --template")
+	}
+
+	var tmpl *template.Template
+	if templateText != "" {
+		var err error
+		tmpl, err = template.New("inspect").Parse(templateText)
+		if err != nil {
+			color.New(color.FgRed, color.Bold).Printf("Invalid template: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	failed := false
+	var all []InspectData
+	for i, tarballPath := range args {
+		data, err := inspectBackup(tarballPath)
+		if err != nil {
+			color.New(color.FgRed, color.Bold).Fprintf(os.Stderr, "Cannot inspect %s: %v\n", tarballPath, err)
+			failed = true
+			continue
+		}
+
+		if jsonOutput {
+			all = append(all, data)
+			continue
+		}
+
+		if tmpl != nil {
+			if err := tmpl.Execute(os.Stdout, data); err != nil {
+				color.New(color.FgRed, color.Bold).Printf("Template error for %s: %v\n", tarballPath, err)
+				failed = true
+			}
+			fmt.Println()
+			continue
+		}
+
+		if i > 0 {
+			fmt.Println()
+		}
+		printInspectData(data)
+	}
+
+	if jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(all); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// inspectBackup gathers everything known about a backup file: the metadata
+// sidecar when present, otherwise what can be inferred from its name
+func inspectBackup(tarballPath string) (InspectData, error) {
+	tarballPath = logicalBackupPath(tarballPath)
+	size, modTime, err := statBackup(tarballPath)
+	if err != nil {
+		return InspectData{}, err
+	}
+
+	data := InspectData{
+		Path:     tarballPath,
+		FileSize: size,
+		ModTime:  modTime,
+	}
+
+	// The archive itself is the authority on what a restore would load, so
+	// it is read even when the sidecar exists
+	if contents, err := readArchiveContents(tarballPath); err != nil {
+		data.ContentsError = err.Error()
+	} else {
+		data.Contents = contents
+	}
+
+	if info, err := loadImageInfo(tarballPath + ".json"); err == nil {
+		data.ImageInfo = info
+		data.HasMetadata = true
+		return data, nil
+	}
+
+	// No sidecar: infer compression, encryption and name from the file name
+	name := filepath.Base(tarballPath)
+	if strings.HasSuffix(name, encExtension) {
+		data.Encrypted = true
+		name = strings.TrimSuffix(name, encExtension)
+	}
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"):
+		data.CompressType = "gzip"
+		name = strings.TrimSuffix(name, ".tar.gz")
+	case strings.HasSuffix(name, ".tgz"):
+		data.CompressType = "gzip"
+		name = strings.TrimSuffix(name, ".tgz")
+	default:
+		data.CompressType = "none"
+		name = strings.TrimSuffix(name, ".tar")
+	}
+
+	data.ImageName = name
+	if m := legacyNamePattern.FindStringSubmatch(name); m != nil {
+		data.ImageName = m[1]
+		if date, err := time.ParseInLocation("20060102-150405", m[2], time.Local); err == nil {
+			data.BackupDate = date
+		}
+	}
+
+	return data, nil
+}
+
+func printInspectData(data InspectData) {
+	color.New(color.FgHiBlue, color.Bold).Printf("Backup: %s\n", data.Path)
+	fmt.Printf("  File Size: %.2f MB\n", float64(data.FileSize)/(1024*1024))
+	fmt.Printf("  Modified: %s\n", data.ModTime.Format(time.RFC3339))
+
+	if !data.HasMetadata {
+		color.New(color.FgYellow).Println("  No metadata sidecar found; values below are inferred from the file name")
+	}
+
+	// Walk the ImageInfo fields so newly added metadata shows up automatically
+	value := reflect.ValueOf(data.ImageInfo)
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if value.Field(i).IsZero() {
+			continue
+		}
+		fmt.Printf("  %s: %s\n", field.Name, formatInspectValue(field.Name, value.Field(i).Interface()))
+	}
+
+	if data.ContentsError != "" {
+		color.New(color.FgYellow).Printf("  Contents: cannot read archive: %s\n", data.ContentsError)
+		return
+	}
+	fmt.Println("  Contents:")
+	for _, img := range data.Contents {
+		var total int64
+		for _, layer := range img.Layers {
+			total += layer.Size
+		}
+		tags := strings.Join(img.RepoTags, ", ")
+		if tags == "" {
+			tags = "<untagged>"
+		}
+		fmt.Printf("    - %s\n", tags)
+		fmt.Printf("      ID: %s\n", img.ID)
+		if img.Os != "" || img.Architecture != "" {
+			fmt.Printf("      Platform: %s/%s\n", img.Os, img.Architecture)
+		}
+		if !img.Created.IsZero() {
+			fmt.Printf("      Created: %s\n", img.Created.Format(time.RFC3339))
+		}
+		fmt.Printf("      Layers: %d (%.2f MB)\n", len(img.Layers), float64(total)/(1024*1024))
+		for _, layer := range img.Layers {
+			digest := layer.Digest
+			if digest == "" {
+				digest = "<unknown digest>"
+			}
+			fmt.Printf("        %s  %.2f MB\n", digest, float64(layer.Size)/(1024*1024))
+		}
+	}
+}
+
+// readArchiveContents lists the images in a backup by reading its manifest
+// and image configs, decompressing and decrypting as needed. It understands
+// `docker save` archives (manifest.json) and OCI Image Layouts (index.json).
+// The whole archive is read, but only small files are kept in memory.
+func readArchiveContents(tarballPath string) ([]ArchiveImage, error) {
+	encoding, err := detectEncoding(tarballPath, tarballPath)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := encoding.stream(tarballPath)()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	files := make(map[string][]byte)
+	sizes := make(map[string]int64)
+	links := make(map[string]string)
+	tr := tar.NewReader(reader)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeSymlink:
+			links[header.Name] = path.Join(path.Dir(header.Name), header.Linkname)
+		case tar.TypeLink:
+			links[header.Name] = header.Linkname
+		case tar.TypeReg:
+			sizes[header.Name] = header.Size
+			if header.Size <= maxArchiveMetadataSize {
+				data, err := io.ReadAll(tr)
+				if err != nil {
+					return nil, err
+				}
+				files[header.Name] = data
+			}
+		}
+	}
+
+	// resolve follows the symlinks docker uses for layers shared inside the archive
+	resolve := func(name string) string {
+		for seen := 0; seen < len(links); seen++ {
+			target, ok := links[name]
+			if !ok {
+				break
+			}
+			name = target
+		}
+		return name
+	}
+
+	if data, ok := files["manifest.json"]; ok {
+		return readSaveManifest(data, files, sizes, resolve)
+	}
+	if data, ok := files["index.json"]; ok {
+		return readOCIIndex(data, files)
+	}
+	return nil, errors.New("archive has neither manifest.json nor index.json")
+}
+
+// readSaveManifest lists the images of a `docker save` archive
+func readSaveManifest(data []byte, files map[string][]byte, sizes map[string]int64, resolve func(string) string) ([]ArchiveImage, error) {
+	var manifest []saveManifestEntry
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest.json: %w", err)
+	}
+
+	images := make([]ArchiveImage, 0, len(manifest))
+	for _, entry := range manifest {
+		configName := resolve(entry.Config)
+		configData, ok := files[configName]
+		if !ok {
+			return nil, fmt.Errorf("image config %s is missing from the archive", entry.Config)
+		}
+		var cfg archiveConfig
+		if err := json.Unmarshal(configData, &cfg); err != nil {
+			return nil, fmt.Errorf("invalid image config %s: %w", entry.Config, err)
+		}
+
+		img := ArchiveImage{
+			ID:           "sha256:" + strings.TrimSuffix(path.Base(configName), ".json"),
+			RepoTags:     entry.RepoTags,
+			Architecture: cfg.Architecture,
+			Os:           cfg.Os,
+			Created:      cfg.Created,
+		}
+		for i, layer := range entry.Layers {
+			archived := ArchiveLayer{Size: sizes[resolve(layer)]}
+			if i < len(cfg.RootFS.DiffIDs) {
+				archived.Digest = cfg.RootFS.DiffIDs[i]
+			}
+			img.Layers = append(img.Layers, archived)
+		}
+		images = append(images, img)
+	}
+	return images, nil
+}
+
+// readOCIIndex lists the images of an OCI Image Layout archive. Layer sizes
+// are the compressed sizes from the manifests. Nested manifest lists, as
+// written by --all-platforms, list one image per platform under the name of
+// the list; attestation manifests are left out.
+func readOCIIndex(data []byte, files map[string][]byte) ([]ArchiveImage, error) {
+	type descriptor struct {
+		MediaType   string            `json:"mediaType"`
+		Digest      string            `json:"digest"`
+		Size        int64             `json:"size"`
+		Annotations map[string]string `json:"annotations"`
+		Platform    *struct {
+			OS string `json:"os"`
+		} `json:"platform"`
+	}
+	type index struct {
+		Manifests []descriptor `json:"manifests"`
+	}
+	var top index
+	if err := json.Unmarshal(data, &top); err != nil {
+		return nil, fmt.Errorf("invalid index.json: %w", err)
+	}
+
+	blob := func(digest string) ([]byte, error) {
+		name := "blobs/" + strings.Replace(digest, ":", "/", 1)
+		data, ok := files[name]
+		if !ok {
+			return nil, fmt.Errorf("blob %s is missing from the archive", digest)
+		}
+		return data, nil
+	}
+
+	var descs []descriptor
+	for _, desc := range top.Manifests {
+		if !isIndexMediaType(desc.MediaType) {
+			descs = append(descs, desc)
+			continue
+		}
+		data, err := blob(desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		var nested index
+		if err := json.Unmarshal(data, &nested); err != nil {
+			return nil, fmt.Errorf("invalid manifest list %s: %w", desc.Digest, err)
+		}
+		for _, platformDesc := range nested.Manifests {
+			if platformDesc.Platform != nil && platformDesc.Platform.OS == "unknown" {
+				continue
+			}
+			platformDesc.Annotations = desc.Annotations
+			descs = append(descs, platformDesc)
+		}
+	}
+
+	images := make([]ArchiveImage, 0, len(descs))
+	for _, desc := range descs {
+		data, err := blob(desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		var manifest struct {
+			Config descriptor   `json:"config"`
+			Layers []descriptor `json:"layers"`
+		}
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return nil, fmt.Errorf("invalid manifest %s: %w", desc.Digest, err)
+		}
+		configData, err := blob(manifest.Config.Digest)
+		if err != nil {
+			return nil, err
+		}
+		var cfg archiveConfig
+		if err := json.Unmarshal(configData, &cfg); err != nil {
+			return nil, fmt.Errorf("invalid image config %s: %w", manifest.Config.Digest, err)
+		}
+
+		img := ArchiveImage{
+			ID:           manifest.Config.Digest,
+			Architecture: cfg.Architecture,
+			Os:           cfg.Os,
+			Created:      cfg.Created,
+		}
+		if name := desc.Annotations["io.containerd.image.name"]; name != "" {
+			img.RepoTags = []string{name}
+		} else if name := desc.Annotations["org.opencontainers.image.ref.name"]; name != "" {
+			img.RepoTags = []string{name}
+		}
+		for i, layer := range manifest.Layers {
+			archived := ArchiveLayer{Size: layer.Size}
+			if i < len(cfg.RootFS.DiffIDs) {
+				archived.Digest = cfg.RootFS.DiffIDs[i]
+			}
+			img.Layers = append(img.Layers, archived)
+		}
+		images = append(images, img)
+	}
+	return images, nil
+}
+
+func formatInspectValue(name string, v interface{}) string {
+	switch val := v.(type) {
+	case time.Time:
+		return val.Format(time.RFC3339)
+	case []string:
+		if name == "Entrypoint" || name == "Cmd" {
+			return strings.Join(val, " ")
+		}
+		return strings.Join(val, ", ")
+	case map[string]string:
+		pairs := make([]string, 0, len(val))
+		for key, value := range val {
+			pairs = append(pairs, key+"="+value)
+		}
+		sort.Strings(pairs)
+		return strings.Join(pairs, ", ")
+	case []byte:
+		return fmt.Sprintf("%x", val)
+	case int64:
+		if name == "Size" {
+			return fmt.Sprintf("%d bytes (%.2f MB)", val, float64(val)/(1024*1024))
+		}
+	case []BundledImage:
+		names := make([]string, 0, len(val))
+		for _, img := range val {
+			names = append(names, img.ImageName)
+		}
+		return strings.Join(names, ", ")
+	}
+	return fmt.Sprint(v)
+}
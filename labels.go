@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// backupLabels holds the parsed --label pairs: backup stores them in the
+// metadata of every backup, list shows only the backups that have them all
+var backupLabels map[string]string
+
+// parseLabels turns key=value arguments into a map. Keys must be non-empty
+// and unique, and keys and values must be valid UTF-8 so the map survives
+// the trip through JSON unchanged.
+func parseLabels(values []string) (map[string]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	labels := make(map[string]string, len(values))
+	for _, value := range values {
+		key, val, ok := strings.Cut(value, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid label %q (expected key=value)", value)
+		}
+		if !utf8.ValidString(key) || !utf8.ValidString(val) {
+			return nil, fmt.Errorf("invalid label %q: not valid UTF-8", value)
+		}
+		if previous, ok := labels[key]; ok && previous != val {
+			return nil, fmt.Errorf("label %s is given twice with different values", key)
+		}
+		labels[key] = val
+	}
+	return labels, nil
+}
+
+// hasLabels reports whether labels contains every pair of want
+func hasLabels(labels, want map[string]string) bool {
+	for key, val := range want {
+		if got, ok := labels[key]; !ok || got != val {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// Layouts and sort orders accepted by the list command
+const (
+	listFlat    = "flat"
+	listGrouped = "grouped"
+
+	sortByImage = "image"
+	sortByName  = "name"
+	sortByDate  = "date"
+	sortBySize  = "size"
+)
+
+// unknownImageName groups backups without a metadata sidecar
+const unknownImageName = "(no metadata)"
+
+// listSince and listUntil hold the parsed --since and --until bounds of the
+// list command; the zero time leaves that side of the window open
+var listSince, listUntil time.Time
+
+// ListedBackup is one backup printed by list --output json
+type ListedBackup struct {
+	File       string     `json:"file"`
+	Image      string     `json:"image"`
+	Size       int64      `json:"size"`
+	Date       time.Time  `json:"date"`
+	Parts      int        `json:"parts,omitempty"`
+	Signed     bool       `json:"signed"`
+	Incomplete bool       `json:"incomplete,omitempty"`
+	Metadata   *ImageInfo `json:"metadata,omitempty"`
+}
+
+// listEntry is one backup shown by the list command
+type listEntry struct {
+	name    string
+	size    int64
+	date    time.Time
+	parts   int
+	meta    ImageInfo
+	hasMeta bool
+	signed  bool
+	// incomplete marks the .partial files of a backup still being written
+	// or left behind by a crashed run
+	incomplete bool
+}
+
+// imageName returns the image (or bundle) the backup belongs to
+func (e listEntry) imageName() string {
+	if e.hasMeta && e.meta.ImageName != "" {
+		return metadataImageName(e.meta)
+	}
+	return unknownImageName
+}
+
+// isBackupFile reports whether name is a backup tarball, a part of a split
+// backup, or a dedup manifest
+func isBackupFile(name string) bool {
+	plain := strings.TrimSuffix(name, encExtension)
+	return strings.HasSuffix(plain, ".tar") || strings.HasSuffix(plain, ".tar.gz") ||
+		strings.HasSuffix(plain, ".tgz") || strings.HasSuffix(plain, dedupExtension)
+}
+
+// isPartialFile reports whether name is the data of a backup that was never
+// completed
+func isPartialFile(name string) bool {
+	return strings.HasSuffix(name, partialExtension) && isBackupFile(strings.TrimSuffix(name, partialExtension))
+}
+
+// listLocalFiles returns the files below the backup directory by their
+// slash-separated relative path. Name templates may place backups in
+// subdirectories; the dedup blob store and hidden directories are skipped.
+func listLocalFiles(dir string) ([]RemoteFile, error) {
+	var files []RemoteFile
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != dir && (d.Name() == blobStoreDir || strings.HasPrefix(d.Name(), ".")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		files = append(files, RemoteFile{Key: filepath.ToSlash(rel), Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	return files, err
+}
+
+// collectEntries turns a file listing into list entries. Parts of a split
+// backup are combined into one entry under the backup's name, and sidecars
+// are read with readMeta.
+func collectEntries(files []RemoteFile, readMeta func(key string) (ImageInfo, error)) []listEntry {
+	byName := make(map[string]*listEntry)
+	sidecars := make(map[string]bool)
+	var names []string
+
+	for _, file := range files {
+		if strings.HasSuffix(file.Key, ".json") || strings.HasSuffix(file.Key, signatureExtension) {
+			sidecars[file.Key] = true
+			continue
+		}
+		incomplete := isPartialFile(file.Key)
+		if !isBackupFile(file.Key) && !(incomplete && config.ShowIncomplete) {
+			continue
+		}
+
+		name := logicalBackupPath(file.Key)
+		entry, ok := byName[name]
+		if !ok {
+			entry = &listEntry{name: name, incomplete: incomplete}
+			byName[name] = entry
+			names = append(names, name)
+		}
+		entry.size += file.Size
+		if file.ModTime.After(entry.date) {
+			entry.date = file.ModTime
+		}
+		if name != file.Key {
+			entry.parts++
+		}
+	}
+
+	// Sidecars are read by a pool of config.MaxWorkers workers, which matters
+	// on network filesystems and remote storage; each one fills in its own
+	// entry
+	entries := make([]listEntry, len(names))
+	pool := newWorkerPool(context.Background(), min(config.MaxWorkers, len(names)), func(_ int, entry *listEntry) struct{} {
+		meta, err := readMeta(entry.name + ".json")
+		if err != nil {
+			logger.Debug(fmt.Sprintf("Ignoring unreadable metadata for %s: %v", entry.name, err), "path", entry.name, "error", err)
+			return struct{}{}
+		}
+		entry.meta, entry.hasMeta = meta, true
+		if !meta.BackupDate.IsZero() {
+			entry.date = meta.BackupDate
+		}
+		return struct{}{}
+	})
+	for i, name := range names {
+		entries[i] = *byName[name]
+		entries[i].signed = sidecars[name+signatureExtension]
+		if !entries[i].incomplete && sidecars[name+".json"] {
+			pool.Submit(&entries[i])
+		}
+	}
+	pool.Wait()
+	return entries
+}
+
+// localEntries lists the backups in a local backup directory. Metadata comes
+// from index.json where it has the backup, and from the sidecar otherwise, so
+// backups added by other means still show up. A sidecar changed after the
+// index was written makes its index entry stale, and the sidecar is read.
+func localEntries(dir string) ([]listEntry, error) {
+	files, err := listLocalFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	index, err := loadDirIndex(dir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		logger.Debug(fmt.Sprintf("Ignoring %s: %v", indexFile, err), "error", err)
+	}
+
+	modTimes := make(map[string]time.Time, len(files))
+	for _, file := range files {
+		modTimes[file.Key] = file.ModTime
+	}
+	indexed := modTimes[indexFile]
+
+	return collectEntries(files, func(key string) (ImageInfo, error) {
+		if entry, ok := index[strings.TrimSuffix(key, ".json")]; ok && !modTimes[key].After(indexed) {
+			return entry.ImageInfo, nil
+		}
+		return loadImageInfo(filepath.Join(dir, key))
+	}), nil
+}
+
+// backendEntries lists the backups stored in a remote backend
+func backendEntries(ctx context.Context, backend StorageBackend) ([]listEntry, error) {
+	files, err := backend.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return collectEntries(files, func(key string) (ImageInfo, error) {
+		object, err := backend.Open(ctx, key)
+		if err != nil {
+			return ImageInfo{}, err
+		}
+		defer object.Close()
+		return decodeImageInfo(object)
+	}), nil
+}
+
+// matchesImage reports whether the backup contains the image given to --image,
+// comparing normalized references so nginx matches nginx:latest
+func (e listEntry) matchesImage(name string) bool {
+	if e.imageName() == name || e.hasMeta && sameReference(e.meta.ImageName, name) {
+		return true
+	}
+	for _, img := range e.meta.Images {
+		if sameReference(img.ImageName, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesLabels reports whether the backup was made with all the --label
+// pairs
+func (e listEntry) matchesLabels(want map[string]string) bool {
+	return e.hasMeta && hasLabels(e.meta.BackupLabels, want)
+}
+
+// matchesDate reports whether the backup date falls within --since and
+// --until, both inclusive
+func (e listEntry) matchesDate(since, until time.Time) bool {
+	return (since.IsZero() || !e.date.Before(since)) && (until.IsZero() || !e.date.After(until))
+}
+
+// listed converts the entry for list --output json
+func (e listEntry) listed() ListedBackup {
+	backup := ListedBackup{
+		File:       e.name,
+		Image:      e.imageName(),
+		Size:       e.size,
+		Date:       e.date,
+		Parts:      e.parts,
+		Signed:     e.signed,
+		Incomplete: e.incomplete,
+	}
+	if e.hasMeta {
+		meta := e.meta
+		backup.Metadata = &meta
+	}
+	return backup
+}
+
+// parseTimeBound parses a --since or --until value: an RFC 3339 timestamp
+// such as 2024-01-15T08:00:00Z, or a duration such as 48h counted back from
+// now
+func parseTimeBound(flag, value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return time.Time{}, fmt.Errorf("invalid --%s %q (expected an RFC 3339 time such as 2024-01-15T08:00:00Z or a duration such as 48h)", flag, value)
+	}
+	return now.Add(-d), nil
+}
+
+// matchesFilter reports whether the image name, or the name of any bundled
+// image, contains the --filter text or matches it as a glob
+func (e listEntry) matchesFilter(pattern string) bool {
+	names := []string{e.imageName()}
+	for _, img := range e.meta.Images {
+		names = append(names, img.ImageName)
+	}
+	for _, name := range names {
+		if strings.Contains(name, pattern) {
+			return true
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// validateListFlags checks --format, --output, --sort, --filter, --since
+// and --until. "name" is accepted as a synonym for sorting by image.
+func validateListFlags() error {
+	if config.ListFormat != listFlat && config.ListFormat != listGrouped {
+		return fmt.Errorf("invalid --format %q (expected flat or grouped)", config.ListFormat)
+	}
+	if config.Output != "text" && config.Output != "json" {
+		return fmt.Errorf("invalid --output %q (expected text or json)", config.Output)
+	}
+	switch config.SortBy {
+	case sortByName:
+		config.SortBy = sortByImage
+	case sortByImage, sortByDate, sortBySize:
+	default:
+		return fmt.Errorf("invalid --sort %q (expected date, name or size)", config.SortBy)
+	}
+	var err error
+	if backupLabels, err = parseLabels(config.Labels); err != nil {
+		return err
+	}
+	now := time.Now()
+	if listSince, err = parseTimeBound("since", config.ListSince, now); err != nil {
+		return err
+	}
+	if listUntil, err = parseTimeBound("until", config.ListUntil, now); err != nil {
+		return err
+	}
+	if !listSince.IsZero() && !listUntil.IsZero() && listSince.After(listUntil) {
+		return fmt.Errorf("--since %s is after --until %s", config.ListSince, config.ListUntil)
+	}
+	return validatePatterns("filter", []string{config.ListFilter})
+}
+
+// sortEntries orders backups by --sort. Dates and sizes sort largest
+// first; ties and image order fall back to newest first.
+func sortEntries(entries []listEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		switch config.SortBy {
+		case sortBySize:
+			if a.size != b.size {
+				return a.size > b.size
+			}
+		case sortByImage:
+			if a.imageName() != b.imageName() {
+				return a.imageName() < b.imageName()
+			}
+		}
+		if !a.date.Equal(b.date) {
+			return a.date.After(b.date)
+		}
+		return a.name < b.name
+	})
+}
+
+// printListJSON prints the backups as a JSON array in --sort order; the
+// --format layout does not apply
+func printListJSON(entries []listEntry) error {
+	sortEntries(entries)
+	backups := make([]ListedBackup, 0, len(entries))
+	for _, entry := range entries {
+		backups = append(backups, entry.listed())
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(backups)
+}
+
+// printFlat prints every backup on its own, in --sort order
+func printFlat(entries []listEntry) {
+	sortEntries(entries)
+	for _, entry := range entries {
+		printListEntry(entry, "")
+	}
+}
+
+// printGrouped prints one header per image followed by its backups, newest
+// first. Groups are ordered by name, by their newest backup, or by their total
+// size depending on --sort.
+func printGrouped(entries []listEntry) {
+	groups := make(map[string][]listEntry)
+	var names []string
+	for _, entry := range entries {
+		name := entry.imageName()
+		if _, ok := groups[name]; !ok {
+			names = append(names, name)
+		}
+		groups[name] = append(groups[name], entry)
+	}
+
+	totals := make(map[string]int64)
+	for name, group := range groups {
+		sort.SliceStable(group, func(i, j int) bool { return group[i].date.After(group[j].date) })
+		for _, entry := range group {
+			totals[name] += entry.size
+		}
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		a, b := names[i], names[j]
+		switch config.SortBy {
+		case sortByDate:
+			if da, db := groups[a][0].date, groups[b][0].date; !da.Equal(db) {
+				return da.After(db)
+			}
+		case sortBySize:
+			if totals[a] != totals[b] {
+				return totals[a] > totals[b]
+			}
+		}
+		return a < b
+	})
+
+	for _, name := range names {
+		group := groups[name]
+		noun := "backups"
+		if len(group) == 1 {
+			noun = "backup"
+		}
+		color.New(color.FgHiCyan, color.Bold).Printf("%s (%d %s, %.2f MB)\n", name, len(group), noun, float64(totals[name])/(1024*1024))
+		for _, entry := range group {
+			printListEntry(entry, "  ")
+		}
+	}
+}
+
+// printListSummary prints the totals of the listed backups. Incomplete files
+// are not counted, and sizes are added up in bytes before they are formatted.
+func printListSummary(entries []listEntry) {
+	stats := collectStats(entries)
+	fmt.Println("---------------------------------")
+	if stats.Backups == 0 {
+		fmt.Println("No complete backups")
+		return
+	}
+	noun := "backups"
+	if stats.Backups == 1 {
+		noun = "backup"
+	}
+	fmt.Printf("Total: %d %s of %d images, %s\n", stats.Backups, noun, len(stats.Images), formatTotalBytes(stats.TotalBytes))
+	fmt.Printf("Oldest: %s\n", stats.Oldest.Format(time.RFC3339))
+	fmt.Printf("Newest: %s\n", stats.Newest.Format(time.RFC3339))
+}
+
+// printListEntry prints one backup with its metadata, indented by indent
+func printListEntry(entry listEntry, indent string) {
+	meta := entry.meta
+
+	fmt.Printf("%sBackup: %s", indent, entry.name)
+	if entry.incomplete {
+		color.New(color.FgYellow).Print(" [incomplete]")
+	} else if !entry.signed {
+		color.New(color.FgYellow).Print(" [unsigned]")
+	}
+	fmt.Println()
+	fmt.Printf("%s  Size: %.2f MB\n", indent, float64(entry.size)/(1024*1024))
+	fmt.Printf("%s  Date: %s\n", indent, entry.date.Format(time.RFC3339))
+	if len(meta.BackupLabels) > 0 {
+		fmt.Printf("%s  Backup labels: %s\n", indent, formatInspectValue("BackupLabels", meta.BackupLabels))
+	}
+	if meta.Container != nil && !meta.isExport() {
+		fmt.Printf("%s  Container: %s\n", indent, meta.Container)
+	}
+	if len(meta.Volumes) > 0 {
+		fmt.Printf("%s  Volumes: %s\n", indent, strings.Join(meta.Volumes, ", "))
+	}
+	if entry.parts > 0 {
+		fmt.Printf("%s  Parts: %d\n", indent, entry.parts)
+	}
+
+	// Display metadata if available
+	if entry.hasMeta && len(meta.Images) > 0 {
+		fmt.Printf("%s  Bundle: %s (%d images)\n", indent, meta.ImageName, len(meta.Images))
+		fmt.Printf("%s  Format: %s\n", indent, backupFormat(meta))
+		for _, img := range meta.Images {
+			fmt.Printf("%s    - %s [%s]\n", indent, img.ImageName, strings.Join(img.Tags, ", "))
+			if config.Verbose {
+				fmt.Printf("%s      ID: %s\n", indent, img.ImageID)
+			}
+		}
+		if config.Verbose {
+			fmt.Printf("%s  Compression: %s\n", indent, formatCompression(meta))
+			fmt.Printf("%s  Encrypted: %s\n", indent, formatEncryption(meta))
+		}
+	} else if entry.hasMeta && meta.isExport() {
+		fmt.Printf("%s  Container export: %s\n", indent, meta.ImageName)
+		if meta.SourceImage != "" {
+			fmt.Printf("%s  Created from: %s\n", indent, meta.SourceImage)
+		}
+		if config.Verbose && meta.Container != nil {
+			fmt.Printf("%s  Container ID: %s\n", indent, meta.Container.ID)
+			if meta.Container.Started != nil {
+				fmt.Printf("%s  Container started: %s\n", indent, meta.Container.Started.Format(time.RFC3339))
+			}
+			fmt.Printf("%s  Compression: %s\n", indent, formatCompression(meta))
+		}
+	} else if entry.hasMeta {
+		fmt.Printf("%s  Image: %s\n", indent, entry.imageName())
+		fmt.Printf("%s  Tags: %s\n", indent, strings.Join(meta.Tags, ", "))
+		fmt.Printf("%s  Format: %s\n", indent, backupFormat(meta))
+		// Backups of one tag may hold different platforms of it
+		if meta.Os != "" || meta.Architecture != "" {
+			platform := Platform{OS: meta.Os, Architecture: meta.Architecture, Variant: meta.Variant}
+			fmt.Printf("%s  Platform: %s\n", indent, platform)
+		}
+		if config.Verbose {
+			fmt.Printf("%s  ID: %s\n", indent, meta.ImageID)
+			if len(meta.Platforms) > 0 {
+				fmt.Printf("%s  Platforms: %s\n", indent, strings.Join(meta.Platforms, ", "))
+			}
+			if !meta.Created.IsZero() {
+				fmt.Printf("%s  Created: %s\n", indent, meta.Created.Format(time.RFC3339))
+			}
+			for _, digest := range meta.RepoDigests {
+				fmt.Printf("%s  Digest: %s\n", indent, digest)
+			}
+			if len(meta.Entrypoint) > 0 {
+				fmt.Printf("%s  Entrypoint: %s\n", indent, strings.Join(meta.Entrypoint, " "))
+			}
+			if len(meta.Cmd) > 0 {
+				fmt.Printf("%s  Cmd: %s\n", indent, strings.Join(meta.Cmd, " "))
+			}
+			if len(meta.Labels) > 0 {
+				fmt.Printf("%s  Labels: %s\n", indent, formatInspectValue("Labels", meta.Labels))
+			}
+			if len(meta.Layers) > 0 {
+				fmt.Printf("%s  Layers: %d\n", indent, len(meta.Layers))
+				for _, layer := range meta.Layers {
+					fmt.Printf("%s    %s\n", indent, layer)
+				}
+			}
+			fmt.Printf("%s  Compression: %s\n", indent, formatCompression(meta))
+			fmt.Printf("%s  Encrypted: %s\n", indent, formatEncryption(meta))
+		}
+	}
+	fmt.Println()
+}
+
+// formatEncryption describes whether a backup is encrypted and with which
+// scheme. Backups from before the scheme was recorded used the passphrase.
+func formatEncryption(meta ImageInfo) string {
+	switch {
+	case !meta.Encrypted:
+		return "no"
+	case meta.EncryptionScheme == encSchemeAge:
+		return fmt.Sprintf("age (%d recipients)", len(meta.EncryptionRecipients))
+	default:
+		return "passphrase (" + encSchemePassphrase + ")"
+	}
+}
+
+// formatCompression describes a backup's compression, with the level when it
+// was recorded
+func formatCompression(meta ImageInfo) string {
+	if meta.CompressLevel > 0 {
+		return fmt.Sprintf("%s (level %d)", meta.CompressType, meta.CompressLevel)
+	}
+	return meta.CompressType
+}
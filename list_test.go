@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// BenchmarkRunList measures how fast list reads the metadata sidecars of a
+// backup directory, sequentially and with several workers
+func BenchmarkRunList(b *testing.B) {
+	const backups = 1000
+	dir := b.TempDir()
+	for i := 0; i < backups; i++ {
+		name := filepath.Join(dir, fmt.Sprintf("app_%d-20240101-030000.tar.gz", i))
+		if err := os.WriteFile(name, nil, 0644); err != nil {
+			b.Fatal(err)
+		}
+		info := ImageInfo{ImageName: fmt.Sprintf("app:%d", i), ImageID: fmt.Sprintf("sha256:%064x", i), BackupDate: time.Now()}
+		if err := writeImageInfo(name+".json", info); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.Cleanup(func() { config = defaultConfig() })
+
+	for _, workers := range []int{1, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			config = defaultConfig()
+			config.MaxWorkers = workers
+			for i := 0; i < b.N; i++ {
+				entries, err := localEntries(dir)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(entries) != backups {
+					b.Fatalf("listed %d backups, want %d", len(entries), backups)
+				}
+			}
+		})
+	}
+}
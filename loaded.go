@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// errLoaded is returned by restoreImage when every image of a backup is
+// already in the daemon
+var errLoaded = errors.New("already present")
+
+// errTagConflict is returned by restoreImage when loading a backup would move
+// a tag that now points to another image and --overwrite-tags is not set
+var errTagConflict = errors.New("tag conflict")
+
+// validateRestoreExisting checks --skip-existing, --force and --overwrite.
+// Skipping images that are already in the daemon is the default;
+// --skip-existing is kept so existing scripts keep working. --overwrite always
+// loads, so it implies --force and --overwrite-tags.
+func validateRestoreExisting() error {
+	if config.SkipExisting && (config.Force || config.Overwrite) {
+		return fmt.Errorf("--skip-existing cannot be combined with --force or --overwrite")
+	}
+	if config.Overwrite {
+		config.Force = true
+		config.OverwriteTags = true
+	}
+	return nil
+}
+
+// existingImages compares the images the backup at tarballPath restores with
+// the daemon. present is true when every image is already there under the ID
+// and tags recorded in its metadata, and refs then holds those references.
+// conflicts lists the recorded tags that now point to another image, which
+// loading the backup would move. Backups without metadata are always loaded.
+func existingImages(cli DockerClient, ctx context.Context, tarballPath string) (refs []string, present bool, conflicts []string) {
+	info, err := loadImageInfo(logicalBackupPath(tarballPath) + ".json")
+	if err != nil {
+		return nil, false, nil
+	}
+	images := []BundledImage{{ImageName: info.ImageName, ImageID: info.ImageID, Tags: info.Tags}}
+	if len(info.Images) > 0 {
+		images = info.Images
+	}
+
+	present = true
+	for _, img := range images {
+		if len(config.Only) > 0 && !containsReference(config.Only, img.ImageName) {
+			continue
+		}
+		if img.ImageID == "" {
+			present = false
+			continue
+		}
+		// An image without tags can only be looked up by its ID
+		names := img.Tags
+		if len(names) == 0 {
+			names = []string{img.ImageID}
+		}
+		for _, name := range names {
+			inspect, _, err := cli.ImageInspectWithRaw(ctx, name)
+			switch {
+			case err != nil:
+				if !isImageNotFound(err) {
+					logger.Debug(fmt.Sprintf("Could not check whether %s is loaded: %v", name, err), "image", name, "error", err)
+				}
+				present = false
+			case inspect.ID != img.ImageID:
+				conflicts = append(conflicts, fmt.Sprintf("%s (now %s)", name, shortID(inspect.ID)))
+				present = false
+			default:
+				refs = appendUnique(refs, name)
+			}
+		}
+	}
+	if !present {
+		refs = nil
+	}
+	return refs, present && len(refs) > 0, conflicts
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/errdefs"
+)
+
+// writeTestBackup writes an uncompressed backup of app:1.0 with image ID id
+// and returns its path
+func writeTestBackup(t *testing.T, id string) string {
+	t.Helper()
+	path := filepath.Join(config.BackupDir, "app_1.0.tar")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	tw := tar.NewWriter(file)
+	manifest := `[{"Config":"config.json","RepoTags":["app:1.0"],"Layers":[]}]`
+	if err := tw.WriteHeader(&tar.Header{Name: "manifest.json", Mode: 0644, Size: int64(len(manifest))}); err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(tw, manifest)
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	info := ImageInfo{ImageName: "app:1.0", ImageID: id, Tags: []string{"app:1.0"}, Format: formatDocker, CompressType: compressionNone}
+	if err := writeImageInfo(path+".json", info); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRestoreImageSkipExisting(t *testing.T) {
+	const backupID = "sha256:0123456789abcdef"
+	tests := []struct {
+		name         string
+		skipExisting bool
+		present      bool
+		wantLoad     bool
+	}{
+		{"present", true, true, false},
+		{"missing", true, false, true},
+		{"present with --force", false, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupBackupTest(t, compressionNone)
+			config.SkipExisting = tt.skipExisting
+			config.Force = !tt.skipExisting
+			path := writeTestBackup(t, backupID)
+
+			loaded := false
+			cli := newMockDockerClient(t)
+			cli.InspectFunc = func(ref string) (image.InspectResponse, error) {
+				if !tt.present {
+					return image.InspectResponse{}, errdefs.NotFound(errors.New("No such image: " + ref))
+				}
+				return image.InspectResponse{ID: backupID, RepoTags: []string{"app:1.0"}}, nil
+			}
+			cli.LoadFunc = func(input io.Reader) (image.LoadResponse, error) {
+				loaded = true
+				io.Copy(io.Discard, input)
+				return image.LoadResponse{Body: io.NopCloser(strings.NewReader(`{"stream":"Loaded image: app:1.0\n"}`))}, nil
+			}
+
+			err := restoreImage(cli, context.Background(), path)
+			if loaded != tt.wantLoad {
+				t.Errorf("backup loaded = %v, want %v", loaded, tt.wantLoad)
+			}
+			if tt.wantLoad {
+				if err != nil {
+					t.Fatalf("restoreImage() error = %v", err)
+				}
+				return
+			}
+			// Skipped restores are reported apart from loaded ones
+			result := newResult(path, err, time.Now())
+			if result.Status != StatusSkipped {
+				t.Errorf("status = %s, want %s", result.Status, StatusSkipped)
+			}
+			if reason := skipReason([]Result{result}); reason != "already present" {
+				t.Errorf("skip reason = %q, want %q", reason, "already present")
+			}
+		})
+	}
+}
+
+func TestRestoreImageExisting(t *testing.T) {
+	const backupID = "sha256:0123456789abcdef"
+	tests := []struct {
+		name      string
+		localID   string
+		force     bool
+		overwrite bool
+		wantErr   error
+		wantLoad  bool
+	}{
+		{"tag conflict", "sha256:fedcba9876543210", false, false, errTagConflict, false},
+		{"tag conflict with --force", "sha256:fedcba9876543210", true, false, errTagConflict, false},
+		{"tag conflict with --overwrite", "sha256:fedcba9876543210", false, true, nil, true},
+		{"present", backupID, false, false, errLoaded, false},
+		{"present with --overwrite", backupID, false, true, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = defaultConfig()
+			config.BackupDir = t.TempDir()
+			t.Cleanup(func() { config = defaultConfig() })
+			config.Force, config.Overwrite = tt.force, tt.overwrite
+			if err := validateRestoreExisting(); err != nil {
+				t.Fatal(err)
+			}
+			path := writeTestBackup(t, backupID)
+
+			loaded := false
+			cli := newMockDockerClient(t)
+			cli.InspectFunc = func(ref string) (image.InspectResponse, error) {
+				return image.InspectResponse{ID: tt.localID, RepoTags: []string{"app:1.0"}}, nil
+			}
+			cli.LoadFunc = func(input io.Reader) (image.LoadResponse, error) {
+				loaded = true
+				io.Copy(io.Discard, input)
+				return image.LoadResponse{Body: io.NopCloser(strings.NewReader(`{"stream":"Loaded image: app:1.0\n"}`))}, nil
+			}
+
+			err := restoreImage(cli, context.Background(), path)
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) || tt.wantErr == nil && err != nil {
+				t.Fatalf("restoreImage() error = %v, want %v", err, tt.wantErr)
+			}
+			if loaded != tt.wantLoad {
+				t.Errorf("backup loaded = %v, want %v", loaded, tt.wantLoad)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// localBackend stores backups in a local directory, so commands that move
+// files between locations can treat local and remote directories alike
+type localBackend struct {
+	root string
+}
+
+// newLocalBackend returns the backend for a local directory, creating it
+// when create is set
+func newLocalBackend(root string, create bool) (*localBackend, error) {
+	if create {
+		if err := os.MkdirAll(root, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create directory %s: %w", root, err)
+		}
+	}
+	stat, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !stat.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+	return &localBackend{root: root}, nil
+}
+
+func (b *localBackend) localPath(key string) string {
+	return filepath.Join(b.root, filepath.FromSlash(key))
+}
+
+// Put writes r to a temporary file next to the destination and renames it
+// into place, like the SFTP backend
+func (b *localBackend) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	dest := b.localPath(key)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(dest), err)
+	}
+
+	tmp := dest + ".uploading"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, &contextReader{ctx: ctx, r: r})
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
+
+func (b *localBackend) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	return os.Open(b.localPath(key))
+}
+
+func (b *localBackend) Delete(ctx context.Context, key string) error {
+	return os.Remove(b.localPath(key))
+}
+
+func (b *localBackend) List(ctx context.Context) ([]RemoteFile, error) {
+	return listLocalFiles(b.root)
+}
+
+// SetModTime keeps the date of a migrated file
+func (b *localBackend) SetModTime(ctx context.Context, key string, t time.Time) error {
+	return os.Chtimes(b.localPath(key), t, t)
+}
+
+func (b *localBackend) String() string {
+	return b.root
+}
+
+// contextReader stops a copy once its context is cancelled
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
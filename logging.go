@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+// outcomeKey marks records that report a finished operation; the console
+// shows successes in green
+const outcomeKey = "outcome"
+
+// --log-format values
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// logLevel is shared by every handler so --log-level and --verbose apply to
+// the console and the log file alike
+var logLevel = new(slog.LevelVar)
+
+// logger receives the progress messages of all commands. Command output such
+// as listings, summaries and JSON is still written to stdout directly.
+var logger = slog.New(newConsoleHandler(os.Stderr))
+
+// debugEnabled reports whether debug messages are logged, for output such as
+// the docker CLI's own messages that bypasses the logger
+func debugEnabled() bool {
+	return logger.Enabled(context.Background(), slog.LevelDebug)
+}
+
+// logSuccess logs a completed operation at info level
+func logSuccess(msg string, args ...any) {
+	logger.Info(msg, append(args, outcomeKey, "success")...)
+}
+
+// setupLogging applies --log-level, --verbose, --quiet, --log-format and
+// --log-file.
+// With the text format the console gets colored messages on a terminal and
+// key=value lines otherwise, and the log file gets key=value lines; the json
+// format writes one JSON object per message to both. Messages of the standard
+// log package, including fatal errors, are logged at error level.
+func setupLogging(cmd *cobra.Command) error {
+	levelName, _ := cmd.Flags().GetString("log-level")
+	level, err := parseLogLevel(levelName)
+	if err != nil {
+		return err
+	}
+	// --log-level beats --verbose unless only the verbose setting came from
+	// the command line
+	explicitLevel := cmd.Flags().Changed("log-level") && (!configuredFlags["log-level"] || configuredFlags["verbose"])
+	if config.Verbose && !explicitLevel {
+		level = slog.LevelDebug
+	}
+	// --quiet keeps only errors and wins over --verbose
+	if config.Quiet && !explicitLevel {
+		level = slog.LevelError
+	}
+	// The color package already turns itself off for NO_COLOR and when
+	// stdout is not a terminal
+	if config.Quiet || config.NoColor {
+		color.NoColor = true
+	}
+	logLevel.Set(level)
+
+	format, _ := cmd.Flags().GetString("log-format")
+	options := &slog.HandlerOptions{Level: logLevel}
+	newHandler := func(w io.Writer) slog.Handler { return slog.NewTextHandler(w, options) }
+	switch format {
+	case logFormatText:
+	case logFormatJSON:
+		newHandler = func(w io.Writer) slog.Handler { return slog.NewJSONHandler(w, options) }
+	default:
+		return fmt.Errorf("invalid --log-format %q (expected text or json)", format)
+	}
+
+	console := newHandler(os.Stderr)
+	if format == logFormatText && term.IsTerminal(int(os.Stderr.Fd())) {
+		console = newConsoleHandler(os.Stderr)
+	}
+	handlers := multiHandler{console}
+
+	if path, _ := cmd.Flags().GetString("log-file"); path != "" {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open log file: %w", err)
+		}
+		handlers = append(handlers, newHandler(file))
+	}
+
+	logger = slog.New(handlers)
+	log.SetFlags(0)
+	log.SetOutput(slog.NewLogLogger(handlers, slog.LevelError).Writer())
+	return nil
+}
+
+// parseLogLevel accepts debug, info, warn and error
+func parseLogLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info", "":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("invalid --log-level %q (expected debug, info, warn or error)", name)
+}
+
+// consoleHandler prints only the message of each record, colored by level,
+// for people watching a terminal. Attributes are left to the structured
+// handlers since the messages already name what they refer to.
+type consoleHandler struct {
+	w  io.Writer
+	mu *sync.Mutex
+}
+
+func newConsoleHandler(w io.Writer) *consoleHandler {
+	return &consoleHandler{w: w, mu: &sync.Mutex{}}
+}
+
+func (h *consoleHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= logLevel.Level()
+}
+
+func (h *consoleHandler) Handle(_ context.Context, record slog.Record) error {
+	style := color.New()
+	switch {
+	case record.Level >= slog.LevelError:
+		style = color.New(color.FgRed, color.Bold)
+	case record.Level >= slog.LevelWarn:
+		style = color.New(color.FgYellow)
+	case record.Level < slog.LevelInfo:
+		style = color.New(color.Faint)
+	default:
+		record.Attrs(func(attr slog.Attr) bool {
+			if attr.Key == outcomeKey && attr.Value.String() == "success" {
+				style = color.New(color.FgGreen, color.Bold)
+				return false
+			}
+			return true
+		})
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := style.Fprintln(h.w, record.Message)
+	return err
+}
+
+func (h *consoleHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *consoleHandler) WithGroup(string) slog.Handler      { return h }
+
+// multiHandler sends every record to all of its handlers
+type multiHandler []slog.Handler
+
+func (m multiHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range m {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m multiHandler) Handle(ctx context.Context, record slog.Record) error {
+	var firstErr error
+	for _, h := range m {
+		if !h.Enabled(ctx, record.Level) {
+			continue
+		}
+		if err := h.Handle(ctx, record.Clone()); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (m multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(multiHandler, len(m))
+	for i, h := range m {
+		handlers[i] = h.WithAttrs(attrs)
+	}
+	return handlers
+}
+
+func (m multiHandler) WithGroup(name string) slog.Handler {
+	handlers := make(multiHandler, len(m))
+	for i, h := range m {
+		handlers[i] = h.WithGroup(name)
+	}
+	return handlers
+}
@@ -2,41 +2,273 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
+	"text/template"
 	"time"
 
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/client"
 	"github.com/fatih/color"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/spf13/cobra"
 )
 
 type Config struct {
-	BackupDir    string
-	MaxWorkers   int
-	Verbose      bool
-	CompressType string
+	BackupDir        string
+	MaxWorkers       int
+	Verbose          bool
+	Quiet            bool
+	NoBanner         bool
+	NoColor          bool
+	CompressType     string
+	CompressLevel    int
+	CompressThreads  int
+	IOWorkers        int
+	Format           string
+	AllPlatforms     bool
+	Dedup            bool
+	SplitSize        int64
+	RateLimit        int64
+	PerWorkerLimit   bool
+	CompressionRatio float64
+	MinFree          int64
+	IgnoreSpaceCheck bool
+	Only             []string
+	Checksum         string
+	Report           string
+	TargetContext    string
+	PullFallback     bool
+	Pull             bool
+	AlwaysPull       bool
+	RemoveAfter      bool
+	RegistryAuth     string
+	DockerAuth       bool
+	Push             bool
+	PushPrefix       string
+	RemoveAfterPush  bool
+	ListFormat       string
+	SortBy           string
+	ListImage        string
+	ListFilter       string
+	ListSince        string
+	ListUntil        string
+	Labels           []string
+	ShowIncomplete   bool
+	PruneIncomplete  bool
+	SSHIdentity      string
+	Endpoint         string
+	NameTemplate     string
+	DryRun           bool
+	Output           string
+	Encrypt          bool
+	PassphraseFile   string
+	Recipients       []string
+	IdentityFiles    []string
+	FailFast         bool
+	Bundle           string
+	Remote           string
+	RemoteOnly       bool
+	ToRegistry       string
+	RegistryUser     string
+	RegistryPassword string
+	NoTarball        bool
+	Retag            string
+	UntagOriginal    bool
+	RenamePolicy     string
+	RemoveSourceTag  bool
+	Timeout          time.Duration
+	TotalTimeout     time.Duration
+	ForceKill        time.Duration
+	Since            time.Duration
+	All              bool
+	Excludes         []string
+	Filters          []string
+	Force            bool
+	KeepLast         int
+	OnExist          string
+	Sign             bool
+	SigningKey       string
+	RequireSignature bool
+	PublicKey        string
+	Watch            bool
+	Interval         time.Duration
+	Cron             string
+	RunOnce          bool
+	NotifyWebhook    string
+	NotifySecret     string
+	NotifyTimeout    time.Duration
+	NotifyOn         string
+	NotifyHeaders    []string
+	NotifyTemplate   string
+	WatchFilters     []string
+	WatchDebounce    time.Duration
+	Retries          int
+	RetryDelay       time.Duration
+	SkipExisting     bool
+	OverwriteTags    bool
+	Overwrite        bool
+	Containers       []string
+	Pause            bool
+	KeepImage        bool
+	Volumes          bool
+	Manifest         string
+	Stdout           bool
+	MetadataFile     string
+	Deduplicate      bool
+	Platform         string
+	TagAsLatest      bool
+	OutputTemplate   string
+	Host             string
+	Context          string
+	DockerHost       string
+	TLSCA            string
+	TLSCert          string
+	TLSKey           string
 }
 
 // ImageInfo stores metadata about backed up images
 type ImageInfo struct {
-	ImageName    string    `json:"image_name"`
-	ImageID      string    `json:"image_id"`
-	Tags         []string  `json:"tags"`
-	Size         int64     `json:"size"`
-	BackupDate   time.Time `json:"backup_date"`
-	CompressType string    `json:"compress_type"`
+	SchemaVersion        int               `json:"schema_version,omitempty"`
+	ImageName            string            `json:"image_name"`
+	ImageID              string            `json:"image_id"`
+	Tags                 []string          `json:"tags"`
+	Size                 int64             `json:"size"`
+	BackupDate           time.Time         `json:"backup_date"`
+	CompressType         string            `json:"compress_type"`
+	CompressLevel        int               `json:"compress_level,omitempty"`
+	Format               string            `json:"format,omitempty"`
+	Encrypted            bool              `json:"encrypted,omitempty"`
+	EncryptionSalt       []byte            `json:"encryption_salt,omitempty"`
+	EncryptionNonce      []byte            `json:"encryption_nonce,omitempty"`
+	EncryptionScheme     string            `json:"encryption_scheme,omitempty"`
+	EncryptionRecipients []string          `json:"encryption_recipients,omitempty"`
+	Images               []BundledImage    `json:"images,omitempty"`
+	Architecture         string            `json:"architecture,omitempty"`
+	Os                   string            `json:"os,omitempty"`
+	Variant              string            `json:"variant,omitempty"`
+	Created              time.Time         `json:"created,omitempty"`
+	LayerCount           int               `json:"layer_count,omitempty"`
+	Parts                []PartInfo        `json:"parts,omitempty"`
+	Platforms            []string          `json:"platforms,omitempty"`
+	RepoDigests          []string          `json:"repo_digests,omitempty"`
+	Labels               map[string]string `json:"labels,omitempty"`
+	Entrypoint           []string          `json:"entrypoint,omitempty"`
+	Cmd                  []string          `json:"cmd,omitempty"`
+	Layers               []string          `json:"layers,omitempty"`
+	BackupLabels         map[string]string `json:"backup_labels,omitempty"`
+	Container            *SourceContainer  `json:"container,omitempty"`
+	Kind                 string            `json:"kind,omitempty"`
+	SourceImage          string            `json:"source_image,omitempty"`
+	Platform             string            `json:"platform,omitempty"`
+	Volumes              []string          `json:"volumes,omitempty"`
 }
 
+// imageInfoSchemaVersion is the version of the metadata sidecar written by
+// this build. Version 2 added the digests, variant, labels, entrypoint, cmd
+// and layers, version 3 the backup labels, version 4 the source container,
+// version 5 the kind and source image of container exports, version 6 the
+// platform selected with --platform, version 7 the start time of exported
+// containers, version 8 the volumes archived with --volumes; sidecars without
+// a schema_version are version 1.
+const imageInfoSchemaVersion = 8
+
+// BundledImage describes one image stored in a multi-image bundle
+type BundledImage struct {
+	ImageName string   `json:"image_name"`
+	ImageID   string   `json:"image_id"`
+	Tags      []string `json:"tags"`
+	Size      int64    `json:"size"`
+}
+
+// config is the configuration of the running command, built by useConfig
+// from that command's flags before it runs
 var config Config
 
+// commandConfigs holds the Config the flags of each command are bound to.
+// Every command binds its own, so the flags of one command never change the
+// configuration another command sees; the root command's holds the global
+// flags.
+var commandConfigs = map[*cobra.Command]*Config{}
+
+// defaultConfig returns the built-in defaults
+func defaultConfig() Config {
+	return Config{
+		BackupDir:     "docker-backups",
+		CompressLevel: defaultCompressLevel,
+		MaxWorkers:    3,
+		DockerAuth:    true,
+		Verbose:       false,
+		CompressType:  "gzip",
+		NameTemplate:  defaultNameTemplate,
+		OnExist:       onExistOverwrite,
+		Output:        "text",
+		Retries:       0,
+		RetryDelay:    5 * time.Second,
+	}
+}
+
+// newCommandConfig returns a Config holding the defaults for the flags of cmd
+// and its subcommands to bind to
+func newCommandConfig(cmd *cobra.Command) *Config {
+	cfg := defaultConfig()
+	commandConfigs[cmd] = &cfg
+	return &cfg
+}
+
+// useConfig makes the flags of cmd, or of its nearest parent with flags of its
+// own, and the global flags the configuration of this run. Settings of other
+// commands and of earlier runs do not carry over.
+func useConfig(cmd *cobra.Command) {
+	config = defaultConfig()
+	for c := cmd; c.HasParent(); c = c.Parent() {
+		if cfg, ok := commandConfigs[c]; ok {
+			config = *cfg
+			break
+		}
+	}
+	if global, ok := commandConfigs[cmd.Root()]; ok {
+		config.Quiet = global.Quiet
+		config.NoBanner = global.NoBanner
+		config.NoColor = global.NoColor
+		config.Host = global.Host
+		config.Context = global.Context
+	}
+}
+
+// nameTmpl is the parsed --name-template used to build backup file names
+var nameTmpl *template.Template
+
+// backupCatalog receives successful backups when the backup directory has a catalog
+var backupCatalog *catalogUpdater
+
+// dirIndexUpdates receives successful backups for the index.json of a local
+// backup directory
+var dirIndexUpdates *dirIndexUpdater
+
+// remoteBackend receives finished backups when --remote is set
+var remoteBackend StorageBackend
+
+// passphrase is the key material for --encrypt and for restoring encrypted backups
+var (
+	passphrase     []byte
+	passphraseErr  error
+	passphraseOnce sync.Once
+)
+
 var banner = `
                _             _                    _         _               _                     
   __ _ ___ ___| |__  __ _ __| |___  _ _ __ ___ __| |___  __| |_____ _ _ ___(_)_ __  __ _ __ _ ___ 
@@ -49,33 +281,137 @@ Made with ❤️ by Abhinandan-Khurana
 `
 
 func main() {
-	config = Config{
-		BackupDir:    "docker-backups",
-		MaxWorkers:   3,
-		Verbose:      false,
-		CompressType: "gzip",
-	}
-
 	rootCmd := &cobra.Command{
 		Use:   "go-backup-docker-image",
 		Short: "Docker Image Backup Tool",
 		Long:  "A tool to backup Docker images as tarballs and restore them when needed",
 		PersistentPreRun: func(cmd *cobra.Command, args []string) {
-			if cmd.Name() != "help" && cmd.Name() != "completion" {
+			if err := applyConfig(cmd); err != nil {
+				log.Fatal(err)
+			}
+			useConfig(cmd)
+			if err := setupLogging(cmd); err != nil {
+				log.Fatal(err)
+			}
+			if loadedConfigFile != "" {
+				logger.Debug(fmt.Sprintf("Loaded config file %s", loadedConfigFile), "path", loadedConfigFile)
+			}
+			manifest, _ := cmd.Flags().GetString("manifest")
+			if toStdout, _ := cmd.Flags().GetBool("stdout"); manifest == "-" || toStdout {
+				reserveStdout()
+			}
+			if output, _ := cmd.Flags().GetString("output"); output == "json" {
+				return
+			}
+			if jsonOutput, _ := cmd.Flags().GetBool("json"); jsonOutput {
+				return
+			}
+			if !config.Quiet && !config.NoBanner && cmd.Name() != "help" && !isCompletionCommand(cmd) {
 				color.New(color.FgCyan, color.Bold).Println(banner)
 			}
 		},
 	}
+	rootCfg := newCommandConfig(rootCmd)
+	rootCmd.PersistentFlags().String("config", "", "Config file with default flag values (default: $XDG_CONFIG_HOME/go-backup-docker-image/config.yaml, ~/.go-backup-docker-image.yaml or ./go-backup-docker-image.yaml)")
+	rootCmd.PersistentFlags().BoolVarP(&rootCfg.Quiet, "quiet", "q", false, "Hide the banner, colors and per-item progress; only errors and results are printed")
+	rootCmd.PersistentFlags().BoolVar(&rootCfg.NoBanner, "no-banner", false, "Do not print the banner")
+	rootCmd.PersistentFlags().BoolVar(&rootCfg.NoColor, "no-color", false, "Disable colored output (also disabled by NO_COLOR or when stdout is not a terminal)")
+	rootCmd.PersistentFlags().String("log-level", "info", "Minimum level of progress messages: debug, info, warn or error (--verbose means debug)")
+	rootCmd.PersistentFlags().String("log-file", "", "Also append progress messages as structured lines to this file")
+	rootCmd.PersistentFlags().String("log-format", logFormatText, "Format of log lines: text (colored on a terminal) or json")
+	rootCmd.PersistentFlags().StringVar(&rootCfg.Host, "host", "", "Docker daemon to use, e.g. unix:///run/podman/podman.sock, tcp://10.0.0.5:2376 or ssh://user@host (default: DOCKER_HOST)")
+	rootCmd.PersistentFlags().StringVar(&rootCfg.Context, "context", "", "docker CLI context to use, with its TLS material (default: DOCKER_CONTEXT)")
 
 	backupCmd := &cobra.Command{
 		Use:   "backup [IMAGE_NAME...]",
 		Short: "Backup Docker images as tarballs",
 		Run:   runBackup,
 	}
-	backupCmd.Flags().StringVarP(&config.BackupDir, "dir", "d", config.BackupDir, "Directory to store backups")
-	backupCmd.Flags().IntVarP(&config.MaxWorkers, "workers", "w", config.MaxWorkers, "Maximum number of concurrent workers")
-	backupCmd.Flags().BoolVarP(&config.Verbose, "verbose", "v", config.Verbose, "Enable verbose logging")
-	backupCmd.Flags().StringVarP(&config.CompressType, "compress", "c", config.CompressType, "Compression type (gzip, none)")
+	backupCfg := newCommandConfig(backupCmd)
+	backupCmd.Flags().StringVarP(&backupCfg.BackupDir, "dir", "d", backupCfg.BackupDir, "Directory to store backups, or a remote location such as s3://bucket/prefix to stream them to")
+	backupCmd.Flags().IntVarP(&backupCfg.MaxWorkers, "workers", "w", backupCfg.MaxWorkers, "Maximum number of concurrent workers")
+	backupCmd.Flags().IntVar(&backupCfg.IOWorkers, "io-workers", 0, "Maximum number of workers saving and compressing at once, e.g. 1 on a slow disk (default: --workers)")
+	backupCmd.Flags().BoolVarP(&backupCfg.Verbose, "verbose", "v", backupCfg.Verbose, "Enable verbose logging")
+	backupCmd.Flags().StringVarP(&backupCfg.CompressType, "compress", "c", backupCfg.CompressType, "Compression type (gzip, none)")
+	backupCmd.Flags().Var((*compressLevelFlag)(&backupCfg.CompressLevel), "compress-level", "Compression level, 1 (fastest) to 9 (smallest) for gzip; 0 is the same as 1")
+	backupCmd.Flags().IntVar(&backupCfg.CompressThreads, "compress-threads", 0, "Threads each backup compresses with (0 divides the CPUs across the workers)")
+	backupCmd.Flags().StringVar(&backupCfg.Format, "format", formatDocker, "Backup format: docker, or oci for an OCI Image Layout archive (restoring oci requires Docker 25+)")
+	backupCmd.Flags().BoolVar(&backupCfg.AllPlatforms, "all-platforms", false, "Save every platform of multi-platform images from their registry manifest list into an OCI layout archive (implies --format oci)")
+	backupCmd.Flags().StringVar(&backupCfg.Platform, "platform", "", "Save only this platform of a multi-platform image, as os/arch[/variant] (requires Docker 28+)")
+	backupCmd.Flags().BoolVar(&backupCfg.Dedup, "dedup", false, "Store layers once by digest in a shared blob store instead of writing a full tarball")
+	backupCmd.Flags().BoolVar(&backupCfg.Dedup, "incremental", false, "Alias for --dedup")
+	backupCmd.Flags().String("split-size", "", "Split backups into parts of at most this size (e.g. 4GB, 500MB)")
+	backupCmd.Flags().String("rate-limit", "", "Limit the combined write rate of all workers, e.g. 50MB/s")
+	backupCmd.Flags().BoolVar(&backupCfg.PerWorkerLimit, "rate-limit-per-worker", false, "Apply --rate-limit to each worker instead of all of them together")
+	backupCmd.Flags().StringVar(&backupCfg.NameTemplate, "name-template", backupCfg.NameTemplate, "Go template for backup file names, may contain / for subdirectories (fields: Name, Repository, SafeName, Tag, Timestamp, Date, ImageID, ShortID, Hostname, Ext)")
+	backupCmd.Flags().StringVar(&backupCfg.OutputTemplate, "output-template", "", "Go template for the subdirectory of --dir backups are written to (fields: Registry, Repository, Tag, Date, Timestamp)")
+	backupCmd.Flags().StringVar(&backupCfg.OnExist, "on-exist", backupCfg.OnExist, "What to do when the backup name already exists: overwrite, skip, fail or rename (append -1, -2, ...)")
+	backupCmd.Flags().BoolVar(&backupCfg.DryRun, "dry-run", backupCfg.DryRun, "Inspect images and report what would be backed up without writing files")
+	backupCmd.Flags().StringVarP(&backupCfg.Output, "output", "o", backupCfg.Output, "Output format (text, json)")
+	backupCmd.Flags().BoolVar(&backupCfg.Encrypt, "encrypt", backupCfg.Encrypt, "Encrypt backups with AES-256-GCM (passphrase from --passphrase-file or "+passphraseEnv+")")
+	backupCmd.Flags().StringVar(&backupCfg.PassphraseFile, "passphrase-file", "", "File containing the encryption passphrase")
+	backupCmd.Flags().BoolVar(&backupCfg.Sign, "sign", false, "Write a detached ed25519 signature (.sig) covering each backup and its metadata")
+	backupCmd.Flags().StringVar(&backupCfg.SigningKey, "signing-key", defaultSigningKey, "Private key for --sign, as created by keygen")
+	backupCmd.Flags().StringArrayVar(&backupCfg.Recipients, "recipient", nil, "Encrypt backups with age to this public key or recipients file instead of a passphrase (repeatable; implies --encrypt)")
+	backupCmd.Flags().IntVar(&backupCfg.Retries, "retries", backupCfg.Retries, "Number of retries for transient Docker errors")
+	backupCmd.Flags().DurationVar(&backupCfg.RetryDelay, "retry-delay", backupCfg.RetryDelay, "Initial delay between retries (doubles each attempt)")
+	backupCmd.Flags().StringVar(&backupCfg.Bundle, "bundle", "", "Save all images into a single tarball with this name")
+	backupCmd.Flags().StringVar(&backupCfg.Remote, "remote", "", "Upload finished backups to remote storage (e.g. s3://bucket/prefix or sftp://user@host:22/path)")
+	backupCmd.Flags().StringVar(&backupCfg.SSHIdentity, "ssh-identity", "", "Private key for sftp:// and ssh:// locations (default: ~/.ssh/id_ed25519, id_ecdsa and id_rsa)")
+	backupCmd.Flags().StringVar(&backupCfg.SSHIdentity, "ssh-key", "", "Alias for --ssh-identity")
+	backupCmd.Flags().StringVar(&backupCfg.Endpoint, "endpoint", "", "S3-compatible endpoint for s3:// locations, e.g. http://localhost:9000 for MinIO (default: $AWS_ENDPOINT_URL)")
+	backupCmd.Flags().BoolVar(&backupCfg.RemoteOnly, "remote-only", false, "Delete the local copy after a successful upload (requires --remote)")
+	backupCmd.Flags().StringVar(&backupCfg.ToRegistry, "to-registry", "", "Also push each image to this registry prefix, e.g. my.registry.local/backup")
+	backupCmd.Flags().StringVar(&backupCfg.RegistryUser, "registry-user", "", "Username for --to-registry (default: credentials from docker login)")
+	backupCmd.Flags().StringVar(&backupCfg.RegistryPassword, "registry-password", "", "Password for --registry-user (default: $"+registryPasswordEnv+")")
+	backupCmd.Flags().BoolVar(&backupCfg.NoTarball, "no-tarball", false, "Only push to --to-registry, without writing a tarball")
+	backupCmd.Flags().DurationVar(&backupCfg.Timeout, "timeout", 0, "Maximum time per image backup (0 means no timeout)")
+	backupCmd.Flags().DurationVar(&backupCfg.TotalTimeout, "total-timeout", 0, "Maximum time for the whole run; images not finished by then time out (0 means no timeout)")
+	backupCmd.Flags().DurationVar(&backupCfg.ForceKill, "force-kill", 0, "After Ctrl-C, cancel backups still running after this long (0 waits for them to finish)")
+	backupCmd.Flags().BoolVar(&backupCfg.FailFast, "fail-fast", backupCfg.FailFast, "Cancel remaining work on the first failure")
+	backupCmd.Flags().BoolVar(&backupCfg.Force, "force", false, "Back up images even if the latest backup has the same image ID or free disk space looks insufficient")
+	backupCmd.Flags().BoolVar(&backupCfg.IgnoreSpaceCheck, "ignore-space-check", false, "Only warn when free disk space looks insufficient")
+	backupCmd.Flags().String("min-free", "", "Free space that must remain in --dir after the backups, e.g. 10GB")
+	backupCmd.Flags().Float64Var(&backupCfg.CompressionRatio, "compression-ratio", defaultCompressionRatio, "Expected size of compressed backups as a fraction of the image size, for the free space check")
+	backupCmd.Flags().StringArrayVar(&backupCfg.Labels, "label", nil, "Store this key=value label in the metadata of each backup (repeatable)")
+	backupCmd.Flags().BoolVar(&backupCfg.Deduplicate, "deduplicate", false, "Skip images whose image ID already has a backup in --dir under any name")
+	backupCmd.Flags().StringVar(&backupCfg.Manifest, "manifest", "", "Write the path of every backup written to this file, one per line, for restore --file (- for stdout)")
+	backupCmd.Flags().BoolVar(&backupCfg.Stdout, "stdout", false, "Stream the backup of a single image to stdout instead of --dir; all other output goes to stderr")
+	backupCmd.Flags().StringVar(&backupCfg.MetadataFile, "metadata-file", "", "With --stdout, write the backup metadata to this file")
+	backupCmd.Flags().StringArrayVar(&backupCfg.Containers, "container", nil, "Commit this container to a backup/<container>:<timestamp> image and back that up (repeatable)")
+	backupCmd.Flags().BoolVar(&backupCfg.Pause, "pause", true, "Pause running containers while --container commits them")
+	backupCmd.Flags().BoolVar(&backupCfg.KeepImage, "keep-image", true, "Keep the image committed by --container after backing it up")
+	backupCmd.Flags().BoolVar(&backupCfg.Volumes, "volumes", false, "Also archive the named volumes of each image's containers into --dir")
+	backupCmd.Flags().StringVar(&backupCfg.DockerHost, "from-host", "", "Back up images from the daemon at this address, e.g. tcp://build-host:2376 or ssh://user@host (overrides --host and --context)")
+	backupCmd.Flags().StringVar(&backupCfg.DockerHost, "remote-docker-host", "", "Alias for --from-host")
+	backupCmd.Flags().StringVar(&backupCfg.TLSCA, "tls-ca", "", "CA certificate to verify a tcp:// --from-host or --host with")
+	backupCmd.Flags().StringVar(&backupCfg.TLSCert, "tls-cert", "", "Client certificate for a tcp:// --from-host or --host")
+	backupCmd.Flags().StringVar(&backupCfg.TLSKey, "tls-key", "", "Client key for --tls-cert")
+	backupCmd.Flags().BoolVar(&backupCfg.Pull, "pull", false, "Pull images the daemon does not have from their registry before backing them up")
+	backupCmd.Flags().BoolVar(&backupCfg.AlwaysPull, "always-pull", false, "Pull every image from its registry before backing it up, even when the daemon has it")
+	backupCmd.Flags().BoolVar(&backupCfg.RemoveAfter, "remove-after-backup", false, "Remove the images --pull pulled once they are backed up")
+	backupCmd.Flags().StringVar(&backupCfg.RegistryAuth, "registry-auth", "", "Base64-encoded AuthConfig JSON to pull with, as in the X-Registry-Auth header (default: $"+registryAuthEnv+")")
+	backupCmd.Flags().BoolVar(&backupCfg.DockerAuth, "registry-auth-from-docker-config", backupCfg.DockerAuth, "Pull with the credentials docker login stored for each image's registry")
+	backupCmd.Flags().DurationVar(&backupCfg.Since, "since", 0, "Only skip unchanged images whose latest backup is newer than this, e.g. 24h; older ones are backed up again")
+	backupCmd.Flags().IntVar(&backupCfg.KeepLast, "keep-last", 0, "After each successful backup, delete all but the N newest backups of that image in --dir (0 keeps all)")
+	backupCmd.Flags().BoolVar(&backupCfg.Watch, "watch", false, "After backing up the given images, keep running and back up newly tagged images")
+	backupCmd.Flags().StringArrayVar(&backupCfg.WatchFilters, "watch-filter", nil, "Only back up watched images whose repo:tag matches this glob (repeatable)")
+	backupCmd.Flags().DurationVar(&backupCfg.WatchDebounce, "watch-debounce", 5*time.Second, "Wait until a watched image had no new events for this long before backing it up")
+	backupCmd.Flags().DurationVar(&backupCfg.Interval, "interval", 0, "Keep running and back up the images every interval, e.g. 24h")
+	backupCmd.Flags().StringVar(&backupCfg.Cron, "cron", "", "Keep running and back up the images on this cron schedule, e.g. \"0 3 * * *\"")
+	backupCmd.Flags().BoolVar(&backupCfg.RunOnce, "run-once", false, "Run the job set up by --interval or --cron once now and exit")
+	backupCmd.Flags().StringVar(&backupCfg.NotifyWebhook, "notify-url", "", "POST a JSON summary to this URL when the run finishes")
+	backupCmd.Flags().StringVar(&backupCfg.NotifyWebhook, "notify-webhook", "", "Alias for --notify-url")
+	backupCmd.Flags().StringVar(&backupCfg.NotifyOn, "notify-on", notifyAlways, "When to notify --notify-url: always or failure")
+	backupCmd.Flags().StringArrayVar(&backupCfg.NotifyHeaders, "notify-header", nil, "Send this 'Name: value' header with the notification, e.g. for authentication (repeatable)")
+	backupCmd.Flags().StringVar(&backupCfg.NotifyTemplate, "notify-template", "", "Go template over the run report producing the JSON body, e.g. for a Slack incoming webhook")
+	backupCmd.Flags().StringVar(&backupCfg.NotifySecret, "notify-secret", "", "Sign webhook bodies with HMAC-SHA256 in the "+signatureHeader+" header")
+	backupCmd.Flags().DurationVar(&backupCfg.NotifyTimeout, "notify-timeout", 10*time.Second, "Timeout for the webhook request")
+	backupCmd.Flags().BoolVarP(&backupCfg.All, "all", "a", false, "Back up every local image")
+	backupCmd.Flags().StringArrayVar(&backupCfg.Filters, "filter", nil, "Back up local images matching a Docker filter such as reference=myregistry/* or label=backup=true (repeatable)")
+	backupCmd.Flags().StringArrayVar(&backupCfg.Excludes, "exclude", nil, "Skip images whose name or repo:tag matches this glob ('<none>' matches untagged images; repeatable)")
+	backupCmd.Flags().StringVar(&backupCfg.Report, "report", "", "Write a JSON summary of the run to this file")
+	backupCmd.Flags().StringVar(&backupCfg.Report, "report-file", "", "Alias for --report")
 	backupCmd.Flags().StringP("file", "f", "", "Read image names from file")
 	backupCmd.Flags().BoolP("stdin", "s", false, "Read image names from stdin")
 
@@ -84,20 +420,313 @@ func main() {
 		Short: "Restore Docker images from tarballs",
 		Run:   runRestore,
 	}
-	restoreCmd.Flags().BoolVarP(&config.Verbose, "verbose", "v", config.Verbose, "Enable verbose logging")
+	restoreCfg := newCommandConfig(restoreCmd)
+	restoreCmd.Flags().BoolVarP(&restoreCfg.Verbose, "verbose", "v", restoreCfg.Verbose, "Enable verbose logging")
+	restoreCmd.Flags().StringVar(&restoreCfg.Report, "report", "", "Write a JSON summary of the run to this file")
+	restoreCmd.Flags().StringVar(&restoreCfg.Report, "report-file", "", "Alias for --report")
 	restoreCmd.Flags().StringP("file", "f", "", "Read tarball paths from file")
 	restoreCmd.Flags().BoolP("stdin", "s", false, "Read tarball paths from stdin")
-	restoreCmd.Flags().IntVarP(&config.MaxWorkers, "workers", "w", config.MaxWorkers, "Maximum number of concurrent workers")
+	restoreCmd.Flags().IntVarP(&restoreCfg.MaxWorkers, "workers", "w", restoreCfg.MaxWorkers, "Maximum number of concurrent workers")
+	restoreCmd.Flags().IntVar(&restoreCfg.Retries, "retries", restoreCfg.Retries, "Number of retries for transient Docker errors")
+	restoreCmd.Flags().DurationVar(&restoreCfg.RetryDelay, "retry-delay", restoreCfg.RetryDelay, "Initial delay between retries (doubles each attempt)")
+	restoreCmd.Flags().DurationVar(&restoreCfg.Timeout, "timeout", 0, "Maximum time per tarball restore (0 means no timeout)")
+	restoreCmd.Flags().DurationVar(&restoreCfg.TotalTimeout, "total-timeout", 0, "Maximum time for the whole run; tarballs not finished by then time out (0 means no timeout)")
+	restoreCmd.Flags().DurationVar(&restoreCfg.ForceKill, "force-kill", 0, "After Ctrl-C, cancel restores still running after this long (0 waits for them to finish)")
+	restoreCmd.Flags().BoolVar(&restoreCfg.FailFast, "fail-fast", restoreCfg.FailFast, "Cancel remaining work on the first failure")
+	restoreCmd.Flags().StringVar(&restoreCfg.Retag, "retag", "", "Tag restored images as repo:tag, or a template like 'restored/{{.Repository}}:{{.Tag}}'")
+	restoreCmd.Flags().BoolVar(&restoreCfg.UntagOriginal, "untag-original", false, "Remove the original tag after applying --retag")
+	restoreCmd.Flags().StringVar(&restoreCfg.RenamePolicy, "rename-policy", "", "YAML file of match/replace rules applied to the restored image names, e.g. to strip a mirror prefix")
+	restoreCmd.Flags().BoolVar(&restoreCfg.RemoveSourceTag, "remove-source-tag", false, "Remove the loaded tag after --rename-policy renamed it")
+	restoreCmd.Flags().BoolVar(&restoreCfg.TagAsLatest, "tag-as-latest", false, "Also tag every restored image as <repository>:latest")
+	restoreCmd.Flags().BoolVar(&restoreCfg.Push, "push", false, "Push restored images below --push-prefix")
+	restoreCmd.Flags().StringVar(&restoreCfg.PushPrefix, "push-prefix", "", "Registry prefix for --push, e.g. registry.internal/apps")
+	restoreCmd.Flags().BoolVar(&restoreCfg.RemoveAfterPush, "remove-after-push", false, "Delete the local images after a successful --push")
+	restoreCmd.Flags().StringVar(&restoreCfg.RegistryUser, "registry-user", "", "Username for --push (default: credentials from docker login)")
+	restoreCmd.Flags().StringVar(&restoreCfg.RegistryPassword, "registry-password", "", "Password for --registry-user (default: $"+registryPasswordEnv+")")
+	restoreCmd.Flags().BoolVar(&restoreCfg.SkipExisting, "skip-existing", false, "Skip backups whose images are already in the daemon with the recorded ID and tags (the default)")
+	restoreCmd.Flags().BoolVar(&restoreCfg.Force, "force", false, "Load backups even if their images are already in the daemon")
+	restoreCmd.Flags().BoolVar(&restoreCfg.Overwrite, "overwrite", false, "Always load backups, even if their images are present or loading moves other tags (--force --overwrite-tags)")
+	restoreCmd.Flags().BoolVar(&restoreCfg.OverwriteTags, "overwrite-tags", false, "Load backups even if that moves local tags that point to other images")
+	restoreCmd.Flags().BoolVar(&restoreCfg.PullFallback, "pull-fallback", false, "If a backup cannot be loaded, pull the image it recorded from its registry instead")
+	restoreCmd.Flags().StringVar(&restoreCfg.TargetContext, "target-context", "", "Load images into the daemon of this docker context (default: DOCKER_CONTEXT or the environment)")
+	restoreCmd.Flags().StringVar(&restoreCfg.DockerHost, "to-host", "", "Load images into the daemon at this address, e.g. unix:///run/podman/podman.sock or ssh://user@host (overrides --host and --context)")
+	restoreCmd.Flags().StringVar(&restoreCfg.DockerHost, "remote-docker-host", "", "Alias for --to-host")
+	restoreCmd.Flags().StringVar(&restoreCfg.TLSCA, "tls-ca", "", "CA certificate to verify a tcp:// --to-host or --host with")
+	restoreCmd.Flags().StringVar(&restoreCfg.TLSCert, "tls-cert", "", "Client certificate for a tcp:// --to-host or --host")
+	restoreCmd.Flags().StringVar(&restoreCfg.TLSKey, "tls-key", "", "Client key for --tls-cert")
+	restoreCmd.Flags().StringVar(&restoreCfg.NotifyWebhook, "notify-url", "", "POST a JSON summary to this URL when the run finishes")
+	restoreCmd.Flags().StringVar(&restoreCfg.NotifyOn, "notify-on", notifyAlways, "When to notify --notify-url: always or failure")
+	restoreCmd.Flags().StringArrayVar(&restoreCfg.NotifyHeaders, "notify-header", nil, "Send this 'Name: value' header with the notification, e.g. for authentication (repeatable)")
+	restoreCmd.Flags().StringVar(&restoreCfg.NotifyTemplate, "notify-template", "", "Go template over the run report producing the JSON body, e.g. for a Slack incoming webhook")
+	restoreCmd.Flags().StringVar(&restoreCfg.NotifySecret, "notify-secret", "", "Sign webhook bodies with HMAC-SHA256 in the "+signatureHeader+" header")
+	restoreCmd.Flags().DurationVar(&restoreCfg.NotifyTimeout, "notify-timeout", 10*time.Second, "Timeout for the webhook request")
+	restoreCmd.Flags().StringArrayVar(&restoreCfg.Only, "only", nil, "Restore only this repo:tag or image ID from a bundle or multi-image tarball (repeatable)")
+	restoreCmd.Flags().StringVar(&restoreCfg.Checksum, "checksum", "", "Fail the restore unless the backup file has this digest, e.g. sha256:<hex> (single backup only)")
+	restoreCmd.Flags().StringVar(&restoreCfg.SSHIdentity, "ssh-identity", "", "Private key for sftp:// and ssh:// backups (default: ~/.ssh/id_ed25519, id_ecdsa and id_rsa)")
+	restoreCmd.Flags().StringVar(&restoreCfg.SSHIdentity, "ssh-key", "", "Alias for --ssh-identity")
+	restoreCmd.Flags().StringVar(&restoreCfg.Endpoint, "endpoint", "", "S3-compatible endpoint for s3:// backups (default: $AWS_ENDPOINT_URL)")
+	restoreCmd.Flags().StringVar(&restoreCfg.PassphraseFile, "passphrase-file", "", "File containing the passphrase for encrypted backups")
+	restoreCmd.Flags().StringVar(&restoreCfg.PublicKey, "public-key", "", "Verify backup signatures with this public key before loading; invalid signatures fail the restore")
+	restoreCmd.Flags().BoolVar(&restoreCfg.RequireSignature, "require-signature", false, "Refuse to restore backups without a valid signature (requires --public-key)")
+	restoreCmd.Flags().StringArrayVar(&restoreCfg.IdentityFiles, "identity", nil, "age identity file for backups encrypted with --recipient (repeatable)")
 
 	listCmd := &cobra.Command{
 		Use:   "list",
 		Short: "List available backup images",
 		Run:   runList,
 	}
-	listCmd.Flags().StringVarP(&config.BackupDir, "dir", "d", config.BackupDir, "Backup directory to list")
-	listCmd.Flags().BoolVarP(&config.Verbose, "verbose", "v", config.Verbose, "Show detailed information")
+	listCfg := newCommandConfig(listCmd)
+	listCmd.Flags().StringVarP(&listCfg.BackupDir, "dir", "d", listCfg.BackupDir, "Backup directory or remote location to list")
+	listCmd.Flags().BoolVarP(&listCfg.Verbose, "verbose", "v", listCfg.Verbose, "Show detailed information")
+	listCmd.Flags().StringVar(&listCfg.Remote, "remote", "", "List backups in remote storage (e.g. s3://bucket/prefix or sftp://user@host/path) instead of --dir")
+	listCmd.Flags().StringVar(&listCfg.SSHIdentity, "ssh-identity", "", "Private key for sftp:// and ssh:// locations (default: ~/.ssh/id_ed25519, id_ecdsa and id_rsa)")
+	listCmd.Flags().StringVar(&listCfg.SSHIdentity, "ssh-key", "", "Alias for --ssh-identity")
+	listCmd.Flags().StringVar(&listCfg.Endpoint, "endpoint", "", "S3-compatible endpoint for s3:// remotes (default: $AWS_ENDPOINT_URL)")
+	listCmd.Flags().StringVar(&listCfg.ListFormat, "format", listFlat, "Output layout: flat (one entry per backup) or grouped (backup history per image)")
+	listCmd.Flags().StringVar(&listCfg.SortBy, "sort", sortByDate, "Sort backups by date (newest first), name or size (largest first)")
+	listCmd.Flags().StringVar(&listCfg.SortBy, "sort-by", sortByDate, "Alias for --sort")
+	listCmd.Flags().StringVar(&listCfg.ListImage, "image", "", "Only list backups of this image")
+	listCmd.Flags().StringVar(&listCfg.ListFilter, "filter", "", "Only list backups whose image name contains this text or matches this glob")
+	listCmd.Flags().StringVar(&listCfg.ListSince, "since", "", "Only list backups made at or after this RFC 3339 time, or this long ago, e.g. 48h")
+	listCmd.Flags().StringVar(&listCfg.ListUntil, "until", "", "Only list backups made at or before this RFC 3339 time, or this long ago, e.g. 24h")
+	listCmd.Flags().StringVarP(&listCfg.Output, "output", "o", listCfg.Output, "Output format (text, json)")
+	listCmd.Flags().StringArrayVar(&listCfg.Labels, "label", nil, "Only list backups labeled with this key=value (repeatable; all must match)")
+	listCmd.Flags().BoolVar(&listCfg.ShowIncomplete, "show-incomplete", false, "Also list .partial files left by backups that are still running or failed")
+	listCmd.Flags().IntVarP(&listCfg.MaxWorkers, "workers", "w", listCfg.MaxWorkers, "Maximum number of metadata files to read at once")
+
+	inspectCmd := &cobra.Command{
+		Use:   "inspect TARBALL_PATH...",
+		Short: "Show full metadata for backup files",
+		Args:  cobra.MinimumNArgs(1),
+		Run:   runInspect,
+	}
+	inspectCfg := newCommandConfig(inspectCmd)
+	inspectCmd.Flags().String("template", "", "Format output using a Go template (e.g. '{{.ImageName}} {{.ImageID}}')")
+	inspectCmd.Flags().Bool("json", false, "Print the metadata and archive contents as JSON")
+	inspectCmd.Flags().StringVar(&inspectCfg.PassphraseFile, "passphrase-file", "", "File containing the passphrase for encrypted backups")
+	inspectCmd.Flags().StringArrayVar(&inspectCfg.IdentityFiles, "identity", nil, "age identity file for backups encrypted with --recipient (repeatable)")
+
+	compareCmd := &cobra.Command{
+		Use:   "compare IMAGE_NAME TARBALL_PATH",
+		Short: "Check whether a local image still matches its backup",
+		Args:  cobra.ExactArgs(2),
+		Run:   runCompare,
+	}
+	compareCfg := newCommandConfig(compareCmd)
+	compareCmd.Flags().Bool("layers", false, "Show which layers were added and removed since the backup, matched by digest")
+	compareCmd.Flags().Bool("checksum", false, "Compare the layer contents of the backup instead of the image ID in its metadata (reads the whole backup)")
+	compareCmd.Flags().StringVar(&compareCfg.PassphraseFile, "passphrase-file", "", "File containing the passphrase for encrypted backups")
+	compareCmd.Flags().StringArrayVar(&compareCfg.IdentityFiles, "identity", nil, "age identity file for backups encrypted with --recipient (repeatable)")
+	compareCmd.Flags().BoolVarP(&compareCfg.Verbose, "verbose", "v", compareCfg.Verbose, "Enable verbose logging")
+
+	diffCmd := &cobra.Command{
+		Use:     "diff",
+		Aliases: []string{"status"},
+		Short:   "Show local images without an up-to-date backup and backups of removed images",
+		Args:    cobra.NoArgs,
+		Run:     runDiff,
+	}
+	diffCfg := newCommandConfig(diffCmd)
+	diffCmd.Flags().StringVarP(&diffCfg.BackupDir, "dir", "d", diffCfg.BackupDir, "Backup directory to compare with the local images")
+	diffCmd.Flags().StringVarP(&diffCfg.Output, "output", "o", diffCfg.Output, "Output format (text, json)")
+	diffCmd.Flags().Bool("fail-on-missing", false, "Exit with status 1 when a local image has no backup")
+
+	catalogCmd := &cobra.Command{
+		Use:   "catalog",
+		Short: "Maintain and search a SQLite index of backups",
+	}
+	catalogCfg := newCommandConfig(catalogCmd)
+	catalogCmd.PersistentFlags().StringVarP(&catalogCfg.BackupDir, "dir", "d", catalogCfg.BackupDir, "Backup directory containing the catalog")
+	catalogCmd.PersistentFlags().BoolVarP(&catalogCfg.Verbose, "verbose", "v", catalogCfg.Verbose, "Enable verbose logging")
+
+	catalogBuildCmd := &cobra.Command{
+		Use:   "build",
+		Short: "Build or rebuild the catalog from the metadata sidecars",
+		Run:   runCatalogBuild,
+	}
 
-	rootCmd.AddCommand(backupCmd, restoreCmd, listCmd)
+	catalogQueryCmd := &cobra.Command{
+		Use:   "query",
+		Short: "Print backup paths matching the given filters",
+		Run:   runCatalogQuery,
+	}
+	catalogQueryCmd.Flags().String("image", "", "Match backups of this image name")
+	catalogQueryCmd.Flags().String("tag", "", "Match backups containing this tag")
+	catalogQueryCmd.Flags().String("after", "", "Match backups taken at or after this date (RFC3339 or YYYY-MM-DD)")
+	catalogQueryCmd.Flags().String("before", "", "Match backups taken before this date (RFC3339 or YYYY-MM-DD)")
+
+	catalogCmd.AddCommand(catalogBuildCmd, catalogQueryCmd)
+
+	reindexCmd := &cobra.Command{
+		Use:   "reindex",
+		Short: "Rebuild index.json of the backup directory from the metadata sidecars",
+		Args:  cobra.NoArgs,
+		Run:   runReindex,
+	}
+	reindexCfg := newCommandConfig(reindexCmd)
+	reindexCmd.Flags().StringVarP(&reindexCfg.BackupDir, "dir", "d", reindexCfg.BackupDir, "Backup directory to index")
+	reindexCmd.Flags().BoolVarP(&reindexCfg.Verbose, "verbose", "v", reindexCfg.Verbose, "Enable verbose logging")
+
+	statsCmd := &cobra.Command{
+		Use:   "stats",
+		Short: "Summarize the backups in a directory and the space they take",
+		Args:  cobra.NoArgs,
+		Run:   runStats,
+	}
+	statsCfg := newCommandConfig(statsCmd)
+	statsCmd.Flags().StringVarP(&statsCfg.BackupDir, "dir", "d", statsCfg.BackupDir, "Backup directory to analyze")
+	statsCmd.Flags().StringVarP(&statsCfg.Output, "output", "o", statsCfg.Output, "Output format (text, json)")
+	statsCmd.Flags().Int("top", 0, "Only show the N images whose backups take the most space")
+
+	pruneCmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Delete blobs no deduplicated backup references",
+		Run:   runPrune,
+	}
+	pruneCfg := newCommandConfig(pruneCmd)
+	pruneCmd.Flags().StringVarP(&pruneCfg.BackupDir, "dir", "d", pruneCfg.BackupDir, "Backup directory to prune")
+	pruneCmd.Flags().BoolVarP(&pruneCfg.Verbose, "verbose", "v", pruneCfg.Verbose, "List removed blobs")
+	pruneCmd.Flags().BoolVar(&pruneCfg.DryRun, "dry-run", false, "Show what would be removed without deleting anything")
+	pruneCmd.Flags().BoolVar(&pruneCfg.PruneIncomplete, "incomplete", false, "Also remove .partial files and temporary directories left by crashed backups")
+
+	deleteCmd := &cobra.Command{
+		Use:   "delete [TARBALL_PATH...]",
+		Short: "Delete specific backups together with their metadata",
+		Long:  "Delete the named backups, or the backups of --image, with their metadata, parts and signatures. Only backups inside --dir are deleted.",
+		Run:   runDelete,
+	}
+	deleteCfg := newCommandConfig(deleteCmd)
+	deleteCmd.Flags().StringVarP(&deleteCfg.BackupDir, "dir", "d", deleteCfg.BackupDir, "Backup directory to delete from")
+	deleteCmd.Flags().String("image", "", "Delete the backups of this image")
+	deleteCmd.Flags().String("before", "", "With --image, only delete backups taken before this date (RFC3339 or YYYY-MM-DD)")
+	deleteCmd.Flags().BoolVar(&deleteCfg.DryRun, "dry-run", false, "Show what would be deleted without deleting anything")
+	deleteCmd.Flags().BoolP("yes", "y", false, "Delete without asking for confirmation")
+	deleteCmd.Flags().BoolVarP(&deleteCfg.Verbose, "verbose", "v", deleteCfg.Verbose, "Enable verbose logging")
+
+	migrateCmd := &cobra.Command{
+		Use:   "migrate --from DIR_OR_URL --to DIR_OR_URL",
+		Short: "Move or copy backups between directories and remote storage",
+		Long:  "Move or copy every backup with its metadata and signature from one directory or remote location to another, keeping file names and dates",
+		Args:  cobra.NoArgs,
+		Run:   runMigrate,
+	}
+	migrateCfg := newCommandConfig(migrateCmd)
+	migrateCmd.Flags().String("from", "", "Directory or remote location (s3://, sftp://) to take backups from")
+	migrateCmd.Flags().String("to", "", "Directory or remote location to put backups in")
+	migrateCmd.Flags().Bool("copy", false, "Keep the backups at --from instead of deleting them after they were copied")
+	migrateCmd.Flags().Bool("overwrite", false, "Copy files again even if the destination already has them with the same SHA-256")
+	migrateCmd.Flags().IntVarP(&migrateCfg.MaxWorkers, "workers", "w", migrateCfg.MaxWorkers, "Maximum number of backups to transfer at once")
+	migrateCmd.Flags().StringVar(&migrateCfg.SSHIdentity, "ssh-identity", "", "Private key for sftp:// and ssh:// locations (default: ~/.ssh/id_ed25519, id_ecdsa and id_rsa)")
+	migrateCmd.Flags().StringVar(&migrateCfg.SSHIdentity, "ssh-key", "", "Alias for --ssh-identity")
+	migrateCmd.Flags().StringVar(&migrateCfg.Endpoint, "endpoint", "", "S3-compatible endpoint for s3:// locations (default: $AWS_ENDPOINT_URL)")
+	migrateCmd.Flags().StringVar(&migrateCfg.Report, "report", "", "Write a JSON summary of the run to this file")
+	migrateCmd.Flags().BoolVarP(&migrateCfg.Verbose, "verbose", "v", migrateCfg.Verbose, "Enable verbose logging")
+	migrateCmd.MarkFlagRequired("from")
+	migrateCmd.MarkFlagRequired("to")
+
+	verifyCmd := &cobra.Command{
+		Use:   "verify TARBALL_PATH...",
+		Short: "Check the signatures of backups",
+		Args:  cobra.MinimumNArgs(1),
+		Run:   runVerify,
+	}
+	verifyCfg := newCommandConfig(verifyCmd)
+	verifyCmd.Flags().String("public-key", defaultPublicKey, "Public key to verify signatures with")
+	verifyCmd.Flags().StringVar(&verifyCfg.SSHIdentity, "ssh-identity", "", "Private key for sftp:// and ssh:// backups (default: ~/.ssh/id_ed25519, id_ecdsa and id_rsa)")
+	verifyCmd.Flags().StringVar(&verifyCfg.Endpoint, "endpoint", "", "S3-compatible endpoint for s3:// backups (default: $AWS_ENDPOINT_URL)")
+	verifyCmd.Flags().BoolVarP(&verifyCfg.Verbose, "verbose", "v", verifyCfg.Verbose, "Enable verbose logging")
+
+	exportCmd := &cobra.Command{
+		Use:   "export CONTAINER...",
+		Short: "Export the filesystems of containers as tarballs",
+		Long:  "Export the flattened filesystem of each container, without image history, to a tarball with a metadata sidecar; load it again with import",
+		Args:  cobra.MinimumNArgs(1),
+		Run:   runExport,
+	}
+	exportCfg := newCommandConfig(exportCmd)
+	exportCmd.Flags().StringVarP(&exportCfg.BackupDir, "dir", "d", exportCfg.BackupDir, "Directory to store exports")
+	exportCmd.Flags().StringVarP(&exportCfg.CompressType, "compress", "c", exportCfg.CompressType, "Compression type (gzip, none)")
+	exportCmd.Flags().IntVarP(&exportCfg.MaxWorkers, "workers", "w", exportCfg.MaxWorkers, "Maximum number of concurrent workers")
+	exportCmd.Flags().DurationVar(&exportCfg.Timeout, "timeout", 0, "Maximum time per container export (0 means no timeout)")
+	exportCmd.Flags().BoolVar(&exportCfg.DryRun, "dry-run", false, "Inspect the containers and report where they would be exported without writing files")
+	exportCmd.Flags().BoolVarP(&exportCfg.Verbose, "verbose", "v", exportCfg.Verbose, "Enable verbose logging")
+
+	importCmd := &cobra.Command{
+		Use:   "import TARBALL_PATH",
+		Short: "Import a container export as a new image",
+		Args:  cobra.ExactArgs(1),
+		Run:   runImport,
+	}
+	importCfg := newCommandConfig(importCmd)
+	importCmd.Flags().String("ref", "", "Tag the imported image as repo:tag (default: untagged)")
+	importCmd.Flags().StringArray("change", nil, "Apply a Dockerfile instruction such as 'CMD [\"/bin/sh\"]' or 'ENV KEY=value' to the image (repeatable)")
+	importCmd.Flags().StringVar(&importCfg.SSHIdentity, "ssh-identity", "", "Private key for sftp:// and ssh:// exports (default: ~/.ssh/id_ed25519, id_ecdsa and id_rsa)")
+	importCmd.Flags().StringVar(&importCfg.Endpoint, "endpoint", "", "S3-compatible endpoint for s3:// exports (default: $AWS_ENDPOINT_URL)")
+	importCmd.Flags().BoolVarP(&importCfg.Verbose, "verbose", "v", importCfg.Verbose, "Enable verbose logging")
+
+	keygenCmd := &cobra.Command{
+		Use:   "keygen",
+		Short: "Generate an ed25519 key pair for signing backups",
+		Args:  cobra.NoArgs,
+		Run:   runKeygen,
+	}
+	keygenCmd.Flags().String("signing-key", defaultSigningKey, "Where to write the private key")
+	keygenCmd.Flags().String("public-key", defaultPublicKey, "Where to write the public key")
+	keygenCmd.Flags().Bool("force", false, "Overwrite existing key files")
+
+	configCmd := &cobra.Command{
+		Use:   "config",
+		Short: "Manage the config file",
+	}
+
+	configInitCmd := &cobra.Command{
+		Use:   "init [PATH]",
+		Short: "Write a config file listing every option with its default",
+		Long:  "Write a commented config file listing every option with its built-in default to PATH, or to $XDG_CONFIG_HOME/go-backup-docker-image/config.yaml",
+		Args:  cobra.MaximumNArgs(1),
+		Run:   runConfigInit,
+	}
+	configInitCmd.Flags().Bool("force", false, "Overwrite an existing config file")
+
+	configCmd.AddCommand(configInitCmd)
+
+	// Dynamic shell completion for arguments and enumerated flag values
+	backupCmd.ValidArgsFunction = completeImages
+	compareCmd.ValidArgsFunction = func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		if len(args) == 0 {
+			return completeImages(cmd, args, toComplete)
+		}
+		return completeBackups(cmd, args, toComplete)
+	}
+	for _, cmd := range []*cobra.Command{restoreCmd, inspectCmd, verifyCmd, deleteCmd, importCmd} {
+		cmd.ValidArgsFunction = completeBackups
+	}
+	rootCmd.RegisterFlagCompletionFunc("log-level", completeValues("debug", "info", "warn", "error"))
+	rootCmd.RegisterFlagCompletionFunc("log-format", completeValues(logFormatText, "json"))
+	for _, cmd := range []*cobra.Command{backupCmd, exportCmd} {
+		cmd.RegisterFlagCompletionFunc("compress", completeValues(compressionGzip, compressionNone))
+	}
+	for _, cmd := range []*cobra.Command{backupCmd, diffCmd, statsCmd, listCmd} {
+		cmd.RegisterFlagCompletionFunc("output", completeValues("text", "json"))
+	}
+	backupCmd.RegisterFlagCompletionFunc("format", completeValues(formatDocker, formatOCI))
+	backupCmd.RegisterFlagCompletionFunc("on-exist", completeValues(onExistOverwrite, onExistSkip, onExistFail, onExistRename))
+	listCmd.RegisterFlagCompletionFunc("format", completeValues(listFlat, listGrouped))
+	listCmd.RegisterFlagCompletionFunc("sort", completeValues(sortByDate, sortByName, sortBySize))
+	listCmd.RegisterFlagCompletionFunc("sort-by", completeValues(sortByDate, sortByName, sortBySize))
+
+	watchCmd := &cobra.Command{
+		Use:   "watch [IMAGE_NAME...]",
+		Short: "Keep running and back up images as they are built, tagged or pulled",
+		Run: func(cmd *cobra.Command, args []string) {
+			config.Watch = true
+			runBackup(cmd, args)
+		},
+	}
+	commandConfigs[watchCmd] = backupCfg
+	addWatchFlags(watchCmd, backupCmd)
+
+	rootCmd.AddCommand(backupCmd, watchCmd, restoreCmd, listCmd, inspectCmd, compareCmd, diffCmd, migrateCmd, verifyCmd, keygenCmd, catalogCmd, reindexCmd, statsCmd, pruneCmd, deleteCmd, exportCmd, importCmd, configCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		color.New(color.FgRed, color.Bold).Println(err)
@@ -113,14 +742,8 @@ func runBackup(cmd *cobra.Command, args []string) {
 
 	// If stdin flag is used, read image names from stdin
 	if stdInput {
-		scanner := bufio.NewScanner(os.Stdin)
-		for scanner.Scan() {
-			name := strings.TrimSpace(scanner.Text())
-			if name != "" {
-				imageNames = append(imageNames, name)
-			}
-		}
-		if err := scanner.Err(); err != nil {
+		var err error
+		if imageNames, err = readInputList(os.Stdin); err != nil {
 			log.Fatalf("Error reading stdin: %v", err)
 		}
 	} else if fileInput != "" {
@@ -131,121 +754,967 @@ func runBackup(cmd *cobra.Command, args []string) {
 		}
 		defer file.Close()
 
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			name := strings.TrimSpace(scanner.Text())
-			if name != "" {
-				imageNames = append(imageNames, name)
-			}
-		}
-		if err := scanner.Err(); err != nil {
+		if imageNames, err = readInputList(file); err != nil {
 			log.Fatalf("Error reading file: %v", err)
 		}
 	} else {
 		imageNames = args
 	}
 
-	if len(imageNames) == 0 {
-		log.Fatal("No image names provided. Use command arguments, --file, or --stdin")
+	if len(imageNames) == 0 && !config.All && len(config.Filters) == 0 && !config.Watch && len(config.Containers) == 0 {
+		log.Fatal("No image names provided. Use command arguments, --file, --stdin, --all, --filter, --container, or --watch")
+	}
+	if config.Manifest != "" && config.DryRun {
+		log.Fatal("--manifest cannot be combined with --dry-run")
+	}
+	if len(config.Containers) > 0 && (config.Bundle != "" || config.DryRun || config.Watch) {
+		log.Fatal("--container cannot be combined with --bundle, --dry-run or --watch")
+	}
+	if config.Watch && (config.Bundle != "" || config.DryRun || config.TotalTimeout > 0) {
+		log.Fatal("--watch cannot be combined with --bundle, --dry-run or --total-timeout")
+	}
+	if config.WatchDebounce < 0 {
+		log.Fatal("--watch-debounce must not be negative")
+	}
+	if config.Timeout < 0 || config.TotalTimeout < 0 {
+		log.Fatal("--timeout and --total-timeout cannot be negative")
+	}
+	sched, err := parseSchedule()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if sched != nil && (config.Watch || config.DryRun) {
+		log.Fatal("--interval and --cron cannot be combined with --watch or --dry-run")
+	}
+	if config.RunOnce && sched == nil {
+		log.Fatal("--run-once requires --interval or --cron")
+	}
+	imageFilters, err := parseImageFilters(config.Filters)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := validatePatterns("watch-filter", config.WatchFilters); err != nil {
+		log.Fatal(err)
+	}
+	if err := validatePatterns("exclude", config.Excludes); err != nil {
+		log.Fatal(err)
 	}
 
-	// Ensure backup directory exists
-	if err := os.MkdirAll(config.BackupDir, 0755); err != nil {
-		log.Fatalf("Failed to create backup directory: %v", err)
+	tmpl, err := parseNameTemplate(config.NameTemplate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	nameTmpl = tmpl
+	if config.OutputTemplate != "" {
+		if config.Bundle != "" {
+			log.Fatal("--output-template cannot be combined with --bundle")
+		}
+		if outputTmpl, err = parseOutputTemplate(config.OutputTemplate); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := validateOnExist(config.OnExist); err != nil {
+		log.Fatal(err)
+	}
+	if config.Output != "text" && config.Output != "json" {
+		log.Fatalf("Invalid output format %q (expected text or json)", config.Output)
+	}
+	if config.Format != formatDocker && config.Format != formatOCI {
+		log.Fatalf("Invalid backup format %q (expected docker or oci)", config.Format)
+	}
+	if config.AllPlatforms {
+		if cmd.Flags().Changed("format") && config.Format != formatOCI {
+			log.Fatal("--all-platforms writes OCI layout archives and cannot be combined with --format docker")
+		}
+		if config.Bundle != "" {
+			log.Fatal("--all-platforms cannot be combined with --bundle")
+		}
+		config.Format = formatOCI
+	}
+	if config.Platform != "" {
+		platform, err := parsePlatform(config.Platform)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if config.AllPlatforms || config.Bundle != "" || config.NoTarball || config.ToRegistry != "" {
+			log.Fatal("--platform cannot be combined with --all-platforms, --bundle, --no-tarball or --to-registry")
+		}
+		selectedPlatform = &platform
+		config.Platform = platform.String()
+	}
+	if config.CompressThreads < 0 {
+		log.Fatal("--compress-threads must not be negative")
+	}
+	if config.AlwaysPull {
+		config.Pull = true
+	}
+	if config.RemoveAfter && !config.Pull {
+		log.Fatal("--remove-after-backup requires --pull or --always-pull")
+	}
+	if config.RegistryAuth == "" {
+		config.RegistryAuth = os.Getenv(registryAuthEnv)
+	}
+	if config.RegistryAuth != "" && config.Pull {
+		auth, err := parseRegistryAuth(config.RegistryAuth)
+		if err != nil {
+			log.Fatal(err)
+		}
+		pullAuth = auth
+	} else if cmd.Flags().Changed("registry-auth") {
+		log.Fatal("--registry-auth requires --pull or --always-pull")
+	}
+	if config.IOWorkers < 0 {
+		log.Fatal("--io-workers must not be negative")
+	}
+	if config.IOWorkers > 0 && config.IOWorkers < config.MaxWorkers {
+		ioSlots = make(chan struct{}, config.IOWorkers)
+	}
+	if cmd.Flags().Changed("compress-level") {
+		if err := validateCompressLevel(config.CompressType, config.CompressLevel); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(config.Recipients) > 0 {
+		if config.PassphraseFile != "" {
+			log.Fatal("--recipient cannot be combined with --passphrase-file")
+		}
+		config.Encrypt = true
+	}
+	if config.Dedup && (config.Encrypt || config.Format == formatOCI || config.Remote != "") {
+		log.Fatal("--dedup cannot be combined with --encrypt, --format oci, or --remote")
+	}
+	if splitSize, _ := cmd.Flags().GetString("split-size"); splitSize != "" {
+		if config.SplitSize, err = parseSize(splitSize); err != nil {
+			log.Fatalf("Invalid --split-size: %v", err)
+		}
+		if config.Dedup {
+			log.Fatal("--split-size cannot be combined with --dedup")
+		}
+	}
+	if backupLabels, err = parseLabels(config.Labels); err != nil {
+		log.Fatalf("Invalid --label: %v", err)
+	}
+	if minFree, _ := cmd.Flags().GetString("min-free"); minFree != "" {
+		if config.MinFree, err = parseSize(minFree); err != nil {
+			log.Fatalf("Invalid --min-free: %v", err)
+		}
+	}
+	if config.CompressionRatio <= 0 || config.CompressionRatio > 1 {
+		log.Fatal("--compression-ratio must be greater than 0 and at most 1")
+	}
+	if rateLimit, _ := cmd.Flags().GetString("rate-limit"); rateLimit != "" {
+		if config.RateLimit, err = parseRate(rateLimit); err != nil {
+			log.Fatalf("Invalid --rate-limit: %v", err)
+		}
+		setRateLimit(config.RateLimit)
+	} else if config.PerWorkerLimit {
+		log.Fatal("--rate-limit-per-worker requires --rate-limit")
+	}
+	if err := validateDockerHost("from-host"); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseNotifyFlags(); err != nil {
+		log.Fatal(err)
 	}
 
 	// Initialize Docker client
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	cli, err := newDockerClient("")
 	if err != nil {
 		log.Fatalf("Failed to create Docker client: %v", err)
 	}
 	defer cli.Close()
+	logger.Debug("Using Docker daemon at "+daemonAddress(cli), "host", daemonAddress(cli))
 
-	var wg sync.WaitGroup
-	semaphore := make(chan struct{}, config.MaxWorkers)
-	ctx := context.Background()
+	ctx, stop := shutdownContext(config.ForceKill)
+	defer stop()
 
-	for _, imageName := range imageNames {
-		wg.Add(1)
-		semaphore <- struct{}{}
-		go func(img string) {
-			defer wg.Done()
-			defer func() { <-semaphore }()
+	if err := pingDaemon(cli, ctx); err != nil {
+		log.Fatal(err)
+	}
+	// Telling image IDs from hex-only repository names needs the daemon
+	if imageNames, err = normalizeImageNames(cli, ctx, imageNames); err != nil {
+		log.Fatal(err)
+	}
+	if config.Stdout {
+		if err := validateStdoutBackup(cmd, imageNames); err != nil {
+			log.Fatal(err)
+		}
+	} else if config.MetadataFile != "" {
+		log.Fatal("--metadata-file requires --stdout")
+	}
 
-			backupImage(cli, ctx, img)
-		}(imageName)
+	if config.Encrypt && !config.DryRun {
+		if encryptionScheme() == encSchemeAge {
+			_, err = loadRecipients()
+		} else {
+			_, err = loadPassphrase(false)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	wg.Wait()
-	fmt.Println("All backup operations completed")
+	if config.RemoteOnly && config.Remote == "" {
+		log.Fatal("--remote-only requires --remote")
+	}
+	if config.KeepLast < 0 {
+		log.Fatal("--keep-last must not be negative")
+	}
+	if config.Since < 0 {
+		log.Fatal("--since must not be negative")
+	}
+	if config.Since > 0 && config.Force {
+		log.Fatal("--since cannot be combined with --force")
+	}
+	if config.Deduplicate && (config.Force || config.NoTarball || isRemotePath(config.BackupDir)) {
+		log.Fatal("--deduplicate cannot be combined with --force, --no-tarball or a remote --dir")
+	}
+	if config.KeepLast > 0 && config.NoTarball {
+		log.Fatal("--keep-last cannot be combined with --no-tarball")
+	}
+	if config.Sign {
+		if config.NoTarball {
+			log.Fatal("--sign cannot be combined with --no-tarball")
+		}
+		if signingKey, err = readSigningKey(config.SigningKey); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if config.ToRegistry != "" {
+		if err := validateRegistryPrefix("to-registry", config.ToRegistry); err != nil {
+			log.Fatal(err)
+		}
+		if config.Bundle != "" {
+			log.Fatal("--to-registry cannot be combined with --bundle")
+		}
+	}
+	if config.NoTarball {
+		if config.ToRegistry == "" {
+			log.Fatal("--no-tarball requires --to-registry")
+		}
+		if config.Encrypt || config.Dedup || config.Remote != "" || config.SplitSize > 0 || config.Format == formatOCI {
+			log.Fatal("--no-tarball cannot be combined with --encrypt, --dedup, --remote, --split-size, or --format oci")
+		}
+	}
+	if config.Volumes && (config.Bundle != "" || config.DryRun || config.NoTarball || config.Encrypt || config.Remote != "" || isRemotePath(config.BackupDir)) {
+		log.Fatal("--volumes cannot be combined with --bundle, --dry-run, --no-tarball, --encrypt, --remote or a remote --dir")
+	}
+	// A remote --dir receives the backup stream directly, with no local copy
+	remoteDir := isRemotePath(config.BackupDir)
+	if remoteDir {
+		if config.Dedup || config.SplitSize > 0 || config.Format == formatOCI || config.Remote != "" {
+			log.Fatal("a remote --dir cannot be combined with --dedup, --split-size, --format oci, or --remote")
+		}
+		if !config.DryRun && !config.NoTarball {
+			if _, err := remoteDirBackend(config.BackupDir); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+	if config.Remote != "" && !config.DryRun {
+		remoteBackend, err = newStorageBackend(ctx, config.Remote)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if config.DryRun {
+		ctx, cancel := withTotalTimeout(ctx)
+		defer cancel()
+		names, err := resolveBackupImages(cli, ctx, imageNames, imageFilters)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !runDryRun(cli, ctx, names) {
+			cli.Close()
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Ensure backup directory exists
+	if !config.NoTarball && !config.Stdout && !remoteDir {
+		if err := os.MkdirAll(config.BackupDir, 0755); err != nil {
+			log.Fatalf("Failed to create backup directory: %v", err)
+		}
+	}
+
+	if sched != nil {
+		failed := runScheduled(sched, config.RunOnce, func() ([]Result, bool) {
+			ctx, cancel := withTotalTimeout(ctx)
+			defer cancel()
+			results, failed, err := backupOnce(cli, ctx, imageNames, imageFilters)
+			if err != nil {
+				logger.Error(fmt.Sprintf("Backup run %s failed: %v", runID, err), "error", err)
+				return results, true
+			}
+			return results, failed
+		})
+		if failed {
+			cli.Close()
+			os.Exit(1)
+		}
+		return
+	}
+
+	ctx, cancel := withTotalTimeout(ctx)
+	defer cancel()
+	results, failed, err := backupOnce(cli, ctx, imageNames, imageFilters)
+	if err != nil {
+		log.Fatal(err)
+	}
+	exitIfInterrupted(results, "images not backed up")
+	if failed {
+		cli.Close()
+		os.Exit(1)
+	}
+}
+
+// resolveBackupImages adds the images found by --all and --filter to the
+// images named on the command line, then drops excluded images and names of
+// the same image
+func resolveBackupImages(cli DockerClient, ctx context.Context, imageNames []string, imageFilters filters.Args) ([]string, error) {
+	imageNames = slices.Clone(imageNames)
+	if config.All || len(config.Filters) > 0 {
+		explicit := len(imageNames)
+		matched, err := listImages(cli, ctx, imageFilters)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list images: %w", err)
+		}
+		if len(matched) == 0 && len(config.Filters) > 0 && explicit == 0 {
+			return nil, fmt.Errorf("--filter %s matched no images", strings.Join(config.Filters, " --filter "))
+		}
+		for _, name := range matched {
+			if !slices.Contains(imageNames[:explicit], name) {
+				enumeratedImages[name] = true
+			}
+		}
+		imageNames = appendUnique(imageNames, matched...)
+	}
+
+	imageNames = dedupeImages(cli, ctx, excludeImages(imageNames))
+	if len(imageNames) == 0 && !config.Watch && len(config.Containers) == 0 {
+		return nil, errors.New("no images to back up")
+	}
+	if config.All || len(config.Filters) > 0 || len(config.Excludes) > 0 {
+		logger.Debug(fmt.Sprintf("Resolved %d images to back up: %s", len(imageNames), strings.Join(imageNames, ", ")),
+			"images", imageNames)
+	}
+	return imageNames, nil
+}
+
+// backupOnce backs up the configured images once and prints, reports and
+// notifies the outcome. It returns the results and whether any failed, or an
+// error when the run could not start.
+func backupOnce(cli DockerClient, ctx context.Context, imageNames []string, imageFilters filters.Args) ([]Result, bool, error) {
+	remoteDir := isRemotePath(config.BackupDir)
+	// Each scheduled run starts from the images and backups there are now
+	clear(enumeratedImages)
+	resetClaimedNames()
+	imageNames, err := resolveBackupImages(cli, ctx, imageNames, imageFilters)
+	if err != nil {
+		return nil, false, err
+	}
+
+	started := time.Now()
+	backupCatalog = startCatalogUpdater(config.BackupDir)
+	// --stdout leaves the backup directory alone
+	local := !config.NoTarball && !config.Stdout
+	if !config.Force && local && !remoteDir {
+		lastBackups = loadBackupIndex(config.BackupDir)
+	}
+	if local && !remoteDir {
+		if err := checkDiskSpace(cli, ctx, imageNames); err != nil {
+			backupCatalog.Close()
+			return nil, false, err
+		}
+	}
+	if local {
+		dirIndexUpdates = startDirIndexUpdater(config.BackupDir)
+	}
+
+	var results []Result
+	if config.Bundle != "" {
+		results = runJobs(ctx, []string{config.Bundle}, func(ctx context.Context, bundle string) error {
+			return backupBundle(cli, ctx, bundle, imageNames)
+		})
+	} else if len(imageNames) > 0 {
+		results = runJobs(ctx, imageNames, func(ctx context.Context, img string) error {
+			return backupImage(cli, ctx, img)
+		})
+	}
+	if len(config.Containers) > 0 {
+		results = append(results, runJobs(ctx, appendUnique(nil, config.Containers...), func(ctx context.Context, name string) error {
+			return backupContainer(cli, ctx, name)
+		})...)
+	}
+
+	if config.Watch && draining.Err() == nil {
+		results = append(results, watchImages(cli, draining)...)
+	}
+	removePendingBackups()
+
+	backupCatalog.Close()
+	dirIndexUpdates.Close()
+	closeRemoteBackends()
+
+	logger.Info("All backup operations completed")
+	failed := printSummary("Backup", results)
+	report := newRunReport("backup", results, started)
+	finishReport(report)
+	if config.Manifest != "" {
+		if err := writeManifest(config.Manifest, results); err != nil {
+			logger.Error(fmt.Sprintf("Failed to write manifest %s: %v", config.Manifest, err), "path", config.Manifest, "error", err)
+			failed = true
+		}
+	}
+
+	notifyRun(report)
+	return results, failed, nil
 }
 
 // backupImage creates a tarball backup of a single Docker image
-func backupImage(cli *client.Client, ctx context.Context, imageName string) {
-	if config.Verbose {
-		fmt.Printf("Starting backup of image: %s\n", imageName)
+func backupImage(cli DockerClient, ctx context.Context, imageName string) error {
+	logger.Debug("Starting backup of image: "+imageName, "image", imageName)
+	started := time.Now()
+
+	unlock := lockImages([]string{imageName})
+	defer unlock()
+
+	img, err := inspectImage(cli, ctx, imageName)
+	if disappeared(imageName, err) {
+		logger.Warn(fmt.Sprintf("%s was removed after it was listed, skipped", imageName), "image", imageName)
+		return fmt.Errorf("%w: %v", errDisappeared, err)
+	}
+	if err != nil {
+		return fmt.Errorf("error inspecting image: %w", err)
+	}
+	defer removePulledImage(cli, ctx, imageName)
+
+	// An image named by ID or digest is backed up under its canonical name,
+	// while imageName still identifies this job
+	name := canonicalName(imageName, img.RepoTags, img.ID)
+	if name != imageName {
+		logger.Debug(fmt.Sprintf("Backing up %s as %s", imageName, name), "image", imageName, "name", name)
+	}
+	if config.Stdout {
+		return backupToStdout(cli, ctx, imageName, name, img)
 	}
 
-	img, _, err := cli.ImageInspectWithRaw(ctx, imageName)
+	if existing, ok := lastBackups.unchanged(name, img.ID); ok {
+		if config.Since > 0 {
+			logger.Info(fmt.Sprintf("Skipping %s — backed up %s", imageName, formatAge(existing.date)), "image", imageName, "backup", existing.tarball, outcomeKey, "skipped")
+		} else {
+			logger.Info(fmt.Sprintf("%s is unchanged since %s, skipped", imageName, existing.tarball), "image", imageName, "backup", existing.tarball, outcomeKey, "skipped")
+		}
+		return errUnchanged
+	}
+	if config.Deduplicate {
+		if existing, ok := lastBackups.identical(img.ID); ok {
+			logger.Info(fmt.Sprintf("Deduplication: skipping %s, identical backup at %s", imageName, existing.tarball), "image", imageName, "backup", existing.tarball, outcomeKey, "skipped")
+			return errIdentical
+		}
+	}
+
+	if config.NoTarball {
+		return mirrorBackup(cli, ctx, name, time.Now())
+	}
+
+	// The image inspect describes one platform; with --platform the metadata
+	// records the one that is saved
+	inspected := Platform{OS: img.Os, Architecture: img.Architecture, Variant: img.Variant}
+	platform, size := inspected, img.Size
+	if selectedPlatform != nil {
+		saved, savedSize, err := localPlatform(cli, ctx, imageName, img)
+		if err != nil {
+			return err
+		}
+		if saved != inspected {
+			logger.Debug(fmt.Sprintf("Saving %s of %s, inspected as %s", saved, imageName, inspected), "image", imageName, "platform", saved.String())
+		}
+		platform = saved
+		if savedSize > 0 {
+			size = savedSize
+		}
+	}
+
+	var index v1.ImageIndex
+	var platforms []string
+	if config.AllPlatforms {
+		err = withRetry(ctx, "fetch manifest list of "+imageName, func() (err error) {
+			index, platforms, err = fetchImageIndex(ctx, imageName, img.RepoDigests)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if index == nil {
+			logger.Warn(fmt.Sprintf("%s has no multi-platform manifest list in a registry, saving only %s/%s", imageName, img.Os, img.Architecture),
+				"image", imageName)
+		} else {
+			logger.Info(fmt.Sprintf("Saving %d platforms of %s: %s", len(platforms), imageName, strings.Join(platforms, ", ")), "image", imageName, "platforms", platforms)
+		}
+	}
+
+	baseName, err := backupBaseName(name, img.ID, time.Now())
 	if err != nil {
-		log.Printf("Error inspecting image %s: %v", imageName, err)
-		return
+		return fmt.Errorf("failed to build backup name: %w", err)
+	}
+	tarballName, err := resolveTarballName(tarballPath(baseName), imageName)
+	if errors.Is(err, errExists) {
+		logger.Info(fmt.Sprintf("%s already exists, skipped %s", tarballName, imageName), "image", imageName, "path", tarballName, outcomeKey, "skipped")
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	// A backup that fails before it is signed gives its name back
+	kept := false
+	defer func() {
+		if !kept {
+			releaseTarballName(tarballName)
+		}
+	}()
+	// With --io-workers, only that many workers write at once
+	release, err := acquireIO(ctx)
+	if err != nil {
+		return err
+	}
+	printSaving(imageName, tarballName)
+	setPending(tarballName, true)
+
+	var encryption EncryptionParams
+	err = withRetry(ctx, "save "+imageName, func() (err error) {
+		if index != nil {
+			encryption, err = saveIndex(ctx, imageName, index, partialName(tarballName))
+		} else {
+			encryption, err = saveImage(cli, ctx, []string{imageName}, partialName(tarballName))
+		}
+		return err
+	})
+	if err != nil {
+		release()
+		removeBackup(tarballName)
+		if disappeared(imageName, err) {
+			logger.Warn(fmt.Sprintf("%s was removed while it was being saved, skipped", imageName), "image", imageName)
+			return fmt.Errorf("%w: %v", errDisappeared, err)
+		}
+		return saveError("image", err)
+	}
+
+	var volumes, volumeArchives []string
+	if config.Volumes {
+		volumes, volumeArchives, err = backupVolumes(cli, ctx, imageName, img.ID)
+	}
+	release()
+	if err != nil {
+		removeBackup(tarballName)
+		return err
 	}
 
-	safeImageName := strings.ReplaceAll(imageName, "/", "_")
-	safeImageName = strings.ReplaceAll(safeImageName, ":", "_")
-	timestamp := time.Now().Format("20060102-150405")
-	tarballName := filepath.Join(config.BackupDir, fmt.Sprintf("%s-%s.tar", safeImageName, timestamp))
+	imageInfo := newImageInfo(imageName, name, img, platform, inspected, size, encryption)
+	imageInfo.Platforms = platforms
+	imageInfo.Volumes = volumes
+	if config.SplitSize > 0 {
+		imageInfo.Parts = listSavedParts(tarballName)
+	}
 
-	if config.CompressType == "gzip" {
-		tarballName += ".gz"
+	if err := writeImageInfo(tarballName+".json", imageInfo); err != nil {
+		removeBackup(tarballName)
+		removeVolumeArchives(volumeArchives)
+		return err
+	}
+	if err := commitBackup(tarballName); err != nil {
+		removeBackup(tarballName)
+		removeVolumeArchives(volumeArchives)
+		return err
 	}
+	setPending(tarballName, false)
+	if config.Sign {
+		if err := signBackup(tarballName); err != nil {
+			removeBackup(tarballName)
+			removeVolumeArchives(volumeArchives)
+			return err
+		}
+	}
+	kept = true
+	recordBackupOutput(imageName, tarballName)
 
-	var cmd *exec.Cmd
+	if err := uploadBackup(ctx, tarballName); err != nil {
+		return err
+	}
+	if !config.RemoteOnly {
+		backupCatalog.add(tarballName, imageInfo)
+		dirIndexUpdates.add(tarballName, imageInfo)
+		lastBackups.record(name, indexedBackup{imageID: img.ID, platform: imageInfo.Platform, tarball: tarballName, date: imageInfo.BackupDate})
+	}
 
-	if config.CompressType == "gzip" {
-		fmt.Printf("Saving image %s to %s (gzip compressed)...\n", imageName, tarballName)
-		cmd = exec.Command("sh", "-c", fmt.Sprintf("docker save %s | gzip > %s", imageName, tarballName))
+	logSuccess(fmt.Sprintf("Successfully backed up image %s to %s", imageName, tarballName), "image", imageName, "path", tarballName,
+		"duration", time.Since(started).Round(time.Millisecond))
+
+	// The new backup is kept, so a failed rotation does not fail the backup
+	if err := rotateBackups(ctx, name); err != nil {
+		logger.Warn(fmt.Sprintf("Failed to rotate backups of %s: %v", imageName, err), "image", imageName, "error", err)
+	}
+
+	if config.ToRegistry != "" {
+		return mirrorBackup(cli, ctx, name, imageInfo.BackupDate)
+	}
+	return nil
+}
+
+// newImageInfo returns the metadata of a backup of img saved under name.
+// platform is the platform that was saved, and inspected the one img
+// describes.
+func newImageInfo(imageName, name string, img image.InspectResponse, platform, inspected Platform, size int64, encryption EncryptionParams) ImageInfo {
+	imageInfo := ImageInfo{
+		SchemaVersion: imageInfoSchemaVersion,
+		ImageName:     name,
+		ImageID:       img.ID,
+		Tags:          img.RepoTags,
+		Size:          size,
+		BackupDate:    time.Now(),
+		CompressType:  metadataCompressType(),
+		CompressLevel: compressLevel(),
+		Format:        config.Format,
+		Encrypted:     config.Encrypt,
+		Architecture:  platform.Architecture,
+		Os:            platform.OS,
+		Variant:       platform.Variant,
+		Created:       parseCreated(img.Created),
+		LayerCount:    len(img.RootFS.Layers),
+		RepoDigests:   img.RepoDigests,
+		BackupLabels:  backupLabels,
+		Layers:        img.RootFS.Layers,
+		Container:     committedContainer(imageName),
+
+		EncryptionSalt:       encryption.Salt,
+		EncryptionNonce:      encryption.Nonce,
+		EncryptionScheme:     encryptionScheme(),
+		EncryptionRecipients: encryption.Recipients,
+	}
+	if img.Config != nil {
+		imageInfo.Labels = img.Config.Labels
+		imageInfo.Entrypoint = img.Config.Entrypoint
+		imageInfo.Cmd = img.Config.Cmd
+	}
+	if selectedPlatform != nil {
+		imageInfo.Platform = selectedPlatform.String()
+		// The inspect described another platform, whose layers and command
+		// are not those of the saved image
+		if platform != inspected {
+			imageInfo.Created = time.Time{}
+			imageInfo.LayerCount = 0
+			imageInfo.Layers = nil
+			imageInfo.Entrypoint = nil
+			imageInfo.Cmd = nil
+		}
+	}
+	return imageInfo
+}
+
+// parseCreated converts the daemon's RFC 3339 creation timestamp, returning
+// the zero time when it is missing or malformed
+func parseCreated(created string) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, created)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// pendingBackups holds the backups of this run whose metadata has not been
+// written yet, so an interrupted run can remove what its workers left behind
+var (
+	pendingBackups   = map[string]bool{}
+	pendingBackupsMu sync.Mutex
+)
+
+// setPending marks a backup as being written, or as complete or removed
+func setPending(tarballName string, pending bool) {
+	pendingBackupsMu.Lock()
+	defer pendingBackupsMu.Unlock()
+	if pending {
+		pendingBackups[tarballName] = true
 	} else {
-		fmt.Printf("Saving image %s to %s...\n", imageName, tarballName)
-		cmd = exec.Command("docker", "save", "-o", tarballName, imageName)
+		delete(pendingBackups, tarballName)
 	}
+}
 
-	if config.Verbose {
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
+// removePendingBackups deletes the backups that were started but never got
+// their metadata. Workers clean up after themselves when they fail, so this
+// only finds anything when a worker was stopped before it could.
+func removePendingBackups() {
+	pendingBackupsMu.Lock()
+	names := make([]string, 0, len(pendingBackups))
+	for name := range pendingBackups {
+		names = append(names, name)
 	}
+	pendingBackupsMu.Unlock()
 
-	if err := cmd.Run(); err != nil {
-		log.Printf("Failed to save image %s: %v", imageName, err)
+	for _, name := range names {
+		logger.Warn("Removing incomplete backup "+name, "path", name)
+		removeBackup(name)
+	}
+}
+
+// removeBackup deletes a partially written tarball and its metadata sidecar
+func removeBackup(tarballName string) {
+	setPending(tarballName, false)
+	if isRemotePath(tarballName) {
+		removeRemoteBackup(tarballName)
 		return
 	}
 
-	imageInfo := ImageInfo{
-		ImageName:    imageName,
-		ImageID:      img.ID,
-		Tags:         img.RepoTags,
-		Size:         img.Size,
-		BackupDate:   time.Now(),
-		CompressType: config.CompressType,
+	partial := partialName(tarballName)
+	paths := append(findParts(tarballName), findParts(partial)...)
+	paths = append(paths, tarballName, partial, tarballName+".json", tarballName+signatureExtension)
+	for _, path := range paths {
+		if err := os.Remove(path); err == nil {
+			logger.Debug("Removed partial file "+path, "path", path)
+		}
+	}
+}
+
+// tarballPath returns the backup path for baseName with the extension for the
+// configured compression and encryption, unless baseName already ends with it
+func tarballPath(baseName string) string {
+	ext := backupExtension()
+	if !strings.HasSuffix(baseName, ext) {
+		baseName += ext
+	}
+	if isRemotePath(config.BackupDir) {
+		return strings.TrimSuffix(config.BackupDir, "/") + "/" + filepath.ToSlash(baseName)
+	}
+	return filepath.Join(config.BackupDir, baseName)
+}
+
+// backupExtension returns the file extension for the configured format,
+// compression and encryption
+func backupExtension() string {
+	if config.Dedup {
+		return dedupExtension
+	}
+
+	ext := ".tar"
+	if config.CompressType == "gzip" {
+		ext += ".gz"
+	}
+	if config.Encrypt {
+		ext += encExtension
+	}
+	return ext
+}
+
+func printSaving(what, tarballName string) {
+	msg := fmt.Sprintf("Saving %s to %s...", what, tarballName)
+	switch {
+	case config.Dedup:
+		msg = fmt.Sprintf("Saving %s to %s (deduplicated)...", what, tarballName)
+	case config.Encrypt:
+		msg = fmt.Sprintf("Saving %s to %s (encrypted)...", what, tarballName)
+	case config.CompressType == "gzip":
+		msg = fmt.Sprintf("Saving %s to %s (gzip compressed)...", what, tarballName)
+	}
+	logger.Info(msg, "image", what, "path", tarballName)
+}
+
+// writeImageInfo writes the .json metadata sidecar for a backup
+func writeImageInfo(metadataPath string, imageInfo ImageInfo) error {
+	if isRemotePath(metadataPath) {
+		data, err := json.MarshalIndent(imageInfo, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to write metadata: %w", err)
+		}
+		// The sidecar is small; finish it even if the run is being cancelled
+		if err := putRemoteFile(context.Background(), metadataPath, append(data, '\n')); err != nil {
+			return fmt.Errorf("failed to upload metadata: %w", err)
+		}
+		return nil
 	}
 
-	metadataPath := tarballName + ".json"
 	metadataFile, err := os.Create(metadataPath)
 	if err != nil {
-		log.Printf("Failed to create metadata file for %s: %v", imageName, err)
-		return
+		return fmt.Errorf("failed to create metadata file: %w", err)
 	}
 	defer metadataFile.Close()
 
 	encoder := json.NewEncoder(metadataFile)
 	encoder.SetIndent("", "  ")
 	if err := encoder.Encode(imageInfo); err != nil {
-		log.Printf("Failed to write metadata for %s: %v", imageName, err)
+		return fmt.Errorf("failed to write metadata: %w", err)
+	}
+	return nil
+}
+
+// saveImage writes the `docker save` archive of one or more images to tarballName
+func saveImage(cli DockerClient, ctx context.Context, imageNames []string, tarballName string) (EncryptionParams, error) {
+	if isRemotePath(tarballName) {
+		return saveStream(cli, ctx, imageNames, tarballName)
+	}
+
+	// Name templates may place backups in subdirectories
+	if err := os.MkdirAll(filepath.Dir(tarballName), 0755); err != nil {
+		return EncryptionParams{}, err
+	}
+
+	if config.Dedup {
+		return saveDedup(cli, ctx, imageNames, tarballName)
+	}
+	if config.Format == formatOCI {
+		return saveOCI(cli, ctx, imageNames, tarballName)
+	}
+	return saveStream(cli, ctx, imageNames, tarballName)
+}
+
+// imageSave opens the daemon's save archive of imageNames, restricted to the
+// selected --platform when there is one
+func imageSave(cli DockerClient, ctx context.Context, imageNames []string) (io.ReadCloser, error) {
+	var opts []client.ImageSaveOption
+	if selectedPlatform != nil {
+		opts = append(opts, client.ImageSaveWithPlatforms(selectedPlatform.oci()))
+	}
+	return cli.ImageSave(ctx, imageNames, opts...)
+}
+
+// saveStream copies the save archive through the configured compression and
+// encryption into tarballName, or into numbered parts with --split-size. The
+// output is only closed cleanly once the whole archive was read, so a failure
+// on either side leaves a partial file for the caller to remove rather than a
+// silently truncated backup.
+func saveStream(cli DockerClient, ctx context.Context, imageNames []string, tarballName string) (params EncryptionParams, err error) {
+	output, err := createOutput(ctx, tarballName)
+	if err != nil {
+		return EncryptionParams{}, err
+	}
+	defer func() {
+		// Remote uploads are cancelled rather than completed with partial data
+		if aborter, ok := output.(interface{ Abort(error) }); ok && err != nil {
+			aborter.Abort(err)
+		}
+		output.Close()
+	}()
+
+	out, params, err := newBackupWriter(throttle(ctx, output))
+	if err != nil {
+		return params, err
+	}
+
+	body, err := imageSave(cli, ctx, imageNames)
+	if err != nil {
+		return params, err
+	}
+	defer body.Close()
+	started := time.Now()
+	n, err := io.Copy(out, &contextReader{ctx: ctx, r: body})
+	if err != nil {
+		return params, err
+	}
+
+	if err := out.Close(); err != nil {
+		return params, err
+	}
+	logSaveThroughput(imageNames, n, time.Since(started))
+	return params, output.Close()
+}
+
+// logSaveThroughput reports with --verbose how fast an image was saved and
+// compressed, to compare compression settings
+func logSaveThroughput(imageNames []string, n int64, elapsed time.Duration) {
+	if !debugEnabled() || elapsed <= 0 {
 		return
 	}
+	name := strings.Join(imageNames, ", ")
+	rate := float64(n) / (1024 * 1024) / elapsed.Seconds()
+	msg := fmt.Sprintf("Saved %s of %s in %s (%.1f MB/s", formatBytes(n), name, elapsed.Round(time.Millisecond), rate)
+	if config.CompressType == compressionGzip {
+		msg += fmt.Sprintf(", gzip level %d with %d threads", compressLevel(), compressThreads())
+	}
+	logger.Debug(msg+")", "image", name, "bytes", n, "seconds", elapsed.Seconds(), "mb_per_second", rate)
+}
+
+// newBackupWriter layers the configured gzip compression and encryption over
+// w. Closing the returned writer flushes both layers but leaves w open.
+func newBackupWriter(w io.Writer) (io.WriteCloser, EncryptionParams, error) {
+	var params EncryptionParams
+	var closers multiCloser
+	var out io.Writer = w
 
-	color.New(color.FgGreen, color.Bold).Printf("Successfully backed up image %s to %s\n", imageName, tarballName)
+	switch encryptionScheme() {
+	case encSchemeAge:
+		ageWriter, err := newAgeEncryptWriter(w)
+		if err != nil {
+			return nil, params, err
+		}
+		params.Recipients = recipientKeys()
+		out = ageWriter
+		closers = append(closers, ageWriter)
+	case encSchemePassphrase:
+		key, err := loadPassphrase(false)
+		if err != nil {
+			return nil, params, err
+		}
+		encWriter, encParams, err := newEncryptWriter(w, key)
+		if err != nil {
+			return nil, params, err
+		}
+		params = encParams
+		out = encWriter
+		closers = append(closers, encWriter)
+	}
+	if config.CompressType == compressionGzip {
+		gzWriter, err := newGzipWriter(out)
+		if err != nil {
+			return nil, params, err
+		}
+		out = gzWriter
+		// gzip must be flushed before the encryption trailer is written
+		closers = append(multiCloser{gzWriter}, closers...)
+	}
+
+	return struct {
+		io.Writer
+		io.Closer
+	}{out, closers}, params, nil
+}
+
+// loadPassphrase reads the passphrase once per run and caches it for all workers
+func loadPassphrase(prompt bool) ([]byte, error) {
+	passphraseOnce.Do(func() {
+		passphrase, passphraseErr = readPassphrase(config.PassphraseFile, prompt)
+	})
+	return passphrase, passphraseErr
+}
+
+// loadImageInfo reads the .json metadata sidecar that accompanies a tarball
+func loadImageInfo(metadataPath string) (ImageInfo, error) {
+	var metadataFile io.ReadCloser
+	var err error
+	if metadataPath == stdinPath+".json" {
+		// A backup on stdin has no sidecar
+		return ImageInfo{}, fs.ErrNotExist
+	}
+	if isRemotePath(metadataPath) {
+		metadataFile, err = openRemoteFile(metadataPath)
+	} else {
+		metadataFile, err = os.Open(metadataPath)
+	}
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	defer metadataFile.Close()
+	return decodeImageInfo(metadataFile)
+}
+
+// decodeImageInfo reads a metadata sidecar of any schema version
+func decodeImageInfo(r io.Reader) (ImageInfo, error) {
+	var imageInfo ImageInfo
+	err := json.NewDecoder(r).Decode(&imageInfo)
+	if err == nil && imageInfo.SchemaVersion == 0 {
+		imageInfo.SchemaVersion = 1
+	}
+	return imageInfo, err
 }
 
 func runRestore(cmd *cobra.Command, args []string) {
@@ -255,14 +1724,8 @@ func runRestore(cmd *cobra.Command, args []string) {
 	stdInput, _ := cmd.Flags().GetBool("stdin")
 
 	if stdInput {
-		scanner := bufio.NewScanner(os.Stdin)
-		for scanner.Scan() {
-			path := strings.TrimSpace(scanner.Text())
-			if path != "" {
-				tarballPaths = append(tarballPaths, path)
-			}
-		}
-		if err := scanner.Err(); err != nil {
+		var err error
+		if tarballPaths, err = readInputList(os.Stdin); err != nil {
 			log.Fatalf("Error reading stdin: %v", err)
 		}
 	} else if fileInput != "" {
@@ -272,14 +1735,7 @@ func runRestore(cmd *cobra.Command, args []string) {
 		}
 		defer file.Close()
 
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			path := strings.TrimSpace(scanner.Text())
-			if path != "" {
-				tarballPaths = append(tarballPaths, path)
-			}
-		}
-		if err := scanner.Err(); err != nil {
+		if tarballPaths, err = readInputList(file); err != nil {
 			log.Fatalf("Error reading file: %v", err)
 		}
 	} else {
@@ -289,139 +1745,511 @@ func runRestore(cmd *cobra.Command, args []string) {
 	if len(tarballPaths) == 0 {
 		log.Fatal("No tarball paths provided. Use command arguments, --file, or --stdin")
 	}
+	tarballPaths = appendUnique(nil, tarballPaths...)
+
+	if slices.Contains(tarballPaths, stdinPath) {
+		switch {
+		case len(tarballPaths) > 1 || stdInput:
+			log.Fatal("A backup on stdin (-) must be the only one restored")
+		case len(config.Only) > 0:
+			log.Fatal("--only cannot be used with a backup on stdin (-), which can only be read once")
+		}
+	}
+	if config.Checksum != "" {
+		if len(tarballPaths) > 1 {
+			log.Fatal("--checksum can only be used when restoring a single backup")
+		}
+		digest, err := parseChecksum(config.Checksum)
+		if err != nil {
+			log.Fatal(err)
+		}
+		restoreChecksum = digest
+	}
+	if config.UntagOriginal && config.Retag == "" {
+		log.Fatal("--untag-original requires --retag")
+	}
+	if config.RenamePolicy != "" {
+		if config.Retag != "" {
+			log.Fatal("--rename-policy cannot be combined with --retag")
+		}
+		rules, err := loadRenamePolicy(config.RenamePolicy)
+		if err != nil {
+			log.Fatal(err)
+		}
+		renamePolicy = rules
+	} else if config.RemoveSourceTag {
+		log.Fatal("--remove-source-tag requires --rename-policy")
+	}
+	if config.Timeout < 0 || config.TotalTimeout < 0 {
+		log.Fatal("--timeout and --total-timeout cannot be negative")
+	}
+	if config.Push {
+		if config.PushPrefix == "" {
+			log.Fatal("--push requires --push-prefix")
+		}
+		if err := validateRegistryPrefix("push-prefix", config.PushPrefix); err != nil {
+			log.Fatal(err)
+		}
+	} else if config.PushPrefix != "" || config.RemoveAfterPush {
+		log.Fatal("--push-prefix and --remove-after-push require --push")
+	}
+	if config.RequireSignature && config.PublicKey == "" {
+		log.Fatal("--require-signature requires --public-key")
+	}
+	if err := validateRestoreExisting(); err != nil {
+		log.Fatal(err)
+	}
+	if err := validateDockerHost("to-host"); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseNotifyFlags(); err != nil {
+		log.Fatal(err)
+	}
+	if config.PublicKey != "" {
+		key, err := readPublicKey(config.PublicKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		verifyKey = key
+	}
+	if config.Retag != "" {
+		tmpl, err := parseRetag(config.Retag, len(tarballPaths))
+		if err != nil {
+			log.Fatal(err)
+		}
+		retagTmpl = tmpl
+	}
 
-	var wg sync.WaitGroup
-	semaphore := make(chan struct{}, config.MaxWorkers)
+	cli, err := newDockerClient(config.TargetContext)
+	if err != nil {
+		log.Fatalf("Failed to create Docker client: %v", err)
+	}
+	defer cli.Close()
+	logger.Debug("Using Docker daemon at "+daemonAddress(cli), "host", daemonAddress(cli))
 
-	for _, tarballPath := range tarballPaths {
-		wg.Add(1)
-		semaphore <- struct{}{}
-		go func(path string) {
-			defer wg.Done()
-			defer func() { <-semaphore }()
+	ctx, stop := shutdownContext(config.ForceKill)
+	defer stop()
+	ctx, cancel := withTotalTimeout(ctx)
+	defer cancel()
+	defer closeRemoteBackends()
 
-			restoreImage(path)
-		}(tarballPath)
+	if err := pingDaemon(cli, ctx); err != nil {
+		log.Fatal(err)
 	}
 
-	wg.Wait()
-	color.New(color.FgGreen, color.Bold).Println("All restore operations completed")
+	// Loading the same image from several backups at once races in the daemon,
+	// so backups whose images all come from another backup are skipped
+	duplicates := findDuplicateRestores(tarballPaths)
+	printDuplicateRestores(tarballPaths, duplicates)
+
+	started := time.Now()
+	results := runJobs(ctx, tarballPaths, func(ctx context.Context, path string) error {
+		if dup, ok := duplicates[path]; ok {
+			return fmt.Errorf("%w (%s)", errDuplicate, dup.winner)
+		}
+		return restoreImage(cli, ctx, path)
+	})
+
+	logger.Info("All restore operations completed")
+	failed := printSummary("Restore", results)
+	report := newRunReport("restore", results, started)
+	if config.Push {
+		report.Pushes = takePushes()
+		printPushSummary(report.Pushes)
+	}
+	finishReport(report)
+	notifyRun(report)
+	exitIfInterrupted(results, "images not restored")
+	if failed {
+		os.Exit(1)
+	}
 }
 
-func restoreImage(tarballPath string) {
-	if config.Verbose {
-		color.New(color.FgBlue, color.Bold).Printf("Starting restore of image from: %s\n", tarballPath)
+func restoreImage(cli DockerClient, ctx context.Context, tarballPath string) error {
+	logger.Debug("Starting restore of image from: "+tarballPath, "path", tarballPath)
+	started := time.Now()
+
+	// Backups that share images with another restore in flight wait for it
+	unlock := lockImages(restoreReferences(tarballPath))
+	defer unlock()
+
+	// Loading must not quietly move a tag such as latest back to an older
+	// image, and images that are already there are not loaded again
+	refs, present, conflicts := existingImages(cli, ctx, tarballPath)
+	if len(conflicts) > 0 {
+		if !config.OverwriteTags {
+			logger.Warn(fmt.Sprintf("Warning: skipped %s, loading it would move %s; pass --overwrite-tags to load it anyway", tarballPath, strings.Join(conflicts, ", ")),
+				"path", tarballPath, "tags", conflicts, outcomeKey, "skipped")
+			return fmt.Errorf("%w: %s", errTagConflict, strings.Join(conflicts, ", "))
+		}
+		logger.Info(fmt.Sprintf("Moving %s to the images of %s", strings.Join(conflicts, ", "), tarballPath), "path", tarballPath, "tags", conflicts)
+	}
+	if present && !config.Force {
+		logger.Info(fmt.Sprintf("Images of %s are already present, skipped", tarballPath), "path", tarballPath, outcomeKey, "skipped")
+		if err := finishRestore(cli, ctx, refs); err != nil {
+			return err
+		}
+		return errLoaded
 	}
 
-	// Check for metadata file to determine compression type
-	metadataPath := tarballPath + ".json"
-	var compressed bool
+	// Naming any part of a split backup restores the whole backup. Remote
+	// backups are streamed from their storage backend as they are loaded.
+	localPath := logicalBackupPath(tarballPath)
+
+	if info, err := loadImageInfo(localPath + ".json"); err == nil && info.isExport() {
+		return fmt.Errorf("%s %w", tarballPath, errIsExport)
+	}
 
-	// First check the extension
-	if strings.HasSuffix(tarballPath, ".tar.gz") || strings.HasSuffix(tarballPath, ".tgz") {
-		compressed = true
+	// A tampered backup must not fall back to pulling either
+	if err := checkRestoreSignature(tarballPath, localPath); err != nil {
+		return err
+	}
+
+	output, err := loadBackup(cli, ctx, tarballPath, localPath)
+	if err != nil {
+		if !config.PullFallback || ctx.Err() != nil {
+			return err
+		}
+		return pullFallback(cli, ctx, tarballPath, localPath, err)
+	}
+
+	logSuccess("Successfully restored image from "+tarballPath, "path", tarballPath, "duration", time.Since(started).Round(time.Millisecond))
+	logger.Debug(fmt.Sprintf("Docker output: %s", bytes.TrimSpace(output)), "path", tarballPath, "output", string(bytes.TrimSpace(output)))
+	loaded := parseLoadedImages(output)
+	if len(loaded) > 0 {
+		logger.Info("Loaded "+strings.Join(loaded, ", "), "path", tarballPath, "images", loaded)
 	} else {
-		// Then check metadata if available
-		if _, err := os.Stat(metadataPath); err == nil {
-			metadataFile, err := os.Open(metadataPath)
-			if err == nil {
-				defer metadataFile.Close()
-
-				var imageInfo ImageInfo
-				decoder := json.NewDecoder(metadataFile)
-				if err := decoder.Decode(&imageInfo); err == nil {
-					compressed = imageInfo.CompressType == "gzip"
-				}
+		logger.Warn(fmt.Sprintf("Warning: the daemon did not report which images %s loaded", tarballPath), "path", tarballPath)
+	}
+	if info, err := loadImageInfo(localPath + ".json"); err == nil && info.Container != nil {
+		logger.Info(fmt.Sprintf("Loaded %s, committed from container %s", info.ImageName, info.Container),
+			"path", tarballPath, "image", info.ImageName, "container", info.Container.Name)
+	}
+
+	return finishRestore(cli, ctx, loaded)
+}
+
+// finishRestore applies --rename-policy, --retag and --push to the restored
+// images
+func finishRestore(cli DockerClient, ctx context.Context, refs []string) error {
+	if renamePolicy != nil {
+		renamed, err := applyRenamePolicy(cli, ctx, refs)
+		if err != nil {
+			return err
+		}
+		refs = renamed
+	}
+	if retagTmpl != nil {
+		tags, err := retagImages(cli, ctx, refs)
+		if err != nil {
+			return err
+		}
+		logger.Info("Restored image tags: "+strings.Join(tags, ", "), "tags", tags)
+		refs = tags
+	}
+	if config.TagAsLatest {
+		if err := tagAsLatest(cli, ctx, refs); err != nil {
+			return err
+		}
+	}
+	if config.Push {
+		return pushRestored(cli, ctx, refs)
+	}
+	return nil
+}
+
+// loadBackup detects the kind of backup at localPath and loads it into the
+// daemon, returning the daemon's output. tarballPath is the name used in
+// messages.
+func loadBackup(cli DockerClient, ctx context.Context, tarballPath, localPath string) ([]byte, error) {
+	encoding, err := detectEncoding(localPath, tarballPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if encoding.dedup && localPath == stdinPath {
+		return nil, fmt.Errorf("deduplicated backups cannot be restored from stdin")
+	}
+
+	info, infoErr := loadImageInfo(localPath + ".json")
+	if !encoding.dedup && isOCIBackup(localPath, encoding.compression, encoding.encrypted) {
+		if err := checkOCISupport(cli, ctx); err != nil {
+			return nil, err
+		}
+		logger.Debug(tarballPath+" is an OCI Image Layout archive", "path", tarballPath)
+		if infoErr == nil {
+			checkPlatformSupport(cli, ctx, tarballPath, info.Platforms)
+		}
+	}
+	if infoErr == nil {
+		checkPlatformMatch(cli, ctx, tarballPath, info)
+	}
+
+	msg := fmt.Sprintf("Loading image from %s...", tarballPath)
+	switch {
+	case encoding.dedup:
+		msg = fmt.Sprintf("Loading deduplicated image from %s...", tarballPath)
+	case encoding.encrypted:
+		msg = fmt.Sprintf("Loading encrypted image from %s...", tarballPath)
+	case encoding.compression != compressionNone:
+		msg = fmt.Sprintf("Loading %s-compressed image from %s...", encoding.compression, tarballPath)
+	}
+	logger.Info(msg, "path", tarballPath, "compression", encoding.compression, "encrypted", encoding.encrypted)
+
+	stream := encoding.stream(localPath)
+
+	var output []byte
+	err = withRetry(ctx, "load "+tarballPath, func() (err error) {
+		output, err = loadImage(cli, ctx, stream)
+		return err
+	})
+	if err != nil {
+		return output, fmt.Errorf("failed to load image: %w\n%s", err, output)
+	}
+	return output, nil
+}
+
+// backupEncoding describes how the `docker save` stream of a backup is stored
+type backupEncoding struct {
+	compression string
+	encrypted   bool
+	dedup       bool
+}
+
+// detectEncoding inspects the backup at localPath. The file contents decide;
+// the extension and metadata are only consulted when the leading bytes are
+// inconclusive. tarballPath is the name used in messages.
+func detectEncoding(localPath, tarballPath string) (backupEncoding, error) {
+	header, err := readHeader(localPath)
+	if err != nil {
+		return backupEncoding{}, fmt.Errorf("failed to read backup: %w", err)
+	}
+
+	encoding := backupEncoding{
+		compression: fallbackCompression(localPath, tarballPath),
+		encrypted:   isEncryptedHeader(header),
+		dedup:       isDedupHeader(header),
+	}
+	if !encoding.encrypted && !encoding.dedup {
+		if detected := detectCompression(header); detected != "" {
+			encoding.compression = detected
+		} else {
+			logger.Debug(fmt.Sprintf("Could not detect compression of %s, assuming %s", tarballPath, encoding.compression), "path", tarballPath)
+		}
+	}
+	return encoding, nil
+}
+
+// stream returns the opener for the plain tar stream of the backup at localPath
+func (e backupEncoding) stream(localPath string) imageStream {
+	if e.dedup {
+		return dedupStream(localPath)
+	}
+	return backupStream(localPath, e.compression, e.encrypted)
+}
+
+// fallbackCompression guesses the compression of a backup from its name and
+// metadata, for use when the file contents are inconclusive
+func fallbackCompression(localPath, tarballPath string) string {
+	name := strings.TrimSuffix(tarballPath, encExtension)
+	if strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz") {
+		return compressionGzip
+	}
+	if imageInfo, err := loadImageInfo(localPath + ".json"); err == nil &&
+		(imageInfo.CompressType == compressionGzip || imageInfo.CompressType == "oci-zip") {
+		return compressionGzip
+	}
+	return compressionNone
+}
+
+// imageStream opens the plain `docker save` tar stream of a backup. Each call
+// starts from the beginning, so the stream can be read more than once.
+type imageStream func() (io.ReadCloser, error)
+
+// backupStream returns the opener for a tarball backup. For encrypted backups
+// the compression is detected from the decrypted bytes, and the first chunk is
+// authenticated when the stream is opened so a wrong passphrase never feeds
+// garbage to the daemon. With --checksum, the stored bytes are hashed as they
+// stream and reaching the end with another digest fails the load.
+func backupStream(tarballPath, compression string, encrypted bool) imageStream {
+	return func() (io.ReadCloser, error) {
+		file, err := openBackup(tarballPath)
+		if err != nil {
+			return nil, err
+		}
+
+		var stored io.Reader = file
+		if restoreChecksum != "" {
+			stored = &checksumReader{r: file, hash: sha256.New(), want: restoreChecksum, name: tarballPath}
+		}
+		buffered := bufio.NewReader(stored)
+		var reader io.Reader = buffered
+		kind := compression
+		if encrypted {
+			decrypted, err := newDecryptingReader(buffered)
+			if err != nil {
+				file.Close()
+				return nil, err
 			}
+
+			// Peeking reads the first chunk, so a damaged one fails here too
+			plain := bufio.NewReaderSize(decrypted, encChunkSize)
+			header, err := plain.Peek(sniffLength)
+			if err != nil && err != io.EOF {
+				file.Close()
+				return nil, err
+			}
+			if detected := detectCompression(header); detected != "" {
+				kind = detected
+			}
+			reader = plain
+		}
+
+		decompressed, err := newDecompressReader(reader, kind)
+		if err != nil {
+			file.Close()
+			return nil, err
 		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{decompressed, multiCloser{decompressed, file}}, nil
 	}
+}
 
-	var cmd *exec.Cmd
+// loadImage feeds a backup stream into the daemon's image load endpoint and
+// returns the daemon's messages. With --only, only the selected images are
+// passed on.
+func loadImage(cli DockerClient, ctx context.Context, stream imageStream) ([]byte, error) {
+	open := stream
+	if len(config.Only) > 0 {
+		open = func() (io.ReadCloser, error) {
+			return selectImages(stream, config.Only)
+		}
+	}
 
-	if compressed {
-		color.New(color.FgYellow, color.Bold).Printf("Loading compressed image from %s...\n", tarballPath)
-		cmd = exec.Command("sh", "-c", fmt.Sprintf("gunzip -c %s | docker load", tarballPath))
-	} else {
-		fmt.Printf("Loading image from %s...\n", tarballPath)
-		cmd = exec.Command("docker", "load", "-i", tarballPath)
+	reader, err := open()
+	if err != nil {
+		return nil, err
 	}
+	defer reader.Close()
 
-	output, err := cmd.CombinedOutput()
+	resp, err := cli.ImageLoad(ctx, reader, client.ImageLoadWithQuiet(true))
 	if err != nil {
-		log.Printf("Failed to load image from %s: %v\n%s", tarballPath, err, output)
-		return
+		return nil, err
 	}
+	defer resp.Body.Close()
 
-	fmt.Printf("Successfully restored image from %s\n", tarballPath)
-	fmt.Printf("Docker output: %s\n", output)
+	return readLoadOutput(resp.Body)
+}
+
+// readLoadOutput turns the daemon's JSON message stream into the text `docker
+// load` would print, returning an error for any error message
+func readLoadOutput(body io.Reader) ([]byte, error) {
+	var output bytes.Buffer
+	decoder := json.NewDecoder(body)
+	for {
+		var msg struct {
+			Stream      string `json:"stream"`
+			Error       string `json:"error"`
+			ErrorDetail *struct {
+				Message string `json:"message"`
+			} `json:"errorDetail"`
+		}
+		if err := decoder.Decode(&msg); err == io.EOF {
+			return output.Bytes(), nil
+		} else if err != nil {
+			return output.Bytes(), err
+		}
+
+		if msg.ErrorDetail != nil && msg.ErrorDetail.Message != "" {
+			return output.Bytes(), errors.New(msg.ErrorDetail.Message)
+		}
+		if msg.Error != "" {
+			return output.Bytes(), errors.New(msg.Error)
+		}
+		output.WriteString(msg.Stream)
+	}
 }
 
 func runList(cmd *cobra.Command, args []string) {
-	if _, err := os.Stat(config.BackupDir); os.IsNotExist(err) {
-		color.New(color.FgRed, color.Bold).Printf("Backup directory %s does not exist\n", config.BackupDir)
-		return
+	if err := validateListFlags(); err != nil {
+		log.Fatal(err)
 	}
 
-	files, err := os.ReadDir(config.BackupDir)
-	if err != nil {
-		log.Fatalf("Failed to read backup directory: %v", err)
+	location := config.Remote
+	if location == "" && isRemotePath(config.BackupDir) {
+		location = config.BackupDir
 	}
 
-	tarFiles := make(map[string]os.FileInfo)
-	metaFiles := make(map[string]ImageInfo)
+	var entries []listEntry
+	if location != "" {
+		ctx, stop := signalContext()
+		defer stop()
 
-	for _, file := range files {
-		if file.IsDir() {
-			continue
+		backend, err := newStorageBackend(ctx, location)
+		if err != nil {
+			log.Fatal(err)
 		}
+		defer closeBackend(backend)
 
-		name := file.Name()
-		info, err := file.Info()
+		entries, err = backendEntries(ctx, backend)
 		if err != nil {
-			continue
+			log.Fatalf("Failed to list %s: %v", backend, err)
+		}
+	} else {
+		if _, err := os.Stat(config.BackupDir); os.IsNotExist(err) {
+			logger.Error(fmt.Sprintf("Backup directory %s does not exist", config.BackupDir), "dir", config.BackupDir)
+			return
 		}
 
-		if strings.HasSuffix(name, ".tar") || strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz") {
-			tarFiles[name] = info
-		} else if strings.HasSuffix(name, ".json") {
-			// Try to parse metadata
-			metaPath := filepath.Join(config.BackupDir, name)
-			metaFile, err := os.Open(metaPath)
-			if err == nil {
-				defer metaFile.Close()
-
-				var imageInfo ImageInfo
-				decoder := json.NewDecoder(metaFile)
-				if err := decoder.Decode(&imageInfo); err == nil {
-					baseName := strings.TrimSuffix(name, ".json")
-					metaFiles[baseName] = imageInfo
-				}
-			}
+		var err error
+		entries, err = localEntries(config.BackupDir)
+		if err != nil {
+			log.Fatalf("Failed to read backup directory: %v", err)
+		}
+	}
+
+	filtered := entries[:0]
+	for _, entry := range entries {
+		if config.ListImage != "" && !entry.matchesImage(config.ListImage) {
+			continue
+		}
+		if config.ListFilter != "" && !entry.matchesFilter(config.ListFilter) {
+			continue
+		}
+		if len(backupLabels) > 0 && !entry.matchesLabels(backupLabels) {
+			continue
+		}
+		if !entry.matchesDate(listSince, listUntil) {
+			continue
 		}
+		filtered = append(filtered, entry)
 	}
+	entries = filtered
 
-	if len(tarFiles) == 0 {
-		color.New(color.FgHiRed, color.Bold).Println("No backups found")
+	if config.Output == "json" {
+		if err := printListJSON(entries); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(entries) == 0 {
+		if config.ListImage != "" || config.ListFilter != "" || len(backupLabels) > 0 || !listSince.IsZero() || !listUntil.IsZero() {
+			logger.Warn("No backups match the given --image, --filter, --label, --since or --until")
+		} else {
+			logger.Warn("No backups found", "dir", config.BackupDir)
+		}
 		return
 	}
 
 	color.New(color.FgHiBlue, color.Bold).Println("Available Docker image backups:")
 	fmt.Println("---------------------------------")
 
-	for name, info := range tarFiles {
-		fmt.Printf("Backup: %s\n", name)
-		fmt.Printf("  Size: %.2f MB\n", float64(info.Size())/(1024*1024))
-		fmt.Printf("  Date: %s\n", info.ModTime().Format(time.RFC3339))
-
-		// Display metadata if available
-		if meta, exists := metaFiles[name]; exists {
-			fmt.Printf("  Image: %s\n", meta.ImageName)
-			fmt.Printf("  Tags: %s\n", strings.Join(meta.Tags, ", "))
-			if config.Verbose {
-				fmt.Printf("  ID: %s\n", meta.ImageID)
-				fmt.Printf("  Compression: %s\n", meta.CompressType)
-			}
-		}
-		fmt.Println()
+	if config.ListFormat == listGrouped {
+		printGrouped(entries)
+	} else {
+		printFlat(entries)
 	}
+	printListSummary(entries)
 }
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/errdefs"
+)
+
+// testArchive stands in for the tar stream of docker save
+const testArchive = "image archive from docker save"
+
+// setupBackupTest points the configuration at a temporary backup directory
+// with a fixed backup name, so tests know which files to expect
+func setupBackupTest(t *testing.T, compress string) {
+	t.Helper()
+	config = defaultConfig()
+	config.BackupDir = t.TempDir()
+	config.CompressType = compress
+	config.Format = formatDocker
+	config.NameTemplate = "{{.SafeName}}"
+	tmpl, err := parseNameTemplate(config.NameTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nameTmpl = tmpl
+	t.Cleanup(func() {
+		config = defaultConfig()
+		nameTmpl = nil
+		lastBackups = nil
+		resetClaimedNames()
+	})
+}
+
+func TestBackupImage(t *testing.T) {
+	inspected := func(ref string) (image.InspectResponse, error) {
+		return image.InspectResponse{ID: "sha256:0123456789abcdef", RepoTags: []string{"app:1.0"}, Os: "linux", Architecture: "amd64", Size: 1024}, nil
+	}
+	saved := func(images []string) (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader(testArchive)), nil
+	}
+
+	tests := []struct {
+		name     string
+		compress string
+		inspect  func(string) (image.InspectResponse, error)
+		save     func([]string) (io.ReadCloser, error)
+		setup    func(t *testing.T)
+		wantErr  string
+		wantFile string
+	}{
+		{
+			name:     "image not found",
+			compress: compressionGzip,
+			inspect: func(string) (image.InspectResponse, error) {
+				return image.InspectResponse{}, errdefs.NotFound(errors.New("No such image: app:1.0"))
+			},
+			wantErr: "error inspecting image",
+		},
+		{
+			name:     "save failure",
+			compress: compressionGzip,
+			inspect:  inspected,
+			save: func([]string) (io.ReadCloser, error) {
+				return nil, errors.New("daemon went away")
+			},
+			wantErr: "daemon went away",
+		},
+		{
+			name:     "metadata write failure",
+			compress: compressionGzip,
+			inspect:  inspected,
+			save:     saved,
+			// A directory in place of the sidecar cannot be created as a file
+			setup: func(t *testing.T) {
+				if err := os.Mkdir(filepath.Join(config.BackupDir, "app_1.0.tar.gz.json"), 0755); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: "failed to create metadata file",
+		},
+		{
+			name:     "gzip",
+			compress: compressionGzip,
+			inspect:  inspected,
+			save:     saved,
+			wantFile: "app_1.0.tar.gz",
+		},
+		{
+			name:     "no compression",
+			compress: compressionNone,
+			inspect:  inspected,
+			save:     saved,
+			wantFile: "app_1.0.tar",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupBackupTest(t, tt.compress)
+			if tt.setup != nil {
+				tt.setup(t)
+			}
+			cli := newMockDockerClient(t)
+			cli.InspectFunc, cli.SaveFunc = tt.inspect, tt.save
+
+			err := backupImage(cli, context.Background(), "app:1.0")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("backupImage() error = %v, want %q", err, tt.wantErr)
+				}
+				// A failed backup leaves no tarball behind
+				for _, name := range []string{"app_1.0.tar.gz", partialName("app_1.0.tar.gz")} {
+					if _, err := os.Stat(filepath.Join(config.BackupDir, name)); err == nil {
+						t.Errorf("%s was left behind", name)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("backupImage() error = %v", err)
+			}
+
+			path := filepath.Join(config.BackupDir, tt.wantFile)
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.compress == compressionGzip {
+				zr, err := gzip.NewReader(bytes.NewReader(data))
+				if err != nil {
+					t.Fatalf("%s is not gzip compressed: %v", tt.wantFile, err)
+				}
+				if data, err = io.ReadAll(zr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if string(data) != testArchive {
+				t.Errorf("%s holds %q, want %q", tt.wantFile, data, testArchive)
+			}
+
+			info, err := loadImageInfo(path + ".json")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.ImageName != "app:1.0" || info.ImageID != "sha256:0123456789abcdef" {
+				t.Errorf("metadata records %s %s, want app:1.0 sha256:0123456789abcdef", info.ImageName, info.ImageID)
+			}
+		})
+	}
+}
+
+func TestBackupImageTestDaemon(t *testing.T) {
+	setupBackupTest(t, compressionNone)
+	cli := newTestDaemon(t, func(w http.ResponseWriter, r *http.Request) bool {
+		switch {
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/images/app:1.0/json"):
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"Id":"sha256:0123456789abcdef","RepoTags":["app:1.0"],"Size":1024}`)
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/images/get") && r.URL.Query().Get("names") == "app:1.0":
+			io.WriteString(w, testArchive)
+		default:
+			return false
+		}
+		return true
+	})
+
+	if err := backupImage(cli, context.Background(), "app:1.0"); err != nil {
+		t.Fatalf("backupImage() error = %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(config.BackupDir, "app_1.0.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != testArchive {
+		t.Errorf("app_1.0.tar holds %q, want %q", data, testArchive)
+	}
+}
+
+func TestBackupOnceEnumeratesEachRun(t *testing.T) {
+	setupBackupTest(t, compressionNone)
+	config.All = true
+	t.Cleanup(func() { clear(enumeratedImages) })
+
+	var listed []string
+	cli := newMockDockerClient(t)
+	cli.ListFunc = func(image.ListOptions) ([]image.Summary, error) {
+		var summaries []image.Summary
+		for _, name := range listed {
+			summaries = append(summaries, image.Summary{ID: "sha256:" + name, RepoTags: []string{name}})
+		}
+		return summaries, nil
+	}
+	cli.InspectFunc = func(ref string) (image.InspectResponse, error) {
+		return image.InspectResponse{ID: "sha256:" + ref, RepoTags: []string{ref}, Os: "linux", Architecture: "amd64"}, nil
+	}
+	cli.SaveFunc = func([]string) (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader(testArchive)), nil
+	}
+
+	for _, run := range [][]string{{"old:1"}, {"new:1"}} {
+		listed = run
+		results, failed, err := backupOnce(cli, context.Background(), nil, filters.NewArgs())
+		if err != nil || failed {
+			t.Fatalf("backupOnce() = %v, %v", failed, err)
+		}
+		if len(results) != 1 || results[0].Name != run[0] {
+			t.Errorf("backupOnce() backed up %v, want %v", results, run)
+		}
+	}
+	if enumeratedImages["old:1"] || !enumeratedImages["new:1"] {
+		t.Errorf("enumerated images = %v, want only new:1", enumeratedImages)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// reservedStdout is the real stdout while --manifest - or --stdout writes
+// there and everything else is sent to stderr
+var reservedStdout *os.File
+
+// reserveStdout sends the progress, table and summary normally printed on
+// stdout to stderr, so `--manifest -` can be piped straight into
+// `restore --stdin` and `--stdout` into another program
+func reserveStdout() {
+	reservedStdout = os.Stdout
+	os.Stdout = os.Stderr
+	color.Output = color.Error
+}
+
+// manifestPaths returns the location of every backup written by the run, in
+// the form restore --file and --stdin accept: absolute paths for local
+// backups, and the remote location for backups only kept in remote storage.
+// Failed and skipped items wrote nothing and are left out.
+func manifestPaths(results []Result) ([]string, error) {
+	var paths []string
+	for _, result := range results {
+		if result.Status != StatusSucceeded || result.Path == "" {
+			continue
+		}
+		path := result.Path
+		switch {
+		case isRemotePath(path):
+		case config.RemoteOnly && config.Remote != "":
+			path = strings.TrimSuffix(config.Remote, "/") + "/" + filepath.Base(path)
+		default:
+			abs, err := filepath.Abs(path)
+			if err != nil {
+				return nil, err
+			}
+			path = abs
+		}
+		paths = appendUnique(paths, path)
+	}
+	return paths, nil
+}
+
+// writeManifest writes the backups of the run to path, one per line, or to
+// stdout when path is "-"
+func writeManifest(path string, results []Result) error {
+	paths, err := manifestPaths(results)
+	if err != nil {
+		return err
+	}
+	var data strings.Builder
+	for _, p := range paths {
+		data.WriteString(p + "\n")
+	}
+
+	if path == "-" {
+		_, err := reservedStdout.WriteString(data.String())
+		return err
+	}
+	if err := writeFileAtomic(path, []byte(data.String())); err != nil {
+		return err
+	}
+	logger.Debug(fmt.Sprintf("Wrote %d backups to manifest %s", len(paths), path), "path", path)
+	return nil
+}
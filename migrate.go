@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// openLocation returns the backend for a local directory or a remote
+// location such as s3://bucket/prefix
+func openLocation(location string, create bool) (StorageBackend, error) {
+	if isRemotePath(location) {
+		return remoteDirBackend(location)
+	}
+	return newLocalBackend(location, create)
+}
+
+// groupBackupFiles groups a listing into backups by their logical name. Each
+// backup lists its data files (the tarball or its parts) before its signature
+// and metadata, so it only looks complete at the destination once its data
+// has arrived. Sidecars without a backup and other files, such as the
+// catalog, are left alone.
+func groupBackupFiles(files []RemoteFile) ([]string, map[string][]RemoteFile) {
+	backups := make(map[string][]RemoteFile)
+	byKey := make(map[string]RemoteFile, len(files))
+	var names []string
+	for _, file := range files {
+		byKey[file.Key] = file
+		if !isBackupFile(file.Key) {
+			continue
+		}
+		name := logicalBackupPath(file.Key)
+		if _, ok := backups[name]; !ok {
+			names = append(names, name)
+		}
+		backups[name] = append(backups[name], file)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		data := backups[name]
+		sort.Slice(data, func(i, j int) bool { return data[i].Key < data[j].Key })
+		for _, ext := range []string{signatureExtension, ".json"} {
+			if sidecar, ok := byKey[name+ext]; ok {
+				data = append(data, sidecar)
+			}
+		}
+		backups[name] = data
+	}
+	return names, backups
+}
+
+func runMigrate(cmd *cobra.Command, args []string) {
+	from, _ := cmd.Flags().GetString("from")
+	to, _ := cmd.Flags().GetString("to")
+	copyOnly, _ := cmd.Flags().GetBool("copy")
+	overwrite, _ := cmd.Flags().GetBool("overwrite")
+
+	if strings.TrimSuffix(from, "/") == strings.TrimSuffix(to, "/") {
+		log.Fatal("--from and --to must be different locations")
+	}
+
+	ctx, stop := signalContext()
+	defer stop()
+	defer closeRemoteBackends()
+
+	src, err := openLocation(from, false)
+	if err != nil {
+		log.Fatalf("Failed to open %s: %v", from, err)
+	}
+	dst, err := openLocation(to, true)
+	if err != nil {
+		log.Fatalf("Failed to open %s: %v", to, err)
+	}
+
+	files, err := src.List(ctx)
+	if err != nil {
+		log.Fatalf("Failed to list %s: %v", from, err)
+	}
+	names, backups := groupBackupFiles(files)
+	if len(names) == 0 {
+		logger.Warn("No backups found in "+from, "dir", from)
+		return
+	}
+
+	existing, err := dst.List(ctx)
+	if err != nil {
+		log.Fatalf("Failed to list %s: %v", to, err)
+	}
+	atDestination := make(map[string]RemoteFile, len(existing))
+	for _, file := range existing {
+		atDestination[file.Key] = file
+	}
+
+	started := time.Now()
+	results := runJobs(ctx, names, func(ctx context.Context, name string) error {
+		return migrateBackup(ctx, src, dst, name, backups[name], atDestination, copyOnly, overwrite)
+	})
+	closeRemoteBackends()
+
+	operation := "migrate"
+	if copyOnly {
+		operation = "copy"
+	}
+	logger.Info("All migrate operations completed")
+	failed := printSummary("Migrate", results)
+	finishReport(newRunReport(operation, results, started))
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// migrateBackup copies the files of one backup to dst and, unless copyOnly,
+// deletes them from src once all of them arrived. Files already at the
+// destination with the same SHA-256 are not copied again unless overwrite is
+// set; a file with the same name but different content fails the backup.
+func migrateBackup(ctx context.Context, src, dst StorageBackend, name string, files []RemoteFile, atDestination map[string]RemoteFile, copyOnly, overwrite bool) error {
+	if strings.HasSuffix(strings.TrimSuffix(name, encExtension), dedupExtension) {
+		return fmt.Errorf("dedup backups share the blob store of their directory and cannot be migrated")
+	}
+
+	var copied int64
+	transferred := false
+	for _, file := range files {
+		if existing, ok := atDestination[file.Key]; ok && !overwrite {
+			same, err := sameContent(ctx, src, dst, file, existing)
+			if err != nil {
+				return err
+			}
+			if !same {
+				return fmt.Errorf("%s already exists at %s with different content (use --overwrite to replace it)", file.Key, dst)
+			}
+			logger.Debug(fmt.Sprintf("%s is already at %s", file.Key, dst), "key", file.Key, "remote", dst.String())
+			continue
+		}
+
+		logger.Debug(fmt.Sprintf("Copying %s to %s", file.Key, dst), "key", file.Key, "remote", dst.String())
+		if err := copyBackendFile(ctx, src, dst, file); err != nil {
+			return fmt.Errorf("failed to copy %s: %w", file.Key, err)
+		}
+		copied += file.Size
+		transferred = true
+	}
+
+	if !copyOnly {
+		for _, file := range files {
+			if err := src.Delete(ctx, file.Key); err != nil {
+				return fmt.Errorf("copied to %s but failed to remove %s from %s: %w", dst, file.Key, src, err)
+			}
+		}
+	}
+
+	if !transferred {
+		logger.Info(fmt.Sprintf("%s is already at %s, skipped", name, dst), "path", name, "remote", dst.String(), outcomeKey, "skipped")
+		return errExists
+	}
+
+	recordOutput(name, strings.TrimSuffix(dst.String(), "/")+"/"+name, copied)
+	verb := "Moved"
+	if copyOnly {
+		verb = "Copied"
+	}
+	logSuccess(fmt.Sprintf("%s %s to %s", verb, name, dst), "path", name, "remote", dst.String())
+	return nil
+}
+
+// copyBackendFile streams one file between backends and keeps its date where
+// the destination allows it
+func copyBackendFile(ctx context.Context, src, dst StorageBackend, file RemoteFile) error {
+	reader, err := src.Open(ctx, file.Key)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	if err := dst.Put(ctx, file.Key, reader, file.Size); err != nil {
+		return err
+	}
+	if setter, ok := dst.(modTimeSetter); ok && !file.ModTime.IsZero() {
+		if err := setter.SetModTime(ctx, file.Key, file.ModTime); err != nil {
+			logger.Debug(fmt.Sprintf("Could not keep the date of %s: %v", file.Key, err), "key", file.Key, "error", err)
+		}
+	}
+	return nil
+}
+
+// sameContent reports whether a file at the destination has the same size
+// and SHA-256 as the source
+func sameContent(ctx context.Context, src, dst StorageBackend, file, existing RemoteFile) (bool, error) {
+	if file.Size != existing.Size {
+		return false, nil
+	}
+	srcSum, err := backendFileSHA256(ctx, src, file.Key)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s from %s: %w", file.Key, src, err)
+	}
+	dstSum, err := backendFileSHA256(ctx, dst, file.Key)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s from %s: %w", file.Key, dst, err)
+	}
+	return bytes.Equal(srcSum, dstSum), nil
+}
+
+func backendFileSHA256(ctx context.Context, backend StorageBackend, key string) ([]byte, error) {
+	reader, err := backend.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, reader); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/fatih/color"
+)
+
+// registryPasswordEnv is read when --registry-user is given without
+// --registry-password, to keep the password out of the process list
+const registryPasswordEnv = "BACKUP_REGISTRY_PASSWORD"
+
+// pushedImages records every push attempted by restore --push, in the order
+// the pushes finished, for the push summary and the run report
+var pushedImages struct {
+	sync.Mutex
+	pushes []ReportPush
+}
+
+// recordPush notes the outcome of pushing one restored image
+func recordPush(source, target string, err error) {
+	push := ReportPush{Image: source, Target: target}
+	if err != nil {
+		push.Error = err.Error()
+	}
+	pushedImages.Lock()
+	defer pushedImages.Unlock()
+	pushedImages.pushes = append(pushedImages.pushes, push)
+}
+
+// takePushes returns the recorded pushes sorted by image
+func takePushes() []ReportPush {
+	pushedImages.Lock()
+	defer pushedImages.Unlock()
+	pushes := pushedImages.pushes
+	pushedImages.pushes = nil
+	sort.SliceStable(pushes, func(i, j int) bool { return pushes[i].Image < pushes[j].Image })
+	return pushes
+}
+
+// printPushSummary prints how many restored images were pushed and lists each
+// image with its target, so a pipeline log shows what reached the registry
+func printPushSummary(pushes []ReportPush) {
+	if len(pushes) == 0 {
+		return
+	}
+	var failed int
+	for _, push := range pushes {
+		if push.Error != "" {
+			failed++
+		}
+	}
+
+	summary := fmt.Sprintf("Push summary: %d pushed, %d failed", len(pushes)-failed, failed)
+	if failed > 0 {
+		color.New(color.FgRed, color.Bold).Println(summary)
+	} else {
+		color.New(color.FgGreen, color.Bold).Println(summary)
+	}
+	for _, push := range pushes {
+		if push.Error != "" && push.Target == "" {
+			fmt.Printf("  %-11s %s: %s\n", StatusFailed, push.Image, push.Error)
+		} else if push.Error != "" {
+			fmt.Printf("  %-11s %s -> %s: %s\n", StatusFailed, push.Image, push.Target, push.Error)
+		} else if !config.Quiet {
+			fmt.Printf("  %-11s %s -> %s\n", "pushed", push.Image, push.Target)
+		}
+	}
+}
+
+// validateRegistryPrefix checks that a registry prefix given to flag can be
+// prepended to image paths
+func validateRegistryPrefix(flag, prefix string) error {
+	if _, err := reference.ParseNormalizedNamed(strings.TrimSuffix(prefix, "/") + "/image:tag"); err != nil {
+		return fmt.Errorf("invalid --%s %q: %w", flag, prefix, err)
+	}
+	return nil
+}
+
+// prefixedReference moves imageName below a registry prefix, keeping its
+// repository path and tag and appending tagSuffix to the tag, e.g.
+// my.registry.local/backup/nginx:latest-20240101
+func prefixedReference(prefix, imageName, tagSuffix string) (string, error) {
+	if strings.HasPrefix(imageName, "sha256:") {
+		return "", fmt.Errorf("cannot push %s: images must be named by repository", imageName)
+	}
+	named, err := reference.ParseNormalizedNamed(imageName)
+	if err != nil {
+		return "", fmt.Errorf("cannot push %s: %w", imageName, err)
+	}
+	path := strings.TrimPrefix(reference.Path(named), "library/")
+	tag := "latest"
+	if tagged, ok := named.(reference.Tagged); ok {
+		tag = tagged.Tag()
+	}
+
+	target := fmt.Sprintf("%s/%s:%s%s", strings.TrimSuffix(prefix, "/"), path, tag, tagSuffix)
+	if _, err := reference.ParseNormalizedNamed(target); err != nil {
+		return "", fmt.Errorf("cannot push %s as %s: %w", imageName, target, err)
+	}
+	return target, nil
+}
+
+// mirrorReference returns the name imageName is mirrored under with
+// --to-registry: tagged with the original tag and the backup date
+func mirrorReference(prefix, imageName string, date time.Time) (string, error) {
+	return prefixedReference(prefix, imageName, "-"+date.Format("20060102"))
+}
+
+// mirrorImage tags imageName under the --to-registry prefix and pushes it.
+// The temporary local tag is removed afterwards.
+func mirrorImage(cli DockerClient, ctx context.Context, imageName string, date time.Time) (string, error) {
+	target, err := mirrorReference(config.ToRegistry, imageName, date)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		// Only the tag is removed; the image itself is still referenced by imageName
+		if _, err := cli.ImageRemove(context.WithoutCancel(ctx), target, image.RemoveOptions{}); err != nil {
+			logger.Debug(fmt.Sprintf("Failed to remove temporary tag %s: %v", target, err), "tag", target, "error", err)
+		}
+	}()
+	return target, pushImage(cli, ctx, imageName, target)
+}
+
+// pushImage tags source as target and pushes target, printing the push progress
+func pushImage(cli DockerClient, ctx context.Context, source, target string) error {
+	auth, err := pushAuth(target)
+	if err != nil {
+		return err
+	}
+	if err := cli.ImageTag(ctx, source, target); err != nil {
+		return fmt.Errorf("failed to tag %s as %s: %w", source, target, err)
+	}
+
+	logger.Info(fmt.Sprintf("Pushing %s to %s...", source, target), "image", source, "target", target)
+	err = withRetry(ctx, "push "+target, func() error {
+		body, err := cli.ImagePush(ctx, target, image.PushOptions{RegistryAuth: auth})
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		return printPushProgress(body, source)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to push %s: %w", target, err)
+	}
+	return nil
+}
+
+// pushAuth returns the registry credentials for pushing target: the
+// --registry-user flags when given, otherwise those from `docker login`
+func pushAuth(target string) (string, error) {
+	if config.RegistryUser == "" {
+		auth, err := registryAuth(target)
+		if err != nil {
+			return "", fmt.Errorf("failed to read registry credentials: %w", err)
+		}
+		return auth, nil
+	}
+
+	named, err := reference.ParseNormalizedNamed(target)
+	if err != nil {
+		return "", err
+	}
+	password := config.RegistryPassword
+	if password == "" {
+		password = os.Getenv(registryPasswordEnv)
+	}
+	return registry.EncodeAuthConfig(registry.AuthConfig{
+		Username:      config.RegistryUser,
+		Password:      password,
+		ServerAddress: reference.Domain(named),
+	})
+}
+
+// printPushProgress prints each layer's status as it changes, skipping the
+// byte-level progress updates, and returns the first error the daemon reports
+func printPushProgress(body io.Reader, imageName string) error {
+	last := make(map[string]string)
+	decoder := json.NewDecoder(body)
+	for {
+		var msg struct {
+			ID          string `json:"id"`
+			Status      string `json:"status"`
+			Error       string `json:"error"`
+			ErrorDetail *struct {
+				Message string `json:"message"`
+			} `json:"errorDetail"`
+		}
+		if err := decoder.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if msg.ErrorDetail != nil && msg.ErrorDetail.Message != "" {
+			return errors.New(msg.ErrorDetail.Message)
+		}
+		if msg.Error != "" {
+			return errors.New(msg.Error)
+		}
+		if msg.Status == "" || last[msg.ID] == msg.Status {
+			continue
+		}
+		last[msg.ID] = msg.Status
+
+		switch {
+		case msg.ID == "":
+			logger.Info(fmt.Sprintf("  %s: %s", imageName, msg.Status), "image", imageName, "status", msg.Status)
+		case msg.Status != "Pushing" && msg.Status != "Preparing" && msg.Status != "Waiting":
+			logger.Info(fmt.Sprintf("  %s: %s %s", imageName, msg.ID, msg.Status), "image", imageName, "layer", msg.ID, "status", msg.Status)
+		default:
+			logger.Debug(fmt.Sprintf("  %s: %s %s", imageName, msg.ID, msg.Status), "image", imageName, "layer", msg.ID, "status", msg.Status)
+		}
+	}
+}
+
+// mirrorBackup pushes an image to the --to-registry mirror and reports the result
+func mirrorBackup(cli DockerClient, ctx context.Context, imageName string, date time.Time) error {
+	target, err := mirrorImage(cli, ctx, imageName, date)
+	if err != nil {
+		return err
+	}
+	logSuccess(fmt.Sprintf("Mirrored image %s to %s", imageName, target), "image", imageName, "target", target)
+	return nil
+}
+
+// pushRestored pushes restored images below the --push-prefix, and with
+// --remove-after-push deletes the local tags afterwards. Every image is
+// attempted; failures are reported per image and returned together.
+func pushRestored(cli DockerClient, ctx context.Context, refs []string) error {
+	if len(refs) == 0 {
+		return fmt.Errorf("cannot push: the daemon did not report any loaded images")
+	}
+
+	var errs []error
+	for _, ref := range refs {
+		target, err := prefixedReference(config.PushPrefix, ref, "")
+		if err == nil {
+			err = pushImage(cli, ctx, ref, target)
+		}
+		recordPush(ref, target, err)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Push of %s failed: %v", ref, err), "image", ref, "error", err)
+			errs = append(errs, err)
+			continue
+		}
+		logSuccess(fmt.Sprintf("Pushed %s to %s", ref, target), "image", ref, "target", target)
+
+		if config.RemoveAfterPush {
+			for _, tag := range []string{target, ref} {
+				if _, err := cli.ImageRemove(ctx, tag, image.RemoveOptions{PruneChildren: true}); err != nil {
+					logger.Warn(fmt.Sprintf("Warning: failed to remove %s: %v", tag, err), "image", tag, "error", err)
+				} else {
+					logger.Debug("Removed local image "+tag, "image", tag)
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
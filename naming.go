@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/distribution/reference"
+)
+
+// defaultNameTemplate reproduces the historical {safe_image_name}-{timestamp} scheme
+const defaultNameTemplate = "{{.SafeName}}-{{.Timestamp}}"
+
+// NameData holds the fields available to --name-template. Name (or its
+// alias Repository) is the repository without tag or digest and may contain
+// slashes, which create subdirectories. Ext is the extension for the
+// configured compression and encryption; it is appended automatically unless
+// the template ends with it.
+type NameData struct {
+	Name       string
+	Repository string
+	SafeName   string
+	Timestamp  string
+	ImageID    string
+	ShortID    string
+	Tag        string
+	Hostname   string
+	Ext        string
+
+	now time.Time
+}
+
+// Date formats the backup time with a Go layout, 2006-01-02 without one, so
+// both {{.Date}} and {{.Date "20060102"}} work
+func (d NameData) Date(layout ...string) (string, error) {
+	return formatDate(d.now, layout)
+}
+
+// OutputData holds the fields available to --output-template. Registry is the
+// registry host, docker.io for Docker Hub images, and Repository the path
+// within it, without the library/ of official images.
+type OutputData struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Timestamp  string
+
+	now time.Time
+}
+
+// Date formats the backup time like NameData.Date
+func (d OutputData) Date(layout ...string) (string, error) {
+	return formatDate(d.now, layout)
+}
+
+func formatDate(t time.Time, layout []string) (string, error) {
+	switch len(layout) {
+	case 0:
+		return t.Format("2006-01-02"), nil
+	case 1:
+		return t.Format(layout[0]), nil
+	}
+	return "", fmt.Errorf("Date takes at most one layout, got %d", len(layout))
+}
+
+// outputTmpl is the parsed --output-template, nil when backups are written
+// directly to the backup directory
+var outputTmpl *template.Template
+
+// parseOutputTemplate parses the --output-template and checks that it renders
+// to a directory inside the backup directory
+func parseOutputTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("output").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid output template: %w", err)
+	}
+	if _, err := renderOutputDir(tmpl, "ghcr.io/example/app:1.0", time.Now()); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// newOutputData builds the --output-template fields for an image backed up at
+// the given time
+func newOutputData(imageName string, now time.Time) OutputData {
+	data := OutputData{Repository: imageName, Tag: "latest", Timestamp: now.Format("20060102-150405"), now: now}
+	named, err := reference.ParseNormalizedNamed(imageName)
+	if err != nil {
+		return data
+	}
+	data.Registry = reference.Domain(named)
+	data.Repository = strings.TrimPrefix(reference.FamiliarName(named), data.Registry+"/")
+	if tagged, ok := named.(reference.Tagged); ok {
+		data.Tag = tagged.Tag()
+	}
+	return data
+}
+
+// renderOutputDir renders the --output-template for imageName into a relative
+// directory below the backup directory
+func renderOutputDir(tmpl *template.Template, imageName string, now time.Time) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, newOutputData(imageName, now)); err != nil {
+		return "", fmt.Errorf("invalid output template: %w", err)
+	}
+	dir := strings.TrimSpace(buf.String())
+	if strings.Contains(dir, `\`) || dir != "" && !filepath.IsLocal(filepath.FromSlash(dir)) {
+		return "", fmt.Errorf("output template result %q must be a relative directory inside the backup directory", dir)
+	}
+	return filepath.FromSlash(dir), nil
+}
+
+// backupBaseName returns the name of a new backup of imageName relative to the
+// backup directory: the --name-template result, below the --output-template
+// directory when one is set
+func backupBaseName(imageName, imageID string, now time.Time) (string, error) {
+	baseName, err := renderName(nameTmpl, newNameData(imageName, imageID, now))
+	if err != nil || outputTmpl == nil {
+		return baseName, err
+	}
+	dir, err := renderOutputDir(outputTmpl, imageName, now)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, baseName), nil
+}
+
+// parseNameTemplate parses the naming template and checks that it renders to a
+// usable file name, so a bad template fails before any image is processed
+func parseNameTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid name template: %w", err)
+	}
+
+	sample := newNameData("library/example:latest", "sha256:0123456789abcdef", time.Now())
+	if _, err := renderName(tmpl, sample); err != nil {
+		return nil, err
+	}
+
+	return tmpl, nil
+}
+
+// renderName executes the naming template and rejects results that would
+// escape the backup directory or produce an empty file name. Forward slashes
+// are allowed and place the backup in a subdirectory of the backup directory.
+func renderName(tmpl *template.Template, data NameData) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("invalid name template: %w", err)
+	}
+
+	name := strings.TrimSpace(buf.String())
+	if name == "" || strings.HasSuffix(name, "/") || strings.TrimSuffix(path.Base(name), backupExtension()) == "" {
+		return "", fmt.Errorf("name template produced an empty file name")
+	}
+	if strings.Contains(name, `\`) || !filepath.IsLocal(filepath.FromSlash(name)) {
+		return "", fmt.Errorf("name template result %q must be a relative path inside the backup directory", name)
+	}
+
+	return filepath.FromSlash(name), nil
+}
+
+// newNameData builds the template fields for an image backed up at the given time
+func newNameData(imageName, imageID string, now time.Time) NameData {
+	safeImageName := strings.ReplaceAll(imageName, "/", "_")
+	safeImageName = strings.ReplaceAll(safeImageName, ":", "_")
+
+	ref := imageName
+	if i := strings.Index(ref, "@"); i >= 0 {
+		ref = ref[:i]
+	}
+	tag := "latest"
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		tag = ref[i+1:]
+	}
+
+	name := ref
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name = name[:i]
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+
+	return NameData{
+		Name:       name,
+		Repository: name,
+		SafeName:   safeImageName,
+		Timestamp:  now.Format("20060102-150405"),
+		ImageID:    shortID(imageID),
+		ShortID:    shortID(imageID),
+		Tag:        tag,
+		Hostname:   hostname,
+		Ext:        backupExtension(),
+		now:        now,
+	}
+}
+
+// shortID returns the 12 character form of an image ID
+func shortID(id string) string {
+	id = strings.TrimPrefix(id, "sha256:")
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
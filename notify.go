@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// signatureHeader carries the HMAC-SHA256 of the webhook body when
+// --notify-secret is set, formatted as "sha256=<hex>"
+const signatureHeader = "X-Backup-Signature"
+
+// backupOutputs remembers the tarball written for each backup until its
+// Result is collected
+var backupOutputs = struct {
+	sync.Mutex
+	byName map[string]backupOutput
+}{byName: make(map[string]backupOutput)}
+
+type backupOutput struct {
+	path string
+	size int64
+}
+
+// recordBackupOutput notes the tarball written for an image or bundle
+func recordBackupOutput(name, tarballName string) {
+	var size int64
+	if stat, err := os.Stat(tarballName); err == nil {
+		size = stat.Size()
+	} else if uploaded, ok := uploadedSizes.LoadAndDelete(tarballName); ok {
+		size = uploaded.(int64)
+	}
+
+	recordOutput(name, tarballName, size)
+}
+
+// recordOutput notes the location and size of what a job wrote
+func recordOutput(name, location string, size int64) {
+	backupOutputs.Lock()
+	defer backupOutputs.Unlock()
+	backupOutputs.byName[name] = backupOutput{path: location, size: size}
+}
+
+// takeBackupOutput returns and forgets the tarball recorded for name, so an
+// image backed up again in watch mode reports its new tarball
+func takeBackupOutput(name string) (string, int64) {
+	backupOutputs.Lock()
+	defer backupOutputs.Unlock()
+	output := backupOutputs.byName[name]
+	delete(backupOutputs.byName, name)
+	return output.path, output.size
+}
+
+// Values of --notify-on
+const (
+	notifyAlways  = "always"
+	notifyFailure = "failure"
+)
+
+// notifyTmpl is the parsed --notify-template, nil to send the run report as is
+var notifyTmpl *template.Template
+
+// notifyHeaders are the --notify-header values, sent with every notification
+var notifyHeaders http.Header
+
+// notifyFuncs are available in --notify-template: json quotes a value as JSON,
+// so report fields such as error messages can be embedded in a JSON body, and
+// bytes renders a byte count in MB
+var notifyFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"bytes": formatBytes,
+}
+
+// parseNotifyFlags checks --notify-on and parses --notify-header and
+// --notify-template
+func parseNotifyFlags() error {
+	if config.NotifyOn != notifyAlways && config.NotifyOn != notifyFailure {
+		return fmt.Errorf("invalid --notify-on %q (expected always or failure)", config.NotifyOn)
+	}
+	if config.NotifyWebhook == "" && (len(config.NotifyHeaders) > 0 || config.NotifyTemplate != "") {
+		return fmt.Errorf("--notify-header and --notify-template require --notify-url")
+	}
+
+	notifyHeaders = make(http.Header)
+	for _, header := range config.NotifyHeaders {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return fmt.Errorf("invalid --notify-header %q (expected Name: value)", header)
+		}
+		notifyHeaders.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+
+	if config.NotifyTemplate != "" {
+		tmpl, err := template.New("notify").Funcs(notifyFuncs).Option("missingkey=error").Parse(config.NotifyTemplate)
+		if err != nil {
+			return fmt.Errorf("invalid --notify-template: %w", err)
+		}
+		notifyTmpl = tmpl
+	}
+	return nil
+}
+
+// notifyRun posts the run report to --notify-url when --notify-on asks for
+// it. A broken webhook is reported but never changes the exit status.
+func notifyRun(report RunReport) {
+	if config.NotifyWebhook == "" || (config.NotifyOn == notifyFailure && report.Failed == 0) {
+		return
+	}
+	if err := sendWebhook(config.NotifyWebhook, config.NotifySecret, config.NotifyTimeout, report); err != nil {
+		logger.Warn(fmt.Sprintf("Warning: webhook notification failed: %v", err), "error", err)
+	} else {
+		logger.Debug("Sent webhook notification to "+config.NotifyWebhook, "url", config.NotifyWebhook)
+	}
+}
+
+// notifyBody renders the body of a notification: the run report as JSON, or
+// --notify-template executed over it
+func notifyBody(report RunReport) ([]byte, error) {
+	if notifyTmpl == nil {
+		return json.Marshal(report)
+	}
+	var buf bytes.Buffer
+	if err := notifyTmpl.Execute(&buf, report); err != nil {
+		return nil, fmt.Errorf("invalid --notify-template: %w", err)
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, fmt.Errorf("--notify-template did not produce valid JSON: %s", buf.String())
+	}
+	return buf.Bytes(), nil
+}
+
+// sendWebhook posts the run report to url, signing the body when secret is set
+func sendWebhook(url, secret string, timeout time.Duration, report RunReport) error {
+	body, err := notifyBody(report)
+	if err != nil {
+		return err
+	}
+
+	// The run context may already be cancelled by an interrupt, and the
+	// notification should still go out in that case
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, values := range notifyHeaders {
+		req.Header[name] = values
+	}
+	if secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		req.Header.Set(signatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/api/types/versions"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// Backup formats selectable with --format
+const (
+	formatDocker = "docker"
+	formatOCI    = "oci"
+)
+
+// ociMinAPIVersion is the daemon API version of Docker 25, the first release
+// whose `docker load` accepts OCI Image Layout archives
+const ociMinAPIVersion = "1.44"
+
+// ociLayoutFile is the marker file at the root of every OCI Image Layout
+const ociLayoutFile = "oci-layout"
+
+// metadataCompressType returns the CompressType recorded in backup metadata
+func metadataCompressType() string {
+	if config.Dedup {
+		return "dedup"
+	}
+	if config.Format != formatOCI {
+		return config.CompressType
+	}
+	if config.CompressType == "gzip" {
+		return "oci-zip"
+	}
+	return "oci-none"
+}
+
+// saveOCI exports the images with `docker save`, converts them into an OCI
+// Image Layout and archives the layout directory into tarballName, compressed
+// and encrypted according to the backup flags
+func saveOCI(cli DockerClient, ctx context.Context, imageNames []string, tarballName string) (EncryptionParams, error) {
+	workDir, err := os.MkdirTemp(filepath.Dir(tarballName), ".oci-")
+	if err != nil {
+		return EncryptionParams{}, err
+	}
+	defer os.RemoveAll(workDir)
+
+	dockerTar := filepath.Join(workDir, "docker.tar")
+	if err := saveDockerTar(cli, ctx, imageNames, dockerTar); err != nil {
+		return EncryptionParams{}, err
+	}
+
+	layoutDir := filepath.Join(workDir, "layout")
+	path, err := layout.Write(layoutDir, empty.Index)
+	if err != nil {
+		return EncryptionParams{}, fmt.Errorf("failed to create OCI layout: %w", err)
+	}
+
+	for _, imageName := range imageNames {
+		// Image IDs have no tag; tarball.Image then requires a single image
+		var tag *name.Tag
+		annotations := map[string]string{}
+		if parsed, err := name.NewTag(imageName); err == nil && !strings.HasPrefix(imageName, "sha256:") {
+			tag = &parsed
+			annotations["io.containerd.image.name"] = parsed.Name()
+			annotations["org.opencontainers.image.ref.name"] = parsed.TagStr()
+		}
+
+		img, err := tarball.ImageFromPath(dockerTar, tag)
+		if err != nil {
+			return EncryptionParams{}, fmt.Errorf("failed to read %s from docker save output: %w", imageName, err)
+		}
+		if img, err = toOCIImage(img); err != nil {
+			return EncryptionParams{}, fmt.Errorf("failed to convert %s to OCI media types: %w", imageName, err)
+		}
+		if err := path.AppendImage(img, layout.WithAnnotations(annotations)); err != nil {
+			return EncryptionParams{}, fmt.Errorf("failed to write %s to OCI layout: %w", imageName, err)
+		}
+	}
+
+	// The Docker tarball is no longer needed; free the space before archiving
+	os.Remove(dockerTar)
+
+	return archiveLayout(ctx, layoutDir, tarballName)
+}
+
+// saveDockerTar writes the uncompressed save archive of imageNames to path
+func saveDockerTar(cli DockerClient, ctx context.Context, imageNames []string, path string) error {
+	body, err := imageSave(cli, ctx, imageNames)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := io.Copy(file, &contextReader{ctx: ctx, r: body}); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// toOCIImage rewrites an image read from a `docker save` archive with OCI
+// manifest, config and layer media types. Older daemons save Docker schema 2
+// media types, which some OCI tooling refuses.
+func toOCIImage(img v1.Image) (v1.Image, error) {
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+
+	base := mutate.ConfigMediaType(mutate.MediaType(empty.Image, types.OCIManifestSchema1), types.OCIConfigJSON)
+	adds := make([]mutate.Addendum, 0, len(layers))
+	for _, layer := range layers {
+		adds = append(adds, mutate.Addendum{Layer: layer, MediaType: types.OCILayer})
+	}
+	converted, err := mutate.Append(base, adds...)
+	if err != nil {
+		return nil, err
+	}
+	// Keep the original config (history, rootfs, platform) instead of the one
+	// Append derived from the layers
+	return mutate.ConfigFile(converted, configFile)
+}
+
+// archiveLayout writes layoutDir as a tar stream into tarballName, with
+// oci-layout and index.json first so restore can recognize the archive from
+// its leading bytes
+func archiveLayout(ctx context.Context, layoutDir, tarballName string) (EncryptionParams, error) {
+	file, err := createOutput(ctx, tarballName)
+	if err != nil {
+		return EncryptionParams{}, err
+	}
+	defer file.Close()
+
+	out, params, err := newBackupWriter(throttle(ctx, file))
+	if err != nil {
+		return params, err
+	}
+
+	tw := tar.NewWriter(out)
+
+	addFile := func(path string) error {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(layoutDir, path)
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(tw, src)
+		return err
+	}
+
+	for _, name := range []string{ociLayoutFile, "index.json"} {
+		if err := addFile(filepath.Join(layoutDir, name)); err != nil {
+			return params, err
+		}
+	}
+	err = filepath.WalkDir(filepath.Join(layoutDir, "blobs"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return addFile(path)
+	})
+	if err != nil {
+		return params, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return params, err
+	}
+	if err := out.Close(); err != nil {
+		return params, err
+	}
+	return params, file.Close()
+}
+
+// backupFormat returns the format of a backup from its metadata. Metadata
+// written before the format was recorded is recognized by its CompressType.
+func backupFormat(info ImageInfo) string {
+	if info.Format != "" {
+		return info.Format
+	}
+	if strings.HasPrefix(info.CompressType, "oci-") {
+		return formatOCI
+	}
+	return formatDocker
+}
+
+// isOCIBackup reports whether a backup is an OCI Image Layout archive, from
+// its metadata or, for unencrypted files, by checking whether the first tar
+// entry is the oci-layout file. Stdin can only be read once, so a backup on
+// stdin is not checked.
+func isOCIBackup(path, compression string, encrypted bool) bool {
+	if info, err := loadImageInfo(path + ".json"); err == nil && backupFormat(info) == formatOCI {
+		return true
+	}
+	if encrypted || path == stdinPath {
+		return false
+	}
+
+	file, err := openBackup(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	reader, err := newDecompressReader(bufio.NewReader(file), compression)
+	if err != nil {
+		return false
+	}
+	defer reader.Close()
+
+	header, err := tar.NewReader(reader).Next()
+	return err == nil && header.Name == ociLayoutFile
+}
+
+// checkOCISupport fails early with a clear message when the daemon is too old
+// to load OCI Image Layout archives
+func checkOCISupport(cli DockerClient, ctx context.Context) error {
+	version, err := cli.ServerVersion(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to query Docker version: %w", err)
+	}
+	if versions.LessThan(version.APIVersion, ociMinAPIVersion) {
+		return fmt.Errorf("OCI layout archives require Docker 25 or newer to restore (daemon is %s, API %s)",
+			version.Version, version.APIVersion)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+)
+
+// --on-exist policies for a backup whose target name is already taken
+const (
+	onExistOverwrite = "overwrite"
+	onExistSkip      = "skip"
+	onExistFail      = "fail"
+	onExistRename    = "rename"
+)
+
+// errExists is returned by backupImage when --on-exist skip finds an existing
+// backup under the target name
+var errExists = errors.New("backup already exists")
+
+// claimedNames holds the backup names taken by this run and the image or
+// bundle each belongs to, so concurrent workers rendering the same name do not
+// write to the same file
+var (
+	claimedNames   = map[string]string{}
+	claimedNamesMu sync.Mutex
+)
+
+// releaseTarballName gives back the name claimed for a backup that failed,
+// so --on-exist no longer counts it as taken
+func releaseTarballName(tarballName string) {
+	claimedNamesMu.Lock()
+	delete(claimedNames, tarballName)
+	claimedNamesMu.Unlock()
+}
+
+// resetClaimedNames forgets the names claimed by earlier runs. Each scheduled
+// run checks the backup directory afresh, since backups of an earlier run may
+// have failed or been rotated away since.
+func resetClaimedNames() {
+	claimedNamesMu.Lock()
+	clear(claimedNames)
+	claimedNamesMu.Unlock()
+}
+
+// validateOnExist checks the --on-exist value
+func validateOnExist(policy string) error {
+	switch policy {
+	case onExistOverwrite, onExistSkip, onExistFail, onExistRename:
+		return nil
+	}
+	return fmt.Errorf("invalid --on-exist %q (expected overwrite, skip, fail or rename)", policy)
+}
+
+// resolveTarballName applies --on-exist to the target of a new backup of
+// owner. It returns the name to write to, the existing name with errExists for
+// skip, or an error for fail. Rename appends -1, -2, ... before the extension.
+// Overwrite replaces existing backups, but two images of the same run
+// rendering the same name are an error, since one would silently replace the
+// other.
+func resolveTarballName(tarballName, owner string) (string, error) {
+	claimedNamesMu.Lock()
+	defer claimedNamesMu.Unlock()
+
+	if config.OnExist == onExistOverwrite {
+		if other, ok := claimedNames[tarballName]; ok && other != owner {
+			return "", fmt.Errorf("--name-template renders %s for both %s and %s (add a field such as {{.Tag}} or {{.ShortID}} to tell them apart)",
+				tarballName, other, owner)
+		}
+		claimedNames[tarballName] = owner
+		return tarballName, nil
+	}
+
+	exists, err := nameTaken(tarballName)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		claimedNames[tarballName] = owner
+		return tarballName, nil
+	}
+
+	switch config.OnExist {
+	case onExistSkip:
+		return tarballName, errExists
+	case onExistFail:
+		return "", fmt.Errorf("%s already exists (use --on-exist overwrite, skip or rename)", tarballName)
+	}
+
+	ext := backupExtension()
+	stem := strings.TrimSuffix(tarballName, ext)
+	for n := 1; ; n++ {
+		candidate := fmt.Sprintf("%s-%d%s", stem, n, ext)
+		exists, err := nameTaken(candidate)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			claimedNames[candidate] = owner
+			return candidate, nil
+		}
+	}
+}
+
+// nameTaken reports whether a backup, one of its parts or its metadata
+// exists under tarballName, or another worker of this run claimed it
+func nameTaken(tarballName string) (bool, error) {
+	if _, ok := claimedNames[tarballName]; ok {
+		return true, nil
+	}
+
+	if isRemotePath(tarballName) {
+		for _, path := range []string{tarballName, tarballName + ".json"} {
+			file, err := openRemoteFile(path)
+			if err == nil {
+				file.Close()
+				return true, nil
+			}
+			if !errors.Is(err, fs.ErrNotExist) {
+				return false, fmt.Errorf("failed to check for an existing backup: %w", err)
+			}
+		}
+		return false, nil
+	}
+
+	if len(findParts(tarballName)) > 0 {
+		return true, nil
+	}
+	for _, path := range []string{tarballName, tarballName + ".json"} {
+		_, err := os.Stat(path)
+		if err == nil {
+			return true, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return false, fmt.Errorf("failed to check for an existing backup: %w", err)
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/docker/docker/api/types/image"
+)
+
+func TestResolveTarballNameReleased(t *testing.T) {
+	inspect := func(string) (image.InspectResponse, error) {
+		return image.InspectResponse{ID: "sha256:0123456789abcdef", RepoTags: []string{"app:1.0"}, Os: "linux", Architecture: "amd64"}, nil
+	}
+	saveErr := errors.New("daemon went away")
+
+	tests := []struct {
+		name     string
+		onExist  string
+		previous func(t *testing.T)
+		want     string
+	}{
+		{
+			name:    "skip after a failed backup",
+			onExist: onExistSkip,
+			previous: func(t *testing.T) {
+				cli := newMockDockerClient(t)
+				cli.InspectFunc = inspect
+				cli.SaveFunc = func([]string) (io.ReadCloser, error) {
+					return nil, saveErr
+				}
+				if err := backupImage(cli, context.Background(), "app:1.0"); !errors.Is(err, saveErr) {
+					t.Fatalf("backupImage() error = %v, want %v", err, saveErr)
+				}
+			},
+			want: "app_1.0.tar.gz",
+		},
+		{
+			name:    "rename after a reset",
+			onExist: onExistRename,
+			previous: func(t *testing.T) {
+				if _, err := resolveTarballName(backupDirPath("app_1.0.tar.gz"), "app:1.0"); err != nil {
+					t.Fatal(err)
+				}
+				resetClaimedNames()
+			},
+			want: "app_1.0.tar.gz",
+		},
+		{
+			name:    "rename while claimed",
+			onExist: onExistRename,
+			previous: func(t *testing.T) {
+				if _, err := resolveTarballName(backupDirPath("app_1.0.tar.gz"), "app:1.0"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: "app_1.0-1.tar.gz",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupBackupTest(t, compressionGzip)
+			config.OnExist = tt.onExist
+			tt.previous(t)
+
+			got, err := resolveTarballName(backupDirPath("app_1.0.tar.gz"), "app:1.0")
+			if err != nil {
+				t.Fatalf("resolveTarballName() error = %v", err)
+			}
+			if want := backupDirPath(tt.want); got != want {
+				t.Errorf("resolveTarballName() = %s, want %s", got, want)
+			}
+		})
+	}
+}
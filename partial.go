@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// partialExtension marks backup files that are still being written. A local
+// backup is saved under its name plus this extension and only renamed once
+// its metadata is written, so a failed or interrupted save never leaves a
+// file that looks like a complete backup.
+const partialExtension = ".partial"
+
+// partialName returns the name a backup is saved under until commitBackup.
+// Remote uploads only appear once complete, so they keep their name.
+func partialName(tarballName string) string {
+	if isRemotePath(tarballName) {
+		return tarballName
+	}
+	return tarballName + partialExtension
+}
+
+// commitBackup renames the data files of a saved backup, the tarball or its
+// parts, from their partial names to their final names
+func commitBackup(tarballName string) error {
+	partial := partialName(tarballName)
+	if partial == tarballName {
+		return nil
+	}
+	files := []string{partial}
+	if _, err := os.Stat(partial); err != nil {
+		files = findParts(partial)
+	}
+	for _, file := range files {
+		if err := os.Rename(file, strings.TrimSuffix(file, partialExtension)); err != nil {
+			return fmt.Errorf("failed to complete backup: %w", err)
+		}
+	}
+	return nil
+}
+
+// incompleteMinAge keeps prune --incomplete away from backups that are still
+// being written by another run, whose files keep changing
+const incompleteMinAge = time.Hour
+
+// pruneIncomplete removes what crashed backups left in dir: .partial data
+// files, the sidecars written for them and temporary OCI layout and blob
+// files. It returns the number of files and directories removed and their
+// size.
+func pruneIncomplete(dir string) (int, int64, error) {
+	cutoff := time.Now().Add(-incompleteMinAge)
+	var stale []string
+	var size int64
+	abandoned := make(map[string]bool)
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir() && strings.HasPrefix(d.Name(), ".oci-"):
+			if info.ModTime().Before(cutoff) {
+				stale = append(stale, path)
+			}
+			return filepath.SkipDir
+		case d.IsDir():
+			return nil
+		case isPartialFile(d.Name()), strings.HasPrefix(d.Name(), ".tmp-") && filepath.Dir(path) == blobDir(dir):
+			if info.ModTime().Before(cutoff) {
+				stale = append(stale, path)
+				size += info.Size()
+				if isPartialFile(d.Name()) {
+					abandoned[logicalBackupPath(strings.TrimSuffix(path, partialExtension))] = true
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Metadata is written just before a backup is renamed into place, so a
+	// crash in between leaves a sidecar whose data only exists as .partial
+	for tarballName := range abandoned {
+		if _, _, err := statBackup(tarballName); err == nil {
+			continue
+		}
+		for _, sidecar := range []string{tarballName + ".json", tarballName + signatureExtension} {
+			if _, err := os.Stat(sidecar); err == nil {
+				stale = append(stale, sidecar)
+			}
+		}
+	}
+
+	removed := 0
+	for _, path := range stale {
+		if config.DryRun {
+			logger.Info("Would remove incomplete backup file "+path, "path", path)
+			removed++
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			logger.Error(fmt.Sprintf("Failed to remove %s: %v", path, err), "path", path, "error", err)
+			continue
+		}
+		logger.Debug("Removed incomplete backup file "+path, "path", path)
+		removed++
+	}
+	return removed, size, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Platform is an os/arch[/variant] platform selected with --platform
+type Platform struct {
+	OS           string
+	Architecture string
+	Variant      string
+}
+
+func (p Platform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// matches reports whether an image of the given platform satisfies p. A
+// platform without a variant accepts any variant of its architecture.
+func (p Platform) matches(os, architecture, variant string) bool {
+	return p.OS == os && p.Architecture == architecture && (p.Variant == "" || p.Variant == variant)
+}
+
+// parsePlatform parses a --platform value such as linux/amd64 or linux/arm/v7
+func parsePlatform(s string) (Platform, error) {
+	parts := strings.Split(strings.ToLower(strings.TrimSpace(s)), "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return Platform{}, fmt.Errorf("invalid --platform %q (expected os/arch or os/arch/variant, such as linux/amd64)", s)
+	}
+	for _, part := range parts {
+		if part == "" {
+			return Platform{}, fmt.Errorf("invalid --platform %q (expected os/arch or os/arch/variant, such as linux/amd64)", s)
+		}
+	}
+	p := Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// selectedPlatform is the parsed --platform, nil when every platform the
+// daemon has is saved
+var selectedPlatform *Platform
+
+// localPlatform checks that the selected platform of img is present in the
+// daemon and returns the platform that will be saved along with its unpacked
+// size, or 0 when the daemon does not report one. Daemons using the containerd
+// image store list the platforms of multi-platform images; the classic store
+// keeps a single platform per image, which must be the selected one.
+func localPlatform(cli DockerClient, ctx context.Context, imageName string, img image.InspectResponse) (Platform, int64, error) {
+	want := *selectedPlatform
+
+	inspect, err := cli.ImageInspect(ctx, imageName, client.ImageInspectWithManifests(true))
+	if err != nil {
+		// Daemons older than API 1.48 cannot list manifests
+		logger.Debug(fmt.Sprintf("Could not list the platforms of %s: %v", imageName, err), "image", imageName, "error", err)
+	}
+
+	var available []string
+	for _, m := range inspect.Manifests {
+		if m.Kind != image.ManifestKindImage || m.ImageData == nil || !m.Available {
+			continue
+		}
+		p := m.ImageData.Platform
+		have := Platform{OS: p.OS, Architecture: p.Architecture, Variant: p.Variant}
+		if want.matches(have.OS, have.Architecture, have.Variant) {
+			return have, m.ImageData.Size.Unpacked, nil
+		}
+		available = appendUnique(available, have.String())
+	}
+	if len(available) > 0 {
+		return Platform{}, 0, fmt.Errorf("platform %s of %s is not present locally (available: %s); back up with --always-pull or run docker pull --platform %s %s",
+			want, imageName, strings.Join(available, ", "), want, imageName)
+	}
+
+	if !want.matches(img.Os, img.Architecture, img.Variant) {
+		have := Platform{OS: img.Os, Architecture: img.Architecture, Variant: img.Variant}
+		return Platform{}, 0, fmt.Errorf("platform %s of %s is not present locally (the daemon has %s)", want, imageName, have)
+	}
+	return Platform{OS: img.Os, Architecture: img.Architecture, Variant: img.Variant}, img.Size, nil
+}
+
+// oci converts p for the Docker API, which needs API 1.48 (Docker 28) to save
+// a single platform
+func (p Platform) oci() ocispec.Platform {
+	return ocispec.Platform{OS: p.OS, Architecture: p.Architecture, Variant: p.Variant}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// containerdSnapshotter is reported in the driver status of daemons using the
+// containerd image store, the only store that keeps more than one platform
+const containerdSnapshotter = "io.containerd.snapshotter.v1"
+
+// fetchImageIndex returns the manifest list an image was pulled from and its
+// platforms, or a nil index when the image has no registry digest or its
+// registry manifest is a single-platform image. The digest pins the exact list
+// that was pulled, even if the tag has moved since.
+func fetchImageIndex(ctx context.Context, imageName string, repoDigests []string) (v1.ImageIndex, []string, error) {
+	if len(repoDigests) == 0 {
+		return nil, nil, nil
+	}
+
+	digest := repoDigests[0]
+	if named, err := name.ParseReference(imageName); err == nil {
+		for _, candidate := range repoDigests {
+			if ref, err := name.NewDigest(candidate); err == nil && ref.Context() == named.Context() {
+				digest = candidate
+				break
+			}
+		}
+	}
+	ref, err := name.NewDigest(digest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid repo digest %s: %w", digest, err)
+	}
+
+	logger.Debug(fmt.Sprintf("Fetching manifest list of %s from %s", imageName, ref.Context().RegistryStr()), "image", imageName, "digest", digest)
+	desc, err := remote.Get(ref, remote.WithContext(ctx), remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch manifest list of %s: %w", imageName, err)
+	}
+	if !desc.MediaType.IsIndex() {
+		return nil, nil, nil
+	}
+	index, err := desc.ImageIndex()
+	if err != nil {
+		return nil, nil, err
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, nil, err
+	}
+	return index, indexPlatforms(manifest), nil
+}
+
+// indexPlatforms lists the platforms of a manifest list as os/arch[/variant].
+// Attestation manifests, which have the platform unknown/unknown, are left out.
+func indexPlatforms(manifest *v1.IndexManifest) []string {
+	var platforms []string
+	for _, desc := range manifest.Manifests {
+		if desc.Platform == nil || desc.Platform.OS == "unknown" {
+			continue
+		}
+		platform := desc.Platform.OS + "/" + desc.Platform.Architecture
+		if desc.Platform.Variant != "" {
+			platform += "/" + desc.Platform.Variant
+		}
+		platforms = appendUnique(platforms, platform)
+	}
+	return platforms
+}
+
+// saveIndex writes a manifest list with the images of all its platforms into
+// an OCI Image Layout archive. The layers come from the registry, since the
+// daemon only holds its own platform.
+func saveIndex(ctx context.Context, imageName string, index v1.ImageIndex, tarballName string) (EncryptionParams, error) {
+	if err := os.MkdirAll(filepath.Dir(tarballName), 0755); err != nil {
+		return EncryptionParams{}, err
+	}
+	workDir, err := os.MkdirTemp(filepath.Dir(tarballName), ".oci-")
+	if err != nil {
+		return EncryptionParams{}, err
+	}
+	defer os.RemoveAll(workDir)
+
+	layoutDir := filepath.Join(workDir, "layout")
+	path, err := layout.Write(layoutDir, empty.Index)
+	if err != nil {
+		return EncryptionParams{}, fmt.Errorf("failed to create OCI layout: %w", err)
+	}
+
+	annotations := map[string]string{}
+	if tag, err := name.NewTag(imageName); err == nil && !strings.HasPrefix(imageName, "sha256:") {
+		annotations["io.containerd.image.name"] = tag.Name()
+		annotations["org.opencontainers.image.ref.name"] = tag.TagStr()
+	}
+	if err := path.AppendIndex(index, layout.WithAnnotations(annotations)); err != nil {
+		return EncryptionParams{}, fmt.Errorf("failed to download the platform images of %s: %w", imageName, err)
+	}
+
+	return archiveLayout(ctx, layoutDir, tarballName)
+}
+
+// checkPlatformSupport warns before loading a multi-platform backup into a
+// daemon whose image store keeps only its own platform
+func checkPlatformSupport(cli DockerClient, ctx context.Context, tarballPath string, platforms []string) {
+	if len(platforms) < 2 {
+		return
+	}
+	info, err := cli.Info(ctx)
+	if err != nil {
+		return
+	}
+	for _, status := range info.DriverStatus {
+		if status[1] == containerdSnapshotter {
+			return
+		}
+	}
+	logger.Warn(fmt.Sprintf("Warning: %s contains %d platforms (%s), but the daemon does not use the containerd image store and only loads its own platform (%s/%s)",
+		tarballPath, len(platforms), strings.Join(platforms, ", "), info.OSType, info.Architecture),
+		"path", tarballPath, "platforms", platforms)
+}
+
+// isIndexMediaType reports whether a descriptor points to a manifest list
+func isIndexMediaType(mediaType string) bool {
+	return types.MediaType(mediaType).IsIndex()
+}
+
+// checkPlatformMatch warns before loading a single-platform backup built for
+// another OS or architecture than the daemon's, since its containers would
+// fail to start or run under emulation. Multi-platform backups are covered
+// by checkPlatformSupport.
+func checkPlatformMatch(cli DockerClient, ctx context.Context, tarballPath string, info ImageInfo) {
+	if info.Architecture == "" || len(info.Platforms) > 1 {
+		return
+	}
+	version, err := cli.ServerVersion(ctx)
+	if err != nil {
+		return
+	}
+	if info.Architecture == version.Arch && (info.Os == "" || info.Os == version.Os) {
+		return
+	}
+	platform := info.Os + "/" + info.Architecture
+	if info.Variant != "" {
+		platform += "/" + info.Variant
+	}
+	logger.Warn(fmt.Sprintf("Warning: %s was backed up from a %s image, but the daemon runs on %s/%s",
+		tarballPath, platform, version.Os, version.Arch),
+		"path", tarballPath, "platform", platform, "daemon_platform", version.Os+"/"+version.Arch)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// WorkerPool runs a function over the items submitted to it in a fixed number
+// of goroutines, so --workers 3 means exactly three goroutines however many
+// items there are. Items wait in Submit until a worker is idle.
+type WorkerPool[T, R any] struct {
+	ctx       context.Context
+	items     chan T
+	results   chan R
+	workers   sync.WaitGroup
+	collected []R
+	done      chan struct{}
+}
+
+// newWorkerPool starts workers goroutines that run fn on each submitted item.
+// fn also receives the number of the worker running it, from 1. Once ctx is
+// done the pool takes no more items.
+func newWorkerPool[T, R any](ctx context.Context, workers int, fn func(worker int, item T) R) *WorkerPool[T, R] {
+	p := &WorkerPool[T, R]{
+		ctx:     ctx,
+		items:   make(chan T),
+		results: make(chan R),
+		done:    make(chan struct{}),
+	}
+	for id := 1; id <= max(workers, 1); id++ {
+		p.workers.Add(1)
+		go func(id int) {
+			defer p.workers.Done()
+			for item := range p.items {
+				p.results <- fn(id, item)
+			}
+		}(id)
+	}
+	go func() {
+		defer close(p.done)
+		for result := range p.results {
+			p.collected = append(p.collected, result)
+		}
+	}()
+	return p
+}
+
+// Submit hands item to the next idle worker, waiting until one is. It returns
+// false without running item when the pool's context is done first.
+func (p *WorkerPool[T, R]) Submit(item T) bool {
+	if p.ctx.Err() != nil {
+		return false
+	}
+	select {
+	case p.items <- item:
+		return true
+	case <-p.ctx.Done():
+		return false
+	}
+}
+
+// Wait stops the pool from taking more items, waits for the submitted ones to
+// finish and returns their results in the order they finished
+func (p *WorkerPool[T, R]) Wait() []R {
+	close(p.items)
+	p.workers.Wait()
+	close(p.results)
+	<-p.done
+	return p.collected
+}
+
+// ioSlots limits how many backups save and compress at once with
+// --io-workers, while the other workers inspect and prepare their images. It
+// is nil when every worker may write.
+var ioSlots chan struct{}
+
+// acquireIO waits for an --io-workers slot and returns the function that
+// frees it. It fails when ctx is done first.
+func acquireIO(ctx context.Context) (func(), error) {
+	if ioSlots == nil {
+		return func() {}, nil
+	}
+	select {
+	case ioSlots <- struct{}{}:
+		return func() { <-ioSlots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
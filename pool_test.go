@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync/atomic"
+	"testing"
+)
+
+func TestWorkerPoolConcurrency(t *testing.T) {
+	const workers, items = 3, 20
+
+	var inFlight, peak atomic.Int32
+	started := make(chan int, items)
+	release := make(chan struct{})
+	pool := newWorkerPool(context.Background(), workers, func(_ int, item int) int {
+		n := inFlight.Add(1)
+		for {
+			old := peak.Load()
+			if n <= old || peak.CompareAndSwap(old, n) {
+				break
+			}
+		}
+		started <- item
+		// Hold every worker until all of them are busy
+		<-release
+		inFlight.Add(-1)
+		return item * 2
+	})
+
+	submitted := make(chan struct{})
+	go func() {
+		defer close(submitted)
+		for i := 0; i < items; i++ {
+			if !pool.Submit(i) {
+				t.Errorf("Submit(%d) refused an item", i)
+			}
+		}
+	}()
+	// With every worker held, the next Submit blocks, so no more can start
+	for i := 0; i < workers; i++ {
+		<-started
+	}
+	if got := inFlight.Load(); got != workers {
+		t.Errorf("%d items running with every worker held, want %d", got, workers)
+	}
+	close(release)
+	<-submitted
+	results := pool.Wait()
+
+	if got := peak.Load(); got != workers {
+		t.Errorf("peak concurrency = %d, want %d", got, workers)
+	}
+	if len(results) != items {
+		t.Fatalf("Wait() returned %d results, want %d", len(results), items)
+	}
+	sort.Ints(results)
+	for i, result := range results {
+		if result != i*2 {
+			t.Errorf("results[%d] = %d, want %d", i, result, i*2)
+		}
+	}
+}
+
+func TestWorkerPoolCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	pool := newWorkerPool(ctx, 2, func(_ int, item int) int { return item })
+	if !pool.Submit(1) {
+		t.Fatal("Submit() refused an item before the context was cancelled")
+	}
+	cancel()
+	if pool.Submit(2) {
+		t.Error("Submit() took an item after the context was cancelled")
+	}
+	if results := pool.Wait(); len(results) != 1 || results[0] != 1 {
+		t.Errorf("Wait() = %v, want [1]", results)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/jsonmessage"
+)
+
+// errPulled marks a restore that recovered by pulling from a registry instead
+// of loading the backup
+var errPulled = errors.New("pulled from registry")
+
+// pullFallback recovers from a failed load by pulling the images recorded in
+// the backup's metadata. The returned error wraps errPulled on success so the
+// run summary reports the image as pulled rather than loaded.
+func pullFallback(cli DockerClient, ctx context.Context, tarballPath, localPath string, loadErr error) error {
+	info, err := loadImageInfo(localPath + ".json")
+	if err != nil {
+		return fmt.Errorf("%w; no metadata to pull from a registry: %v", loadErr, err)
+	}
+
+	refs, err := pullReferences(info)
+	if err != nil {
+		return fmt.Errorf("%w; cannot pull from a registry: %v", loadErr, err)
+	}
+
+	logger.Warn(fmt.Sprintf("Could not load %s, pulling %s from the registry (--pull-fallback)", tarballPath, strings.Join(refs, ", ")),
+		"path", tarballPath, "images", refs)
+	logger.Debug(fmt.Sprintf("Load error: %v", loadErr), "path", tarballPath, "error", loadErr)
+
+	platform := ""
+	if info.Os != "" && info.Architecture != "" {
+		platform = info.Os + "/" + info.Architecture
+	}
+	for _, ref := range refs {
+		err := withRetry(ctx, "pull "+ref, func() error {
+			return pullImage(cli, ctx, ref, platform)
+		})
+		if err != nil {
+			return fmt.Errorf("%w; pulling %s also failed: %v", loadErr, ref, err)
+		}
+	}
+
+	logSuccess(fmt.Sprintf("Pulled %s from the registry instead of loading %s", strings.Join(refs, ", "), tarballPath), "path", tarballPath, "images", refs)
+
+	if err := finishRestore(cli, ctx, refs); err != nil {
+		return err
+	}
+	return fmt.Errorf("%w (load failed: %v)", errPulled, loadErr)
+}
+
+// pullReferences returns the references to pull for a backup: the bundled
+// images (restricted by --only) or the single image that was saved. Image IDs
+// cannot be pulled.
+func pullReferences(info ImageInfo) ([]string, error) {
+	images := []BundledImage{{ImageName: info.ImageName, Tags: info.Tags}}
+	if len(info.Images) > 0 {
+		images = info.Images
+	}
+
+	var refs []string
+	for _, img := range images {
+		if len(config.Only) > 0 && !containsReference(config.Only, img.ImageName) {
+			continue
+		}
+		if len(img.Tags) == 0 {
+			return nil, fmt.Errorf("%s was backed up by ID and has no registry reference", img.ImageName)
+		}
+		if _, err := reference.ParseNormalizedNamed(img.ImageName); err != nil {
+			return nil, fmt.Errorf("invalid image reference %s: %w", img.ImageName, err)
+		}
+		refs = append(refs, img.ImageName)
+	}
+	if len(refs) == 0 {
+		return nil, fmt.Errorf("none of %s is in this backup", strings.Join(config.Only, ", "))
+	}
+	return refs, nil
+}
+
+// containsReference reports whether refs contains a reference equal to name
+func containsReference(refs []string, name string) bool {
+	for _, ref := range refs {
+		if sameReference(ref, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// pullImage pulls ref with the credentials of --registry-auth or from the
+// docker CLI configuration
+func pullImage(cli DockerClient, ctx context.Context, ref, platform string) error {
+	auth, err := pullCredentials(ref)
+	if err != nil {
+		return fmt.Errorf("failed to read registry credentials: %w", err)
+	}
+
+	body, err := cli.ImagePull(ctx, ref, image.PullOptions{RegistryAuth: auth, Platform: platform})
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	// Every progress message is shown with --verbose, otherwise the download
+	// is summed up periodically; errors arrive in the message stream
+	if debugEnabled() {
+		return jsonmessage.DisplayJSONMessagesStream(body, os.Stdout, 0, false, nil)
+	}
+	return logPullProgress(ref, body)
+}
+
+// pullProgressInterval is how often a pull without --verbose logs how much
+// it has downloaded
+const pullProgressInterval = 5 * time.Second
+
+// logPullProgress reads the messages of a pull, logging the bytes downloaded
+// across all layers every pullProgressInterval. It returns the error the
+// daemon reported, if any.
+func logPullProgress(ref string, r io.Reader) error {
+	layers := make(map[string]jsonmessage.JSONProgress)
+	last := time.Now()
+	decoder := json.NewDecoder(r)
+	for {
+		var msg jsonmessage.JSONMessage
+		if err := decoder.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if msg.Error != nil {
+			return msg.Error
+		}
+
+		switch progress := layers[msg.ID]; {
+		case msg.Status == "Downloading" && msg.Progress != nil:
+			layers[msg.ID] = *msg.Progress
+		case msg.Status == "Download complete" && progress.Total > 0:
+			progress.Current = progress.Total
+			layers[msg.ID] = progress
+		}
+
+		if time.Since(last) >= pullProgressInterval && len(layers) > 0 {
+			var current, total int64
+			for _, progress := range layers {
+				current += progress.Current
+				total += progress.Total
+			}
+			logger.Info(fmt.Sprintf("Pulling %s: %s of %s downloaded", ref, formatBytes(current), formatBytes(total)),
+				"image", ref, "bytes", current, "total_bytes", total)
+			last = time.Now()
+		}
+	}
+}
+
+// inspectImage inspects an image to back up. With --pull, an image the daemon
+// does not have is pulled from its registry first, and with --always-pull
+// every image is. The pull asks for the --platform when one is selected.
+func inspectImage(cli DockerClient, ctx context.Context, imageName string) (image.InspectResponse, error) {
+	var img image.InspectResponse
+	inspect := func() error {
+		return withRetry(ctx, "inspect "+imageName, func() (err error) {
+			img, _, err = cli.ImageInspectWithRaw(ctx, imageName)
+			return err
+		})
+	}
+
+	// Images found by --all or --filter were local, so one that is gone now
+	// was removed on purpose and is not pulled back
+	err := inspect()
+	missing := errdefs.IsNotFound(err) && config.Pull && !enumeratedImages[imageName]
+	if !missing && (err != nil || !config.AlwaysPull) {
+		return img, err
+	}
+
+	if missing {
+		logger.Info(fmt.Sprintf("%s is not present locally, pulling it (--pull)", imageName), "image", imageName)
+	} else {
+		logger.Info(fmt.Sprintf("Pulling %s (--always-pull)", imageName), "image", imageName)
+	}
+	err = withRetry(ctx, "pull "+imageName, func() error {
+		return pullImage(cli, ctx, imageName, config.Platform)
+	})
+	if err != nil {
+		if missing {
+			return img, fmt.Errorf("not present locally and pulling it failed: %w", err)
+		}
+		return img, fmt.Errorf("pulling it failed: %w", err)
+	}
+	logSuccess("Pulled "+imageName, "image", imageName)
+	if missing {
+		pulledImages.Store(imageName, true)
+	}
+	return img, inspect()
+}
+
+// pulledImages holds the images this run pulled because the daemon did not
+// have them, which --remove-after-backup removes again
+var pulledImages sync.Map
+
+// removePulledImage untags an image pulled by this run once its backup is
+// done, with --remove-after-backup. The image itself is deleted when no other
+// tag or container uses it. Failing to remove it does not fail the backup.
+func removePulledImage(cli DockerClient, ctx context.Context, imageName string) {
+	if _, ok := pulledImages.LoadAndDelete(imageName); !ok || !config.RemoveAfter {
+		return
+	}
+	if _, err := cli.ImageRemove(context.WithoutCancel(ctx), imageName, image.RemoveOptions{}); err != nil {
+		logger.Warn(fmt.Sprintf("Warning: failed to remove pulled image %s: %v", imageName, err), "image", imageName, "error", err)
+		return
+	}
+	logger.Info(fmt.Sprintf("Removed pulled image %s (--remove-after-backup)", imageName), "image", imageName)
+}
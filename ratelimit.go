@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimitBurst is the largest write let through at once. Smaller bursts
+// spread the traffic more evenly but wake the writers more often.
+const rateLimitBurst = 256 * 1024
+
+// rateLimiter caps the combined write rate of all workers with --rate-limit.
+// It is nil without a limit.
+var rateLimiter *rate.Limiter
+
+// parseRate parses rates such as 50MB/s, 512K or 1048576 bytes per second
+func parseRate(value string) (int64, error) {
+	text := strings.TrimSpace(value)
+	text = strings.TrimSuffix(strings.TrimSuffix(text, "/s"), "ps")
+	bytes, err := parseSize(text)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q", value)
+	}
+	return bytes, nil
+}
+
+// setRateLimit shares a limit of bytesPerSecond among all backup writers
+func setRateLimit(bytesPerSecond int64) {
+	rateLimiter = rate.NewLimiter(rate.Limit(bytesPerSecond), int(min(bytesPerSecond, rateLimitBurst)))
+}
+
+// throttle returns w limited by --rate-limit, or w itself without a limit.
+// With --rate-limit-per-worker, each call gets a limiter of its own; a
+// worker writes one backup stream at a time.
+func throttle(ctx context.Context, w io.Writer) io.Writer {
+	if rateLimiter == nil {
+		return w
+	}
+	limiter := rateLimiter
+	if config.PerWorkerLimit {
+		limiter = rate.NewLimiter(rateLimiter.Limit(), rateLimiter.Burst())
+	}
+	return &rateLimitedWriter{ctx: ctx, w: w, limiter: limiter}
+}
+
+// rateLimitedWriter waits for its limiter before each chunk of a write, so
+// one large write cannot exceed the burst. Waiting ends when ctx is
+// cancelled, so an interrupt is not held up by the limit.
+type rateLimitedWriter struct {
+	ctx     context.Context
+	w       io.Writer
+	limiter *rate.Limiter
+}
+
+func (t *rateLimitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), t.limiter.Burst())
+		if err := t.limiter.WaitN(t.ctx, n); err != nil {
+			return written, err
+		}
+		m, err := t.w.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/distribution/reference"
+	dockerconfig "github.com/docker/cli/cli/config"
+	"github.com/docker/docker/api/types/registry"
+)
+
+// registryAuthEnv supplies --registry-auth when the flag is not given, so the
+// credentials do not show up in the process list
+const registryAuthEnv = "BACKUP_REGISTRY_AUTH"
+
+// dockerHubAuthKey is the key the docker CLI stores Docker Hub credentials
+// under, registry.IndexServer in the docker packages
+const dockerHubAuthKey = "https://index.docker.io/v1/"
+
+// registryAuth returns the encoded X-Registry-Auth value for pulling ref from
+// the credentials `docker login` stored. It resolves them the way the docker
+// CLI's ResolveAuthConfig does: the config file and its credsStore and
+// credHelpers decide, with Docker Hub under its index server key. It returns
+// "" when there are no credentials for the registry.
+func registryAuth(ref string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return "", err
+	}
+	configKey := reference.Domain(named)
+	if configKey == "docker.io" {
+		configKey = dockerHubAuthKey
+	}
+
+	configFile, err := dockerconfig.Load(dockerConfigDir())
+	if err != nil {
+		return "", err
+	}
+	auth, err := configFile.GetAuthConfig(configKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to get credentials for %s: %w", configKey, err)
+	}
+	if auth.Username == "" && auth.IdentityToken == "" && auth.RegistryToken == "" {
+		return "", nil
+	}
+	return registry.EncodeAuthConfig(registry.AuthConfig(auth))
+}
+
+// pullAuth holds the credentials given with backup --registry-auth
+var pullAuth *registry.AuthConfig
+
+// parseRegistryAuth decodes a --registry-auth value: an AuthConfig JSON
+// object, encoded with base64 like the docker API's X-Registry-Auth header.
+// Errors never quote the value, since it holds a password.
+func parseRegistryAuth(value string) (*registry.AuthConfig, error) {
+	value = strings.TrimSpace(value)
+	data, err := base64.URLEncoding.DecodeString(value)
+	if err != nil {
+		data, err = base64.StdEncoding.DecodeString(value)
+	}
+	if err != nil {
+		return nil, errors.New("invalid --registry-auth: not base64 encoded")
+	}
+
+	var auth registry.AuthConfig
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&auth); err != nil {
+		return nil, errors.New("invalid --registry-auth: not an AuthConfig JSON object")
+	}
+	// Accept the auth field of config.json entries too
+	if auth.Auth != "" && auth.Username == "" {
+		decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if err != nil {
+			return nil, errors.New("invalid --registry-auth: auth is not base64 encoded")
+		}
+		auth.Username, auth.Password, _ = strings.Cut(string(decoded), ":")
+		auth.Auth = ""
+	}
+	if auth.Username == "" && auth.IdentityToken == "" && auth.RegistryToken == "" {
+		return nil, errors.New("invalid --registry-auth: no username or token")
+	}
+	return &auth, nil
+}
+
+// pullCredentials returns the X-Registry-Auth value for pulling ref: the
+// --registry-auth credentials when their serveraddress is the registry of ref
+// or empty, otherwise those from `docker login` unless
+// --registry-auth-from-docker-config=false
+func pullCredentials(ref string) (string, error) {
+	if pullAuth != nil {
+		named, err := reference.ParseNormalizedNamed(ref)
+		if err != nil {
+			return "", err
+		}
+		if pullAuth.ServerAddress == "" || authKeyHost(pullAuth.ServerAddress) == authKeyHost(reference.Domain(named)) {
+			return registry.EncodeAuthConfig(*pullAuth)
+		}
+	}
+	if !config.DockerAuth {
+		return "", nil
+	}
+	return registryAuth(ref)
+}
+
+// authKeyHost reduces a --registry-auth serveraddress, which may be a bare
+// host or a URL, to its host
+func authKeyHost(key string) string {
+	key = strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+	host, _, _ := strings.Cut(key, "/")
+	if host == "index.docker.io" || host == "registry-1.docker.io" {
+		return "docker.io"
+	}
+	return host
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/registry"
+)
+
+// testSecret is the password in the test credentials; it must never show up
+// in an error
+const testSecret = "s3cret-pa55"
+
+// setupRegistryAuthTest writes a docker config with credentials for Docker
+// Hub and parses --registry-auth credentials for registry.internal
+func setupRegistryAuthTest(t *testing.T) {
+	t.Helper()
+	config = defaultConfig()
+	dir := t.TempDir()
+	t.Setenv("DOCKER_CONFIG", dir)
+	hub := base64.StdEncoding.EncodeToString([]byte("hubuser:hubpass"))
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), []byte(`{"auths":{"`+dockerHubAuthKey+`":{"auth":"`+hub+`"}}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	auth, err := parseRegistryAuth(base64.URLEncoding.EncodeToString([]byte(`{"username":"ci","password":"` + testSecret + `","serveraddress":"registry.internal"}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pullAuth = auth
+	t.Cleanup(func() {
+		config = defaultConfig()
+		pullAuth = nil
+	})
+}
+
+func TestPullImageRegistryAuth(t *testing.T) {
+	tests := []struct {
+		name       string
+		ref        string
+		dockerAuth bool
+		wantUser   string
+		wantPass   string
+	}{
+		{"matching serveraddress", "registry.internal/apps/api:2.3", true, "ci", testSecret},
+		{"other registry falls back to docker config", "nginx:latest", true, "hubuser", "hubpass"},
+		{"docker config disabled", "nginx:latest", false, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupRegistryAuthTest(t)
+			config.DockerAuth = tt.dockerAuth
+
+			var header string
+			cli := newMockDockerClient(t)
+			cli.PullFunc = func(ref string, options image.PullOptions) (io.ReadCloser, error) {
+				header = options.RegistryAuth
+				return io.NopCloser(strings.NewReader("")), nil
+			}
+			if err := pullImage(cli, context.Background(), tt.ref, ""); err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.wantUser == "" {
+				if header != "" {
+					t.Errorf("RegistryAuth = %q, want none", header)
+				}
+				return
+			}
+			auth, err := registry.DecodeAuthConfig(header)
+			if err != nil {
+				t.Fatalf("RegistryAuth %q does not decode: %v", header, err)
+			}
+			if auth.Username != tt.wantUser || auth.Password != tt.wantPass {
+				t.Errorf("pulled as %s:%s, want %s:%s", auth.Username, auth.Password, tt.wantUser, tt.wantPass)
+			}
+		})
+	}
+}
+
+func TestParseRegistryAuthErrorsHideSecret(t *testing.T) {
+	encode := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	tests := map[string]string{
+		"not base64":    "password=" + testSecret + "!",
+		"invalid JSON":  encode(`{"username":"ci","password":"` + testSecret + `"`),
+		"unknown field": encode(`{"username":"ci","password":"` + testSecret + `","secret":"` + testSecret + `"}`),
+		"bad auth":      encode(`{"auth":"` + testSecret + `!"}`),
+		"no username":   encode(`{"password":"` + testSecret + `"}`),
+	}
+	for name, value := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := parseRegistryAuth(value)
+			if err == nil {
+				t.Fatal("parseRegistryAuth() accepted invalid credentials")
+			}
+			if strings.Contains(err.Error(), testSecret) || strings.Contains(err.Error(), value) {
+				t.Errorf("error %q reveals the credentials", err)
+			}
+		})
+	}
+}
+
+func TestRegistryAuthDockerConfig(t *testing.T) {
+	basic := func(user, pass string) string { return base64.StdEncoding.EncodeToString([]byte(user + ":" + pass)) }
+	// A credential helper that has credentials for every registry
+	helperDir := t.TempDir()
+	helper := "#!/bin/sh\necho '{\"Username\":\"helperuser\",\"Secret\":\"helperpass\"}'\n"
+	if err := os.WriteFile(filepath.Join(helperDir, "docker-credential-test"), []byte(helper), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", helperDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	tests := []struct {
+		name       string
+		configJSON string
+		ref        string
+		wantUser   string
+	}{
+		{"docker hub index key", `{"auths":{"` + dockerHubAuthKey + `":{"auth":"` + basic("hubuser", "x") + `"}}}`, "index.docker.io/library/nginx", "hubuser"},
+		{"url key", `{"auths":{"https://registry.internal":{"auth":"` + basic("fileuser", "x") + `"}}}`, "registry.internal/app:1", "fileuser"},
+		{"credHelpers before auths", `{"auths":{"registry.internal":{"auth":"` + basic("fileuser", "x") + `"}},"credHelpers":{"registry.internal":"test"}}`, "registry.internal/app:1", "helperuser"},
+		{"no credentials", `{"auths":{"registry.internal":{"auth":"` + basic("fileuser", "x") + `"}}}`, "ghcr.io/app:1", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			t.Setenv("DOCKER_CONFIG", dir)
+			if err := os.WriteFile(filepath.Join(dir, "config.json"), []byte(tt.configJSON), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			header, err := registryAuth(tt.ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantUser == "" {
+				if header != "" {
+					t.Errorf("registryAuth() = %q, want none", header)
+				}
+				return
+			}
+			auth, err := registry.DecodeAuthConfig(header)
+			if err != nil {
+				t.Fatalf("registryAuth() %q does not decode: %v", header, err)
+			}
+			if auth.Username != tt.wantUser {
+				t.Errorf("registryAuth() user = %s, want %s", auth.Username, tt.wantUser)
+			}
+		})
+	}
+}
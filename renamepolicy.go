@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/image"
+	"gopkg.in/yaml.v3"
+)
+
+// renameRule is one entry of a --rename-policy file: every occurrence of
+// Match in a restored reference is replaced with Replace
+type renameRule struct {
+	Match   string `yaml:"match"`
+	Replace string `yaml:"replace"`
+}
+
+// renamePolicy holds the rules loaded from --rename-policy, applied in order
+var renamePolicy []renameRule
+
+// loadRenamePolicy reads a --rename-policy file, a YAML list of rules with
+// match and replace keys
+func loadRenamePolicy(path string) ([]renameRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rename policy: %w", err)
+	}
+	var rules []renameRule
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&rules); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("invalid rename policy %s: %w", path, err)
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("rename policy %s has no rules", path)
+	}
+	for i, rule := range rules {
+		if rule.Match == "" {
+			return nil, fmt.Errorf("rule %d of rename policy %s has no match", i+1, path)
+		}
+	}
+	return rules, nil
+}
+
+// renameReference applies every rule of the policy to ref
+func renameReference(ref string, rules []renameRule) string {
+	for _, rule := range rules {
+		ref = strings.ReplaceAll(ref, rule.Match, rule.Replace)
+	}
+	return ref
+}
+
+// applyRenamePolicy tags every loaded reference that the policy changes under
+// its new name and returns the resulting references. With
+// --remove-source-tag the loaded tag is removed once the new one is in place.
+// Images loaded by ID have no name to rename and are passed on as they are.
+func applyRenamePolicy(cli DockerClient, ctx context.Context, loaded []string) ([]string, error) {
+	var refs []string
+	for _, ref := range loaded {
+		target := renameReference(ref, renamePolicy)
+		if target == ref || imageIDPattern.MatchString(ref) {
+			refs = append(refs, ref)
+			continue
+		}
+		if _, err := reference.ParseNormalizedNamed(target); err != nil {
+			return refs, fmt.Errorf("rename policy turns %s into invalid reference %q: %w", ref, target, err)
+		}
+
+		if err := cli.ImageTag(ctx, ref, target); err != nil {
+			return refs, fmt.Errorf("failed to tag %s as %s: %w", ref, target, err)
+		}
+		logger.Info(fmt.Sprintf("Renamed %s to %s", ref, target), "image", ref, "tag", target)
+		refs = append(refs, target)
+
+		if config.RemoveSourceTag {
+			if _, err := cli.ImageRemove(ctx, ref, image.RemoveOptions{}); err != nil {
+				return refs, fmt.Errorf("failed to remove source tag %s: %w", ref, err)
+			}
+		} else {
+			refs = append(refs, ref)
+		}
+	}
+	return refs, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RunReport is the machine-readable summary of a backup or restore run,
+// written with --report and posted to --notify-webhook
+type RunReport struct {
+	Operation       string         `json:"operation"`
+	RunID           string         `json:"run_id,omitempty"`
+	Hostname        string         `json:"hostname,omitempty"`
+	Attempted       int            `json:"attempted"`
+	Succeeded       int            `json:"succeeded"`
+	Skipped         int            `json:"skipped"`
+	Pulled          int            `json:"pulled,omitempty"`
+	Disappeared     int            `json:"disappeared,omitempty"`
+	TagConflicts    int            `json:"tag_conflicts,omitempty"`
+	Failed          int            `json:"failed"`
+	BytesWritten    int64          `json:"bytes_written"`
+	StartedAt       time.Time      `json:"started_at"`
+	FinishedAt      time.Time      `json:"finished_at"`
+	Duration        string         `json:"duration"`
+	DurationSeconds float64        `json:"duration_seconds"`
+	Results         []ReportResult `json:"results"`
+	Pushes          []ReportPush   `json:"pushes,omitempty"`
+}
+
+// ReportResult describes the outcome of one image, bundle or tarball. Failed
+// counts everything that did not complete, including cancelled and
+// interrupted items; Status tells them apart.
+type ReportResult struct {
+	ImageName       string  `json:"image_name"`
+	Status          string  `json:"status"`
+	OutputPath      string  `json:"output_path,omitempty"`
+	Bytes           int64   `json:"bytes,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	Error           string  `json:"error,omitempty"`
+}
+
+// ReportPush describes one image pushed by restore --push. A tarball holding
+// several images has one entry per image.
+type ReportPush struct {
+	Image  string `json:"image"`
+	Target string `json:"target"`
+	Error  string `json:"error,omitempty"`
+}
+
+// newRunReport summarizes the results of a run
+func newRunReport(operation string, results []Result, started time.Time) RunReport {
+	finished := time.Now()
+	duration := finished.Sub(started)
+	report := RunReport{
+		Operation:       operation,
+		RunID:           runID,
+		Attempted:       len(results),
+		StartedAt:       started,
+		FinishedAt:      finished,
+		Duration:        duration.Round(time.Millisecond).String(),
+		DurationSeconds: duration.Seconds(),
+		Results:         make([]ReportResult, 0, len(results)),
+	}
+	report.Hostname, _ = os.Hostname()
+
+	for _, result := range results {
+		entry := ReportResult{
+			ImageName:       result.Name,
+			Status:          result.Status,
+			OutputPath:      result.Path,
+			Bytes:           result.Bytes,
+			DurationSeconds: result.Duration.Seconds(),
+		}
+		switch result.Status {
+		case StatusSucceeded:
+			report.Succeeded++
+			report.BytesWritten += result.Bytes
+		case StatusSkipped:
+			report.Skipped++
+		case StatusPulled:
+			report.Pulled++
+		case StatusDisappeared:
+			report.Disappeared++
+		case StatusConflict:
+			report.TagConflicts++
+		default:
+			report.Failed++
+		}
+		if result.Err != nil && result.Status != StatusSkipped {
+			entry.Error = result.Err.Error()
+		}
+		report.Results = append(report.Results, entry)
+	}
+	return report
+}
+
+// writeReport writes the report as indented JSON, replacing path atomically
+// so monitoring never reads a half-written file
+func writeReport(path string, report RunReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'))
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// into place
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// finishReport prints the one-line totals and writes --report when set. A
+// report that cannot be written is logged but does not change the exit status.
+func finishReport(report RunReport) {
+	line := fmt.Sprintf("%d of %d %s operations succeeded", report.Succeeded+report.Skipped+report.Pulled, report.Attempted, report.Operation)
+	if report.BytesWritten > 0 {
+		line += ", " + formatBytes(report.BytesWritten) + " written"
+	}
+	fmt.Printf("%s in %s\n", line, report.Duration)
+
+	if config.Report == "" {
+		return
+	}
+	if err := writeReport(config.Report, report); err != nil {
+		logger.Warn(fmt.Sprintf("Warning: failed to write report %s: %v", config.Report, err), "path", config.Report, "error", err)
+	} else {
+		logger.Debug("Wrote run report to "+config.Report, "path", config.Report)
+	}
+}
+
+// formatBytes renders a byte count in MB, matching the list output
+func formatBytes(n int64) string {
+	return fmt.Sprintf("%.2f MB", float64(n)/(1024*1024))
+}
+
+// formatTotalBytes renders a byte count in GB from 1 GB up and in MB below,
+// for totals that can grow large
+func formatTotalBytes(n int64) string {
+	if n >= 1024*1024*1024 {
+		return fmt.Sprintf("%.2f GB", float64(n)/(1024*1024*1024))
+	}
+	return formatBytes(n)
+}
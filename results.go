@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// Result statuses reported in the end-of-run summary
+const (
+	StatusSucceeded   = "succeeded"
+	StatusSkipped     = "skipped"
+	StatusPulled      = "pulled"
+	StatusDisappeared = "disappeared"
+	StatusConflict    = "tag conflict"
+	StatusFailed      = "failed"
+	StatusTimedOut    = "timed out"
+	StatusCancelled   = "cancelled"
+	StatusInterrupted = "interrupted"
+)
+
+// errTimedOut marks a job stopped by --timeout
+var errTimedOut = errors.New("timed out")
+
+// Result records the outcome of a single backup or restore operation. Path
+// and Bytes are set for backups that wrote a tarball.
+type Result struct {
+	Name     string
+	Status   string
+	Err      error
+	Path     string
+	Bytes    int64
+	Duration time.Duration
+}
+
+// newResult classifies the error returned by a job and attaches its output
+// and elapsed time
+func newResult(item string, err error, started time.Time) Result {
+	result := Result{Name: item, Status: StatusSucceeded, Err: err, Duration: time.Since(started)}
+	switch {
+	case err == nil:
+		result.Path, result.Bytes = takeBackupOutput(item)
+	case errors.Is(err, errUnchanged), errors.Is(err, errDuplicate), errors.Is(err, errExists), errors.Is(err, errLoaded), errors.Is(err, errIdentical):
+		result.Status = StatusSkipped
+	case errors.Is(err, errPulled):
+		result.Status = StatusPulled
+	case errors.Is(err, errDisappeared):
+		result.Status = StatusDisappeared
+	case errors.Is(err, errTagConflict):
+		result.Status = StatusConflict
+	case errors.Is(err, errTimedOut):
+		result.Status = StatusTimedOut
+	default:
+		result.Status = StatusFailed
+	}
+	return result
+}
+
+// runJobs feeds the items to a WorkerPool of config.MaxWorkers workers and
+// collects one Result per item. Items are handed out one at a time, so only
+// the running jobs exist at any moment however long the list is. With --fail-fast the
+// first failure cancels the context, and items that never started are
+// reported as cancelled. If ctx itself is cancelled (SIGINT/SIGTERM), or the
+// run is draining after an interrupt, no new work is dispatched and the
+// affected items are reported as interrupted, or as timed out when ctx
+// reached its --total-timeout deadline.
+func runJobs(ctx context.Context, items []string, fn func(ctx context.Context, item string) error) []Result {
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// stoppedStatus distinguishes a user interrupt from a --fail-fast cancellation
+	stoppedStatus := func() string {
+		if errors.Is(parent.Err(), context.DeadlineExceeded) {
+			return StatusTimedOut
+		}
+		if parent.Err() != nil || draining.Err() != nil {
+			return StatusInterrupted
+		}
+		return StatusCancelled
+	}
+
+	workers := min(max(config.MaxWorkers, 1), len(items))
+	activeWorkers.Store(int32(workers))
+	// Hand out items until they run out or the run is stopped; the rest never
+	// start
+	dispatch, stopDispatch := context.WithCancel(ctx)
+	defer stopDispatch()
+	defer context.AfterFunc(draining, stopDispatch)()
+	pool := newWorkerPool(dispatch, workers, func(id int, item string) Result {
+		logger.Debug(fmt.Sprintf("Worker %d/%d: started %s", id, workers, item), "worker", id, "item", item)
+		started := time.Now()
+		result := newResult(item, runWithTimeout(ctx, item, fn), started)
+		if result.Status == StatusFailed || result.Status == StatusTimedOut {
+			if ctx.Err() != nil {
+				result.Status = stoppedStatus()
+			} else {
+				logger.Error(fmt.Sprintf("%s: %v", item, result.Err), "item", item, "error", result.Err)
+				if config.FailFast {
+					cancel()
+				}
+			}
+		}
+		logger.Debug(fmt.Sprintf("Worker %d/%d: %s %s in %s", id, workers, item, result.Status, result.Duration.Round(time.Millisecond)),
+			"worker", id, "item", item, "status", result.Status)
+		return result
+	})
+
+	var stopped []Result
+	for i, item := range items {
+		if pool.Submit(item) {
+			continue
+		}
+		err := ctx.Err()
+		if err == nil {
+			err = draining.Err()
+		}
+		if errors.Is(parent.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("%w: --total-timeout of %s expired before it started", errTimedOut, config.TotalTimeout)
+		}
+		for _, skipped := range items[i:] {
+			stopped = append(stopped, Result{Name: skipped, Status: stoppedStatus(), Err: err})
+		}
+		break
+	}
+
+	// Report results in input order rather than completion order
+	order := make(map[string]int, len(items))
+	for i, item := range items {
+		if _, seen := order[item]; !seen {
+			order[item] = i
+		}
+	}
+
+	results := append(pool.Wait(), stopped...)
+	sort.SliceStable(results, func(i, j int) bool {
+		return order[results[i].Name] < order[results[j].Name]
+	})
+	return results
+}
+
+// printSummary prints a table of all items, the per-status counts and the
+// failing items with their reasons. It returns true if any item failed or did
+// not run; skipped items, restores skipped for a tag conflict and images
+// pulled with --pull-fallback count as successful.
+func printSummary(operation string, results []Result) bool {
+	counts := make(map[string]int)
+	for _, result := range results {
+		counts[result.Status]++
+	}
+
+	fmt.Println()
+	if !config.Quiet {
+		printResultTable(results)
+	}
+	summary := fmt.Sprintf("%s summary: %d succeeded, ", operation, counts[StatusSucceeded])
+	if counts[StatusSkipped] > 0 {
+		summary += fmt.Sprintf("%d skipped (%s), ", counts[StatusSkipped], skipReason(results))
+	}
+	if counts[StatusPulled] > 0 {
+		summary += fmt.Sprintf("%d pulled from registry, ", counts[StatusPulled])
+	}
+	if counts[StatusDisappeared] > 0 {
+		summary += fmt.Sprintf("%d disappeared during backup, ", counts[StatusDisappeared])
+	}
+	if counts[StatusConflict] > 0 {
+		summary += fmt.Sprintf("%d skipped for tag conflicts, ", counts[StatusConflict])
+	}
+	summary += fmt.Sprintf("%d failed", counts[StatusFailed])
+	for _, status := range []string{StatusTimedOut, StatusCancelled, StatusInterrupted} {
+		if counts[status] > 0 {
+			summary += fmt.Sprintf(", %d %s", counts[status], status)
+		}
+	}
+
+	failed := counts[StatusSucceeded]+counts[StatusSkipped]+counts[StatusPulled]+counts[StatusDisappeared]+counts[StatusConflict] != len(results)
+	if failed {
+		color.New(color.FgRed, color.Bold).Println(summary)
+	} else {
+		color.New(color.FgGreen, color.Bold).Println(summary)
+	}
+
+	// Pulled backups are listed with their load error so corruption is not
+	// silently papered over, and tag conflicts with the tags involved
+	for _, result := range results {
+		if result.Status == StatusSucceeded || result.Status == StatusSkipped {
+			continue
+		}
+		fmt.Printf("  %-11s %s: %v\n", result.Status, result.Name, result.Err)
+	}
+	return failed
+}
+
+// printResultTable prints one row per item with its status, the size of the
+// backup it wrote and how long it took
+func printResultTable(results []Result) {
+	if len(results) == 0 {
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTATUS\tSIZE\tELAPSED")
+	for _, result := range results {
+		size := "-"
+		if result.Path != "" {
+			size = formatBytes(result.Bytes)
+		}
+		elapsed := "-"
+		if result.Duration > 0 {
+			elapsed = result.Duration.Round(time.Millisecond).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", result.Name, result.Status, size, elapsed)
+	}
+	w.Flush()
+	fmt.Println()
+}
+
+// skipReason describes why items were skipped: images unchanged since their
+// last backup, backups whose name already exists, restores duplicated by
+// another backup in the batch, restores whose images are already present, or
+// images with an identical backup under another name
+func skipReason(results []Result) string {
+	var reasons []string
+	for _, result := range results {
+		if result.Status != StatusSkipped {
+			continue
+		}
+		switch {
+		case errors.Is(result.Err, errDuplicate):
+			reasons = appendUnique(reasons, "duplicate")
+		case errors.Is(result.Err, errExists):
+			reasons = appendUnique(reasons, "already exists")
+		case errors.Is(result.Err, errLoaded):
+			reasons = appendUnique(reasons, "already present")
+		case errors.Is(result.Err, errIdentical):
+			reasons = appendUnique(reasons, "identical backup")
+		default:
+			reasons = appendUnique(reasons, "unchanged")
+		}
+	}
+	return strings.Join(reasons, ", ")
+}
+
+// runWithTimeout applies the per-item --timeout to a single job
+func runWithTimeout(ctx context.Context, item string, fn func(ctx context.Context, item string) error) error {
+	if config.Timeout <= 0 {
+		return fn(ctx, item)
+	}
+
+	jobCtx, cancel := context.WithTimeout(ctx, config.Timeout)
+	defer cancel()
+
+	err := fn(jobCtx, item)
+	if err != nil && errors.Is(jobCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+		return fmt.Errorf("%w after %s: %w", errTimedOut, config.Timeout, err)
+	}
+	return err
+}
+
+// withTotalTimeout applies --total-timeout to a whole run. Once it expires,
+// running items are cancelled and the ones still queued never start.
+func withTotalTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if config.TotalTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, config.TotalTimeout)
+}
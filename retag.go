@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/image"
+)
+
+// RetagData holds the fields available to a --retag template
+type RetagData struct {
+	Repository string
+	Tag        string
+}
+
+// retagTmpl is the parsed --retag value; a value without template actions is
+// used verbatim as the new reference
+var retagTmpl *template.Template
+
+// parseRetag validates the --retag value. A literal reference can only be
+// applied when restoring a single tarball.
+func parseRetag(text string, tarballCount int) (*template.Template, error) {
+	if !strings.Contains(text, "{{") {
+		if tarballCount > 1 {
+			return nil, fmt.Errorf("--retag %q names a single reference; use a template such as 'restored/{{.Repository}}:{{.Tag}}' for batch restores", text)
+		}
+		if _, err := reference.ParseNormalizedNamed(text); err != nil {
+			return nil, fmt.Errorf("invalid --retag reference %q: %w", text, err)
+		}
+	}
+
+	tmpl, err := template.New("retag").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --retag template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// parseLoadedImages extracts the references reported by `docker load`
+func parseLoadedImages(output []byte) []string {
+	var refs []string
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		if ref, ok := strings.CutPrefix(line, "Loaded image: "); ok {
+			refs = append(refs, ref)
+		} else if id, ok := strings.CutPrefix(line, "Loaded image ID: "); ok {
+			refs = append(refs, id)
+		}
+	}
+	return refs
+}
+
+// splitReference returns the familiar repository name and tag of ref
+func splitReference(ref string) (string, string, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return "", "", err
+	}
+
+	tag := "latest"
+	if tagged, ok := named.(reference.Tagged); ok {
+		tag = tagged.Tag()
+	}
+	return reference.FamiliarName(named), tag, nil
+}
+
+// tagAsLatest tags every restored reference that is not already latest as
+// <repository>:latest for --tag-as-latest. Images loaded without a tag have
+// no repository to tag and are skipped with a warning.
+func tagAsLatest(cli DockerClient, ctx context.Context, refs []string) error {
+	for _, ref := range refs {
+		named, err := reference.ParseNormalizedNamed(ref)
+		if err != nil {
+			logger.Warn(fmt.Sprintf("Warning: %s has no repository, not tagging it as latest", ref), "image", ref)
+			continue
+		}
+		if tagged, ok := named.(reference.Tagged); ok && tagged.Tag() == "latest" {
+			continue
+		}
+		target := reference.FamiliarName(named) + ":latest"
+		if err := cli.ImageTag(ctx, ref, target); err != nil {
+			return fmt.Errorf("failed to tag %s as %s: %w", ref, target, err)
+		}
+		logger.Info(fmt.Sprintf("Tagged %s as %s", ref, target), "image", ref, "tag", target)
+	}
+	return nil
+}
+
+// retagImages applies --retag to every loaded reference and returns the
+// resulting tags. With --untag-original the loaded tag is removed once the new
+// one is in place, which only untags since the image is still referenced.
+func retagImages(cli DockerClient, ctx context.Context, loaded []string) ([]string, error) {
+	if retagTmpl == nil {
+		return loaded, nil
+	}
+	if len(loaded) == 0 {
+		return nil, fmt.Errorf("cannot retag: docker load did not report any loaded images")
+	}
+	if len(loaded) > 1 && !strings.Contains(config.Retag, "{{") {
+		return nil, fmt.Errorf("tarball contains %d images; use a --retag template", len(loaded))
+	}
+
+	var finalTags []string
+	for _, ref := range loaded {
+		repository, tag, err := splitReference(ref)
+		if err != nil {
+			return finalTags, fmt.Errorf("cannot retag %s: %w", ref, err)
+		}
+
+		var buf bytes.Buffer
+		if err := retagTmpl.Execute(&buf, RetagData{Repository: repository, Tag: tag}); err != nil {
+			return finalTags, fmt.Errorf("invalid --retag template: %w", err)
+		}
+		target := strings.TrimSpace(buf.String())
+
+		if err := cli.ImageTag(ctx, ref, target); err != nil {
+			return finalTags, fmt.Errorf("failed to tag %s as %s: %w", ref, target, err)
+		}
+		finalTags = append(finalTags, target)
+
+		if config.UntagOriginal && target != ref {
+			if _, err := cli.ImageRemove(ctx, ref, image.RemoveOptions{}); err != nil {
+				return finalTags, fmt.Errorf("failed to remove original tag %s: %w", ref, err)
+			}
+		} else {
+			finalTags = append(finalTags, ref)
+		}
+	}
+	return finalTags, nil
+}
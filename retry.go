@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/errdefs"
+)
+
+// maxRetryDelay caps the exponential backoff between attempts
+const maxRetryDelay = 2 * time.Minute
+
+// withRetry runs fn until it succeeds, fails permanently, or config.Retries
+// retries are exhausted. The delay starts at config.RetryDelay and doubles
+// after every attempt. Context cancellation aborts the wait immediately.
+func withRetry(ctx context.Context, operation string, fn func() error) error {
+	delay := config.RetryDelay
+
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= config.Retries || isPermanentError(err) || ctx.Err() != nil {
+			return err
+		}
+
+		logger.Debug(fmt.Sprintf("WARN: %s failed (attempt %d/%d), retrying in %s: %v", operation, attempt+1, config.Retries+1, delay, err),
+			"operation", operation, "attempt", attempt+1, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// isPermanentError reports whether retrying err cannot help, such as when the
+// image does not exist or its reference is invalid
+func isPermanentError(err error) bool {
+	if isImageNotFound(err) || errdefs.IsInvalidParameter(err) || isInvalidReference(err) {
+		return true
+	}
+	if isDiskFull(err) {
+		return true
+	}
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, ErrWrongPassphrase) || errors.Is(err, ErrNoMatchingIdentity) ||
+		errors.Is(err, errBadSignature) || errors.Is(err, errUnsigned) || errors.Is(err, errStdinReread) ||
+		errors.Is(err, errReadOnlyBackend) {
+		return true
+	}
+
+	return false
+}
+
+// isImageNotFound reports whether err says that an image does not exist, as
+// returned by the API or printed by `docker save`
+func isImageNotFound(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errdefs.IsNotFound(err) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "no such image") || strings.Contains(msg, "reference does not exist")
+}
+
+// isInvalidReference reports whether err says that an image reference is
+// malformed, as returned by the reference parser or the daemon
+func isInvalidReference(err error) bool {
+	for _, invalid := range []error{reference.ErrReferenceInvalidFormat, reference.ErrNameContainsUppercase, reference.ErrNameEmpty,
+		reference.ErrNameTooLong, reference.ErrNameNotCanonical, reference.ErrTagInvalidFormat, reference.ErrDigestInvalidFormat} {
+		if errors.Is(err, invalid) {
+			return true
+		}
+	}
+	return strings.Contains(strings.ToLower(err.Error()), "invalid reference format")
+}
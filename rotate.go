@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// rotateBackups deletes all but the newest config.KeepLast backups of
+// imageName in the backup directory. It only runs after a backup of the image
+// succeeded, so a failed backup never pushes an older one out. Backups are
+// matched by the image name in their metadata; backups without a sidecar are
+// never deleted.
+func rotateBackups(ctx context.Context, imageName string) error {
+	if config.KeepLast <= 0 {
+		return nil
+	}
+
+	var entries []listEntry
+	var err error
+	if isRemotePath(config.BackupDir) {
+		backend, backendErr := remoteDirBackend(config.BackupDir)
+		if backendErr != nil {
+			return backendErr
+		}
+		entries, err = backendEntries(ctx, backend)
+	} else {
+		entries, err = localEntries(config.BackupDir)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read backup directory: %w", err)
+	}
+
+	var backups []listEntry
+	for _, entry := range entries {
+		if entry.hasMeta && !entry.meta.isExport() && sameReference(metadataImageName(entry.meta), imageName) {
+			backups = append(backups, entry)
+		}
+	}
+	if len(backups) <= config.KeepLast {
+		return nil
+	}
+
+	// collectEntries already prefers the BackupDate from the metadata
+	sort.SliceStable(backups, func(i, j int) bool {
+		return backups[i].date.After(backups[j].date)
+	})
+
+	var errs []error
+	for _, entry := range backups[config.KeepLast:] {
+		tarballName := backupDirPath(entry.name)
+		if err := deleteBackup(ctx, tarballName, entry.signed); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove %s: %w", tarballName, err))
+			continue
+		}
+		backupCatalog.remove(tarballName)
+		dirIndexUpdates.remove(tarballName)
+		releaseTarballName(tarballName)
+		logger.Info(fmt.Sprintf("Removed old backup %s of %s (--keep-last %d)", tarballName, imageName, config.KeepLast), "image", imageName, "path", tarballName)
+	}
+	return errors.Join(errs...)
+}
+
+// backupDirPath returns the path of a backup from its slash-separated key
+// relative to the backup directory
+func backupDirPath(key string) string {
+	if isRemotePath(config.BackupDir) {
+		return strings.TrimSuffix(config.BackupDir, "/") + "/" + key
+	}
+	return filepath.Join(config.BackupDir, filepath.FromSlash(key))
+}
+
+// deleteBackup removes a complete backup: its tarball or parts, its metadata
+// sidecar and, when signed, its signature
+func deleteBackup(ctx context.Context, tarballName string, signed bool) error {
+	if isRemotePath(tarballName) {
+		backend, key, err := remoteBackendFor(tarballName)
+		if err != nil {
+			return err
+		}
+		keys := []string{key, key + ".json"}
+		if signed {
+			keys = append(keys, key+signatureExtension)
+		}
+		for _, k := range keys {
+			if err := backend.Delete(ctx, k); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, path := range append(backupFiles(tarballName), tarballName+".json", tarballName+signatureExtension) {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// s3Backend stores backups in an S3-compatible bucket. Credentials come from
+// the standard AWS environment variables, the shared credentials file, or the
+// instance metadata service. Use --endpoint or AWS_ENDPOINT_URL to target
+// MinIO or another S3-compatible service.
+// s3StreamPartSize is the multipart chunk size for uploads of unknown length.
+// Each part is buffered in memory, and S3 allows at most 10000 parts, so this
+// caps streamed backups at about 640 GB.
+const s3StreamPartSize = 64 << 20
+
+type s3Backend struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func newS3Backend(ctx context.Context, u *url.URL) (*s3Backend, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("s3 location %q is missing a bucket name", u.String())
+	}
+
+	endpoint := "s3.amazonaws.com"
+	secure := true
+	custom := config.Endpoint
+	if custom == "" {
+		custom = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	if custom != "" {
+		if !strings.Contains(custom, "://") {
+			custom = "https://" + custom
+		}
+		endpointURL, err := url.Parse(custom)
+		if err != nil || endpointURL.Host == "" {
+			return nil, fmt.Errorf("invalid S3 endpoint %q", custom)
+		}
+		endpoint = endpointURL.Host
+		secure = endpointURL.Scheme != "http"
+	}
+
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.FileAWSCredentials{},
+		&credentials.IAM{},
+	})
+
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  creds,
+		Secure: secure,
+		Region: region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 client: %w", err)
+	}
+
+	return &s3Backend{
+		client: client,
+		bucket: u.Host,
+		prefix: strings.Trim(u.Path, "/"),
+	}, nil
+}
+
+func (b *s3Backend) objectName(key string) string {
+	return path.Join(b.prefix, key)
+}
+
+func (b *s3Backend) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	opts := minio.PutObjectOptions{ContentType: "application/octet-stream"}
+	if size < 0 {
+		opts.PartSize = s3StreamPartSize
+	}
+
+	_, err := b.client.PutObject(ctx, b.bucket, b.objectName(key), r, size, opts)
+	if err != nil {
+		// minio-go aborts failed multipart uploads with the request context,
+		// which is already cancelled after an interrupt. Abort again without
+		// it so no dangling upload keeps accruing storage charges.
+		b.client.RemoveIncompleteUpload(context.WithoutCancel(ctx), b.bucket, b.objectName(key))
+	}
+	return err
+}
+
+func (b *s3Backend) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	object, err := b.client.GetObject(ctx, b.bucket, b.objectName(key), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// GetObject is lazy; stat now so a missing key reports fs.ErrNotExist
+	// like the other backends
+	if _, err := object.Stat(); err != nil {
+		object.Close()
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, fmt.Errorf("%s: %w", key, fs.ErrNotExist)
+		}
+		return nil, err
+	}
+	return object, nil
+}
+
+func (b *s3Backend) Delete(ctx context.Context, key string) error {
+	return b.client.RemoveObject(ctx, b.bucket, b.objectName(key), minio.RemoveObjectOptions{})
+}
+
+func (b *s3Backend) List(ctx context.Context) ([]RemoteFile, error) {
+	prefix := b.prefix
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	var files []RemoteFile
+	for object := range b.client.ListObjects(ctx, b.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		files = append(files, RemoteFile{
+			Key:     strings.TrimPrefix(object.Key, prefix),
+			Size:    object.Size,
+			ModTime: object.LastModified,
+		})
+	}
+	return files, nil
+}
+
+func (b *s3Backend) String() string {
+	return "s3://" + path.Join(b.bucket, b.prefix)
+}
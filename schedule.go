@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// schedule decides when backup --interval and --cron start a run
+type schedule interface {
+	// next returns the first run time strictly after t
+	next(t time.Time) time.Time
+}
+
+// intervalSchedule runs every fixed duration, counted from when the
+// process started so the runs do not drift with their own duration
+type intervalSchedule struct {
+	start time.Time
+	every time.Duration
+}
+
+func (s intervalSchedule) next(t time.Time) time.Time {
+	if t.Before(s.start) {
+		return s.start
+	}
+	return s.start.Add((t.Sub(s.start)/s.every + 1) * s.every)
+}
+
+// cronSchedule is a standard five field cron expression, evaluated in the
+// local time zone. Each field is a bit set of the values it allows.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// Like cron, a day matches either day field when both are restricted
+	domStar, dowStar bool
+}
+
+// cronField describes the range of one cron field
+type cronField struct {
+	name     string
+	min, max int
+}
+
+var cronFields = []cronField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseCron parses a --cron expression such as "0 3 * * *". Fields accept
+// *, numbers, ranges (1-5), lists (1,15) and steps (*/15 or 0-30/10); the
+// @daily style macros are accepted too. Sunday is 0 or 7.
+func parseCron(expr string) (*cronSchedule, error) {
+	spec := strings.TrimSpace(expr)
+	if macro, ok := cronMacros[strings.ToLower(spec)]; ok {
+		spec = macro
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("invalid --cron %q (expected 5 fields: minute hour day-of-month month day-of-week)", expr)
+	}
+
+	var sets [5]uint64
+	for i, field := range fields {
+		set, err := parseCronField(field, cronFields[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid --cron %q: %w", expr, err)
+		}
+		sets[i] = set
+	}
+	// Sunday may be written as 7
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+	return &cronSchedule{
+		minute:  sets[0],
+		hour:    sets[1],
+		dom:     sets[2],
+		month:   sets[3],
+		dow:     sets[4],
+		domStar: strings.HasPrefix(fields[2], "*"),
+		dowStar: strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+func parseCronField(field string, f cronField) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepPart)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q in the %s field", stepPart, f.name)
+			}
+			step = n
+		}
+
+		lo, hi := f.min, f.max
+		if rangePart != "*" {
+			first, last, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if lo, err = cronValue(first, f); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = cronValue(last, f); err != nil {
+					return 0, err
+				}
+				if hi < lo {
+					return 0, fmt.Errorf("invalid range %q in the %s field", rangePart, f.name)
+				}
+			} else if hasStep {
+				// 5/15 means from 5 to the end in steps of 15
+				hi = f.max
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+func cronValue(s string, f cronField) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < f.min || n > f.max {
+		return 0, fmt.Errorf("invalid value %q in the %s field (expected %d-%d)", s, f.name, f.min, f.max)
+	}
+	return n, nil
+}
+
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<t.Day()) != 0
+	dow := s.dow&(1<<t.Weekday()) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next walks forward from t a month, day, hour or minute at a time,
+// skipping whole units that cannot match. An expression that never matches,
+// such as February 30, gives up after five years and returns the zero time.
+func (s *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if s.month&(1<<t.Month()) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<t.Hour()) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<t.Minute()) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// parseSchedule returns the schedule set by --interval or --cron, or nil
+// when backup runs once
+func parseSchedule() (schedule, error) {
+	switch {
+	case config.Interval < 0:
+		return nil, fmt.Errorf("--interval must not be negative")
+	case config.Interval > 0 && config.Cron != "":
+		return nil, fmt.Errorf("--interval cannot be combined with --cron")
+	case config.Interval > 0:
+		if config.Interval < time.Minute {
+			return nil, fmt.Errorf("--interval must be at least 1m")
+		}
+		return intervalSchedule{start: time.Now(), every: config.Interval}, nil
+	case config.Cron != "":
+		sched, err := parseCron(config.Cron)
+		if err != nil {
+			return nil, err
+		}
+		if sched.next(time.Now()).IsZero() {
+			return nil, fmt.Errorf("--cron %q never matches a date", config.Cron)
+		}
+		return sched, nil
+	}
+	return nil, nil
+}
+
+// runID identifies the current scheduled run in its log lines and report
+var runID string
+
+func newRunID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// runScheduled starts run at every time of sched until a signal asks the
+// process to stop, or only once right away with once, returning whether that
+// run failed. Runs never overlap: a tick that comes while the previous run is
+// still going is skipped and logged. A signal during a run lets the images in
+// flight finish, then the process exits like an unscheduled run.
+func runScheduled(sched schedule, once bool, run func() ([]Result, bool)) bool {
+	base := logger
+	defer func() { logger = base }()
+	start := func(scheduledAt time.Time) ([]Result, bool) {
+		runID = newRunID()
+		logger = base.With("run_id", runID)
+		logger.Info("Starting backup run "+runID, "scheduled_at", scheduledAt)
+		results, failed := run()
+		if skipped := ticksBetween(sched, scheduledAt, time.Now()); skipped > 0 && !once {
+			logger.Warn(fmt.Sprintf("Backup run %s was still going at the next scheduled time, skipped %d runs", runID, skipped), "skipped", skipped)
+		}
+		logger = base
+		runID = ""
+		return results, failed
+	}
+
+	if once {
+		results, failed := start(time.Now())
+		exitIfInterrupted(results, "images not backed up")
+		return failed
+	}
+	for {
+		next := sched.next(time.Now())
+		if next.IsZero() {
+			logger.Error("The schedule has no upcoming run times, stopping")
+			return false
+		}
+		logger.Info("Next backup run at "+next.Format("2006-01-02 15:04:05"), "next_run", next)
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-draining.Done():
+			timer.Stop()
+			logger.Info("Stopped waiting for the next backup run")
+			return false
+		case <-timer.C:
+		}
+
+		results, _ := start(next)
+		exitIfInterrupted(results, "images not backed up")
+	}
+}
+
+// ticksBetween counts the times of sched after from and up to to
+func ticksBetween(sched schedule, from, to time.Time) int {
+	var n int
+	for t := sched.next(from); !t.IsZero() && !t.After(to); t = sched.next(t) {
+		n++
+	}
+	return n
+}
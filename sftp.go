@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpDialTimeout bounds the TCP connect and SSH handshake
+const sftpDialTimeout = 30 * time.Second
+
+// sftpBackend stores backups on a host reachable over SSH, addressed as
+// sftp://user@host:port/path or ssh://user@host:/path. Host keys are checked
+// against ~/.ssh/known_hosts; authentication uses --ssh-identity (default: the
+// keys in ~/.ssh) and the ssh-agent when SSH_AUTH_SOCK is set.
+type sftpBackend struct {
+	ssh    *ssh.Client
+	client *sftp.Client
+	scheme string
+	addr   string
+	root   string
+}
+
+func newSFTPBackend(u *url.URL) (*sftpBackend, error) {
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("%s location %q is missing a host", u.Scheme, u.String())
+	}
+
+	username := u.User.Username()
+	if username == "" {
+		current, err := user.Current()
+		if err != nil {
+			return nil, fmt.Errorf("%s location %q has no user and the current user is unknown: %w", u.Scheme, u.String(), err)
+		}
+		username = current.Username
+	}
+	port := u.Port()
+	if port == "" {
+		port = "22"
+	}
+	addr := net.JoinHostPort(u.Hostname(), port)
+
+	auth, err := sshAuthMethods()
+	if err != nil {
+		return nil, err
+	}
+	hostKeys, err := sshHostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+
+	sshClient, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            username,
+		Auth:            auth,
+		HostKeyCallback: hostKeys,
+		Timeout:         sftpDialTimeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+
+	client, err := sftp.NewClient(sshClient, sftp.UseConcurrentWrites(true))
+	if err != nil {
+		sshClient.Close()
+		return nil, fmt.Errorf("failed to start SFTP on %s: %w", addr, err)
+	}
+
+	// sftp://host/~/backups is relative to the login directory. The port of
+	// scp-style ssh://host:/path locations is empty, so the default is used.
+	root := u.Path
+	if root == "" || root == "/~" {
+		root = "."
+	} else if rest, ok := strings.CutPrefix(root, "/~/"); ok {
+		root = rest
+	}
+	return &sftpBackend{ssh: sshClient, client: client, scheme: u.Scheme, addr: addr, root: root}, nil
+}
+
+// defaultSSHIdentities are the keys in ~/.ssh tried when --ssh-identity is not
+// given, in the order ssh itself tries them
+var defaultSSHIdentities = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// sshAuthMethods returns the identity files and, when available, the ssh-agent
+// as authentication methods. Default identities that are missing or passphrase
+// protected are skipped as long as another method is available.
+func sshAuthMethods() ([]ssh.AuthMethod, error) {
+	var methods []ssh.AuthMethod
+
+	if config.SSHIdentity != "" {
+		signer, err := loadSSHIdentity(config.SSHIdentity)
+		if err != nil {
+			return nil, err
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	} else {
+		home, _ := os.UserHomeDir()
+		var signers []ssh.Signer
+		for _, name := range defaultSSHIdentities {
+			signer, err := loadSSHIdentity(filepath.Join(home, ".ssh", name))
+			if err == nil {
+				signers = append(signers, signer)
+			} else if !errors.Is(err, os.ErrNotExist) {
+				logger.Debug(fmt.Sprintf("Skipping SSH identity: %v", err), "error", err)
+			}
+		}
+		if len(signers) > 0 {
+			methods = append(methods, ssh.PublicKeys(signers...))
+		}
+	}
+
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+
+	if len(methods) == 0 {
+		return nil, errors.New("no usable SSH identity in ~/.ssh and no ssh-agent available; use --ssh-identity")
+	}
+	return methods, nil
+}
+
+// loadSSHIdentity reads an unencrypted private key
+func loadSSHIdentity(path string) (ssh.Signer, error) {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SSH identity: %w", err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(key)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		return nil, fmt.Errorf("SSH identity %s is passphrase protected; add it to ssh-agent instead", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid SSH identity %s: %w", path, err)
+	}
+	return signer, nil
+}
+
+// sshHostKeyCallback verifies host keys against the user's known_hosts file
+func sshHostKeyCallback() (ssh.HostKeyCallback, error) {
+	home, _ := os.UserHomeDir()
+	knownHosts := filepath.Join(home, ".ssh", "known_hosts")
+	callback, err := knownhosts.New(knownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s (connect once with ssh to add the host key): %w", knownHosts, err)
+	}
+	return callback, nil
+}
+
+func (b *sftpBackend) remotePath(key string) string {
+	return path.Join(b.root, key)
+}
+
+// Put streams r into a temporary file next to the destination and renames it
+// into place, so an interrupted upload never leaves a truncated backup
+func (b *sftpBackend) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	dest := b.remotePath(key)
+	if err := b.client.MkdirAll(path.Dir(dest)); err != nil {
+		return fmt.Errorf("failed to create %s: %w", path.Dir(dest), err)
+	}
+
+	tmp := dest + ".uploading"
+	file, err := b.client.Create(tmp)
+	if err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() { file.Close() })
+	defer stop()
+
+	_, err = file.ReadFrom(r)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		b.client.Remove(tmp)
+		return err
+	}
+
+	if err := b.client.PosixRename(tmp, dest); err != nil {
+		// Servers without the posix-rename extension refuse to replace files
+		b.client.Remove(dest)
+		if err := b.client.Rename(tmp, dest); err != nil {
+			b.client.Remove(tmp)
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *sftpBackend) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	file, err := b.client.Open(b.remotePath(key))
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { file.Close() })
+	return &sftpReader{File: file, stop: stop}, nil
+}
+
+// sftpReader closes the remote file when the context is cancelled mid-read
+type sftpReader struct {
+	*sftp.File
+	stop func() bool
+}
+
+func (r *sftpReader) Close() error {
+	r.stop()
+	return r.File.Close()
+}
+
+func (b *sftpBackend) Delete(ctx context.Context, key string) error {
+	return b.client.Remove(b.remotePath(key))
+}
+
+func (b *sftpBackend) List(ctx context.Context) ([]RemoteFile, error) {
+	var files []RemoteFile
+	walker := b.client.Walk(b.root)
+	for walker.Step() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err := walker.Err(); err != nil {
+			return nil, err
+		}
+		info := walker.Stat()
+		if info.IsDir() || strings.HasSuffix(info.Name(), ".uploading") {
+			continue
+		}
+		rel := walker.Path()
+		if b.root != "." {
+			rel = strings.TrimPrefix(strings.TrimPrefix(rel, b.root), "/")
+		}
+		files = append(files, RemoteFile{Key: rel, Size: info.Size(), ModTime: info.ModTime()})
+	}
+	return files, nil
+}
+
+// SetModTime keeps the date of a migrated file
+func (b *sftpBackend) SetModTime(ctx context.Context, key string, t time.Time) error {
+	return b.client.Chtimes(b.remotePath(key), t, t)
+}
+
+func (b *sftpBackend) Close() error {
+	b.client.Close()
+	return b.ssh.Close()
+}
+
+func (b *sftpBackend) String() string {
+	return b.scheme + "://" + b.addr + "/" + strings.TrimPrefix(b.root, "/")
+}
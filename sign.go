@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// Signed backups have a detached .sig file next to them. It holds an ed25519
+// signature over the SHA-256 of the backup data (all parts of a split backup,
+// in order) and of its .json metadata, so neither can be altered unnoticed.
+const (
+	signatureExtension = ".sig"
+	signatureContext   = "go-backup-docker-image signature v1"
+	signatureAlgorithm = "ed25519"
+
+	defaultSigningKey = "signing-key.pem"
+	defaultPublicKey  = "signing-key.pub.pem"
+)
+
+var (
+	// errUnsigned is returned when a backup has no signature file
+	errUnsigned = errors.New("backup is not signed")
+	// errBadSignature is returned when a signature does not verify
+	errBadSignature = errors.New("signature verification failed")
+)
+
+// signingKey signs new backups when --sign is set; verifyKey checks backups
+// on restore when --public-key is set
+var (
+	signingKey ed25519.PrivateKey
+	verifyKey  ed25519.PublicKey
+)
+
+// BackupSignature is the content of a .sig file
+type BackupSignature struct {
+	Algorithm      string `json:"algorithm"`
+	KeyID          string `json:"key_id"`
+	BackupSHA256   string `json:"backup_sha256"`
+	MetadataSHA256 string `json:"metadata_sha256"`
+	Signature      []byte `json:"signature"`
+}
+
+// signedMessage returns the bytes the signature covers
+func (s BackupSignature) signedMessage() []byte {
+	return []byte(fmt.Sprintf("%s\nbackup sha256:%s\nmetadata sha256:%s\n", signatureContext, s.BackupSHA256, s.MetadataSHA256))
+}
+
+// keyID identifies a public key in signature files and messages
+func keyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// readSigningKey loads a PKCS #8 ed25519 private key in PEM format
+func readSigningKey(path string) (ed25519.PrivateKey, error) {
+	block, err := readPEM(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing key %s: %w", path, err)
+	}
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key %s is not an ed25519 key", path)
+	}
+	return private, nil
+}
+
+// readPublicKey loads a PKIX ed25519 public key in PEM format
+func readPublicKey(path string) (ed25519.PublicKey, error) {
+	block, err := readPEM(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key %s: %w", path, err)
+	}
+	public, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key %s is not an ed25519 key", path)
+	}
+	return public, nil
+}
+
+func readPEM(path, blockType string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != blockType {
+		return nil, fmt.Errorf("%s does not contain a PEM %q block", path, blockType)
+	}
+	return block, nil
+}
+
+// digestBackup hashes the data and metadata of a backup. The data is read
+// through openBackup, so split and remote backups are covered as a whole.
+func digestBackup(tarballName string) (backup, metadata string, err error) {
+	backup, err = backupSHA256(tarballName)
+	if err != nil {
+		return "", "", err
+	}
+
+	sidecar, err := readBackupFile(tarballName + ".json")
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read metadata: %w", err)
+	}
+	sum := sha256.Sum256(sidecar)
+	return backup, hex.EncodeToString(sum[:]), nil
+}
+
+// readBackupFile reads a small file next to a backup, such as its metadata
+// or signature
+func readBackupFile(path string) ([]byte, error) {
+	if !isRemotePath(path) {
+		return os.ReadFile(path)
+	}
+	file, err := openRemoteFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// signBackup writes the .sig file for a finished backup. The backup is read
+// back in full, from the remote directory when it was streamed there.
+func signBackup(tarballName string) error {
+	sig := BackupSignature{Algorithm: signatureAlgorithm, KeyID: keyID(signingKey.Public().(ed25519.PublicKey))}
+	var err error
+	sig.BackupSHA256, sig.MetadataSHA256, err = digestBackup(tarballName)
+	if err != nil {
+		return fmt.Errorf("failed to sign backup: %w", err)
+	}
+	sig.Signature = ed25519.Sign(signingKey, sig.signedMessage())
+
+	data, err := json.MarshalIndent(sig, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	sigPath := tarballName + signatureExtension
+	if isRemotePath(sigPath) {
+		err = putRemoteFile(context.Background(), sigPath, data)
+	} else {
+		err = os.WriteFile(sigPath, data, 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write signature: %w", err)
+	}
+	logger.Debug(fmt.Sprintf("Signed %s with key %s", tarballName, sig.KeyID), "path", tarballName, "key", sig.KeyID)
+	return nil
+}
+
+// verifyBackup checks the signature of a backup against pub. It returns
+// errUnsigned when there is no signature file and wraps errBadSignature when
+// the signature does not match the key, the data or the metadata.
+func verifyBackup(tarballName string, pub ed25519.PublicKey) (BackupSignature, error) {
+	var sig BackupSignature
+	data, err := readBackupFile(tarballName + signatureExtension)
+	if errors.Is(err, fs.ErrNotExist) {
+		return sig, errUnsigned
+	}
+	if err != nil {
+		return sig, fmt.Errorf("failed to read signature: %w", err)
+	}
+	if err := json.Unmarshal(data, &sig); err != nil {
+		return sig, fmt.Errorf("%w: malformed signature file: %v", errBadSignature, err)
+	}
+	if sig.Algorithm != signatureAlgorithm {
+		return sig, fmt.Errorf("%w: unsupported algorithm %q", errBadSignature, sig.Algorithm)
+	}
+	if id := keyID(pub); sig.KeyID != id {
+		return sig, fmt.Errorf("%w: signed by key %s, not %s", errBadSignature, sig.KeyID, id)
+	}
+	if !ed25519.Verify(pub, sig.signedMessage(), sig.Signature) {
+		return sig, fmt.Errorf("%w: signature does not match its digests", errBadSignature)
+	}
+
+	backup, metadata, err := digestBackup(tarballName)
+	if err != nil {
+		return sig, err
+	}
+	if backup != sig.BackupSHA256 {
+		return sig, fmt.Errorf("%w: backup data was modified after signing", errBadSignature)
+	}
+	if metadata != sig.MetadataSHA256 {
+		return sig, fmt.Errorf("%w: metadata was modified after signing", errBadSignature)
+	}
+	return sig, nil
+}
+
+// checkRestoreSignature verifies a backup before it is restored when
+// --public-key is set. Unsigned backups are only refused with
+// --require-signature.
+func checkRestoreSignature(tarballPath, localPath string) error {
+	if verifyKey == nil {
+		return nil
+	}
+	logger.Debug(fmt.Sprintf("Verifying signature of %s...", tarballPath), "path", tarballPath)
+	_, err := verifyBackup(localPath, verifyKey)
+	if errors.Is(err, errUnsigned) && !config.RequireSignature {
+		logger.Warn(fmt.Sprintf("Warning: %s is not signed", tarballPath), "path", tarballPath)
+		return nil
+	}
+	return err
+}
+
+func runVerify(cmd *cobra.Command, args []string) {
+	publicKey, _ := cmd.Flags().GetString("public-key")
+	pub, err := readPublicKey(publicKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	failed := false
+	for _, arg := range args {
+		tarballPath := logicalBackupPath(arg)
+		sig, err := verifyBackup(tarballPath, pub)
+		switch {
+		case err == nil:
+			color.New(color.FgGreen).Printf("OK       %s (key %s)\n", arg, sig.KeyID)
+		case errors.Is(err, errUnsigned):
+			color.New(color.FgYellow).Printf("UNSIGNED %s\n", arg)
+			failed = true
+		default:
+			color.New(color.FgRed, color.Bold).Printf("INVALID  %s: %v\n", arg, err)
+			failed = true
+		}
+	}
+	closeRemoteBackends()
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func runKeygen(cmd *cobra.Command, args []string) {
+	privatePath, _ := cmd.Flags().GetString("signing-key")
+	publicPath, _ := cmd.Flags().GetString("public-key")
+	force, _ := cmd.Flags().GetBool("force")
+
+	pub, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		log.Fatalf("Failed to generate key: %v", err)
+	}
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		log.Fatal(err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	if err := writePEM(privatePath, flags, 0600, &pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}); err != nil {
+		log.Fatalf("Failed to write signing key: %v", err)
+	}
+	if err := writePEM(publicPath, flags, 0644, &pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}); err != nil {
+		os.Remove(privatePath)
+		log.Fatalf("Failed to write public key: %v", err)
+	}
+
+	color.New(color.FgGreen, color.Bold).Printf("Generated signing key %s (key %s)\n", privatePath, keyID(pub))
+	fmt.Printf("  Signing key: %s (keep this secret)\n", privatePath)
+	fmt.Printf("  Public key:  %s\n", publicPath)
+}
+
+// writePEM writes one PEM block; keygen refuses to overwrite keys unless --force
+func writePEM(path string, flags int, perm os.FileMode, block *pem.Block) error {
+	file, err := os.OpenFile(path, flags, perm)
+	if errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("%s already exists (use --force to overwrite)", path)
+	}
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(file, block); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// signalContext returns a context that is cancelled on the first SIGINT or
+// SIGTERM. The handler is removed after the first signal, so a second Ctrl-C
+// falls back to the default behavior and terminates the process immediately.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case <-signals:
+			signal.Stop(signals)
+			logger.Warn("Interrupted, waiting for in-flight operations to stop (press Ctrl-C again to force exit)...")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
+	}
+}
+
+// draining is done once an interrupt asked a run started with
+// shutdownContext to stop. runJobs starts no new work after that, while the
+// work already running goes on.
+var draining = context.Background()
+
+// shutdownContext is signalContext for commands that finish their in-flight
+// work on an interrupt. The first SIGINT or SIGTERM only stops new work from
+// starting; the returned context is cancelled forceKill later to stop what is
+// still running, or never when forceKill is 0. A second signal terminates the
+// process immediately.
+func shutdownContext(forceKill time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopCtx, stopWork := context.WithCancel(context.Background())
+	draining = stopCtx
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case <-signals:
+			signal.Stop(signals)
+			if forceKill > 0 {
+				logger.Warn(fmt.Sprintf("Interrupted, waiting up to %s for in-flight operations to finish (press Ctrl-C again to force exit)...", forceKill),
+					"force_kill", forceKill)
+				time.AfterFunc(forceKill, func() {
+					if ctx.Err() == nil {
+						logger.Warn(fmt.Sprintf("In-flight operations did not finish within %s, cancelling them", forceKill), "force_kill", forceKill)
+						cancel()
+					}
+				})
+			} else {
+				logger.Warn("Interrupted, waiting for in-flight operations to finish (press Ctrl-C again to force exit)...")
+			}
+			stopWork()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(signals)
+		stopWork()
+		cancel()
+	}
+}
+
+// exitIfInterrupted ends a run stopped by a signal with status 130, the
+// shell convention for SIGINT, after reporting the items that never finished
+func exitIfInterrupted(results []Result, what string) {
+	if draining.Err() == nil {
+		return
+	}
+	var stopped int
+	for _, result := range results {
+		if result.Status == StatusInterrupted {
+			stopped++
+		}
+	}
+	color.New(color.FgYellow, color.Bold).Printf("Interrupted: %d %s\n", stopped, what)
+	os.Exit(130)
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PartInfo describes one file of a backup written with --split-size
+type PartInfo struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// writtenParts holds the parts, with checksums, recorded by each chunkWriter
+// until the backup's metadata is written
+var writtenParts sync.Map
+
+// partPattern matches part file names such as nginx-20240101.part002.tar.gz
+var partPattern = regexp.MustCompile(`^(.*)\.part(\d{3,})(\.tar.*)$`)
+
+// partPath returns the file name of part n (starting at 1) of a split backup,
+// inserting .partNNN before the .tar extension
+func partPath(tarballName string, n int) string {
+	prefix, ext := splitTarExtension(tarballName)
+	return fmt.Sprintf("%s.part%03d%s", prefix, n, ext)
+}
+
+// splitTarExtension splits a backup path into the name and its .tar[.gz][.enc]
+// extension
+func splitTarExtension(path string) (string, string) {
+	base := filepath.Base(path)
+	if i := strings.LastIndex(base, ".tar"); i > 0 {
+		return filepath.Join(filepath.Dir(path), base[:i]), base[i:]
+	}
+	return path, ""
+}
+
+// logicalBackupPath maps a part file name back to the name of the whole backup
+func logicalBackupPath(path string) string {
+	// Slicing rather than filepath.Join keeps remote URLs intact
+	base := filepath.Base(path)
+	if m := partPattern.FindStringSubmatch(base); m != nil {
+		return path[:len(path)-len(base)] + m[1] + m[3]
+	}
+	return path
+}
+
+// findParts returns the part files of a split backup in order, preferring the
+// list in the metadata sidecar and falling back to matching .partNNN files
+func findParts(tarballName string) []string {
+	if info, err := loadImageInfo(tarballName + ".json"); err == nil && len(info.Parts) > 0 {
+		parts := make([]string, len(info.Parts))
+		for i, part := range info.Parts {
+			parts[i] = filepath.Join(filepath.Dir(tarballName), part.Name)
+		}
+		return parts
+	}
+
+	prefix, ext := splitTarExtension(tarballName)
+	matches, _ := filepath.Glob(prefix + ".part*" + ext)
+
+	type numbered struct {
+		path string
+		n    int
+	}
+	var parts []numbered
+	for _, match := range matches {
+		m := partPattern.FindStringSubmatch(filepath.Base(match))
+		if m == nil || filepath.Join(filepath.Dir(match), m[1]+m[3]) != tarballName {
+			continue
+		}
+		n, _ := strconv.Atoi(m[2])
+		parts = append(parts, numbered{match, n})
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].n < parts[j].n })
+
+	paths := make([]string, len(parts))
+	for i, part := range parts {
+		paths[i] = part.path
+	}
+	return paths
+}
+
+// listParts returns the name, size and checksum of every part written for
+// tarballName, or nil when the backup was not split
+func listParts(tarballName string) []PartInfo {
+	if parts, ok := writtenParts.LoadAndDelete(tarballName); ok {
+		return parts.([]PartInfo)
+	}
+
+	var parts []PartInfo
+	for _, path := range findParts(tarballName) {
+		stat, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		parts = append(parts, PartInfo{Name: filepath.Base(path), Size: stat.Size()})
+	}
+	return parts
+}
+
+// listSavedParts returns the parts of a backup saved under its partial name,
+// named as they will be once the backup is committed
+func listSavedParts(tarballName string) []PartInfo {
+	parts := listParts(partialName(tarballName))
+	for i := range parts {
+		parts[i].Name = strings.TrimSuffix(parts[i].Name, partialExtension)
+	}
+	return parts
+}
+
+// backupFiles returns the data files of a backup: its parts when it was split,
+// otherwise the tarball itself
+func backupFiles(tarballName string) []string {
+	if _, err := os.Stat(tarballName); err == nil {
+		return []string{tarballName}
+	}
+	if parts := findParts(tarballName); len(parts) > 0 {
+		return parts
+	}
+	return []string{tarballName}
+}
+
+// statBackup returns the total size of a backup's data files and the
+// modification time of the last one
+func statBackup(tarballName string) (int64, time.Time, error) {
+	var size int64
+	var modTime time.Time
+	for _, path := range backupFiles(tarballName) {
+		stat, err := os.Stat(path)
+		if err != nil {
+			return 0, time.Time{}, err
+		}
+		size += stat.Size()
+		modTime = stat.ModTime()
+	}
+	return size, modTime, nil
+}
+
+// openBackup opens a backup for reading, concatenating the parts of a split
+// backup into one stream. All parts must be present before anything is read,
+// and each part's checksum is verified as the stream reaches its end.
+func openBackup(tarballName string) (io.ReadCloser, error) {
+	if tarballName == stdinPath {
+		return openStdinBackup()
+	}
+	if isRemotePath(tarballName) {
+		return openRemoteBackup(tarballName)
+	}
+
+	files := backupFiles(tarballName)
+	if len(files) == 1 {
+		return os.Open(files[0])
+	}
+
+	parts, err := verifyParts(tarballName, files)
+	if err != nil {
+		return nil, err
+	}
+
+	readers := make([]io.Reader, 0, len(files))
+	closers := make(multiCloser, 0, len(files))
+	for i, path := range files {
+		file, err := os.Open(path)
+		if err != nil {
+			closers.Close()
+			return nil, err
+		}
+		closers = append(closers, file)
+
+		var reader io.Reader = file
+		if parts != nil && parts[i].SHA256 != "" {
+			reader = &checksumReader{r: file, hash: sha256.New(), want: parts[i].SHA256, name: path}
+		}
+		readers = append(readers, reader)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(readers...), closers}, nil
+}
+
+// verifyParts checks that every part of a split backup is present: against
+// the sizes in the metadata when available, otherwise by requiring the part
+// numbers to be consecutive from 1. It returns the recorded parts, if any.
+func verifyParts(tarballName string, files []string) ([]PartInfo, error) {
+	info, err := loadImageInfo(tarballName + ".json")
+	if err != nil || len(info.Parts) == 0 {
+		for i, path := range files {
+			m := partPattern.FindStringSubmatch(filepath.Base(path))
+			if n, _ := strconv.Atoi(m[2]); n != i+1 {
+				return nil, fmt.Errorf("split backup %s is missing part %03d", tarballName, i+1)
+			}
+		}
+		return nil, nil
+	}
+
+	for i, part := range info.Parts {
+		stat, err := os.Stat(files[i])
+		if err != nil {
+			return nil, fmt.Errorf("split backup %s is missing part %s", tarballName, part.Name)
+		}
+		if stat.Size() != part.Size {
+			return nil, fmt.Errorf("part %s is %d bytes, expected %d", part.Name, stat.Size(), part.Size)
+		}
+	}
+	return info.Parts, nil
+}
+
+// checksumReader verifies the SHA-256 of a part once it has been fully read
+type checksumReader struct {
+	r    io.Reader
+	hash hash.Hash
+	want string
+	name string
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(c.hash.Sum(nil)) != c.want {
+		return n, fmt.Errorf("checksum mismatch in %s", c.name)
+	}
+	return n, err
+}
+
+// restoreChecksum is the hex SHA-256 given to restore --checksum, which the
+// backup file must have as stored
+var restoreChecksum string
+
+// parseChecksum validates a --checksum value of the form sha256:<64 hex
+// digits> and returns the digest
+func parseChecksum(value string) (string, error) {
+	digest, ok := strings.CutPrefix(value, "sha256:")
+	if decoded, err := hex.DecodeString(digest); !ok || err != nil || len(decoded) != sha256.Size {
+		return "", fmt.Errorf("invalid --checksum %q (expected sha256: followed by 64 hex digits)", value)
+	}
+	return strings.ToLower(digest), nil
+}
+
+type multiCloser []io.Closer
+
+func (c multiCloser) Close() error {
+	var errs []error
+	for _, closer := range c {
+		errs = append(errs, closer.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// chunkWriter writes a stream into numbered part files of at most size bytes
+type chunkWriter struct {
+	tarballName string
+	size        int64
+	part        int
+	written     int64
+	file        *os.File
+	hash        hash.Hash
+	parts       []PartInfo
+}
+
+func newChunkWriter(tarballName string, size int64) *chunkWriter {
+	return &chunkWriter{tarballName: tarballName, size: size}
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		if w.file == nil || w.written >= w.size {
+			if err := w.next(); err != nil {
+				return total, err
+			}
+		}
+
+		chunk := p
+		if remaining := w.size - w.written; int64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+		n, err := w.file.Write(chunk)
+		w.hash.Write(chunk[:n])
+		total += n
+		w.written += int64(n)
+		if err != nil {
+			return total, err
+		}
+		p = p[n:]
+	}
+	return total, nil
+}
+
+// next closes the current part and starts the following one
+func (w *chunkWriter) next() error {
+	if err := w.finishPart(); err != nil {
+		return err
+	}
+	w.part++
+	file, err := os.Create(partPath(w.tarballName, w.part))
+	if err != nil {
+		return err
+	}
+	w.file = file
+	w.written = 0
+	w.hash = sha256.New()
+	return nil
+}
+
+// finishPart closes the current part and records its size and checksum
+func (w *chunkWriter) finishPart() error {
+	if w.file == nil {
+		return nil
+	}
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.parts = append(w.parts, PartInfo{
+		Name:   filepath.Base(w.file.Name()),
+		Size:   w.written,
+		SHA256: hex.EncodeToString(w.hash.Sum(nil)),
+	})
+	w.file = nil
+	return nil
+}
+
+// Close finishes the last part and makes the part list available to listParts.
+// Closing more than once is a no-op.
+func (w *chunkWriter) Close() error {
+	if w.part == 0 {
+		// An empty stream still produces one (empty) part
+		if err := w.next(); err != nil {
+			return err
+		}
+	}
+	if w.file == nil {
+		return nil
+	}
+	if err := w.finishPart(); err != nil {
+		return err
+	}
+	writtenParts.Store(w.tarballName, w.parts)
+	return nil
+}
+
+// createOutput opens the destination for a backup stream, splitting it into
+// parts when --split-size is set or uploading it when it is a remote location
+func createOutput(ctx context.Context, tarballName string) (io.WriteCloser, error) {
+	if isRemotePath(tarballName) {
+		return newUploadWriter(ctx, tarballName)
+	}
+	if config.SplitSize > 0 {
+		return newChunkWriter(tarballName, config.SplitSize), nil
+	}
+	return os.Create(tarballName)
+}
+
+// parseSize parses sizes such as 4GB, 500M or 1048576. Units are powers of
+// 1024 and the B/iB suffix is optional.
+func parseSize(value string) (int64, error) {
+	text := strings.ToUpper(strings.TrimSpace(value))
+	text = strings.TrimSuffix(strings.TrimSuffix(text, "IB"), "B")
+
+	multiplier := int64(1)
+	for i, unit := range []string{"K", "M", "G", "T"} {
+		if strings.HasSuffix(text, unit) {
+			multiplier = int64(1) << (10 * (i + 1))
+			text = strings.TrimSuffix(text, unit)
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return int64(n * float64(multiplier)), nil
+}
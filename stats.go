@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// BackupStats summarizes the backups in a directory, printed as is with
+// --output json
+type BackupStats struct {
+	Backups          int            `json:"backups"`
+	TotalBytes       int64          `json:"total_bytes"`
+	Oldest           *time.Time     `json:"oldest,omitempty"`
+	Newest           *time.Time     `json:"newest,omitempty"`
+	Compression      map[string]int `json:"compression"`
+	CompressionRatio float64        `json:"compression_ratio,omitempty"`
+	Images           []ImageStats   `json:"images"`
+	Dedup            *DedupStats    `json:"dedup,omitempty"`
+}
+
+// ImageStats is the number and cumulative size of the backups of one image
+type ImageStats struct {
+	Image   string `json:"image"`
+	Backups int    `json:"backups"`
+	Bytes   int64  `json:"bytes"`
+}
+
+// DedupStats describes the blob store shared by deduplicated backups
+type DedupStats struct {
+	Backups           int   `json:"backups"`
+	Blobs             int   `json:"blobs"`
+	LogicalBytes      int64 `json:"logical_bytes"`
+	StoredBytes       int64 `json:"stored_bytes"`
+	UnreferencedBlobs int   `json:"unreferenced_blobs"`
+	UnreferencedBytes int64 `json:"unreferenced_bytes"`
+}
+
+func runStats(cmd *cobra.Command, args []string) {
+	top, _ := cmd.Flags().GetInt("top")
+	if config.Output != "text" && config.Output != "json" {
+		log.Fatalf("Invalid output format %q (expected text or json)", config.Output)
+	}
+	if top < 0 {
+		log.Fatal("--top must not be negative")
+	}
+
+	entries, err := localEntries(config.BackupDir)
+	if err != nil {
+		log.Fatalf("Failed to read backup directory: %v", err)
+	}
+	stats := collectStats(entries)
+	if top > 0 && len(stats.Images) > top {
+		stats.Images = stats.Images[:top]
+	}
+
+	usage, err := scanDedupUsage(config.BackupDir)
+	if err != nil {
+		log.Fatalf("Failed to read backup directory: %v", err)
+	}
+	if usage.backups > 0 {
+		stats.Dedup = &DedupStats{
+			Backups:           usage.backups,
+			Blobs:             usage.blobs,
+			LogicalBytes:      usage.logicalBytes,
+			StoredBytes:       usage.storedBytes,
+			UnreferencedBlobs: len(usage.unreferenced),
+			UnreferencedBytes: usage.orphanBytes,
+		}
+	}
+
+	if config.Output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(stats); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	printStats(stats, top)
+}
+
+// collectStats adds up the backups in entries. Images are sorted by the space
+// their backups take, largest first. The compression ratio is the average of
+// backup size over recorded image size, for backups whose metadata records
+// one; deduplicated backups and container exports have no such ratio.
+func collectStats(entries []listEntry) BackupStats {
+	stats := BackupStats{Compression: make(map[string]int), Images: []ImageStats{}}
+	byImage := make(map[string]*ImageStats)
+	var ratios float64
+	var rated int
+
+	for _, entry := range entries {
+		if entry.incomplete {
+			continue
+		}
+		stats.Backups++
+		stats.TotalBytes += entry.size
+		if stats.Oldest == nil || entry.date.Before(*stats.Oldest) {
+			stats.Oldest = &entry.date
+		}
+		if stats.Newest == nil || entry.date.After(*stats.Newest) {
+			stats.Newest = &entry.date
+		}
+
+		compression := "unknown"
+		if entry.hasMeta && entry.meta.CompressType != "" {
+			compression = entry.meta.CompressType
+		}
+		stats.Compression[compression]++
+
+		name := entry.imageName()
+		image, ok := byImage[name]
+		if !ok {
+			image = &ImageStats{Image: name}
+			byImage[name] = image
+		}
+		image.Backups++
+		image.Bytes += entry.size
+
+		if entry.hasMeta && entry.meta.Size > 0 && !entry.meta.isExport() && !strings.HasSuffix(entry.name, dedupExtension) {
+			ratios += float64(entry.size) / float64(entry.meta.Size)
+			rated++
+		}
+	}
+
+	for _, image := range byImage {
+		stats.Images = append(stats.Images, *image)
+	}
+	sort.Slice(stats.Images, func(i, j int) bool {
+		if stats.Images[i].Bytes != stats.Images[j].Bytes {
+			return stats.Images[i].Bytes > stats.Images[j].Bytes
+		}
+		return stats.Images[i].Image < stats.Images[j].Image
+	})
+	if rated > 0 {
+		stats.CompressionRatio = ratios / float64(rated)
+	}
+	return stats
+}
+
+func printStats(stats BackupStats, top int) {
+	if stats.Backups == 0 {
+		color.New(color.FgHiRed, color.Bold).Println("No backups found")
+		return
+	}
+
+	color.New(color.FgHiBlue, color.Bold).Printf("Backups in %s:\n", config.BackupDir)
+	fmt.Printf("  Backups: %d\n", stats.Backups)
+	fmt.Printf("  Total size: %s\n", formatBytes(stats.TotalBytes))
+	fmt.Printf("  Oldest: %s\n", stats.Oldest.Format("2006-01-02 15:04:05"))
+	fmt.Printf("  Newest: %s\n", stats.Newest.Format("2006-01-02 15:04:05"))
+
+	kinds := make([]string, 0, len(stats.Compression))
+	for kind := range stats.Compression {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	fmt.Print("  Compression:")
+	for i, kind := range kinds {
+		if i > 0 {
+			fmt.Print(",")
+		}
+		fmt.Printf(" %s %d", kind, stats.Compression[kind])
+	}
+	fmt.Println()
+	if stats.CompressionRatio > 0 {
+		fmt.Printf("  Average compression ratio: %.1f%% of the image size\n", 100*stats.CompressionRatio)
+	}
+
+	fmt.Println()
+	if top > 0 {
+		color.New(color.FgHiBlue, color.Bold).Printf("Top %d images by backup size:\n", top)
+	} else {
+		color.New(color.FgHiBlue, color.Bold).Println("Images by backup size:")
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  IMAGE\tBACKUPS\tSIZE")
+	for _, image := range stats.Images {
+		fmt.Fprintf(w, "  %s\t%d\t%s\n", image.Image, image.Backups, formatBytes(image.Bytes))
+	}
+	w.Flush()
+
+	if stats.Dedup != nil {
+		fmt.Println()
+		printDedupStats(*stats.Dedup)
+	}
+}
+
+func printDedupStats(usage DedupStats) {
+	color.New(color.FgHiBlue, color.Bold).Println("Deduplicated backup store:")
+	fmt.Printf("  Backups: %d\n", usage.Backups)
+	fmt.Printf("  Blobs: %d\n", usage.Blobs)
+	fmt.Printf("  Logical size: %s\n", formatBytes(usage.LogicalBytes))
+	fmt.Printf("  Stored size: %s\n", formatBytes(usage.StoredBytes))
+	if usage.LogicalBytes > 0 {
+		saved := usage.LogicalBytes - usage.StoredBytes
+		color.New(color.FgGreen).Printf("  Saved: %s (%.1f%%)\n", formatBytes(saved), 100*float64(saved)/float64(usage.LogicalBytes))
+	}
+	if usage.UnreferencedBlobs > 0 {
+		fmt.Printf("  Unreferenced: %d blobs, %s (run 'prune' to remove)\n", usage.UnreferencedBlobs, formatBytes(usage.UnreferencedBytes))
+	}
+}
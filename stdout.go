@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/signal"
+	"syscall"
+
+	"github.com/docker/docker/api/types/image"
+	"github.com/spf13/cobra"
+)
+
+// stdoutConflicts are the backup flags that write more than one stream or
+// files next to the backup, which --stdout cannot do
+var stdoutConflicts = []string{
+	"all", "filter", "container", "bundle", "watch", "interval", "cron", "dry-run",
+	"dedup", "incremental", "split-size", "format", "all-platforms", "platform",
+	"remote", "to-registry", "no-tarball", "volumes", "sign", "keep-last",
+	"manifest", "deduplicate", "since", "on-exist", "output-template",
+}
+
+// validateStdoutBackup checks that a backup --stdout run streams exactly one
+// image with a single worker
+func validateStdoutBackup(cmd *cobra.Command, imageNames []string) error {
+	for _, name := range stdoutConflicts {
+		if cmd.Flags().Changed(name) {
+			return fmt.Errorf("--stdout cannot be combined with --%s", name)
+		}
+	}
+	if len(imageNames) != 1 {
+		return fmt.Errorf("--stdout streams a single image, got %d", len(imageNames))
+	}
+	if cmd.Flags().Changed("workers") && config.MaxWorkers > 1 {
+		return fmt.Errorf("--stdout cannot be combined with --workers greater than 1")
+	}
+	config.MaxWorkers = 1
+
+	// A reader that goes away must fail the backup instead of killing the
+	// process without a word
+	signal.Ignore(syscall.SIGPIPE)
+	return nil
+}
+
+// backupToStdout streams the backup of img to stdout, compressed and
+// encrypted like a file backup. Nothing is written to the backup directory;
+// the metadata goes to --metadata-file when one is given. Bytes that reached
+// stdout cannot be taken back, so only opening the save stream is retried.
+func backupToStdout(cli DockerClient, ctx context.Context, imageName, name string, img image.InspectResponse) error {
+	logger.Info(fmt.Sprintf("Streaming %s to stdout...", imageName), "image", imageName)
+
+	var body io.ReadCloser
+	err := withRetry(ctx, "save "+imageName, func() (err error) {
+		body, err = imageSave(cli, ctx, []string{imageName})
+		return err
+	})
+	if err != nil {
+		return saveError("image", err)
+	}
+	defer body.Close()
+
+	out, encryption, err := newBackupWriter(throttle(ctx, reservedStdout))
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(out, &contextReader{ctx: ctx, r: body})
+	if err == nil {
+		err = out.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stream %s to stdout: %w", imageName, err)
+	}
+
+	if config.MetadataFile != "" {
+		platform := Platform{OS: img.Os, Architecture: img.Architecture, Variant: img.Variant}
+		if err := writeImageInfo(config.MetadataFile, newImageInfo(imageName, name, img, platform, platform, img.Size, encryption)); err != nil {
+			return err
+		}
+	}
+	logSuccess(fmt.Sprintf("Successfully streamed %s of %s to stdout", formatBytes(n), imageName), "image", imageName, "bytes", n)
+	return nil
+}
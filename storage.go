@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StorageBackend is a remote location that backup files can be copied to and
+// fetched from. Keys are slash-separated paths relative to the backend root.
+type StorageBackend interface {
+	// Put uploads size bytes from r under key. A negative size streams r
+	// until EOF; an error from r aborts the upload without leaving an object.
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Open returns a reader for the object stored under key
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the object stored under key
+	Delete(ctx context.Context, key string) error
+	// List returns every object below the backend root
+	List(ctx context.Context) ([]RemoteFile, error)
+	// String returns the backend location for messages
+	String() string
+}
+
+// RemoteFile is an object stored in a StorageBackend
+type RemoteFile struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// modTimeSetter is implemented by backends that can set the modification time
+// of a stored file; S3 objects always carry their upload time
+type modTimeSetter interface {
+	SetModTime(ctx context.Context, key string, t time.Time) error
+}
+
+// closeBackend releases the connection held by backends such as SFTP
+func closeBackend(backend StorageBackend) {
+	if closer, ok := backend.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// isRemotePath reports whether location refers to a remote storage backend
+func isRemotePath(location string) bool {
+	return strings.Contains(location, "://")
+}
+
+// newStorageBackend creates the backend for a location such as s3://bucket/prefix
+func newStorageBackend(ctx context.Context, location string) (StorageBackend, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote location %q: %w", location, err)
+	}
+
+	switch u.Scheme {
+	case "s3":
+		return newS3Backend(ctx, u)
+	case "sftp", "ssh":
+		return newSFTPBackend(u)
+	case "http", "https":
+		return newHTTPBackend(u), nil
+	default:
+		return nil, fmt.Errorf("unsupported remote location %q (supported schemes: s3, sftp, ssh, http, https)", location)
+	}
+}
+
+// splitRemotePath splits a remote file location into its backend location and object key
+func splitRemotePath(location string) (string, string) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return location, ""
+	}
+
+	dir, key := path.Split(u.Path)
+	u.Path = dir
+	return u.String(), key
+}
+
+// uploadFile copies a local file to the backend under key
+func uploadFile(ctx context.Context, backend StorageBackend, localPath, key string) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	return backend.Put(ctx, key, file, stat.Size())
+}
+
+// uploadBackup copies a finished tarball and its metadata to config.Remote,
+// removing the local copies afterwards when --remote-only is set
+func uploadBackup(ctx context.Context, tarballName string) error {
+	if remoteBackend == nil {
+		return nil
+	}
+
+	files := append(backupFiles(tarballName), tarballName+".json")
+	if _, err := os.Stat(tarballName + signatureExtension); err == nil {
+		files = append(files, tarballName+signatureExtension)
+	}
+	for _, localPath := range files {
+		key := filepath.Base(localPath)
+		logger.Debug(fmt.Sprintf("Uploading %s to %s", localPath, remoteBackend), "path", localPath, "remote", remoteBackend.String())
+		if err := uploadFile(ctx, remoteBackend, localPath, key); err != nil {
+			return fmt.Errorf("failed to upload %s to %s: %w", localPath, remoteBackend, err)
+		}
+	}
+
+	logger.Info(fmt.Sprintf("Uploaded %s to %s", filepath.Base(tarballName), remoteBackend), "path", tarballName, "remote", remoteBackend.String())
+
+	if config.RemoteOnly {
+		removeBackup(tarballName)
+	}
+	return nil
+}
+
+// remoteBackends caches one backend per remote directory, so writing or
+// restoring many backups reuses the same connection
+var remoteBackends = struct {
+	sync.Mutex
+	byLocation map[string]StorageBackend
+}{byLocation: make(map[string]StorageBackend)}
+
+// uploadedSizes holds the number of bytes streamed to each remote backup
+// until recordBackupOutput picks it up
+var uploadedSizes sync.Map
+
+// remoteDirBackend returns the cached backend for a remote directory
+func remoteDirBackend(location string) (StorageBackend, error) {
+	remoteBackends.Lock()
+	defer remoteBackends.Unlock()
+
+	if backend, ok := remoteBackends.byLocation[location]; ok {
+		return backend, nil
+	}
+	// Creating the backend only dials SFTP servers, which have no context
+	backend, err := newStorageBackend(context.Background(), location)
+	if err != nil {
+		return nil, err
+	}
+	remoteBackends.byLocation[location] = backend
+	return backend, nil
+}
+
+// closeRemoteBackends releases every cached backend
+func closeRemoteBackends() {
+	remoteBackends.Lock()
+	defer remoteBackends.Unlock()
+
+	for location, backend := range remoteBackends.byLocation {
+		closeBackend(backend)
+		delete(remoteBackends.byLocation, location)
+	}
+}
+
+// remoteBackendFor returns the backend and key for a remote file. Files below
+// a remote --dir share its backend so name templates can use subdirectories.
+func remoteBackendFor(location string) (StorageBackend, string, error) {
+	dir := strings.TrimSuffix(config.BackupDir, "/") + "/"
+	if isRemotePath(dir) && strings.HasPrefix(location, dir) {
+		backend, err := remoteDirBackend(config.BackupDir)
+		return backend, strings.TrimPrefix(location, dir), err
+	}
+
+	dirLocation, key := splitRemotePath(location)
+	if key == "" {
+		return nil, "", fmt.Errorf("remote path %q does not name a file", location)
+	}
+	backend, err := remoteDirBackend(dirLocation)
+	return backend, key, err
+}
+
+// openRemoteFile opens a remote file such as s3://bucket/prefix/name for reading
+func openRemoteFile(location string) (io.ReadCloser, error) {
+	backend, key, err := remoteBackendFor(location)
+	if err != nil {
+		return nil, err
+	}
+	return backend.Open(context.Background(), key)
+}
+
+// putRemoteFile uploads data as a remote file
+func putRemoteFile(ctx context.Context, location string, data []byte) error {
+	backend, key, err := remoteBackendFor(location)
+	if err != nil {
+		return err
+	}
+	return backend.Put(ctx, key, bytes.NewReader(data), int64(len(data)))
+}
+
+// openRemoteBackup streams a backup straight from its backend, concatenating
+// the parts of a split backup listed in its metadata and verifying their
+// checksums as the stream reaches the end of each one
+func openRemoteBackup(location string) (io.ReadCloser, error) {
+	info, err := loadImageInfo(location + ".json")
+	if err != nil || len(info.Parts) == 0 {
+		return openRemoteFile(location)
+	}
+
+	dir := location[:strings.LastIndex(location, "/")+1]
+	readers := make([]io.Reader, 0, len(info.Parts))
+	closers := make(multiCloser, 0, len(info.Parts))
+	for _, part := range info.Parts {
+		file, err := openRemoteFile(dir + part.Name)
+		if err != nil {
+			closers.Close()
+			return nil, fmt.Errorf("split backup %s is missing part %s: %w", location, part.Name, err)
+		}
+		closers = append(closers, file)
+
+		var reader io.Reader = file
+		if part.SHA256 != "" {
+			reader = &checksumReader{r: file, hash: sha256.New(), want: part.SHA256, name: dir + part.Name}
+		}
+		readers = append(readers, reader)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(readers...), closers}, nil
+}
+
+// removeRemoteBackup deletes a remote backup and its metadata. Failed uploads
+// never create an object, so this only matters once the tarball is complete.
+func removeRemoteBackup(location string) {
+	backend, key, err := remoteBackendFor(location)
+	if err != nil {
+		return
+	}
+	// Cleanup must still run after an interrupt cancelled the run context
+	for _, k := range []string{key, key + ".json", key + signatureExtension} {
+		if err := backend.Delete(context.Background(), k); err == nil {
+			logger.Debug(fmt.Sprintf("Removed partial file %s/%s", backend, k), "remote", backend.String(), "key", k)
+		}
+	}
+}
+
+// uploadWriter streams a backup into a remote object as it is written
+type uploadWriter struct {
+	location string
+	pipe     *io.PipeWriter
+	done     chan error
+	size     int64
+	closed   bool
+	err      error
+}
+
+// newUploadWriter starts uploading to a remote file. The object only appears
+// once Close succeeds; Abort cancels the upload.
+func newUploadWriter(ctx context.Context, location string) (*uploadWriter, error) {
+	backend, key, err := remoteBackendFor(location)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, writer := io.Pipe()
+	w := &uploadWriter{location: location, pipe: writer, done: make(chan error, 1)}
+	go func() {
+		err := backend.Put(ctx, key, reader, -1)
+		// Unblock the writer when the upload fails before the stream ends
+		reader.CloseWithError(err)
+		w.done <- err
+	}()
+	return w, nil
+}
+
+func (w *uploadWriter) Write(p []byte) (int, error) {
+	n, err := w.pipe.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Abort fails the upload with err so the backend discards what it received
+func (w *uploadWriter) Abort(err error) {
+	if w.closed {
+		return
+	}
+	w.closed = true
+	w.pipe.CloseWithError(err)
+	w.err = <-w.done
+}
+
+// Close finishes the upload and waits for the backend to store the object.
+// Closing more than once returns the first result.
+func (w *uploadWriter) Close() error {
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+	w.pipe.Close()
+	w.err = <-w.done
+	if w.err == nil {
+		uploadedSizes.Store(w.location, w.size)
+	}
+	return w.err
+}
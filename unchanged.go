@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errUnchanged is returned by backupImage when the image already has an
+// up-to-date backup and --force was not given
+var errUnchanged = errors.New("unchanged since last backup")
+
+// errIdentical is returned by backupImage when --deduplicate finds a backup of
+// the same image ID under any name
+var errIdentical = errors.New("identical backup exists")
+
+// lastBackups indexes the newest existing backup of each image name. It is nil
+// when --force is set, which disables the unchanged check.
+var lastBackups *backupIndex
+
+type indexedBackup struct {
+	imageID  string
+	platform string
+	tarball  string
+	date     time.Time
+}
+
+// backupIndex maps image names to their most recent backup so the unchanged
+// check is a map lookup rather than a scan of every sidecar file per image.
+// Names are keyed by referenceKey, so a backup recorded as nginx is found for
+// nginx:latest. byID holds the newest backup of each image ID for
+// --deduplicate.
+type backupIndex struct {
+	mu      sync.Mutex
+	entries map[string]indexedBackup
+	byID    map[string]indexedBackup
+}
+
+// loadBackupIndex builds the index from the catalog when one exists, and
+// otherwise by reading every metadata file in dir once. The catalog does not
+// record the platform, so --platform always reads the metadata files.
+func loadBackupIndex(dir string) *backupIndex {
+	index := &backupIndex{entries: make(map[string]indexedBackup), byID: make(map[string]indexedBackup)}
+
+	if _, err := os.Stat(filepath.Join(dir, catalogFile)); err == nil && selectedPlatform == nil {
+		if err := index.loadCatalog(dir); err == nil {
+			return index
+		} else {
+			logger.Debug(fmt.Sprintf("Catalog unavailable, scanning metadata files: %v", err), "error", err)
+		}
+	}
+
+	scanMetadata(dir, func(tarball string, info ImageInfo) {
+		index.record(metadataImageName(info), indexedBackup{imageID: info.ImageID, platform: info.Platform, tarball: tarball, date: info.BackupDate})
+	})
+	return index
+}
+
+// scanMetadata calls fn for every metadata sidecar in dir that names an image
+func scanMetadata(dir string, fn func(tarball string, info ImageInfo)) {
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, ".json") {
+			return nil
+		}
+		info, err := loadImageInfo(path)
+		if err != nil || info.ImageName == "" || info.isExport() {
+			return nil
+		}
+		fn(strings.TrimSuffix(path, ".json"), info)
+		return nil
+	})
+}
+
+// findLatestBackup returns the newest backup of imageName in dir by reading
+// its metadata sidecars. A run that checks many images uses loadBackupIndex
+// instead, which reads them once.
+func findLatestBackup(dir, imageName string) (indexedBackup, bool) {
+	var latest indexedBackup
+	found := false
+	scanMetadata(dir, func(tarball string, info ImageInfo) {
+		if !sameReference(metadataImageName(info), imageName) || found && latest.date.After(info.BackupDate) {
+			return
+		}
+		latest = indexedBackup{imageID: info.ImageID, platform: info.Platform, tarball: tarball, date: info.BackupDate}
+		found = true
+	})
+	return latest, found
+}
+
+// findIdenticalBackup returns the newest backup of imageID in dir under any
+// name, for a --dry-run with --deduplicate
+func findIdenticalBackup(dir, imageID string) (indexedBackup, bool) {
+	index := &backupIndex{entries: make(map[string]indexedBackup), byID: make(map[string]indexedBackup)}
+	scanMetadata(dir, func(tarball string, info ImageInfo) {
+		index.record(metadataImageName(info), indexedBackup{imageID: info.ImageID, platform: info.Platform, tarball: tarball, date: info.BackupDate})
+	})
+	return index.identical(imageID)
+}
+
+func (index *backupIndex) loadCatalog(dir string) error {
+	db, err := openCatalog(dir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT path, image_name, image_id, backup_date FROM backups`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var relPath, imageName, imageID, backupDate string
+		if err := rows.Scan(&relPath, &imageName, &imageID, &backupDate); err != nil {
+			return err
+		}
+		date, _ := time.Parse(time.RFC3339, backupDate)
+		index.record(imageName, indexedBackup{imageID: imageID, tarball: filepath.Join(dir, relPath), date: date})
+	}
+	return rows.Err()
+}
+
+// record notes a backup, keeping only the newest one per image name
+func (index *backupIndex) record(imageName string, backup indexedBackup) {
+	if index == nil {
+		return
+	}
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	if prev, ok := index.byID[backup.imageID]; backup.imageID != "" && (!ok || !prev.date.After(backup.date)) {
+		index.byID[backup.imageID] = backup
+	}
+	key := referenceKey(imageName)
+	if prev, ok := index.entries[key]; ok && prev.date.After(backup.date) {
+		return
+	}
+	index.entries[key] = backup
+}
+
+// identical returns the newest backup of the image ID under any name, if it
+// is of the selected platform and its tarball is still on disk
+func (index *backupIndex) identical(imageID string) (indexedBackup, bool) {
+	if index == nil {
+		return indexedBackup{}, false
+	}
+	index.mu.Lock()
+	prev, ok := index.byID[imageID]
+	index.mu.Unlock()
+
+	if !ok || prev.platform != config.Platform {
+		return indexedBackup{}, false
+	}
+	if _, _, err := statBackup(prev.tarball); err != nil {
+		return indexedBackup{}, false
+	}
+	return prev, true
+}
+
+// unchanged returns the existing backup of imageName if it has the given image
+// ID and its tarball is still on disk
+func (index *backupIndex) unchanged(imageName, imageID string) (indexedBackup, bool) {
+	if index == nil {
+		return indexedBackup{}, false
+	}
+	index.mu.Lock()
+	prev, ok := index.entries[referenceKey(imageName)]
+	index.mu.Unlock()
+
+	if !ok || !prev.current(imageID) {
+		return indexedBackup{}, false
+	}
+	return prev, true
+}
+
+// current reports whether the backup has the given image ID and the selected
+// platform, is recent enough for --since and its tarball is still on disk. A
+// multi-platform image has the same ID whichever platform is saved.
+func (b indexedBackup) current(imageID string) bool {
+	if b.imageID != imageID || b.platform != config.Platform {
+		return false
+	}
+	if config.Since > 0 && time.Since(b.date) > config.Since {
+		return false
+	}
+	_, _, err := statBackup(b.tarball)
+	return err == nil
+}
+
+// formatAge describes how long ago t was, such as "12 minutes ago"
+func formatAge(t time.Time) string {
+	age := time.Since(t)
+	switch {
+	case age < 2*time.Minute:
+		return "1 minute ago"
+	case age < 2*time.Hour:
+		return fmt.Sprintf("%d minutes ago", int(age.Minutes()))
+	case age < 48*time.Hour:
+		return fmt.Sprintf("%d hours ago", int(age.Hours()))
+	}
+	return fmt.Sprintf("%d days ago", int(age.Hours()/24))
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackupIndexOldNames(t *testing.T) {
+	setupBackupTest(t, compressionGzip)
+	// Backups written before names were normalized record the name as given
+	tarball := filepath.Join(config.BackupDir, "nginx.tar.gz")
+	if err := os.WriteFile(tarball, []byte(testArchive), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info := ImageInfo{ImageName: "nginx", ImageID: "sha256:0123456789abcdef", Tags: []string{"nginx:latest"}, BackupDate: time.Now().Add(-time.Hour)}
+	if err := writeImageInfo(tarball+".json", info); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"nginx", "nginx:latest", "docker.io/library/nginx:latest"} {
+		t.Run(name, func(t *testing.T) {
+			if _, ok := loadBackupIndex(config.BackupDir).unchanged(name, info.ImageID); !ok {
+				t.Errorf("backup index does not find the nginx backup for %s", name)
+			}
+			latest, ok := findLatestBackup(config.BackupDir, name)
+			if !ok || latest.tarball != tarball {
+				t.Errorf("findLatestBackup(%s) = %s, %v, want %s", name, latest.tarball, ok, tarball)
+			}
+		})
+	}
+	if _, ok := loadBackupIndex(config.BackupDir).unchanged("nginx:1.27", info.ImageID); ok {
+		t.Error("backup index finds the nginx backup for nginx:1.27")
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// volumeHelperImage runs the tar that archives a volume with --volumes. It is
+// pulled when the daemon does not have it.
+const volumeHelperImage = "busybox:latest"
+
+// anonymousVolumeLabel is set by the daemon on volumes it created for a
+// container without a name; older daemons leave it out, and those volumes
+// are recognized by their random 64 character hex names instead
+const anonymousVolumeLabel = "com.docker.volume.anonymous"
+
+var anonymousVolumeName = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// imageVolumes returns the named volumes mounted by the containers created
+// from the image with the given ID, running or not. Anonymous volumes and
+// bind mounts are left out.
+func imageVolumes(cli DockerClient, ctx context.Context, imageID string) ([]string, error) {
+	containers, err := cli.ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("ancestor", imageID)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	var volumes []string
+	for _, c := range containers {
+		// ancestor also matches containers of images built on this one
+		if c.ImageID != imageID {
+			continue
+		}
+		for _, m := range c.Mounts {
+			if m.Type != mount.TypeVolume || m.Name == "" || anonymousVolumeName.MatchString(m.Name) {
+				continue
+			}
+			volumes = appendUnique(volumes, m.Name)
+		}
+	}
+
+	named := volumes[:0]
+	for _, name := range volumes {
+		vol, err := cli.VolumeInspect(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to inspect volume %s: %w", name, err)
+		}
+		if _, ok := vol.Labels[anonymousVolumeLabel]; !ok {
+			named = append(named, name)
+		}
+	}
+	return named, nil
+}
+
+// volumeArchivePath returns the archive a volume snapshot taken at now is
+// written to
+func volumeArchivePath(volume string, now time.Time) string {
+	return filepath.Join(config.BackupDir, fmt.Sprintf("%s-%s.tar.gz", volume, now.Format("20060102-150405")))
+}
+
+// backupVolumes archives the named volumes of the containers of an image into
+// the backup directory and returns their names and archive paths. When one
+// fails, the archives already written are removed.
+func backupVolumes(cli DockerClient, ctx context.Context, imageName, imageID string) ([]string, []string, error) {
+	volumes, err := imageVolumes(cli, ctx, imageID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(volumes) == 0 {
+		logger.Debug("No named volumes are used by containers of "+imageName, "image", imageName)
+		return nil, nil, nil
+	}
+
+	var archives []string
+	for _, volume := range volumes {
+		archive := volumeArchivePath(volume, time.Now())
+		logger.Info(fmt.Sprintf("Archiving volume %s of %s to %s...", volume, imageName, archive), "image", imageName, "volume", volume, "path", archive)
+		err := withRetry(ctx, "archive volume "+volume, func() error {
+			return archiveVolume(cli, ctx, volume, archive)
+		})
+		if err != nil {
+			removeVolumeArchives(archives)
+			return nil, nil, fmt.Errorf("failed to archive volume %s: %w", volume, err)
+		}
+		archives = append(archives, archive)
+	}
+	return volumes, archives, nil
+}
+
+// archiveVolume runs tar in a temporary container that mounts the volume
+// read-only and streams the gzipped archive to path. The stream goes through
+// the API, so this works with a remote daemon too.
+func archiveVolume(cli DockerClient, ctx context.Context, volume, path string) error {
+	if err := ensureHelperImage(cli, ctx); err != nil {
+		return err
+	}
+	created, err := cli.ContainerCreate(ctx, &container.Config{
+		Image:        volumeHelperImage,
+		Cmd:          []string{"tar", "czf", "-", "-C", "/volume", "."},
+		AttachStdout: true,
+		AttachStderr: true,
+	}, &container.HostConfig{
+		NetworkMode: "none",
+		Mounts:      []mount.Mount{{Type: mount.TypeVolume, Source: volume, Target: "/volume", ReadOnly: true}},
+	}, nil, nil, "")
+	if err != nil {
+		return fmt.Errorf("failed to create helper container: %w", err)
+	}
+	defer func() {
+		if err := cli.ContainerRemove(context.WithoutCancel(ctx), created.ID, container.RemoveOptions{Force: true}); err != nil {
+			logger.Warn(fmt.Sprintf("Warning: failed to remove helper container %s: %v", shortID(created.ID), err), "container", created.ID, "error", err)
+		}
+	}()
+
+	attached, err := cli.ContainerAttach(ctx, created.ID, container.AttachOptions{Stream: true, Stdout: true, Stderr: true})
+	if err != nil {
+		return fmt.Errorf("failed to attach to helper container: %w", err)
+	}
+	defer attached.Close()
+	waitC, waitErrC := cli.ContainerWait(ctx, created.ID, container.WaitConditionNextExit)
+	if err := cli.ContainerStart(ctx, created.ID, container.StartOptions{}); err != nil {
+		return fmt.Errorf("failed to start helper container: %w", err)
+	}
+
+	partial := partialName(path)
+	file, err := os.Create(partial)
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	_, err = stdcopy.StdCopy(file, &stderr, attached.Reader)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		select {
+		case result := <-waitC:
+			if result.StatusCode != 0 {
+				err = fmt.Errorf("tar exited with status %d: %s", result.StatusCode, strings.TrimSpace(stderr.String()))
+			}
+		case err = <-waitErrC:
+		}
+	}
+	if err == nil {
+		err = os.Rename(partial, path)
+	}
+	if err != nil {
+		os.Remove(partial)
+		return err
+	}
+	return nil
+}
+
+// ensureHelperImage pulls volumeHelperImage unless the daemon has it
+func ensureHelperImage(cli DockerClient, ctx context.Context) error {
+	_, err := cli.ImageInspect(ctx, volumeHelperImage)
+	if err == nil || !errdefs.IsNotFound(err) {
+		return err
+	}
+	logger.Info(fmt.Sprintf("Pulling %s to archive volumes...", volumeHelperImage), "image", volumeHelperImage)
+	if err := pullImage(cli, ctx, volumeHelperImage, ""); err != nil {
+		return fmt.Errorf("failed to pull %s: %w", volumeHelperImage, err)
+	}
+	return nil
+}
+
+// removeVolumeArchives deletes the volume archives of a backup that failed
+func removeVolumeArchives(archives []string) {
+	for _, archive := range archives {
+		if err := os.Remove(archive); err == nil {
+			logger.Debug("Removed volume archive "+archive, "path", archive)
+		}
+	}
+}
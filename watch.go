@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// watchReconnectDelay is how long to wait before re-subscribing after the
+// daemon event stream breaks
+const watchReconnectDelay = 5 * time.Second
+
+// watchExcludedFlags are the backup flags the watch command leaves out: they
+// select another way of running or cannot be combined with watching
+var watchExcludedFlags = []string{
+	"watch", "interval", "cron", "run-once", "bundle", "dry-run", "stdout", "metadata-file", "total-timeout", "container",
+}
+
+// addWatchFlags gives the watch command the backup flags that apply to it.
+// They are the same flags, bound to the backup configuration, so both
+// commands accept them with the same defaults.
+func addWatchFlags(watchCmd, backupCmd *cobra.Command) {
+	backupCmd.Flags().VisitAll(func(flag *pflag.Flag) {
+		if !slices.Contains(watchExcludedFlags, flag.Name) {
+			watchCmd.Flags().AddFlag(flag)
+		}
+	})
+}
+
+// validatePatterns checks that every pattern given to a glob flag is valid
+func validatePatterns(flag string, patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid --%s %q: %w", flag, pattern, err)
+		}
+	}
+	return nil
+}
+
+// matchesWatchFilter reports whether a newly tagged image should be backed up.
+// Patterns are matched against the full repo:tag reference; with no patterns
+// every image matches.
+func matchesWatchFilter(name string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// watchImages subscribes to image tag and pull events and backs up every
+// matching image as it appears, with at most config.MaxWorkers backups running
+// at once. Builds show up as tag events. An image is backed up once its events
+// have been quiet for --watch-debounce, so a pull or a build that tags the
+// same image repeatedly causes one backup. It returns when ctx is cancelled
+// (SIGINT/SIGTERM), after waiting for in-flight backups to finish, and reports
+// one Result per backup it started.
+func watchImages(cli DockerClient, ctx context.Context) []Result {
+	// In-flight backups run on a context that survives the interrupt, so
+	// stopping the watch does not leave half-written tarballs behind
+	workCtx := context.WithoutCancel(ctx)
+
+	pool := newWorkerPool(ctx, config.MaxWorkers, func(_ int, name string) Result {
+		started := time.Now()
+		err := runWithTimeout(workCtx, name, func(ctx context.Context, img string) error {
+			return backupImage(cli, ctx, img)
+		})
+		result := newResult(name, err, started)
+		if result.Status == StatusFailed {
+			logger.Error(fmt.Sprintf("%s: %v", name, err), "image", name, "error", err)
+		}
+		return result
+	})
+
+	logger.Info("Watching for new images (press Ctrl-C to stop)...")
+
+	opts := events.ListOptions{
+		Filters: filters.NewArgs(
+			filters.Arg("type", string(events.ImageEventType)),
+			filters.Arg("event", string(events.ActionTag)),
+			filters.Arg("event", string(events.ActionPull)),
+		),
+	}
+
+	// pending holds the timer of every image waiting for its events to
+	// settle; the timers hand the image back to this loop through ready
+	pending := make(map[string]*time.Timer)
+	ready := make(chan string)
+	defer func() {
+		for _, timer := range pending {
+			timer.Stop()
+		}
+	}()
+
+watch:
+	for ctx.Err() == nil {
+		messages, errs := cli.Events(ctx, opts)
+		for {
+			select {
+			case <-ctx.Done():
+				break watch
+			case err := <-errs:
+				if ctx.Err() != nil {
+					break watch
+				}
+				logger.Warn(fmt.Sprintf("Event stream error: %v (reconnecting in %s)", err, watchReconnectDelay), "error", err)
+				select {
+				case <-time.After(watchReconnectDelay):
+				case <-ctx.Done():
+				}
+				continue watch
+			case msg := <-messages:
+				name := msg.Actor.Attributes["name"]
+				if name == "" || !matchesWatchFilter(name, config.WatchFilters) {
+					if name != "" {
+						logger.Debug(fmt.Sprintf("Ignoring %s (does not match --watch-filter)", name), "image", name)
+					}
+					continue
+				}
+				if timer, ok := pending[name]; ok {
+					timer.Reset(config.WatchDebounce)
+					continue
+				}
+				logger.Debug(fmt.Sprintf("Detected %s of %s", msg.Action, name), "image", name, "event", string(msg.Action))
+				pending[name] = time.AfterFunc(config.WatchDebounce, func() {
+					select {
+					case ready <- name:
+					case <-ctx.Done():
+					}
+				})
+			case name := <-ready:
+				// A timer reset just as it fired delivers its image twice
+				if _, ok := pending[name]; !ok {
+					continue
+				}
+				delete(pending, name)
+				pool.Submit(name)
+			}
+		}
+	}
+
+	return pool.Wait()
+}